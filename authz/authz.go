@@ -0,0 +1,182 @@
+// Package authz defines the authorization check the handlers depend on and
+// its Permit.io implementation.
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/permitio/permit-golang/pkg/config"
+	"github.com/permitio/permit-golang/pkg/enforcement"
+	"github.com/permitio/permit-golang/pkg/permit"
+)
+
+// Tenant is the Permit.io tenant all bookstore resources live in.
+const Tenant = "default"
+
+// DefaultPDPURL is the Permit.io policy decision point sidecar.
+const DefaultPDPURL = "http://localhost:7766"
+
+// Subject is the user a check is made for.
+type Subject struct {
+	Key        string                 `json:"key"`
+	Roles      []string               `json:"roles"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Resource is what the subject wants to act on: a resource type, and
+// optionally a specific instance of it.
+type Resource struct {
+	Type       string                 `json:"type"`
+	Key        string                 `json:"key,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Authorizer decides whether a subject may perform an action on a resource.
+type Authorizer interface {
+	Check(ctx context.Context, subject Subject, action string, resource Resource) (bool, error)
+}
+
+// BulkChecker is implemented by authorizers that can decide on many
+// resources in one round trip.
+type BulkChecker interface {
+	CheckAll(ctx context.Context, subject Subject, action string, resources []Resource) ([]bool, error)
+}
+
+// CheckAll decides on each of resources, using a single bulk query when a
+// supports it. The result has one entry per resource.
+func CheckAll(ctx context.Context, a Authorizer, subject Subject, action string, resources []Resource) ([]bool, error) {
+	if bulk, ok := a.(BulkChecker); ok {
+		return bulk.CheckAll(ctx, subject, action, resources)
+	}
+	allowed := make([]bool, len(resources))
+	for i, resource := range resources {
+		ok, err := a.Check(ctx, subject, action, resource)
+		if err != nil {
+			return nil, err
+		}
+		allowed[i] = ok
+	}
+	return allowed, nil
+}
+
+// Explanation describes how a backend reached a decision.
+type Explanation struct {
+	Backend string `json:"backend"`
+	Allowed bool   `json:"allowed"`
+	// Reasons are readable notes on the rules that matched or failed.
+	Reasons []string `json:"reasons,omitempty"`
+	// Raw is the backend's unprocessed response, if it has one.
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// Explainer is implemented by authorizers that can say why they decided
+// the way they did.
+type Explainer interface {
+	Explain(ctx context.Context, subject Subject, action string, resource Resource) (*Explanation, error)
+}
+
+// Permit asks a Permit.io policy decision point.
+type Permit struct {
+	client *permit.Client
+	pdpURL string
+	apiKey string
+}
+
+// NewPermit checks through client. pdpURL and apiKey must match the
+// client's configuration; Explain uses them to query the PDP directly.
+func NewPermit(client *permit.Client, pdpURL, apiKey string) *Permit {
+	return &Permit{client: client, pdpURL: strings.TrimRight(pdpURL, "/"), apiKey: apiKey}
+}
+
+// NewPermitFromKey creates its own Permit.io client.
+func NewPermitFromKey(apiKey, pdpURL string) *Permit {
+	client := permit.NewPermit(config.NewConfigBuilder(apiKey).WithPdpUrl(pdpURL).Build())
+	return NewPermit(client, pdpURL, apiKey)
+}
+
+func (p *Permit) build(subject Subject, resource Resource) (enforcement.User, enforcement.Resource) {
+	user := enforcement.UserBuilder(subject.Key).
+		WithAttributes(subject.Attributes).
+		Build()
+
+	builder := enforcement.ResourceBuilder(resource.Type).
+		WithTenant(Tenant)
+	if resource.Key != "" {
+		builder = builder.WithKey(resource.Key)
+	}
+	if resource.Attributes != nil {
+		builder = builder.WithAttributes(resource.Attributes)
+	}
+	return user, builder.Build()
+}
+
+func (p *Permit) Check(ctx context.Context, subject Subject, action string, resource Resource) (bool, error) {
+	user, res := p.build(subject, resource)
+	return p.client.Check(user, enforcement.Action(action), res)
+}
+
+func (p *Permit) CheckAll(ctx context.Context, subject Subject, action string, resources []Resource) ([]bool, error) {
+	if len(resources) == 0 {
+		return nil, nil
+	}
+	requests := make([]enforcement.CheckRequest, len(resources))
+	for i, resource := range resources {
+		user, res := p.build(subject, resource)
+		requests[i] = *enforcement.NewCheckRequest(user, enforcement.Action(action), res, map[string]string{})
+	}
+	return p.client.BulkCheck(requests...)
+}
+
+// Explain sends the same query as Check but keeps the PDP's full response,
+// including its debug section when the PDP has debugging turned on.
+func (p *Permit) Explain(ctx context.Context, subject Subject, action string, resource Resource) (*Explanation, error) {
+	user, res := p.build(subject, resource)
+	body, err := json.Marshal(enforcement.NewCheckRequest(user, enforcement.Action(action), res, map[string]string{}))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.pdpURL+"/allowed", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying PDP: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading PDP response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("PDP returned %s: %s", resp.Status, raw)
+	}
+
+	var decision enforcement.CheckResponse
+	if err := json.Unmarshal(raw, &decision); err != nil {
+		return nil, fmt.Errorf("error parsing PDP response: %v", err)
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, raw, "", "  "); err == nil {
+		raw = pretty.Bytes()
+	}
+	return &Explanation{
+		Backend: "permit",
+		Allowed: decision.Allow,
+		Raw:     raw,
+	}, nil
+}
@@ -0,0 +1,168 @@
+package authz
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Mismatch is a check on which the primary and secondary backends of a
+// Shadow disagreed, or on which the secondary failed.
+type Mismatch struct {
+	ID               int64    `json:"id,omitempty"`
+	Subject          Subject  `json:"subject"`
+	Action           string   `json:"action"`
+	Resource         Resource `json:"resource"`
+	PrimaryBackend   string   `json:"primary_backend"`
+	PrimaryAllowed   bool     `json:"primary_allowed"`
+	SecondaryBackend string   `json:"secondary_backend"`
+	SecondaryAllowed bool     `json:"secondary_allowed"`
+	SecondaryError   string   `json:"secondary_error,omitempty"`
+	// Reasons holds the explanations of backends that can give one.
+	Reasons   map[string][]string `json:"reasons,omitempty"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// Shadow enforces the primary backend's decisions while also asking the
+// secondary one, so a new policy can be compared against the live one
+// before switching. The secondary is asked concurrently and never delays
+// or changes the response.
+type Shadow struct {
+	primary       Authorizer
+	secondary     Authorizer
+	primaryName   string
+	secondaryName string
+	record        func(Mismatch)
+}
+
+// NewShadow returns a Shadow that hands every disagreement to record.
+func NewShadow(primary Authorizer, primaryName string, secondary Authorizer, secondaryName string, record func(Mismatch)) *Shadow {
+	return &Shadow{
+		primary:       primary,
+		secondary:     secondary,
+		primaryName:   primaryName,
+		secondaryName: secondaryName,
+		record:        record,
+	}
+}
+
+type shadowResult struct {
+	allowed bool
+	err     error
+}
+
+func (s *Shadow) Check(ctx context.Context, subject Subject, action string, resource Resource) (bool, error) {
+	// The shadow check outlives the request, so it must not be cancelled
+	// with it.
+	shadowCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	secondary := make(chan shadowResult, 1)
+	go func() {
+		allowed, err := s.secondary.Check(shadowCtx, subject, action, resource)
+		secondary <- shadowResult{allowed, err}
+	}()
+
+	allowed, err := s.primary.Check(ctx, subject, action, resource)
+	if err != nil {
+		cancel()
+		return false, err
+	}
+
+	go func() {
+		defer cancel()
+		shadow := <-secondary
+		s.compare(shadowCtx, subject, action, resource, allowed, shadow)
+	}()
+
+	return allowed, nil
+}
+
+// CheckAll decides with the primary backend and, like Check, asks the
+// secondary about every resource concurrently, comparing each decision
+// once both are in.
+func (s *Shadow) CheckAll(ctx context.Context, subject Subject, action string, resources []Resource) ([]bool, error) {
+	if len(resources) == 0 {
+		return nil, nil
+	}
+
+	shadowCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	secondary := make(chan []shadowResult, 1)
+	go func() {
+		results := make([]shadowResult, len(resources))
+		shadow, err := CheckAll(shadowCtx, s.secondary, subject, action, resources)
+		for i := range results {
+			results[i].err = err
+			if err == nil {
+				results[i].allowed = shadow[i]
+			}
+		}
+		secondary <- results
+	}()
+
+	allowed, err := CheckAll(ctx, s.primary, subject, action, resources)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		defer cancel()
+		for i, shadow := range <-secondary {
+			s.compare(shadowCtx, subject, action, resources[i], allowed[i], shadow)
+		}
+	}()
+
+	return allowed, nil
+}
+
+// compare records a Mismatch unless the secondary agreed with the primary.
+func (s *Shadow) compare(ctx context.Context, subject Subject, action string, resource Resource, allowed bool, shadow shadowResult) {
+	if shadow.err == nil && shadow.allowed == allowed {
+		return
+	}
+
+	m := Mismatch{
+		Subject:          subject,
+		Action:           action,
+		Resource:         resource,
+		PrimaryBackend:   s.primaryName,
+		PrimaryAllowed:   allowed,
+		SecondaryBackend: s.secondaryName,
+		SecondaryAllowed: shadow.allowed,
+		Reasons:          make(map[string][]string),
+		CreatedAt:        time.Now(),
+	}
+	if shadow.err != nil {
+		m.SecondaryError = shadow.err.Error()
+	}
+	s.explain(ctx, &m, s.primaryName, s.primary)
+	s.explain(ctx, &m, s.secondaryName, s.secondary)
+
+	log.Printf("Authorization mismatch: %s says %t, %s says %t for %s %s %s\n",
+		s.primaryName, allowed, s.secondaryName, shadow.allowed, subject.Key, action, resource.Type)
+	s.record(m)
+}
+
+func (s *Shadow) explain(ctx context.Context, m *Mismatch, name string, backend Authorizer) {
+	explainer, ok := backend.(Explainer)
+	if !ok {
+		return
+	}
+	ex, err := explainer.Explain(ctx, m.Subject, m.Action, m.Resource)
+	if err != nil {
+		log.Printf("Error explaining %s decision: %v\n", name, err)
+		return
+	}
+	m.Reasons[name] = ex.Reasons
+}
+
+// Explain explains the primary decision, which is the one enforced.
+func (s *Shadow) Explain(ctx context.Context, subject Subject, action string, resource Resource) (*Explanation, error) {
+	if explainer, ok := s.primary.(Explainer); ok {
+		return explainer.Explain(ctx, subject, action, resource)
+	}
+	allowed, err := s.primary.Check(ctx, subject, action, resource)
+	if err != nil {
+		return nil, err
+	}
+	return &Explanation{Backend: s.primaryName, Allowed: allowed}, nil
+}
@@ -0,0 +1,300 @@
+// Package bookimport reads catalogue files for the bulk book import. It
+// understands CSV with a header row and JSON lines, maps their columns onto
+// the book fields and leaves validating the values to the caller.
+package bookimport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Format is the syntax of an import file.
+type Format string
+
+const (
+	CSV       Format = "csv"
+	JSONLines Format = "jsonl"
+)
+
+// The book fields an import file can set. Column names are matched to them
+// ignoring case, with spaces and dashes read as underscores; aliases lists
+// the other names accepted for each.
+const (
+	Title       = "title"
+	Author      = "author"
+	PublishedAt = "published_at"
+	Genre       = "genre"
+	Restricted  = "restricted"
+	AgeRating   = "age_rating"
+	ISBN        = "isbn"
+	Categories  = "categories"
+	Tags        = "tags"
+)
+
+var aliases = map[string]string{
+	"title":            Title,
+	"author":           Author,
+	"authors":          Author,
+	"byline":           Author,
+	"published_at":     PublishedAt,
+	"published":        PublishedAt,
+	"publication_date": PublishedAt,
+	"genre":            Genre,
+	"restricted":       Restricted,
+	"age_rating":       AgeRating,
+	"isbn":             ISBN,
+	"isbn_13":          ISBN,
+	"isbn13":           ISBN,
+	"isbn_10":          ISBN,
+	"isbn10":           ISBN,
+	"categories":       Categories,
+	"category":         Categories,
+	"tags":             Tags,
+	"tag":              Tags,
+}
+
+// MaxRows bounds the rows of one file, and maxLineBytes a single JSON line.
+const (
+	MaxRows      = 10000
+	maxLineBytes = 1 << 20
+)
+
+var (
+	// ErrUnknownFormat is returned for formats other than CSV and JSON
+	// lines.
+	ErrUnknownFormat = errors.New("import files must be CSV or JSON lines")
+	// ErrTooManyRows is returned for files with more than MaxRows rows.
+	ErrTooManyRows = fmt.Errorf("import files can have at most %d rows", MaxRows)
+)
+
+// DetectFormat picks the format of a file from an explicit name such as
+// "csv", or else from the file name's extension or its content type.
+func DetectFormat(name, filename, contentType string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "csv":
+		return CSV, nil
+	case "jsonl", "ndjson":
+		return JSONLines, nil
+	case "":
+	default:
+		return "", ErrUnknownFormat
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".csv":
+		return CSV, nil
+	case ".jsonl", ".ndjson":
+		return JSONLines, nil
+	}
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch strings.TrimSpace(strings.ToLower(contentType)) {
+	case "text/csv":
+		return CSV, nil
+	case "application/x-ndjson", "application/jsonl":
+		return JSONLines, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// Row is one book of an import file. Values holds the fields the file has
+// columns for, even when they are blank in this row, so an update can tell
+// a cleared field from one the file does not mention.
+type Row struct {
+	Line   int
+	Values map[string]string
+}
+
+// Has reports whether the file sets field.
+func (r Row) Has(field string) bool {
+	_, ok := r.Values[field]
+	return ok
+}
+
+// File is a parsed import file. Ignored lists the columns that do not map
+// to a book field.
+type File struct {
+	Rows    []Row
+	Ignored []string
+}
+
+// Parse reads an import file. Blank rows are skipped; a malformed row
+// fails the whole file, naming its line.
+func Parse(r io.Reader, format Format) (*File, error) {
+	switch format {
+	case CSV:
+		return parseCSV(r)
+	case JSONLines:
+		return parseJSONLines(r)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// field maps a column name to the book field it sets, or "".
+func field(column string) string {
+	key := strings.ToLower(strings.TrimSpace(column))
+	key = strings.NewReplacer(" ", "_", "-", "_").Replace(key)
+	return aliases[key]
+}
+
+func parseCSV(r io.Reader) (*File, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Spreadsheets often save UTF-8 with a byte order mark.
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	file := &File{}
+	fields := make([]string, len(header))
+	for i, column := range header {
+		if fields[i] = field(column); fields[i] == "" && strings.TrimSpace(column) != "" {
+			file.Ignored = append(file.Ignored, strings.TrimSpace(column))
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := Row{Line: line, Values: make(map[string]string)}
+		blank := true
+		for i, value := range record {
+			if fields[i] == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			// With several columns for one field, such as ISBN-10 and
+			// ISBN-13, the first one filled in wins.
+			if row.Values[fields[i]] == "" {
+				row.Values[fields[i]] = value
+			}
+			if value != "" {
+				blank = false
+			}
+		}
+		if blank {
+			continue
+		}
+		if len(file.Rows) == MaxRows {
+			return nil, ErrTooManyRows
+		}
+		file.Rows = append(file.Rows, row)
+	}
+	return file, nil
+}
+
+func parseJSONLines(r io.Reader) (*File, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+
+	file := &File{}
+	ignored := make(map[string]bool)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if line == 1 {
+			text = bytes.TrimPrefix(text, []byte("\ufeff"))
+		}
+		if len(text) == 0 {
+			continue
+		}
+
+		var object map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&object); err != nil || object == nil {
+			return nil, fmt.Errorf("line %d: each line must be a JSON object", line)
+		}
+
+		row := Row{Line: line, Values: make(map[string]string)}
+		// Sorted so that with several keys for one field the result does
+		// not depend on map order.
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f := field(key)
+			if f == "" {
+				ignored[key] = true
+				continue
+			}
+			value, err := jsonValue(object[key], f)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s: %v", line, key, err)
+			}
+			if row.Values[f] == "" {
+				row.Values[f] = value
+			}
+		}
+		if len(file.Rows) == MaxRows {
+			return nil, ErrTooManyRows
+		}
+		file.Rows = append(file.Rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("lines must be at most %d bytes", maxLineBytes)
+		}
+		return nil, err
+	}
+
+	for key := range ignored {
+		file.Ignored = append(file.Ignored, key)
+	}
+	sort.Strings(file.Ignored)
+	return file, nil
+}
+
+// jsonValue turns a JSON value into the text a CSV cell would hold. Lists
+// are joined the way the book forms separate them: authors with
+// semicolons, categories and tags with commas.
+func jsonValue(v interface{}, field string) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(v), nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case []interface{}:
+		sep := ", "
+		if field == Author {
+			sep = "; "
+		}
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", errors.New("lists must hold strings")
+			}
+			items = append(items, strings.TrimSpace(s))
+		}
+		return strings.Join(items, sep), nil
+	}
+	return "", errors.New("must be a string, number, boolean or list")
+}
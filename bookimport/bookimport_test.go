@@ -0,0 +1,116 @@
+package bookimport
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name, filename, contentType string
+		want                        Format
+		wantErr                     bool
+	}{
+		{name: "CSV", filename: "books.jsonl", want: CSV},
+		{name: "ndjson", want: JSONLines},
+		{name: "xml", filename: "books.csv", wantErr: true},
+		{filename: "Books.CSV", want: CSV},
+		{filename: "books.ndjson", want: JSONLines},
+		{filename: "books.txt", contentType: "text/csv; charset=utf-8", want: CSV},
+		{filename: "upload", contentType: "application/x-ndjson", want: JSONLines},
+		{filename: "books.xlsx", contentType: "application/octet-stream", wantErr: true},
+		{wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := DetectFormat(tt.name, tt.filename, tt.contentType)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnknownFormat) {
+				t.Errorf("DetectFormat(%q, %q, %q) error = %v, want ErrUnknownFormat", tt.name, tt.filename, tt.contentType, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("DetectFormat(%q, %q, %q) = %q, %v, want %q", tt.name, tt.filename, tt.contentType, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	input := "\ufeffTitle,Authors,ISBN-10,ISBN 13,Shelf\n" +
+		"Go,  Alan Donovan; Brian Kernighan ,,9780134190440,A3\n" +
+		",,,,\n" +
+		"\"Notes, Vol. 1\",Ann,0306406152,9780131103627,\n"
+	file, err := Parse(strings.NewReader(input), CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Shelf"}; !reflect.DeepEqual(file.Ignored, want) {
+		t.Errorf("ignored = %q, want %q", file.Ignored, want)
+	}
+	want := []Row{
+		{Line: 2, Values: map[string]string{Title: "Go", Author: "Alan Donovan; Brian Kernighan", ISBN: "9780134190440"}},
+		// The first filled in ISBN column wins.
+		{Line: 4, Values: map[string]string{Title: "Notes, Vol. 1", Author: "Ann", ISBN: "0306406152"}},
+	}
+	if !reflect.DeepEqual(file.Rows, want) {
+		t.Errorf("rows = %+v, want %+v", file.Rows, want)
+	}
+	if file.Rows[0].Has(Genre) {
+		t.Error("row has a genre, but the file has no such column")
+	}
+}
+
+func TestParseJSONLines(t *testing.T) {
+	input := `{"title": "Go", "authors": ["Alan Donovan", "Brian Kernighan"], "tags": ["go", "programming"], "shelf": "A3"}
+
+{"title": "Notes", "restricted": true, "age_rating": 18, "genre": null}
+`
+	file, err := Parse(strings.NewReader(input), JSONLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"shelf"}; !reflect.DeepEqual(file.Ignored, want) {
+		t.Errorf("ignored = %q, want %q", file.Ignored, want)
+	}
+	want := []Row{
+		{Line: 1, Values: map[string]string{Title: "Go", Author: "Alan Donovan; Brian Kernighan", Tags: "go, programming"}},
+		{Line: 3, Values: map[string]string{Title: "Notes", Restricted: "true", AgeRating: "18", Genre: ""}},
+	}
+	if !reflect.DeepEqual(file.Rows, want) {
+		t.Errorf("rows = %+v, want %+v", file.Rows, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		input  string
+		want   string
+	}{
+		{"empty CSV", CSV, "", "the file is empty"},
+		{"ragged CSV", CSV, "title,author\nGo,Ann,extra\n", "wrong number of fields"},
+		{"not an object", JSONLines, "{\"title\": \"Go\"}\n[1, 2]\n", "line 2: each line must be a JSON object"},
+		{"nested object", JSONLines, `{"title": {"en": "Go"}}`, "line 1: title: must be a string"},
+		{"list of numbers", JSONLines, `{"tags": [1]}`, "line 1: tags: lists must hold strings"},
+		{"unknown format", "xml", "<books/>", ErrUnknownFormat.Error()},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.input), tt.format)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseTooManyRows(t *testing.T) {
+	input := "title\n" + strings.Repeat("Go\n", MaxRows)
+	if _, err := Parse(strings.NewReader(input), CSV); err != nil {
+		t.Fatalf("%d rows: %v", MaxRows, err)
+	}
+	if _, err := Parse(strings.NewReader(input+"Go\n"), CSV); !errors.Is(err, ErrTooManyRows) {
+		t.Errorf("%d rows: error = %v, want ErrTooManyRows", MaxRows+1, err)
+	}
+}
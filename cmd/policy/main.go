@@ -0,0 +1,186 @@
+// Command policy validates the policy file and pushes it to Permit.io so the
+// dashboard matches what is committed.
+//
+//	go run ./cmd/policy validate [-file policy.yaml]
+//	go run ./cmd/policy push [-file policy.yaml] [-dry-run]
+//
+// push creates or updates every resource and role in the file and sets each
+// role's permissions to exactly the unconditional ones listed. Resources and
+// roles that only exist in Permit.io are left alone.
+package main
+
+import (
+	"bookstore/policy"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/permitio/permit-golang/pkg/config"
+	permitErrors "github.com/permitio/permit-golang/pkg/errors"
+	permitModels "github.com/permitio/permit-golang/pkg/models"
+	"github.com/permitio/permit-golang/pkg/permit"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: policy validate|push [-file policy.yaml] [-dry-run]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	file := flags.String("file", envOr("POLICY_FILE", "policy.yaml"), "policy file")
+	dryRun := flags.Bool("dry-run", false, "print what push would change without changing it")
+	flags.Parse(os.Args[2:])
+
+	p, err := policy.Load(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch command {
+	case "validate":
+		fmt.Printf("%s is valid: %d resources, %d roles\n", *file, len(p.Resources), len(p.Roles))
+	case "push":
+		if err := godotenv.Load(); err != nil {
+			log.Print("Error loading .env file")
+		}
+		apiKey := os.Getenv("PERMIT_API_KEY")
+		if apiKey == "" {
+			log.Fatal("PERMIT_API_KEY environment variable is not set")
+		}
+		client := permit.NewPermit(config.NewConfigBuilder(apiKey).Build())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		if err := push(ctx, client, p, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
+
+func push(ctx context.Context, client *permit.Client, p *policy.Policy, dryRun bool) error {
+	for _, key := range sortedKeys(p.Resources) {
+		res := p.Resources[key]
+		actions := make(map[string]permitModels.ActionBlockEditable)
+		for _, action := range res.Actions {
+			block := permitModels.NewActionBlockEditable()
+			block.SetName(action)
+			actions[action] = *block
+		}
+		attributes := make(map[string]permitModels.AttributeBlockEditable)
+		for name, typ := range res.Attributes {
+			attributes[name] = *permitModels.NewAttributeBlockEditable(permitModels.AttributeType(typ))
+		}
+		name := res.Name
+		if name == "" {
+			name = key
+		}
+
+		_, err := client.Api.Resources.Get(ctx, key)
+		switch {
+		case isNotFound(err):
+			fmt.Printf("create resource %s %v\n", key, res.Actions)
+			if dryRun {
+				continue
+			}
+			create := permitModels.NewResourceCreate(key, name, actions)
+			create.SetDescription(res.Description)
+			create.SetAttributes(attributes)
+			_, err = client.Api.Resources.Create(ctx, *create)
+		case err == nil:
+			fmt.Printf("update resource %s %v\n", key, res.Actions)
+			if dryRun {
+				continue
+			}
+			update := permitModels.NewResourceUpdate()
+			update.SetName(name)
+			update.SetDescription(res.Description)
+			update.SetActions(actions)
+			update.SetAttributes(attributes)
+			_, err = client.Api.Resources.Update(ctx, key, *update)
+		}
+		if err != nil {
+			return fmt.Errorf("resource %s: %v", key, err)
+		}
+	}
+
+	for _, key := range sortedKeys(p.Roles) {
+		role := p.Roles[key]
+		var permissions []string
+		for _, perm := range role.Permissions {
+			if perm.Conditional() {
+				log.Printf("Skipping conditional permission of role %s on %s %v: set it up as a condition set in Permit.io\n",
+					key, perm.Resource, perm.Actions)
+				continue
+			}
+			for _, action := range perm.Actions {
+				permissions = append(permissions, perm.Resource+":"+action)
+			}
+		}
+		name := role.Name
+		if name == "" {
+			name = key
+		}
+
+		_, err := client.Api.Roles.Get(ctx, key)
+		switch {
+		case isNotFound(err):
+			fmt.Printf("create role %s %v\n", key, permissions)
+			if dryRun {
+				continue
+			}
+			create := permitModels.NewRoleCreate(key, name)
+			create.SetDescription(role.Description)
+			create.SetPermissions(permissions)
+			_, err = client.Api.Roles.Create(ctx, *create)
+		case err == nil:
+			fmt.Printf("update role %s %v\n", key, permissions)
+			if dryRun {
+				continue
+			}
+			update := permitModels.NewRoleUpdate()
+			update.SetName(name)
+			update.SetDescription(role.Description)
+			update.SetPermissions(permissions)
+			_, err = client.Api.Roles.Update(ctx, key, *update)
+		}
+		if err != nil {
+			return fmt.Errorf("role %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var permitErr permitErrors.PermitError
+	return errors.As(err, &permitErr) && permitErr.ErrorCode == permitErrors.NotFound
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,80 @@
+// Command vendorassets downloads the third-party CSS the templates use into
+// static/ so pages can be served under a strict same-origin Content Security
+// Policy. The committed tailwind.min.css holds only the utilities the
+// templates use; to replace it with the full build, run from the
+// repository root:
+//
+//	go run ./cmd/vendorassets -force
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type asset struct {
+	url  string
+	dest string
+}
+
+var assets = []asset{
+	{
+		url:  "https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css",
+		dest: "css/tailwind.min.css",
+	},
+}
+
+func main() {
+	dir := flag.String("dir", "static", "directory to write the assets into")
+	force := flag.Bool("force", false, "download assets that already exist")
+	flag.Parse()
+
+	client := &http.Client{Timeout: time.Minute}
+	for _, a := range assets {
+		dest := filepath.Join(*dir, filepath.FromSlash(a.dest))
+		if _, err := os.Stat(dest); err == nil && !*force {
+			log.Printf("%s already present\n", dest)
+			continue
+		}
+		if err := download(client, a.url, dest); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Downloaded %s to %s\n", a.url, dest)
+	}
+}
+
+func download(client *http.Client, url, dest string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading %s: %s", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error writing %s: %v", dest, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
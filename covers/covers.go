@@ -0,0 +1,177 @@
+// Package covers validates uploaded book cover images and generates the
+// thumbnail sizes the pages show.
+package covers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"net/http"
+)
+
+// Limits on uploads. MaxPixels bounds decoding, so a small file that
+// expands into a huge bitmap is refused before it is decoded. At four bytes
+// a pixel for the decoded image and again for its flattened copy, a cover
+// at the limit takes about 128 MB while it is processed.
+const (
+	MaxBytes    = 5 << 20
+	MaxPixels   = 16_000_000
+	jpegQuality = 85
+)
+
+// OriginalSize names the image as uploaded, alongside the names in Sizes.
+const OriginalSize = "original"
+
+var (
+	// ErrTooLarge is returned for files over MaxBytes or images over
+	// MaxPixels.
+	ErrTooLarge = fmt.Errorf("cover images must be at most %d MB and %d megapixels", MaxBytes>>20, MaxPixels/1_000_000)
+	// ErrUnsupportedType is returned for anything but JPEG, PNG and GIF,
+	// judged by the file's content rather than its name.
+	ErrUnsupportedType = errors.New("cover images must be JPEG, PNG or GIF")
+)
+
+// Size is a thumbnail size, scaled to Width pixels wide. Images narrower
+// than that are not enlarged.
+type Size struct {
+	Name  string
+	Width int
+}
+
+// Sizes are the thumbnails generated for every cover.
+var Sizes = []Size{
+	{Name: "small", Width: 160},
+	{Name: "medium", Width: 400},
+}
+
+// ValidSize reports whether name is OriginalSize or one of Sizes.
+func ValidSize(name string) bool {
+	if name == OriginalSize {
+		return true
+	}
+	for _, s := range Sizes {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Processed is a validated cover: the original bytes as uploaded and a
+// JPEG for each of Sizes. ETag is a hash of the original.
+type Processed struct {
+	ContentType string
+	Width       int
+	Height      int
+	ETag        string
+	Original    []byte
+	Thumbnails  map[string][]byte
+}
+
+// Sniff returns the content type of data, or ErrUnsupportedType.
+func Sniff(data []byte) (string, error) {
+	switch contentType := http.DetectContentType(data); contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return contentType, nil
+	default:
+		return "", ErrUnsupportedType
+	}
+}
+
+// Process checks an uploaded image and renders its thumbnails.
+func Process(data []byte) (*Processed, error) {
+	if len(data) > MaxBytes {
+		return nil, ErrTooLarge
+	}
+	contentType, err := Sniff(data)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrUnsupportedType
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	sum := sha256.Sum256(data)
+	p := &Processed{
+		ContentType: contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+		ETag:        hex.EncodeToString(sum[:16]),
+		Original:    data,
+		Thumbnails:  make(map[string][]byte, len(Sizes)),
+	}
+
+	// Flatten onto white once; JPEG has no transparency.
+	flat := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	for _, size := range Sizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scale(flat, size.Width), &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		p.Thumbnails[size.Name] = buf.Bytes()
+	}
+	return p, nil
+}
+
+// scale shrinks src to width pixels wide, keeping its aspect ratio, by
+// averaging the source pixels each target pixel covers. Narrower images
+// are returned as they are.
+func scale(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw <= width {
+		return src
+	}
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					r += int(row[sx*4])
+					g += int(row[sx*4+1])
+					b += int(row[sx*4+2])
+					n++
+				}
+			}
+			i := y*dst.Stride + x*4
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), 0xff
+		}
+	}
+	return dst
+}
@@ -0,0 +1,119 @@
+package covers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withPNGSize rewrites the dimensions in a PNG's header, fixing up its
+// checksum, so the file claims a size its data does not have.
+func withPNGSize(t *testing.T, data []byte, width, height uint32) []byte {
+	t.Helper()
+	out := append([]byte(nil), data...)
+	// Signature (8), IHDR length (4), "IHDR" (4), then width and height.
+	binary.BigEndian.PutUint32(out[16:], width)
+	binary.BigEndian.PutUint32(out[20:], height)
+	binary.BigEndian.PutUint32(out[29:], crc32.ChecksumIEEE(out[12:29]))
+	return out
+}
+
+func TestProcessLimits(t *testing.T) {
+	small := encodePNG(t, testImage(20, 10))
+
+	var gifData bytes.Buffer
+	if err := gif.Encode(&gifData, testImage(30, 30), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"PNG", small, nil},
+		{"GIF", gifData.Bytes(), nil},
+		{"over the byte limit", append(append([]byte(nil), small...), make([]byte, MaxBytes)...), ErrTooLarge},
+		{"over the pixel limit", withPNGSize(t, small, 4001, 4000), ErrTooLarge},
+		{"far over the pixel limit", withPNGSize(t, small, 40000, 1000), ErrTooLarge},
+		{"at the pixel limit, but corrupt", withPNGSize(t, small, 4000, 4000), ErrUnsupportedType},
+		{"plain text", []byte("this is not an image"), ErrUnsupportedType},
+		{"SVG", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), ErrUnsupportedType},
+		{"truncated PNG", small[:40], ErrUnsupportedType},
+		{"empty", nil, ErrUnsupportedType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Process(tt.data)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Process error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessThumbnails(t *testing.T) {
+	var large bytes.Buffer
+	if err := jpeg.Encode(&large, testImage(800, 1200), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		want        map[string][2]int
+	}{
+		{"large JPEG is scaled", large.Bytes(), "image/jpeg", map[string][2]int{"small": {160, 240}, "medium": {400, 600}}},
+		{"small PNG is not enlarged", encodePNG(t, testImage(120, 60)), "image/png", map[string][2]int{"small": {120, 60}, "medium": {120, 60}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Process(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ContentType != tt.contentType {
+				t.Errorf("content type = %q, want %q", p.ContentType, tt.contentType)
+			}
+			if len(p.ETag) != 32 || !bytes.Equal(p.Original, tt.data) {
+				t.Errorf("ETag %q or original bytes not kept", p.ETag)
+			}
+			for name, size := range tt.want {
+				thumb, err := jpeg.DecodeConfig(bytes.NewReader(p.Thumbnails[name]))
+				if err != nil {
+					t.Fatalf("%s thumbnail: %v", name, err)
+				}
+				if thumb.Width != size[0] || thumb.Height != size[1] {
+					t.Errorf("%s thumbnail is %dx%d, want %dx%d", name, thumb.Width, thumb.Height, size[0], size[1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+package handlers
+
+import (
+	"bookstore/mailer"
+	"bookstore/middleware"
+	"bookstore/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// approverRole is the role whose holders are emailed about new access
+// requests. Deciding them takes the manage permission on users.
+const approverRole = "admin"
+
+const maxJustificationLength = 1000
+
+// requestableActions lists, per resource type, the actions users may ask
+// for access to.
+var requestableActions = map[string][]string{
+	"books": {"view", "create", "update", "delete", "adjust_stock", "set_price", "import"},
+}
+
+// accessRequestLink points at the request form, filled in for the access
+// that was just denied.
+func accessRequestLink(action, resourceType, key string) string {
+	q := url.Values{"action": {action}, "resource": {resourceType}}
+	if key != "" {
+		q.Set("key", key)
+	}
+	return "/access-requests?" + q.Encode()
+}
+
+// accessRequestInput is what a user submits when asking for access.
+type accessRequestInput struct {
+	Action        string `json:"action"`
+	ResourceType  string `json:"resource_type"`
+	ResourceKey   string `json:"resource_key"`
+	Justification string `json:"justification"`
+}
+
+func accessRequestInputFromForm(r *http.Request) accessRequestInput {
+	return accessRequestInput{
+		Action:        r.FormValue("action"),
+		ResourceType:  r.FormValue("resource"),
+		ResourceKey:   strings.TrimSpace(r.FormValue("key")),
+		Justification: strings.TrimSpace(r.FormValue("justification")),
+	}
+}
+
+func (h *Handlers) validateAccessRequestInput(in accessRequestInput) error {
+	actions, ok := requestableActions[in.ResourceType]
+	if !ok {
+		return validationError{"access to " + in.ResourceType + " cannot be requested"}
+	}
+	known := false
+	for _, action := range actions {
+		known = known || action == in.Action
+	}
+	if !known {
+		return validationError{"access to " + in.Action + " " + in.ResourceType + " cannot be requested"}
+	}
+	if in.Justification == "" {
+		return validationError{"a justification is required"}
+	}
+	if len(in.Justification) > maxJustificationLength {
+		return validationError{fmt.Sprintf("the justification must be at most %d characters", maxJustificationLength)}
+	}
+	if in.ResourceKey != "" {
+		// Looking the resource up checks that it exists.
+		if _, err := h.resource(in.ResourceType, in.ResourceKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileAccessRequest records a request by username and tells the approvers.
+func (h *Handlers) fileAccessRequest(ctx context.Context, username string, in accessRequestInput) (*models.AccessRequest, error) {
+	if err := h.validateAccessRequestInput(in); err != nil {
+		return nil, err
+	}
+
+	user, err := middleware.GetUserByUsername(h.db, username)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &models.AccessRequest{
+		UserID:        user.ID,
+		Username:      user.Username,
+		Action:        in.Action,
+		ResourceType:  in.ResourceType,
+		ResourceKey:   in.ResourceKey,
+		Justification: in.Justification,
+	}
+	if err := middleware.CreateAccessRequest(h.db, req); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, validationError{"you already have a pending request for this access"}
+		}
+		return nil, err
+	}
+
+	h.audit(username, "access.request", user.ID, map[string]interface{}{
+		"request_id":    req.ID.String(),
+		"action":        req.Action,
+		"resource_type": req.ResourceType,
+		"resource_key":  req.ResourceKey,
+	})
+	h.notifyApprovers(ctx, req)
+	return req, nil
+}
+
+// describeAccess names the access a request is about, for people.
+func describeAccess(req *models.AccessRequest) string {
+	if req.ResourceKey == "" {
+		return req.Action + " " + req.ResourceType
+	}
+	return req.Action + " " + req.ResourceType + " " + req.ResourceKey
+}
+
+// notifyApprovers emails everyone who can decide req. Failures are only
+// logged: the request is on the admin page either way.
+func (h *Handlers) notifyApprovers(ctx context.Context, req *models.AccessRequest) {
+	approvers, err := middleware.ListUsersWithRole(h.db, approverRole)
+	if err != nil {
+		log.Printf("Error listing approvers: %v\n", err)
+		return
+	}
+
+	for _, approver := range approvers {
+		if approver.Email == "" || approver.Username == req.Username {
+			continue
+		}
+		err := h.mailer.Send(ctx, mailer.Message{
+			To:      approver.Email,
+			Subject: "Access request from " + req.Username,
+			Body: fmt.Sprintf("Hi %s,\n\n%s asks to %s:\n\n%s\n\nReview it at %s\n",
+				approver.Username, req.Username, describeAccess(req), req.Justification, h.baseURL+"/admin/access-requests"),
+		})
+		if err != nil {
+			log.Printf("Error notifying %s of access request %s: %v\n", approver.Username, req.ID, err)
+		}
+	}
+}
+
+// accessDecision is an approver's answer to a request. An approval grants
+// Role when one is given and otherwise exactly the access asked for, until
+// ExpiresAt or for good if it is nil.
+type accessDecision struct {
+	Approve   bool       `json:"approve"`
+	Role      string     `json:"role"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Note      string     `json:"note"`
+}
+
+func accessDecisionFromForm(r *http.Request) accessDecision {
+	decision := accessDecision{
+		Approve: r.FormValue("decision") == "approve",
+		Role:    strings.TrimSpace(r.FormValue("role")),
+		Note:    strings.TrimSpace(r.FormValue("note")),
+	}
+	if days, err := strconv.Atoi(r.FormValue("days")); err == nil && days > 0 {
+		t := time.Now().AddDate(0, 0, days)
+		decision.ExpiresAt = &t
+	}
+	return decision
+}
+
+// decideAccessRequest approves or denies a pending request, grants the
+// access on approval and tells the requester.
+func (h *Handlers) decideAccessRequest(ctx context.Context, actor string, id uuid.UUID, decision accessDecision) (*models.AccessRequest, error) {
+	req, err := middleware.GetAccessRequest(h.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if req.Status != models.AccessRequestPending {
+		return nil, middleware.ErrAccessRequestDecided
+	}
+	if req.Username == actor {
+		return nil, validationError{"you cannot decide your own access request"}
+	}
+
+	req.DecidedBy = actor
+	req.Note = decision.Note
+	req.Status = models.AccessRequestDenied
+	var grant func(tx *sql.Tx) error
+	var previousRoles []string
+	if decision.Approve {
+		if decision.ExpiresAt != nil && !decision.ExpiresAt.After(time.Now()) {
+			return nil, validationError{"expiry must be in the future"}
+		}
+		req.Status = models.AccessRequestApproved
+		req.GrantedRole = decision.Role
+		req.ExpiresAt = decision.ExpiresAt
+
+		if req.GrantedRole != "" {
+			if err := h.checkRoles([]string{req.GrantedRole}); err != nil {
+				return nil, err
+			}
+			if previousRoles, err = h.userEffectiveRoles(req.UserID); err != nil {
+				return nil, err
+			}
+		}
+
+		// The access is granted in the transaction that claims the request,
+		// so two approvers deciding at once cannot both grant it.
+		grant = func(tx *sql.Tx) error {
+			if req.GrantedRole != "" {
+				return middleware.GrantRole(tx, req.UserID, req.GrantedRole, actor, req.ExpiresAt)
+			}
+			return middleware.CreateResourceGrant(tx, &models.ResourceGrant{
+				UserID:       req.UserID,
+				Action:       req.Action,
+				ResourceType: req.ResourceType,
+				ResourceKey:  req.ResourceKey,
+				RequestID:    &req.ID,
+				GrantedBy:    actor,
+				ExpiresAt:    req.ExpiresAt,
+			})
+		}
+	}
+
+	if err := middleware.DecideAccessRequest(h.db, req, grant); err != nil {
+		return nil, err
+	}
+	if req.GrantedRole != "" {
+		if err := h.roleGranted(actor, req.UserID, req.GrantedRole, req.ExpiresAt, previousRoles); err != nil {
+			return nil, err
+		}
+	}
+
+	details := map[string]interface{}{"request_id": req.ID.String(), "access": describeAccess(req)}
+	if req.GrantedRole != "" {
+		details["role"] = req.GrantedRole
+	}
+	if req.ExpiresAt != nil {
+		details["expires_at"] = req.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if req.Note != "" {
+		details["note"] = req.Note
+	}
+	action := "access.deny"
+	if decision.Approve {
+		action = "access.approve"
+	}
+	h.audit(actor, action, req.UserID, details)
+
+	h.notifyRequester(ctx, req)
+	return req, nil
+}
+
+// notifyRequester emails the outcome of req to whoever filed it.
+func (h *Handlers) notifyRequester(ctx context.Context, req *models.AccessRequest) {
+	user, err := middleware.GetUserByID(h.db, req.UserID)
+	if err != nil {
+		log.Printf("Error loading requester of access request %s: %v\n", req.ID, err)
+		return
+	}
+	if user.Email == "" {
+		return
+	}
+
+	outcome := "was denied"
+	if req.Status == models.AccessRequestApproved {
+		outcome = "was approved"
+		if req.GrantedRole != "" {
+			outcome += " with the role " + req.GrantedRole
+		}
+		if req.ExpiresAt != nil {
+			outcome += " until " + req.ExpiresAt.UTC().Format("2006-01-02 15:04 MST")
+		}
+	}
+	body := fmt.Sprintf("Hi %s,\n\nYour request to %s %s by %s.\n", user.Username, describeAccess(req), outcome, req.DecidedBy)
+	if req.Note != "" {
+		body += "\nNote: " + req.Note + "\n"
+	}
+
+	err = h.mailer.Send(ctx, mailer.Message{To: user.Email, Subject: "Your access request " + outcome, Body: body})
+	if err != nil {
+		log.Printf("Error notifying %s of access request %s: %v\n", user.Username, req.ID, err)
+	}
+}
+
+func (h *Handlers) expireResourceGrants() {
+	grants, err := middleware.ExpireResourceGrants(h.db)
+	if err != nil {
+		log.Printf("Error expiring resource grants: %v\n", err)
+		return
+	}
+
+	for _, grant := range grants {
+		h.audit("system", "access.expire", grant.UserID, map[string]interface{}{
+			"action":        grant.Action,
+			"resource_type": grant.ResourceType,
+			"resource_key":  grant.ResourceKey,
+		})
+	}
+}
+
+// AccessRequestsHandler shows the request form, filled in from the query
+// string, with the user's earlier requests (GET), or files a request
+// (POST).
+func (h *Handlers) AccessRequestsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		in := accessRequestInputFromForm(r)
+		var formError string
+		if r.Method == http.MethodPost {
+			_, err := h.fileAccessRequest(r.Context(), username, in)
+			if err == nil {
+				http.Redirect(w, r, "/access-requests", http.StatusSeeOther)
+				return
+			}
+			if errorStatus(err) == http.StatusInternalServerError {
+				log.Printf("Error filing access request: %v\n", err)
+				http.Error(w, "Error filing access request", http.StatusInternalServerError)
+				return
+			}
+			formError = err.Error()
+		}
+
+		user, err := middleware.GetUserByUsername(h.db, username)
+		if err != nil {
+			log.Printf("Error retrieving user: %v\n", err)
+			http.Error(w, "Error fetching access requests", http.StatusInternalServerError)
+			return
+		}
+		requests, err := middleware.ListUserAccessRequests(h.db, user.ID, 50)
+		if err != nil {
+			log.Printf("Error listing access requests: %v\n", err)
+			http.Error(w, "Error fetching access requests", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Input    accessRequestInput
+			Actions  map[string][]string
+			Requests []models.AccessRequest
+			Error    string
+		}{
+			Input:    in,
+			Actions:  requestableActions,
+			Requests: requests,
+			Error:    formError,
+		}
+
+		if err := render(w, r, "access_requests.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying access requests", http.StatusInternalServerError)
+		}
+	}
+}
+
+// AdminAccessRequestsHandler lists access requests, pending ones first.
+func (h *Handlers) AdminAccessRequestsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.authorize(w, r, "manage", "users"); !ok {
+			return
+		}
+
+		requests, err := middleware.ListAccessRequests(h.db, 200)
+		if err != nil {
+			log.Printf("Error listing access requests: %v\n", err)
+			http.Error(w, "Error fetching access requests", http.StatusInternalServerError)
+			return
+		}
+		roles, err := middleware.ListRoles(h.db)
+		if err != nil {
+			log.Printf("Error listing roles: %v\n", err)
+			http.Error(w, "Error fetching roles", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Requests  []models.AccessRequest
+			Roles     []models.Role
+			Durations []int
+		}{
+			Requests:  requests,
+			Roles:     roles,
+			Durations: grantDurations,
+		}
+
+		if err := render(w, r, "admin_access_requests.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying access requests", http.StatusInternalServerError)
+		}
+	}
+}
+
+// AdminDecideAccessRequestHandler approves or denies a request.
+func (h *Handlers) AdminDecideAccessRequestHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid request ID", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := h.decideAccessRequest(r.Context(), actor, id, accessDecisionFromForm(r)); err != nil {
+			log.Printf("Error deciding access request: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/access-requests", http.StatusSeeOther)
+	}
+}
+
+// APIAccessRequestsHandler lists access requests (GET), every request for
+// those who may decide them and their own for everyone else, or files one
+// (POST).
+func (h *Handlers) APIAccessRequestsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			var in accessRequestInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			in.ResourceKey = strings.TrimSpace(in.ResourceKey)
+			in.Justification = strings.TrimSpace(in.Justification)
+
+			req, err := h.fileAccessRequest(r.Context(), username, in)
+			if err != nil {
+				log.Printf("Error filing access request: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusCreated, req)
+			return
+		}
+
+		approver, err := h.permitted(r, username, "manage", "users")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking permissions")
+			return
+		}
+
+		var requests []models.AccessRequest
+		if approver {
+			requests, err = middleware.ListAccessRequests(h.db, 200)
+		} else {
+			var user *models.User
+			if user, err = middleware.GetUserByUsername(h.db, username); err == nil {
+				requests, err = middleware.ListUserAccessRequests(h.db, user.ID, 50)
+			}
+		}
+		if err != nil {
+			log.Printf("Error listing access requests: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching access requests")
+			return
+		}
+		writeJSON(w, http.StatusOK, requests)
+	}
+}
+
+// APIAccessRequestDecisionHandler approves or denies a request.
+func (h *Handlers) APIAccessRequestDecisionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request ID")
+			return
+		}
+
+		var decision accessDecision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		decision.Role = strings.TrimSpace(decision.Role)
+		decision.Note = strings.TrimSpace(decision.Note)
+
+		req, err := h.decideAccessRequest(r.Context(), actor, id, decision)
+		if err != nil {
+			log.Printf("Error deciding access request: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, req)
+	}
+}
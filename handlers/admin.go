@@ -0,0 +1,792 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	permitModels "github.com/permitio/permit-golang/pkg/models"
+)
+
+const minPasswordLength = 8
+
+// validationError marks errors caused by bad input rather than a failure on
+// our side, so handlers can answer with 400 instead of 500.
+type validationError struct {
+	msg string
+}
+
+func (e validationError) Error() string {
+	return e.msg
+}
+
+func errorStatus(err error) int {
+	var ve validationError
+	if errors.As(err, &ve) || errors.Is(err, middleware.ErrBuiltinRole) || errors.Is(err, middleware.ErrRoleCycle) ||
+		errors.Is(err, middleware.ErrCategoryCycle) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, middleware.ErrUserNotFound) || errors.Is(err, middleware.ErrBookNotFound) ||
+		errors.Is(err, middleware.ErrRoleNotFound) || errors.Is(err, middleware.ErrGrantNotFound) ||
+		errors.Is(err, middleware.ErrAccessRequestNotFound) || errors.Is(err, middleware.ErrPriceNotFound) ||
+		errors.Is(err, middleware.ErrOrderNotFound) || errors.Is(err, middleware.ErrPaymentNotFound) ||
+		errors.Is(err, middleware.ErrAuthorNotFound) || errors.Is(err, middleware.ErrCategoryNotFound) ||
+		errors.Is(err, middleware.ErrCoverNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errAccessDenied) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, middleware.ErrAccessRequestDecided) || errors.Is(err, middleware.ErrInsufficientStock) ||
+		errors.Is(err, middleware.ErrOrderChanged) || errors.Is(err, middleware.ErrCategoryHasChildren) ||
+		errors.Is(err, middleware.ErrPaymentInProgress) || errors.Is(err, errISBNTaken) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// userInput is the set of user fields an admin may submit, from either the
+// HTML forms or the JSON API.
+type userInput struct {
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	Roles       []string `json:"roles"`
+	Email       string   `json:"email"`
+	FirstName   string   `json:"first_name"`
+	LastName    string   `json:"last_name"`
+	Department  string   `json:"department"`
+	AgeVerified *bool    `json:"age_verified,omitempty"`
+	Disabled    *bool    `json:"disabled,omitempty"`
+}
+
+// userInputFromForm reads the user forms. Their role checkboxes come with
+// an empty hidden "roles" field, so unticking every box still submits
+// "roles" and clears them.
+func userInputFromForm(r *http.Request) userInput {
+	ageVerified := r.FormValue("age_verified") == "on"
+	in := userInput{
+		Username:    strings.TrimSpace(r.FormValue("username")),
+		Password:    r.FormValue("password"),
+		Email:       strings.TrimSpace(r.FormValue("email")),
+		FirstName:   strings.TrimSpace(r.FormValue("first_name")),
+		LastName:    strings.TrimSpace(r.FormValue("last_name")),
+		Department:  strings.TrimSpace(r.FormValue("department")),
+		AgeVerified: &ageVerified,
+	}
+	if values, ok := r.Form["roles"]; ok {
+		in.Roles = []string{}
+		for _, role := range values {
+			if role = strings.TrimSpace(role); role != "" {
+				in.Roles = append(in.Roles, role)
+			}
+		}
+	}
+	return in
+}
+
+// userInputFromJSON reads an API update onto the current values of user, so
+// fields the body leaves out keep them instead of being cleared. Roles,
+// age_verified and disabled are left alone when omitted anyway.
+func userInputFromJSON(body io.Reader, user *models.User) (userInput, error) {
+	in := userInput{
+		Email:      user.Email,
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+		Department: user.Department,
+	}
+	err := json.NewDecoder(body).Decode(&in)
+	return in, err
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return validationError{"password must be at least 8 characters"}
+	}
+	return nil
+}
+
+// createUser validates the input, stores the user, syncs it to Permit.io and
+// records the change in the audit log.
+func (h *Handlers) createUser(actor string, in userInput) (*models.User, error) {
+	if in.Username == "" {
+		return nil, validationError{"username is required"}
+	}
+	if len(in.Roles) == 0 {
+		return nil, validationError{"at least one role is required"}
+	}
+	if err := h.checkRoles(in.Roles); err != nil {
+		return nil, err
+	}
+	if err := validatePassword(in.Password); err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username:   in.Username,
+		Roles:      in.Roles,
+		Email:      in.Email,
+		FirstName:  in.FirstName,
+		LastName:   in.LastName,
+		Department: in.Department,
+		Active:     true,
+	}
+	if in.AgeVerified != nil {
+		user.AgeVerified = *in.AgeVerified
+	}
+	if in.Disabled != nil {
+		user.Disabled = *in.Disabled
+	}
+
+	if err := middleware.CreateUser(h.db, user, in.Password); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, validationError{"username " + in.Username + " is already taken"}
+		}
+		return nil, err
+	}
+
+	h.syncPermitUser(user, nil)
+	h.audit(actor, "user.create", user.ID, map[string]interface{}{
+		"username": user.Username,
+		"roles":    user.Roles,
+	})
+	return user, nil
+}
+
+// updateUser applies profile, role and disabled changes to an existing user.
+// in.Roles, when set, replaces the user's permanent roles; time-bound grants
+// are left alone.
+func (h *Handlers) updateUser(actor string, id uuid.UUID, in userInput) (*models.User, error) {
+	user, err := middleware.GetUserByID(h.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	previousRoles, err := middleware.EffectiveRoles(h.db, user.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]interface{}{}
+	setRoles := false
+	if in.Roles != nil {
+		if err := h.checkRoles(in.Roles); err != nil {
+			return nil, err
+		}
+		permanent, err := h.permanentRoles(id)
+		if err != nil {
+			return nil, err
+		}
+		roles := sortedRoles(in.Roles)
+		if strings.Join(roles, ",") != strings.Join(permanent, ",") {
+			changes["roles"] = map[string][]string{"from": permanent, "to": roles}
+			setRoles = true
+		}
+	}
+	if in.Email != user.Email {
+		changes["email"] = in.Email
+		user.Email = in.Email
+	}
+	if in.FirstName != user.FirstName || in.LastName != user.LastName {
+		changes["name"] = strings.TrimSpace(in.FirstName + " " + in.LastName)
+		user.FirstName = in.FirstName
+		user.LastName = in.LastName
+	}
+	if in.Department != user.Department {
+		changes["department"] = in.Department
+		user.Department = in.Department
+	}
+	if in.AgeVerified != nil && *in.AgeVerified != user.AgeVerified {
+		changes["age_verified"] = *in.AgeVerified
+		user.AgeVerified = *in.AgeVerified
+	}
+	if in.Disabled != nil && *in.Disabled != user.Disabled {
+		changes["disabled"] = *in.Disabled
+		user.Disabled = *in.Disabled
+	}
+
+	if len(changes) == 0 {
+		return user, nil
+	}
+
+	if err := middleware.UpdateUser(h.db, user); err != nil {
+		return nil, err
+	}
+	if setRoles {
+		if err := middleware.SetUserRoles(h.db, id, in.Roles, actor); err != nil {
+			return nil, err
+		}
+		if user, err = middleware.GetUserByID(h.db, id); err != nil {
+			return nil, err
+		}
+	}
+
+	h.syncPermitUser(user, previousRoles)
+	h.audit(actor, "user.update", user.ID, changes)
+	return user, nil
+}
+
+func (h *Handlers) setUserDisabled(actor string, id uuid.UUID, disabled bool) (*models.User, error) {
+	user, err := middleware.GetUserByID(h.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if user.Username == actor && disabled {
+		return nil, validationError{"you cannot disable your own account"}
+	}
+	return h.updateUser(actor, id, userInput{
+		Email:      user.Email,
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+		Department: user.Department,
+		Disabled:   &disabled,
+	})
+}
+
+func (h *Handlers) resetUserPassword(actor string, id uuid.UUID, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	if err := middleware.SetUserPassword(h.db, id, password); err != nil {
+		return err
+	}
+	h.audit(actor, "user.reset_password", id, nil)
+	return nil
+}
+
+func (h *Handlers) deleteUser(actor string, id uuid.UUID) error {
+	user, err := middleware.GetUserByID(h.db, id)
+	if err != nil {
+		return err
+	}
+	if user.Username == actor {
+		return validationError{"you cannot delete your own account"}
+	}
+	if err := middleware.DeleteUser(h.db, id); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := h.permitClient.Api.Users.Delete(ctx, user.Username); err != nil {
+		log.Printf("Permit user delete failed for %s: %v\n", user.Username, err)
+	}
+
+	h.audit(actor, "user.delete", id, map[string]interface{}{"username": user.Username})
+	return nil
+}
+
+// syncPermitUser pushes the user's profile to Permit.io and brings their role
+// assignments from previousRoles to their current effective roles. Disabled
+// users keep their profile but lose every role so the PDP denies them.
+func (h *Handlers) syncPermitUser(user *models.User, previousRoles []string) {
+	roles, err := middleware.EffectiveRoles(h.db, user.Roles)
+	if err != nil {
+		log.Printf("Permit sync failed for %s: %v\n", user.Username, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	permitUser := permitModels.NewUserCreate(user.Username)
+	permitUser.SetEmail(user.Email)
+	permitUser.SetFirstName(user.FirstName)
+	permitUser.SetLastName(user.LastName)
+	permitUser.SetAttributes(map[string]interface{}{
+		"roles":        roles,
+		"disabled":     user.Disabled,
+		"department":   user.Department,
+		"age_verified": user.AgeVerified,
+	})
+
+	if _, err := h.permitClient.SyncUser(ctx, *permitUser); err != nil {
+		log.Printf("Permit sync failed for %s: %v\n", user.Username, err)
+		return
+	}
+
+	current := make(map[string]bool)
+	if !user.Disabled {
+		for _, role := range roles {
+			current[role] = true
+		}
+	}
+	for _, role := range previousRoles {
+		if current[role] {
+			continue
+		}
+		if _, err := h.permitClient.Api.Users.UnassignRole(ctx, user.Username, role, "default"); err != nil {
+			log.Printf("Permit role unassign failed for %s: %v\n", user.Username, err)
+		}
+	}
+	for _, role := range roles {
+		if !current[role] {
+			continue
+		}
+		if _, err := h.permitClient.Api.Users.AssignRole(ctx, user.Username, role, "default"); err != nil {
+			log.Printf("Permit role assign failed for %s: %v\n", user.Username, err)
+		}
+	}
+}
+
+func (h *Handlers) audit(actor, action string, userID uuid.UUID, details map[string]interface{}) {
+	if err := middleware.RecordAudit(h.db, actor, action, "user", userID.String(), details); err != nil {
+		log.Printf("Audit log error: %v\n", err)
+	}
+}
+
+func (h *Handlers) AdminUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		var formError string
+		if r.Method == http.MethodPost {
+			_, err := h.createUser(actor, userInputFromForm(r))
+			if err == nil {
+				http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+				return
+			}
+			if errorStatus(err) != http.StatusBadRequest {
+				log.Printf("Error creating user: %v\n", err)
+				http.Error(w, "Error creating user", http.StatusInternalServerError)
+				return
+			}
+			formError = err.Error()
+		}
+
+		users, err := middleware.ListUsers(h.db)
+		if err != nil {
+			log.Printf("Error listing users: %v\n", err)
+			http.Error(w, "Error fetching users", http.StatusInternalServerError)
+			return
+		}
+
+		roles, err := middleware.ListRoles(h.db)
+		if err != nil {
+			log.Printf("Error listing roles: %v\n", err)
+			http.Error(w, "Error fetching roles", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Users   []models.User
+			Roles   []models.Role
+			Default string
+			Current string
+			Error   string
+		}{
+			Users:   users,
+			Roles:   roles,
+			Default: models.DefaultRole,
+			Current: actor,
+			Error:   formError,
+		}
+
+		if err := render(w, r, "admin_users.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying users", http.StatusInternalServerError)
+		}
+	}
+}
+
+func (h *Handlers) AdminEditUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		var formError string
+		if r.Method == http.MethodPost {
+			_, err := h.updateUser(actor, id, userInputFromForm(r))
+			if err == nil {
+				http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+				return
+			}
+			if status := errorStatus(err); status != http.StatusBadRequest {
+				log.Printf("Error updating user: %v\n", err)
+				http.Error(w, "Error updating user", status)
+				return
+			}
+			formError = err.Error()
+		}
+
+		user, err := middleware.GetUserByID(h.db, id)
+		if err != nil {
+			log.Printf("Error fetching user for edit: %v\n", err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		history, err := middleware.ListAuditEntries(h.db, "user", id.String(), 20)
+		if err != nil {
+			log.Printf("Error fetching audit entries: %v\n", err)
+		}
+
+		lockedUntil, err := middleware.AccountLockedUntil(h.db, user.Username)
+		if err != nil {
+			log.Printf("Error fetching lockout: %v\n", err)
+		}
+
+		roles, err := middleware.ListRoles(h.db)
+		if err != nil {
+			log.Printf("Error listing roles: %v\n", err)
+			http.Error(w, "Error fetching roles", http.StatusInternalServerError)
+			return
+		}
+
+		grants, err := middleware.ListRoleGrants(h.db, id)
+		if err != nil {
+			log.Printf("Error listing role grants: %v\n", err)
+			http.Error(w, "Error fetching roles", http.StatusInternalServerError)
+			return
+		}
+		permanent := make(map[string]bool)
+		var timeBound []models.RoleGrant
+		for _, grant := range grants {
+			if grant.ExpiresAt == nil {
+				permanent[grant.Role] = true
+			} else {
+				timeBound = append(timeBound, grant)
+			}
+		}
+
+		data := struct {
+			User        *models.User
+			Roles       []models.Role
+			Permanent   map[string]bool
+			TimeBound   []models.RoleGrant
+			Durations   []int
+			History     []models.AuditEntry
+			LockedUntil time.Time
+			Error       string
+		}{
+			User:        user,
+			Roles:       roles,
+			Permanent:   permanent,
+			TimeBound:   timeBound,
+			Durations:   grantDurations,
+			History:     history,
+			LockedUntil: lockedUntil,
+			Error:       formError,
+		}
+
+		if err := render(w, r, "admin_user_edit.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying user", http.StatusInternalServerError)
+		}
+	}
+}
+
+func (h *Handlers) AdminDisableUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		disabled := r.FormValue("disabled") == "true"
+		if _, err := h.setUserDisabled(actor, id, disabled); err != nil {
+			log.Printf("Error changing disabled state: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+	}
+}
+
+func (h *Handlers) AdminDeleteUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.deleteUser(actor, id); err != nil {
+			log.Printf("Error deleting user: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+	}
+}
+
+func (h *Handlers) AdminResetPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.resetUserPassword(actor, id, r.FormValue("password")); err != nil {
+			log.Printf("Error resetting password: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/users/edit?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+func (h *Handlers) unlockUser(actor string, id uuid.UUID) error {
+	user, err := middleware.GetUserByID(h.db, id)
+	if err != nil {
+		return err
+	}
+	if err := middleware.UnlockAccount(h.db, user.Username); err != nil {
+		return err
+	}
+	h.audit(actor, "user.unlock", id, nil)
+	return nil
+}
+
+// AdminUnlockUserHandler lifts a lockout caused by failed logins.
+func (h *Handlers) AdminUnlockUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.unlockUser(actor, id); err != nil {
+			log.Printf("Error unlocking user: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/users/edit?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// AdminResetTwoFactorHandler turns off two-factor authentication for a user
+// who lost their authenticator and recovery codes.
+func (h *Handlers) AdminResetTwoFactorHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := middleware.DisableTOTP(h.db, id); err != nil {
+			log.Printf("Error resetting two-factor: %v\n", err)
+			http.Error(w, "Error resetting two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		h.audit(actor, "user.reset_2fa", id, nil)
+
+		http.Redirect(w, r, "/admin/users/edit?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// writeJSON encodes v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("JSON encode error: %v\n", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// APIUsersHandler lists users (GET) or creates one (POST).
+func (h *Handlers) APIUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			users, err := middleware.ListUsers(h.db)
+			if err != nil {
+				log.Printf("Error listing users: %v\n", err)
+				writeJSONError(w, http.StatusInternalServerError, "error fetching users")
+				return
+			}
+			if users == nil {
+				users = []models.User{}
+			}
+			writeJSON(w, http.StatusOK, users)
+			return
+		}
+
+		var in userInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		user, err := h.createUser(actor, in)
+		if err != nil {
+			log.Printf("Error creating user: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, user)
+	}
+}
+
+// APIUserHandler reads (GET), updates (PUT) or deletes (DELETE) a single user.
+func (h *Handlers) APIUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			user, err := middleware.GetUserByID(h.db, id)
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, user)
+
+		case http.MethodPut:
+			current, err := middleware.GetUserByID(h.db, id)
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			in, err := userInputFromJSON(r.Body, current)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			if in.Disabled != nil && *in.Disabled && current.Username == actor {
+				writeJSONError(w, http.StatusBadRequest, "you cannot disable your own account")
+				return
+			}
+			user, err := h.updateUser(actor, id, in)
+			if err != nil {
+				log.Printf("Error updating user: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, user)
+
+		case http.MethodDelete:
+			if err := h.deleteUser(actor, id); err != nil {
+				log.Printf("Error deleting user: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// APIUserPasswordHandler sets a new password for a user.
+func (h *Handlers) APIUserPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		if err := h.resetUserPassword(actor, id, body.Password); err != nil {
+			log.Printf("Error resetting password: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// APIUserUnlockHandler lifts a lockout caused by failed logins.
+func (h *Handlers) APIUserUnlockHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+
+		if err := h.unlockUser(actor, id); err != nil {
+			log.Printf("Error unlocking user: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bookstore/authz"
+	"bookstore/models"
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/permitio/permit-golang/pkg/config"
+	"github.com/permitio/permit-golang/pkg/permit"
+)
+
+func TestUserInputFromJSON(t *testing.T) {
+	user := &models.User{
+		Username:   "alice",
+		Email:      "alice@example.com",
+		FirstName:  "Alice",
+		LastName:   "Liddell",
+		Department: "sales",
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want userInput
+	}{
+		{
+			name: "partial update keeps omitted fields",
+			body: `{"department":"support"}`,
+			want: userInput{Email: "alice@example.com", FirstName: "Alice", LastName: "Liddell", Department: "support"},
+		},
+		{
+			name: "empty body changes nothing",
+			body: `{}`,
+			want: userInput{Email: "alice@example.com", FirstName: "Alice", LastName: "Liddell", Department: "sales"},
+		},
+		{
+			name: "fields can still be cleared explicitly",
+			body: `{"email":"a@example.com","first_name":"","last_name":"","department":""}`,
+			want: userInput{Email: "a@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := userInputFromJSON(strings.NewReader(tt.body), user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.Email != tt.want.Email || in.FirstName != tt.want.FirstName || in.LastName != tt.want.LastName || in.Department != tt.want.Department {
+				t.Errorf("input = %+v, want %+v", in, tt.want)
+			}
+			if in.Roles != nil || in.AgeVerified != nil || in.Disabled != nil {
+				t.Errorf("roles, age_verified or disabled set although omitted: %+v", in)
+			}
+		})
+	}
+
+	if _, err := userInputFromJSON(strings.NewReader(`{"email":`), user); err == nil {
+		t.Error("a truncated body was accepted")
+	}
+}
+
+// allowAll permits everything.
+type allowAll struct{}
+
+func (allowAll) Check(context.Context, authz.Subject, string, authz.Resource) (bool, error) {
+	return true, nil
+}
+
+func TestAPIUserHandlerPartialUpdate(t *testing.T) {
+	id := uuid.New()
+	userRow := func(id, username, roles, department string) []driver.Value {
+		return []driver.Value{id, username, []byte(roles), username + "@example.com",
+			strings.ToUpper(username[:1]) + username[1:], "Liddell", false, true, false, department, true, time.Now()}
+	}
+	columns := []string{"id", "username", "roles", "email", "first_name", "last_name", "disabled", "active",
+		"totp_enabled", "department", "age_verified", "created_at"}
+	db, stub := newStubDB(t,
+		stubQuery{
+			match:   "FROM sessions WHERE token_hash = $1",
+			columns: columns,
+			rows: func([]driver.Value) [][]driver.Value {
+				return [][]driver.Value{userRow(uuid.NewString(), "admin", "{admin}", "")}
+			},
+		},
+		userStub("admin"),
+		stubQuery{
+			match:   "FROM users WHERE id = $1",
+			columns: columns,
+			rows: func([]driver.Value) [][]driver.Value {
+				return [][]driver.Value{userRow(id.String(), "alice", "{customer}", "sales")}
+			},
+		},
+		stubQuery{
+			match:   "WITH RECURSIVE effective",
+			columns: []string{"key"},
+			rows:    func([]driver.Value) [][]driver.Value { return [][]driver.Value{{"customer"}} },
+		},
+	)
+	// Permit is unreachable, so syncing the user only logs an error.
+	unreachable := config.NewConfigBuilder("test").WithApiUrl("http://127.0.0.1:1").WithPdpUrl("http://127.0.0.1:1").Build()
+	h := &Handlers{db: db, authorizer: allowAll{}, permitClient: permit.NewPermit(unreachable)}
+
+	r := httptest.NewRequest("PUT", "/api/users/"+id.String(), strings.NewReader(`{"department":"support"}`))
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "session-token"})
+	r = mux.SetURLVars(r, map[string]string{"id": id.String()})
+	w := httptest.NewRecorder()
+	h.APIUserHandler()(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	updates := stub.execsMatching("UPDATE users")
+	if len(updates) != 1 {
+		t.Fatalf("ran %d user updates, want 1", len(updates))
+	}
+	// email, first_name, last_name, disabled, department, age_verified
+	want := []driver.Value{"alice@example.com", "Alice", "Liddell", false, "support", true}
+	for i, v := range want {
+		if updates[0].args[i] != v {
+			t.Errorf("update argument %d = %v, want %v", i+1, updates[0].args[i], v)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tokenLifetimes are the expiry choices offered on the tokens page, in days.
+var tokenLifetimes = []int{7, 30, 90, 365}
+
+// principal is the identity behind a request authenticated with an API
+// token.
+type principal struct {
+	user  *models.User
+	token *models.APIToken
+}
+
+type principalKey struct{}
+
+// principalFrom returns the API token identity of the request, or nil for
+// requests that use a session cookie or are anonymous.
+func principalFrom(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// Authenticate resolves an "Authorization: Bearer" API token into the user
+// it belongs to. Requests without the header pass through unchanged so that
+// session cookies keep working; requests with a bad token are rejected.
+func (h *Handlers) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, secret, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") || secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookstore"`)
+			writeJSONError(w, http.StatusUnauthorized, "unsupported authorization scheme")
+			return
+		}
+
+		user, token, err := middleware.ResolveAPIToken(h.db, strings.TrimSpace(secret))
+		if errors.Is(err, middleware.ErrInvalidToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookstore", error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid or expired token")
+			return
+		}
+		if err != nil {
+			log.Printf("API token lookup error: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking token")
+			return
+		}
+
+		p := &principal{user: user, token: token}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// accountUser returns the user of a browser session for account pages. API
+// tokens are not accepted, so a leaked token cannot mint new ones.
+func (h *Handlers) accountUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	if principalFrom(r) != nil {
+		http.Error(w, "API tokens cannot manage tokens", http.StatusForbidden)
+		return nil, false
+	}
+
+	user, err := h.sessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !user.TOTPEnabled && h.mfaRequired(user) {
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return nil, false
+	}
+	return user, true
+}
+
+// apiTokensPage is the data behind api_tokens.html.
+type apiTokensPage struct {
+	Tokens    []models.APIToken
+	Scopes    []string
+	Lifetimes []int
+	NewToken  string
+	Error     string
+	Now       time.Time
+}
+
+// APITokensHandler lists the user's API tokens (GET) and creates a new one
+// (POST). The secret is shown once, right after creation.
+func (h *Handlers) APITokensHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := h.accountUser(w, r)
+		if !ok {
+			return
+		}
+
+		data := apiTokensPage{Scopes: models.TokenScopes, Lifetimes: tokenLifetimes}
+		status := http.StatusOK
+
+		if r.Method == http.MethodPost {
+			token, err := newAPIToken(user, r)
+			if err == nil {
+				data.NewToken, err = middleware.CreateAPIToken(h.db, token)
+			}
+			if err == nil {
+				h.audit(user.Username, "token.create", user.ID, map[string]interface{}{
+					"token":  token.ID,
+					"name":   token.Name,
+					"scopes": token.Scopes,
+				})
+			} else if errorStatus(err) == http.StatusBadRequest {
+				status = http.StatusBadRequest
+				data.Error = err.Error()
+			} else {
+				log.Printf("API token creation error: %v\n", err)
+				http.Error(w, "Error creating token", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		tokens, err := middleware.ListAPITokens(h.db, user.ID)
+		if err != nil {
+			log.Printf("API token list error: %v\n", err)
+			http.Error(w, "Error listing tokens", http.StatusInternalServerError)
+			return
+		}
+		data.Tokens = tokens
+		data.Now = time.Now()
+
+		// The page may carry a fresh secret; keep it out of caches.
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := render(w, r, "api_tokens.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+		}
+	}
+}
+
+// newAPIToken validates the token form.
+func newAPIToken(user *models.User, r *http.Request) (*models.APIToken, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, validationError{"invalid form"}
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		return nil, validationError{"name is required and must be at most 100 characters"}
+	}
+
+	scopes := r.Form["scopes"]
+	if len(scopes) == 0 {
+		return nil, validationError{"select at least one scope"}
+	}
+	for _, scope := range scopes {
+		if !isTokenScope(scope) {
+			return nil, validationError{"unknown scope " + scope}
+		}
+	}
+
+	days, err := strconv.Atoi(r.FormValue("expires_in_days"))
+	if err != nil || !isTokenLifetime(days) {
+		return nil, validationError{"choose an expiry"}
+	}
+
+	return &models.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour),
+	}, nil
+}
+
+func isTokenScope(scope string) bool {
+	for _, s := range models.TokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func isTokenLifetime(days int) bool {
+	for _, d := range tokenLifetimes {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeAPITokenHandler revokes one of the user's API tokens.
+func (h *Handlers) RevokeAPITokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := h.accountUser(w, r)
+		if !ok {
+			return
+		}
+
+		tokenID, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+
+		err = middleware.RevokeAPIToken(h.db, user.ID, tokenID)
+		if errors.Is(err, middleware.ErrTokenNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("API token revoke error: %v\n", err)
+			http.Error(w, "Error revoking token", http.StatusInternalServerError)
+			return
+		}
+		h.audit(user.Username, "token.revoke", user.ID, map[string]interface{}{"token": tokenID})
+
+		http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,554 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxAuthorNameLength and maxAuthorBioLength bound author fields.
+const (
+	maxAuthorNameLength = 200
+	maxAuthorBioLength  = 5000
+)
+
+// parseCredits reads a byline as typed into the book forms: credits
+// separated by semicolons or new lines, each a name optionally followed by
+// a role in parentheses, e.g. "Ursula K. Le Guin; Jane Doe (translator)".
+// It is the inverse of the bylines the server writes.
+func parseCredits(byline string) ([]models.BookAuthor, error) {
+	var credits []models.BookAuthor
+	seen := make(map[string]bool)
+	for _, part := range strings.FieldsFunc(byline, func(r rune) bool { return r == ';' || r == '\n' }) {
+		name := strings.Join(strings.Fields(part), " ")
+		role := models.AuthorRoleAuthor
+		if open := strings.LastIndex(name, " ("); open > 0 && strings.HasSuffix(name, ")") {
+			for _, r := range models.AuthorRoles {
+				if strings.EqualFold(name[open+2:len(name)-1], r) {
+					name, role = name[:open], r
+					break
+				}
+			}
+		}
+		if name == "" {
+			continue
+		}
+		if len(name) > maxAuthorNameLength {
+			return nil, validationError{"author names must be at most " + strconv.Itoa(maxAuthorNameLength) + " characters"}
+		}
+
+		key := strings.ToLower(name) + "\x00" + role
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		credits = append(credits, models.BookAuthor{Name: name, Role: role})
+	}
+	if len(credits) == 0 {
+		return nil, validationError{"at least one author is required"}
+	}
+	return credits, nil
+}
+
+// validateCredits checks credits submitted through the API. Each names an
+// author by ID or by name; roles default to author.
+func validateCredits(credits []models.BookAuthor) error {
+	if len(credits) == 0 {
+		return validationError{"at least one author is required"}
+	}
+	for i := range credits {
+		c := &credits[i]
+		c.Name = strings.Join(strings.Fields(c.Name), " ")
+		if c.AuthorID == uuid.Nil && c.Name == "" {
+			return validationError{"each author needs an author_id or a name"}
+		}
+		if len(c.Name) > maxAuthorNameLength {
+			return validationError{"author names must be at most " + strconv.Itoa(maxAuthorNameLength) + " characters"}
+		}
+		switch c.Role {
+		case "":
+			c.Role = models.AuthorRoleAuthor
+		case models.AuthorRoleAuthor, models.AuthorRoleEditor, models.AuthorRoleTranslator:
+		default:
+			return validationError{"role must be one of " + strings.Join(models.AuthorRoles, ", ")}
+		}
+	}
+	return nil
+}
+
+// authorInput is the set of author fields an editor may submit, from either
+// the HTML forms or the JSON API.
+type authorInput struct {
+	Name string `json:"name"`
+	Bio  string `json:"bio"`
+}
+
+func (in *authorInput) validate() error {
+	in.Name = strings.Join(strings.Fields(in.Name), " ")
+	in.Bio = strings.TrimSpace(in.Bio)
+	if in.Name == "" {
+		return validationError{"name is required"}
+	}
+	if len(in.Name) > maxAuthorNameLength {
+		return validationError{"name must be at most " + strconv.Itoa(maxAuthorNameLength) + " characters"}
+	}
+	if len(in.Bio) > maxAuthorBioLength {
+		return validationError{"bio must be at most " + strconv.Itoa(maxAuthorBioLength) + " characters"}
+	}
+	return nil
+}
+
+func (h *Handlers) auditAuthor(actor, action string, authorID uuid.UUID, details map[string]interface{}) {
+	if err := middleware.RecordAudit(h.db, actor, action, "author", authorID.String(), details); err != nil {
+		log.Printf("Audit log error: %v\n", err)
+	}
+}
+
+// createAuthor stores a new author.
+func (h *Handlers) createAuthor(actor string, in authorInput) (*models.Author, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+	author := &models.Author{Name: in.Name, Bio: in.Bio}
+	if err := middleware.CreateAuthor(h.db, author); err != nil {
+		return nil, err
+	}
+	h.auditAuthor(actor, "author.create", author.ID, map[string]interface{}{"name": author.Name})
+	return author, nil
+}
+
+// updateAuthor renames an author or changes their bio. The bylines of
+// their books follow.
+func (h *Handlers) updateAuthor(actor string, id uuid.UUID, in authorInput) (*models.Author, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+	author, err := middleware.GetAuthor(h.db, id)
+	if err != nil {
+		return nil, err
+	}
+	oldName := author.Name
+	author.Name, author.Bio = in.Name, in.Bio
+	if err := middleware.UpdateAuthor(h.db, author); err != nil {
+		return nil, err
+	}
+	h.auditAuthor(actor, "author.update", author.ID, map[string]interface{}{"old_name": oldName, "name": author.Name})
+	return author, nil
+}
+
+// mergeAuthors folds the duplicate author from into author into.
+func (h *Handlers) mergeAuthors(actor string, from, into uuid.UUID) (*models.Author, error) {
+	if from == into {
+		return nil, validationError{"cannot merge an author into themselves"}
+	}
+	duplicate, err := middleware.GetAuthor(h.db, from)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := middleware.MergeAuthors(h.db, from, into)
+	if err != nil {
+		return nil, err
+	}
+	h.auditAuthor(actor, "author.merge", into, map[string]interface{}{
+		"merged_id":   from.String(),
+		"merged_name": duplicate.Name,
+		"books":       moved,
+	})
+	return middleware.GetAuthor(h.db, into)
+}
+
+// setBookCredits replaces the authors credited on a book.
+func (h *Handlers) setBookCredits(actor string, bookID uuid.UUID, credits []models.BookAuthor) error {
+	if err := middleware.SetBookAuthors(h.db, bookID, credits); err != nil {
+		return err
+	}
+	names := make([]string, len(credits))
+	for i, c := range credits {
+		names[i] = c.Credit()
+	}
+	h.auditBook(actor, "book.set_authors", bookID, map[string]interface{}{"authors": names})
+	return nil
+}
+
+// authorBooks lists the books of an author that username may view.
+func (h *Handlers) authorBooks(r *http.Request, username string, authorID uuid.UUID) ([]middleware.AuthorBook, error) {
+	credited, err := middleware.ListAuthorBooks(h.db, authorID)
+	if err != nil {
+		return nil, err
+	}
+
+	books := make([]models.Book, len(credited))
+	for i := range credited {
+		books[i] = credited[i].Book
+	}
+	books, err = h.visibleBooks(r, username, books)
+	if err != nil {
+		return nil, err
+	}
+	visible := make(map[uuid.UUID]bool, len(books))
+	for _, book := range books {
+		visible[book.ID] = true
+	}
+
+	shown := make([]middleware.AuthorBook, 0, len(books))
+	for _, book := range credited {
+		if visible[book.ID] {
+			shown = append(shown, book)
+		}
+	}
+	return shown, nil
+}
+
+// AuthorsHandler lists authors, optionally those matching ?q= (GET), or
+// adds one (POST).
+func (h *Handlers) AuthorsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if _, ok := h.authorize(w, r, "manage", "authors"); !ok {
+				return
+			}
+			author, err := h.createAuthor(username, authorInput{Name: r.FormValue("name"), Bio: r.FormValue("bio")})
+			if err != nil {
+				log.Printf("Error creating author: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			http.Redirect(w, r, "/authors/view?id="+author.ID.String(), http.StatusSeeOther)
+			return
+		}
+
+		search := strings.TrimSpace(r.URL.Query().Get("q"))
+		authors, err := middleware.ListAuthors(h.db, search, 500)
+		if err != nil {
+			log.Printf("Error fetching authors: %v\n", err)
+			http.Error(w, "Error fetching authors", http.StatusInternalServerError)
+			return
+		}
+		canManage, err := h.permitted(r, username, "manage", "authors")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Authors   []models.Author
+			Search    string
+			CanManage bool
+		}{
+			Authors:   authors,
+			Search:    search,
+			CanManage: canManage,
+		}
+
+		if err := render(w, r, "authors.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying authors", http.StatusInternalServerError)
+		}
+	}
+}
+
+// AuthorHandler shows an author with the books of theirs the user may view.
+func (h *Handlers) AuthorHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid author ID", http.StatusBadRequest)
+			return
+		}
+		author, err := middleware.GetAuthor(h.db, id)
+		if err != nil {
+			log.Printf("Error fetching author: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		books, err := h.authorBooks(r, username, author.ID)
+		if err != nil {
+			log.Printf("Error fetching author's books: %v\n", err)
+			http.Error(w, "Error fetching books", http.StatusInternalServerError)
+			return
+		}
+		canManage, err := h.permitted(r, username, "manage", "authors")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Author    *models.Author
+			Books     []middleware.AuthorBook
+			CanManage bool
+		}{
+			Author:    author,
+			Books:     books,
+			CanManage: canManage,
+		}
+
+		if err := render(w, r, "author.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying author", http.StatusInternalServerError)
+		}
+	}
+}
+
+// EditAuthorHandler renames an author or changes their bio.
+func (h *Handlers) EditAuthorHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "authors")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid author ID", http.StatusBadRequest)
+			return
+		}
+		if _, err := h.updateAuthor(actor, id, authorInput{Name: r.FormValue("name"), Bio: r.FormValue("bio")}); err != nil {
+			log.Printf("Error updating author: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/authors/view?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// MergeAuthorsHandler lists likely duplicate authors (GET) or merges one
+// author into another (POST).
+func (h *Handlers) MergeAuthorsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "authors")
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			from, err := uuid.Parse(r.FormValue("from"))
+			if err != nil {
+				http.Error(w, "Invalid author ID", http.StatusBadRequest)
+				return
+			}
+			into, err := uuid.Parse(r.FormValue("into"))
+			if err != nil {
+				http.Error(w, "Invalid author ID", http.StatusBadRequest)
+				return
+			}
+			if _, err := h.mergeAuthors(actor, from, into); err != nil {
+				log.Printf("Error merging authors: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			http.Redirect(w, r, "/authors/view?id="+into.String(), http.StatusSeeOther)
+			return
+		}
+
+		groups, err := middleware.ListDuplicateAuthors(h.db)
+		if err != nil {
+			log.Printf("Error fetching duplicate authors: %v\n", err)
+			http.Error(w, "Error fetching authors", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Groups [][]models.Author
+			From   string
+		}{
+			Groups: groups,
+			From:   r.URL.Query().Get("from"),
+		}
+
+		if err := render(w, r, "authors_merge.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying authors", http.StatusInternalServerError)
+		}
+	}
+}
+
+// APIAuthorsHandler lists authors, optionally those matching ?q= (GET), or
+// creates one (POST).
+func (h *Handlers) APIAuthorsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			actor, ok := h.authorize(w, r, "manage", "authors")
+			if !ok {
+				return
+			}
+			var in authorInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			author, err := h.createAuthor(actor, in)
+			if err != nil {
+				log.Printf("Error creating author: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusCreated, author)
+			return
+		}
+
+		if _, ok := h.requireLogin(w, r); !ok {
+			return
+		}
+		authors, err := middleware.ListAuthors(h.db, strings.TrimSpace(r.URL.Query().Get("q")), 500)
+		if err != nil {
+			log.Printf("Error fetching authors: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching authors")
+			return
+		}
+		if authors == nil {
+			authors = []models.Author{}
+		}
+		writeJSON(w, http.StatusOK, authors)
+	}
+}
+
+// APIAuthorHandler returns an author with the books of theirs the caller
+// may view (GET) or renames them and changes their bio (PUT).
+func (h *Handlers) APIAuthorHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid author ID")
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			actor, ok := h.authorize(w, r, "manage", "authors")
+			if !ok {
+				return
+			}
+			var in authorInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			author, err := h.updateAuthor(actor, id, in)
+			if err != nil {
+				log.Printf("Error updating author: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, author)
+			return
+		}
+
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+		author, err := middleware.GetAuthor(h.db, id)
+		if err != nil {
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		books, err := h.authorBooks(r, username, author.ID)
+		if err != nil {
+			log.Printf("Error fetching author's books: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching books")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			*models.Author
+			Books []middleware.AuthorBook `json:"books"`
+		}{author, books})
+	}
+}
+
+// APIAuthorMergeHandler merges the author in the URL into the author named
+// in the body: {"into": "<id>"}.
+func (h *Handlers) APIAuthorMergeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "authors")
+		if !ok {
+			return
+		}
+
+		from, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid author ID")
+			return
+		}
+		var body struct {
+			Into uuid.UUID `json:"into"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		author, err := h.mergeAuthors(actor, from, body.Into)
+		if err != nil {
+			log.Printf("Error merging authors: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, author)
+	}
+}
+
+// APIBookAuthorsHandler returns the authors credited on a book (GET) or
+// replaces them (PUT) with a list of {"author_id" or "name", "role"}.
+// Names are matched to existing authors, ignoring case, spacing and
+// punctuation, before new authors are created.
+func (h *Handlers) APIBookAuthorsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "view"
+		if r.Method == http.MethodPut {
+			action = "update"
+		}
+		username, book, ok := h.apiBook(w, r, action)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var credits []models.BookAuthor
+			if err := json.NewDecoder(r.Body).Decode(&credits); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			err := validateCredits(credits)
+			if err == nil {
+				err = h.setBookCredits(username, book.ID, credits)
+			}
+			if err != nil {
+				log.Printf("Error setting book authors: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+		}
+
+		credits, err := middleware.ListBookAuthors(h.db, book.ID)
+		if err != nil {
+			log.Printf("Error fetching book authors: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching authors")
+			return
+		}
+		if credits == nil {
+			credits = []models.BookAuthor{}
+		}
+		writeJSON(w, http.StatusOK, credits)
+	}
+}
@@ -0,0 +1,667 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Limits on category names and on the tags of a single book.
+const (
+	maxCategoryNameLength = 100
+	maxTagLength          = 50
+	maxBookTags           = 20
+	// maxTagFacets bounds how many tags the browse page offers at once.
+	maxTagFacets = 30
+)
+
+// slugify turns a category name into its default slug: lower-case letters
+// and digits with single dashes between words, e.g. "Sci-Fi & Fantasy"
+// becomes "sci-fi-fantasy".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// normalizeTag folds a tag to the form it is stored in: lower case with
+// single spaces.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// normalizeTags folds and dedupes tags, keeping their order.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, validationError{"tags must be at most " + strconv.Itoa(maxTagLength) + " characters"}
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxBookTags {
+		return nil, validationError{"a book can have at most " + strconv.Itoa(maxBookTags) + " tags"}
+	}
+	return normalized, nil
+}
+
+// parseTags reads the comma-separated tags typed into the book forms.
+func parseTags(s string) ([]string, error) {
+	return normalizeTags(strings.Split(s, ","))
+}
+
+// parseCategoryIDs reads the category checkboxes of the book forms.
+func parseCategoryIDs(values []string) ([]int64, error) {
+	ids := []int64{}
+	for _, v := range values {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, validationError{"invalid category ID"}
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// classificationFromForm reads the categories and tags of the book forms.
+func classificationFromForm(r *http.Request) ([]int64, []string, error) {
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil, validationError{"invalid form"}
+	}
+	ids, err := parseCategoryIDs(r.PostForm["category"])
+	if err != nil {
+		return nil, nil, err
+	}
+	tags, err := parseTags(r.PostFormValue("tags"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, tags, nil
+}
+
+// categoryInput is the set of category fields an editor may submit, from
+// either the HTML forms or the JSON API. An empty slug is derived from the
+// name.
+type categoryInput struct {
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	ParentID *int64 `json:"parent_id"`
+}
+
+func (in *categoryInput) validate() error {
+	in.Name = strings.Join(strings.Fields(in.Name), " ")
+	in.Slug = strings.TrimSpace(in.Slug)
+	if in.Name == "" {
+		return validationError{"name is required"}
+	}
+	if len(in.Name) > maxCategoryNameLength {
+		return validationError{"name must be at most " + strconv.Itoa(maxCategoryNameLength) + " characters"}
+	}
+	if in.Slug == "" {
+		in.Slug = slugify(in.Name)
+	}
+	if in.Slug == "" || slugify(in.Slug) != in.Slug {
+		return validationError{"slug must be lower case letters and digits separated by single dashes"}
+	}
+	return nil
+}
+
+// categoryInputFromForm reads a category form. An empty parent makes a
+// top-level category.
+func categoryInputFromForm(r *http.Request) (categoryInput, error) {
+	in := categoryInput{Name: r.FormValue("name"), Slug: r.FormValue("slug")}
+	if parent := r.FormValue("parent_id"); parent != "" {
+		id, err := strconv.ParseInt(parent, 10, 64)
+		if err != nil {
+			return in, validationError{"invalid parent category"}
+		}
+		in.ParentID = &id
+	}
+	return in, nil
+}
+
+// slugTaken turns a unique violation on categories.slug into a
+// validation error.
+func slugTaken(err error, slug string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return validationError{"a category with slug " + slug + " already exists"}
+	}
+	return err
+}
+
+func (h *Handlers) auditCategory(actor, action string, categoryID int64, details map[string]interface{}) {
+	if err := middleware.RecordAudit(h.db, actor, action, "category", strconv.FormatInt(categoryID, 10), details); err != nil {
+		log.Printf("Audit log error: %v\n", err)
+	}
+}
+
+// createCategory stores a new category.
+func (h *Handlers) createCategory(actor string, in categoryInput) (*models.Category, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+	category := &models.Category{Name: in.Name, Slug: in.Slug, ParentID: in.ParentID}
+	if err := middleware.CreateCategory(h.db, category); err != nil {
+		return nil, slugTaken(err, in.Slug)
+	}
+	h.auditCategory(actor, "category.create", category.ID, map[string]interface{}{
+		"name":      category.Name,
+		"slug":      category.Slug,
+		"parent_id": category.ParentID,
+	})
+	return category, nil
+}
+
+// updateCategory renames a category or moves it elsewhere in the tree.
+func (h *Handlers) updateCategory(actor string, id int64, in categoryInput) (*models.Category, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+	category, err := middleware.GetCategory(h.db, id)
+	if err != nil {
+		return nil, err
+	}
+	old := *category
+	category.Name, category.Slug, category.ParentID = in.Name, in.Slug, in.ParentID
+	if err := middleware.UpdateCategory(h.db, category); err != nil {
+		return nil, slugTaken(err, in.Slug)
+	}
+	h.auditCategory(actor, "category.update", category.ID, map[string]interface{}{
+		"old_name":      old.Name,
+		"name":          category.Name,
+		"old_slug":      old.Slug,
+		"slug":          category.Slug,
+		"old_parent_id": old.ParentID,
+		"parent_id":     category.ParentID,
+	})
+	return category, nil
+}
+
+// deleteCategory removes a category without subcategories.
+func (h *Handlers) deleteCategory(actor string, id int64) error {
+	category, err := middleware.GetCategory(h.db, id)
+	if err != nil {
+		return err
+	}
+	if err := middleware.DeleteCategory(h.db, id); err != nil {
+		return err
+	}
+	h.auditCategory(actor, "category.delete", id, map[string]interface{}{"name": category.Name, "slug": category.Slug})
+	return nil
+}
+
+// classifyBook replaces the categories and tags of a book.
+func (h *Handlers) classifyBook(actor string, bookID uuid.UUID, categoryIDs []int64, tags []string) error {
+	if err := middleware.SetBookClassification(h.db, bookID, categoryIDs, tags); err != nil {
+		return err
+	}
+	h.auditBook(actor, "book.classify", bookID, map[string]interface{}{"categories": categoryIDs, "tags": tags})
+	return nil
+}
+
+// loadClassification fills in the categories and tags of a single book.
+func (h *Handlers) loadClassification(book *models.Book) error {
+	categories, err := middleware.ListBookCategories(h.db, book.ID)
+	if err != nil {
+		return err
+	}
+	tags, err := middleware.ListBookTags(h.db, book.ID)
+	if err != nil {
+		return err
+	}
+	book.Categories, book.Tags = categories, tags
+	return nil
+}
+
+// facet is one choice in the browse sidebar: a category or tag, how many
+// of the books on offer it would match, and the link that toggles it.
+type facet struct {
+	Name     string
+	Value    string
+	Depth    int
+	Count    int
+	Selected bool
+	Href     string
+}
+
+// bookBrowse is the books page: the books matching the chosen category and
+// tags, and the facets for narrowing them further.
+type bookBrowse struct {
+	Books      []models.Book
+	Categories []facet
+	Tags       []facet
+	Category   *models.Category
+	Selected   []string
+	ClearHref  string
+}
+
+// booksHref links to the books page filtered by category and tags.
+func booksHref(category string, tags []string) string {
+	q := url.Values{}
+	if category != "" {
+		q.Set("category", category)
+	}
+	for _, tag := range tags {
+		q.Add("tag", tag)
+	}
+	if len(q) == 0 {
+		return "/books"
+	}
+	return "/books?" + q.Encode()
+}
+
+// browseBooks filters books to those in the category named by slug, or any
+// of its subcategories, that carry every one of tags, and counts the
+// facets. books must already be limited to those the user may view, so
+// the counts never reveal hidden books.
+//
+// Category counts ignore the chosen category, so its siblings stay
+// selectable, and include books in subcategories; tag counts are over the
+// books shown.
+func browseBooks(books []models.Book, categories []models.Category, classes *middleware.Classifications, slug string, tags []string) (*bookBrowse, error) {
+	browse := &bookBrowse{Books: []models.Book{}, Selected: tags, ClearHref: booksHref("", nil)}
+
+	byID := make(map[int64]*models.Category, len(categories))
+	for i := range categories {
+		byID[categories[i].ID] = &categories[i]
+		if slug != "" && categories[i].Slug == slug {
+			browse.Category = &categories[i]
+		}
+	}
+	if slug != "" && browse.Category == nil {
+		return nil, middleware.ErrCategoryNotFound
+	}
+
+	categoryCounts := make(map[int64]int)
+	tagCounts := make(map[string]int)
+	for _, book := range books {
+		bookTags := make(map[string]bool)
+		for _, tag := range classes.Tags[book.ID] {
+			bookTags[tag] = true
+		}
+		hasTags := true
+		for _, tag := range tags {
+			if !bookTags[tag] {
+				hasTags = false
+				break
+			}
+		}
+		if !hasTags {
+			continue
+		}
+
+		// A book counts once towards each category it is filed under and
+		// each of their ancestors.
+		in := make(map[int64]bool)
+		for _, id := range classes.Categories[book.ID] {
+			for c := byID[id]; c != nil && !in[c.ID]; {
+				in[c.ID] = true
+				if c.ParentID == nil {
+					break
+				}
+				c = byID[*c.ParentID]
+			}
+		}
+		for id := range in {
+			categoryCounts[id]++
+		}
+		if browse.Category != nil && !in[browse.Category.ID] {
+			continue
+		}
+
+		browse.Books = append(browse.Books, book)
+		for tag := range bookTags {
+			tagCounts[tag]++
+		}
+	}
+
+	for _, c := range categories {
+		selected := browse.Category != nil && browse.Category.ID == c.ID
+		if categoryCounts[c.ID] == 0 && !selected {
+			continue
+		}
+		f := facet{Name: c.Name, Value: c.Slug, Depth: c.Depth, Count: categoryCounts[c.ID], Selected: selected}
+		if selected {
+			f.Href = booksHref("", tags)
+		} else {
+			f.Href = booksHref(c.Slug, tags)
+		}
+		browse.Categories = append(browse.Categories, f)
+	}
+
+	chosen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		chosen[tag] = true
+		if _, ok := tagCounts[tag]; !ok {
+			tagCounts[tag] = 0
+		}
+	}
+	for tag, count := range tagCounts {
+		f := facet{Name: tag, Value: tag, Count: count, Selected: chosen[tag]}
+		if f.Selected {
+			var rest []string
+			for _, t := range tags {
+				if t != tag {
+					rest = append(rest, t)
+				}
+			}
+			f.Href = booksHref(slug, rest)
+		} else {
+			f.Href = booksHref(slug, append(append([]string(nil), tags...), tag))
+		}
+		browse.Tags = append(browse.Tags, f)
+	}
+	sort.Slice(browse.Tags, func(i, j int) bool {
+		a, b := browse.Tags[i], browse.Tags[j]
+		if a.Selected != b.Selected {
+			return a.Selected
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Name < b.Name
+	})
+	// Chosen tags sort first, so they survive the cut.
+	if limit := maxTagFacets + len(tags); len(browse.Tags) > limit {
+		browse.Tags = browse.Tags[:limit]
+	}
+	return browse, nil
+}
+
+// CategoriesHandler shows the category tree (GET) or adds a category
+// (POST).
+func (h *Handlers) CategoriesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if _, ok := h.authorize(w, r, "manage", "categories"); !ok {
+				return
+			}
+			in, err := categoryInputFromForm(r)
+			if err == nil {
+				_, err = h.createCategory(username, in)
+			}
+			if err != nil {
+				log.Printf("Error creating category: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			http.Redirect(w, r, "/categories", http.StatusSeeOther)
+			return
+		}
+
+		categories, err := middleware.ListCategories(h.db)
+		if err != nil {
+			log.Printf("Error fetching categories: %v\n", err)
+			http.Error(w, "Error fetching categories", http.StatusInternalServerError)
+			return
+		}
+		canManage, err := h.permitted(r, username, "manage", "categories")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Categories []models.Category
+			CanManage  bool
+		}{
+			Categories: categories,
+			CanManage:  canManage,
+		}
+
+		if err := render(w, r, "categories.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying categories", http.StatusInternalServerError)
+		}
+	}
+}
+
+// EditCategoryHandler shows a category's form (GET) or renames or moves
+// it (POST).
+func (h *Handlers) EditCategoryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "categories")
+		if !ok {
+			return
+		}
+
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid category ID", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			in, err := categoryInputFromForm(r)
+			if err == nil {
+				_, err = h.updateCategory(actor, id, in)
+			}
+			if err != nil {
+				log.Printf("Error updating category: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			http.Redirect(w, r, "/categories", http.StatusSeeOther)
+			return
+		}
+
+		category, err := middleware.GetCategory(h.db, id)
+		if err != nil {
+			log.Printf("Error fetching category: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		categories, err := middleware.ListCategories(h.db)
+		if err != nil {
+			log.Printf("Error fetching categories: %v\n", err)
+			http.Error(w, "Error fetching categories", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Category   *models.Category
+			Categories []models.Category
+			Parent     int64
+		}{
+			Category:   category,
+			Categories: categories,
+		}
+		if category.ParentID != nil {
+			data.Parent = *category.ParentID
+		}
+
+		if err := render(w, r, "category_edit.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying category", http.StatusInternalServerError)
+		}
+	}
+}
+
+// DeleteCategoryHandler removes a category without subcategories.
+func (h *Handlers) DeleteCategoryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "categories")
+		if !ok {
+			return
+		}
+
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid category ID", http.StatusBadRequest)
+			return
+		}
+		if err := h.deleteCategory(actor, id); err != nil {
+			log.Printf("Error deleting category: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/categories", http.StatusSeeOther)
+	}
+}
+
+// APICategoriesHandler lists the category tree (GET) or creates a category
+// (POST).
+func (h *Handlers) APICategoriesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			actor, ok := h.authorize(w, r, "manage", "categories")
+			if !ok {
+				return
+			}
+			var in categoryInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			category, err := h.createCategory(actor, in)
+			if err != nil {
+				log.Printf("Error creating category: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusCreated, category)
+			return
+		}
+
+		if _, ok := h.requireLogin(w, r); !ok {
+			return
+		}
+		categories, err := middleware.ListCategories(h.db)
+		if err != nil {
+			log.Printf("Error fetching categories: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching categories")
+			return
+		}
+		if categories == nil {
+			categories = []models.Category{}
+		}
+		writeJSON(w, http.StatusOK, categories)
+	}
+}
+
+// APICategoryHandler renames or moves a category (PUT) or deletes it
+// (DELETE).
+func (h *Handlers) APICategoryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "categories")
+		if !ok {
+			return
+		}
+
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid category ID")
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			if err := h.deleteCategory(actor, id); err != nil {
+				log.Printf("Error deleting category: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var in categoryInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		category, err := h.updateCategory(actor, id, in)
+		if err != nil {
+			log.Printf("Error updating category: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, category)
+	}
+}
+
+// bookClassification is the body of the book classification API.
+type bookClassification struct {
+	Categories []int64  `json:"categories"`
+	Tags       []string `json:"tags"`
+}
+
+// APIBookClassificationHandler returns the category IDs and tags of a book
+// (GET) or replaces them (PUT) with {"categories": [ids], "tags": [...]}.
+func (h *Handlers) APIBookClassificationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "view"
+		if r.Method == http.MethodPut {
+			action = "update"
+		}
+		username, book, ok := h.apiBook(w, r, action)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var body bookClassification
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			tags, err := normalizeTags(body.Tags)
+			if err == nil {
+				err = h.classifyBook(username, book.ID, body.Categories, tags)
+			}
+			if err != nil {
+				log.Printf("Error classifying book: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+		}
+
+		if err := h.loadClassification(book); err != nil {
+			log.Printf("Error fetching book classification: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching classification")
+			return
+		}
+		body := bookClassification{Categories: []int64{}, Tags: []string{}}
+		for _, c := range book.Categories {
+			body.Categories = append(body.Categories, c.ID)
+		}
+		body.Tags = append(body.Tags, book.Tags...)
+		writeJSON(w, http.StatusOK, body)
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bookstore/covers"
+	"bookstore/middleware"
+	"bookstore/models"
+	"bookstore/storage"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// MaxRequestBody caps every request body: a cover image plus room for the
+// other fields of the book forms.
+const MaxRequestBody = covers.MaxBytes + 1<<20
+
+// maxFormMemory is how much of a multipart form is held in memory before
+// the rest spills to temporary files.
+const maxFormMemory = 8 << 20
+
+// coverKey is where the blob store keeps one size of a cover.
+func coverKey(bookID uuid.UUID, etag, size string) string {
+	return "covers/" + bookID.String() + "/" + etag + "/" + size
+}
+
+// readCoverUpload reads and checks the image in the "cover" field of a
+// book form. It returns nil when no file was chosen.
+func readCoverUpload(r *http.Request) (*covers.Processed, error) {
+	file, header, err := r.FormFile("cover")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, validationError{"invalid cover upload"}
+	}
+	defer file.Close()
+	if header.Size > covers.MaxBytes {
+		return nil, validationError{covers.ErrTooLarge.Error()}
+	}
+	return processCover(file)
+}
+
+// processCover reads at most one byte past the size limit, so an oversized
+// image is refused without being read in full.
+func processCover(r io.Reader) (*covers.Processed, error) {
+	data, err := io.ReadAll(io.LimitReader(r, covers.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	processed, err := covers.Process(data)
+	if errors.Is(err, covers.ErrTooLarge) || errors.Is(err, covers.ErrUnsupportedType) {
+		return nil, validationError{err.Error()}
+	}
+	return processed, err
+}
+
+// deleteCoverBlobs removes every size of a cover from the blob store.
+// Failures only leave unreferenced files behind, so they are logged.
+func (h *Handlers) deleteCoverBlobs(ctx context.Context, cover *models.Cover) {
+	keys := []string{coverKey(cover.BookID, cover.ETag, covers.OriginalSize)}
+	for _, size := range covers.Sizes {
+		keys = append(keys, coverKey(cover.BookID, cover.ETag, size.Name))
+	}
+	for _, key := range keys {
+		if err := h.blobs.Delete(ctx, key); err != nil {
+			log.Printf("Error deleting cover image %s: %v\n", key, err)
+		}
+	}
+}
+
+// storeCover saves an uploaded cover and its thumbnails as the book's
+// cover, replacing any previous one.
+func (h *Handlers) storeCover(ctx context.Context, actor string, bookID uuid.UUID, p *covers.Processed) (*models.Cover, error) {
+	if err := h.blobs.Put(ctx, coverKey(bookID, p.ETag, covers.OriginalSize), bytes.NewReader(p.Original)); err != nil {
+		return nil, err
+	}
+	for name, data := range p.Thumbnails {
+		if err := h.blobs.Put(ctx, coverKey(bookID, p.ETag, name), bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+
+	cover := &models.Cover{
+		BookID:      bookID,
+		ContentType: p.ContentType,
+		Width:       p.Width,
+		Height:      p.Height,
+		Size:        int64(len(p.Original)),
+		ETag:        p.ETag,
+		UploadedBy:  actor,
+	}
+	previous, err := middleware.SetBookCover(h.db, cover)
+	if err != nil {
+		return nil, err
+	}
+	// Re-uploading the same image reuses its keys.
+	if previous != nil && previous.ETag != cover.ETag {
+		h.deleteCoverBlobs(ctx, previous)
+	}
+
+	h.auditBook(actor, "book.cover_upload", bookID, map[string]interface{}{
+		"content_type": cover.ContentType,
+		"width":        cover.Width,
+		"height":       cover.Height,
+		"size":         cover.Size,
+	})
+	return cover, nil
+}
+
+// removeCover deletes the book's cover and its images.
+func (h *Handlers) removeCover(ctx context.Context, actor string, bookID uuid.UUID) error {
+	cover, err := middleware.DeleteBookCover(h.db, bookID)
+	if err != nil {
+		return err
+	}
+	h.deleteCoverBlobs(ctx, cover)
+	h.auditBook(actor, "book.cover_remove", bookID, nil)
+	return nil
+}
+
+// CoverHandler serves one size of a book's cover to users who may view
+// the book. Pages link to covers with ?v=<etag>, which is cached for good;
+// other requests revalidate with the ETag.
+func (h *Handlers) CoverHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid book ID", http.StatusBadRequest)
+			return
+		}
+		size := mux.Vars(r)["size"]
+		if !covers.ValidSize(size) {
+			http.NotFound(w, r)
+			return
+		}
+		book, err := middleware.GetBookByID(h.db, id)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		permitted, err := h.permittedOn(r, username, "view", bookResource(book))
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		if !permitted {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		cover, err := middleware.GetBookCover(h.db, id)
+		if errors.Is(err, middleware.ErrCoverNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching cover: %v\n", err)
+			http.Error(w, "Error fetching cover", http.StatusInternalServerError)
+			return
+		}
+		blob, err := h.blobs.Get(r.Context(), coverKey(id, cover.ETag, size))
+		if errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Cover image missing from blob store: %s\n", coverKey(id, cover.ETag, size))
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading cover: %v\n", err)
+			http.Error(w, "Error fetching cover", http.StatusInternalServerError)
+			return
+		}
+		defer blob.Close()
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			log.Printf("Error reading cover: %v\n", err)
+			http.Error(w, "Error fetching cover", http.StatusInternalServerError)
+			return
+		}
+
+		contentType := "image/jpeg"
+		if size == covers.OriginalSize {
+			contentType = cover.ContentType
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"`+cover.ETag+"-"+size+`"`)
+		// Covers of restricted books must not land in shared caches.
+		if r.URL.Query().Get("v") == cover.ETag {
+			w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		http.ServeContent(w, r, "", cover.UploadedAt, bytes.NewReader(data))
+	}
+}
+
+// APIBookCoverHandler returns a book's cover details (GET), replaces the
+// cover with the image in the request body (PUT) or removes it (DELETE).
+func (h *Handlers) APIBookCoverHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "view"
+		if r.Method != http.MethodGet {
+			action = "update"
+		}
+		username, book, ok := h.apiBook(w, r, action)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			processed, err := processCover(r.Body)
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			cover, err := h.storeCover(r.Context(), username, book.ID, processed)
+			if err != nil {
+				log.Printf("Error storing cover: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, cover)
+		case http.MethodDelete:
+			if err := h.removeCover(r.Context(), username, book.ID); err != nil {
+				if !errors.Is(err, middleware.ErrCoverNotFound) {
+					log.Printf("Error removing cover: %v\n", err)
+				}
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			cover, err := middleware.GetBookCover(h.db, book.ID)
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, cover)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	const token = "known-token"
+
+	multipartBody := func(value string) (string, string) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField(csrfField, value)
+		form.Close()
+		return body.String(), form.FormDataContentType()
+	}
+	formBody := func(value string) (string, string) {
+		return url.Values{csrfField: {value}}.Encode(), "application/x-www-form-urlencoded"
+	}
+	noBody := func(string) (string, string) { return "", "" }
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		cookie    bool
+		header    string
+		body      func(string) (string, string)
+		field     string
+		principal bool
+		want      int
+	}{
+		{name: "safe method without cookie", method: http.MethodGet, path: "/books", body: noBody, want: http.StatusOK},
+		{name: "safe method ignores token", method: http.MethodGet, path: "/books", cookie: true, header: "wrong", body: noBody, want: http.StatusOK},
+		{name: "form field matches", method: http.MethodPost, path: "/add", cookie: true, body: formBody, field: token, want: http.StatusOK},
+		{name: "multipart field matches", method: http.MethodPost, path: "/add", cookie: true, body: multipartBody, field: token, want: http.StatusOK},
+		{name: "header matches", method: http.MethodDelete, path: "/api/books", cookie: true, header: token, body: noBody, want: http.StatusOK},
+		{name: "header wins over field", method: http.MethodPost, path: "/add", cookie: true, header: "wrong", body: formBody, field: token, want: http.StatusForbidden},
+		{name: "missing token", method: http.MethodPost, path: "/add", cookie: true, body: noBody, want: http.StatusForbidden},
+		{name: "wrong field", method: http.MethodPost, path: "/add", cookie: true, body: formBody, field: "wrong", want: http.StatusForbidden},
+		{name: "wrong header", method: http.MethodPut, path: "/api/books", cookie: true, header: "wrong", body: noBody, want: http.StatusForbidden},
+		{name: "field without cookie", method: http.MethodPost, path: "/add", body: formBody, field: token, want: http.StatusForbidden},
+		{name: "exempt path", method: http.MethodPost, path: "/webhooks/payments", body: noBody, want: http.StatusOK},
+		{name: "API token request", method: http.MethodPost, path: "/api/books", body: noBody, principal: true, want: http.StatusOK},
+	}
+
+	h := &Handlers{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := h.CSRF("/webhooks/payments")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = r.Context().Value(csrfKey{}).(string)
+			}))
+
+			body, contentType := tt.body(tt.field)
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			if contentType != "" {
+				r.Header.Set("Content-Type", contentType)
+			}
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			if tt.principal {
+				r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &principal{}))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if seen == "" {
+				t.Error("the request context carries no CSRF token")
+			}
+			setsCookie := len(w.Result().Cookies()) > 0
+			if tt.cookie && (seen != token || setsCookie) {
+				t.Errorf("token = %q and cookie set = %t, want the existing token kept", seen, setsCookie)
+			}
+			if !tt.cookie && !setsCookie {
+				t.Error("no CSRF cookie was issued")
+			}
+		})
+	}
+}
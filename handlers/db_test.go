@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubQuery answers every query containing match with the rows returns for
+// the query's arguments.
+type stubQuery struct {
+	match   string
+	columns []string
+	rows    func(args []driver.Value) [][]driver.Value
+}
+
+// execCall is a statement run with Exec.
+type execCall struct {
+	query string
+	args  []driver.Value
+}
+
+// stubDB is an in-memory stand-in for the database: queries are answered
+// from stubs and statements run with Exec are recorded.
+type stubDB struct {
+	mu      sync.Mutex
+	queries []stubQuery
+	execs   []execCall
+	// fail, when set, decides the error of each statement run with Exec.
+	fail func(query string, args []driver.Value) error
+}
+
+var (
+	stubDBsMu sync.Mutex
+	stubDBs   = map[string]*stubDB{}
+)
+
+func init() {
+	sql.Register("stub", stubDriver{})
+}
+
+// newStubDB opens a database that answers the given queries.
+func newStubDB(t *testing.T, queries ...stubQuery) (*sql.DB, *stubDB) {
+	t.Helper()
+	stub := &stubDB{queries: queries}
+	stubDBsMu.Lock()
+	stubDBs[t.Name()] = stub
+	stubDBsMu.Unlock()
+
+	db, err := sql.Open("stub", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		stubDBsMu.Lock()
+		delete(stubDBs, t.Name())
+		stubDBsMu.Unlock()
+	})
+	return db, stub
+}
+
+// execsMatching returns the recorded statements containing match.
+func (s *stubDB) execsMatching(match string) []execCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var calls []execCall
+	for _, call := range s.execs {
+		if strings.Contains(call.query, match) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+type stubDriver struct{}
+
+func (stubDriver) Open(name string) (driver.Conn, error) {
+	stubDBsMu.Lock()
+	defer stubDBsMu.Unlock()
+	stub, ok := stubDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no stub database %q", name)
+	}
+	return stubConn{stub}, nil
+}
+
+type stubConn struct{ db *stubDB }
+
+func (c stubConn) Prepare(query string) (driver.Stmt, error) { return stubStmt{c.db, query}, nil }
+func (c stubConn) Close() error                              { return nil }
+func (c stubConn) Begin() (driver.Tx, error)                 { return stubTx{}, nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+	db    *stubDB
+	query string
+}
+
+func (s stubStmt) Close() error  { return nil }
+func (s stubStmt) NumInput() int { return -1 }
+
+func (s stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.execs = append(s.db.execs, execCall{s.query, args})
+	if s.db.fail != nil {
+		if err := s.db.fail(s.query, args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	for _, q := range s.db.queries {
+		if strings.Contains(s.query, q.match) {
+			return &stubRows{columns: q.columns, rows: q.rows(args)}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+type stubRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *stubRows) Columns() []string { return r.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
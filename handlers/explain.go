@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bookstore/authz"
+	"bookstore/middleware"
+	"context"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// explainQuery is an authorization question asked on behalf of support.
+type explainQuery struct {
+	Username     string `json:"user"`
+	Action       string `json:"action"`
+	ResourceType string `json:"resource"`
+	ResourceKey  string `json:"key,omitempty"`
+}
+
+func explainQueryFromRequest(r *http.Request) explainQuery {
+	return explainQuery{
+		Username:     strings.TrimSpace(r.FormValue("user")),
+		Action:       strings.TrimSpace(r.FormValue("action")),
+		ResourceType: strings.TrimSpace(r.FormValue("resource")),
+		ResourceKey:  strings.TrimSpace(r.FormValue("key")),
+	}
+}
+
+// explainResult is the answer: what the authorizer was given and how it
+// decided. Granted is set when an approved access request allows the
+// action on the resource, and Allowed is the decision the handlers would
+// reach counting it.
+type explainResult struct {
+	Query       explainQuery       `json:"query"`
+	Subject     authz.Subject      `json:"subject"`
+	Resource    authz.Resource     `json:"resource"`
+	Explanation *authz.Explanation `json:"explanation"`
+	Granted     bool               `json:"granted"`
+	Allowed     bool               `json:"allowed"`
+}
+
+// explain repeats the check the handlers would make for q and reports how
+// the authorizer reached its decision. API token scopes are not involved.
+func (h *Handlers) explain(ctx context.Context, q explainQuery) (*explainResult, error) {
+	if q.Username == "" || q.Action == "" || q.ResourceType == "" {
+		return nil, validationError{"user, action and resource are required"}
+	}
+	if _, err := middleware.GetUserByUsername(h.db, q.Username); err != nil {
+		return nil, err
+	}
+
+	subject, err := h.subject(q.Username)
+	if err != nil {
+		return nil, err
+	}
+	resource, err := h.resource(q.ResourceType, q.ResourceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &explainResult{Query: q, Subject: subject, Resource: resource}
+	if explainer, ok := h.authorizer.(authz.Explainer); ok {
+		result.Explanation, err = explainer.Explain(ctx, subject, q.Action, resource)
+	} else {
+		var allowed bool
+		allowed, err = h.authorizer.Check(ctx, subject, q.Action, resource)
+		result.Explanation = &authz.Explanation{
+			Backend: "unknown",
+			Allowed: allowed,
+			Reasons: []string{"this authorizer cannot explain its decisions"},
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Like granted, minus the token scopes.
+	keys, err := middleware.GrantedResourceKeys(h.db, q.Username, q.Action, q.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key == "" || key == q.ResourceKey {
+			result.Granted = true
+		}
+	}
+	result.Allowed = result.Explanation.Allowed || result.Granted
+	return result, nil
+}
+
+// AdminExplainHandler shows why a user is or is not allowed to do
+// something. The form submits with GET so results can be shared as links.
+func (h *Handlers) AdminExplainHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.authorize(w, r, "manage", "users"); !ok {
+			return
+		}
+
+		data := struct {
+			Query  explainQuery
+			Result *explainResult
+			Error  string
+		}{Query: explainQueryFromRequest(r)}
+
+		status := http.StatusOK
+		if data.Query.Username != "" {
+			result, err := h.explain(r.Context(), data.Query)
+			if err != nil {
+				status = errorStatus(err)
+				if status == http.StatusInternalServerError {
+					log.Printf("Authorization explain error: %v\n", err)
+				}
+				data.Error = err.Error()
+			}
+			data.Result = result
+		}
+
+		w.WriteHeader(status)
+		if err := render(w, r, "admin_explain.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+		}
+	}
+}
+
+// APIExplainHandler is the JSON form of AdminExplainHandler.
+func (h *Handlers) APIExplainHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.authorize(w, r, "manage", "users"); !ok {
+			return
+		}
+
+		result, err := h.explain(r.Context(), explainQueryFromRequest(r))
+		if err != nil {
+			status := errorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Authorization explain error: %v\n", err)
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bookstore/authz"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// customerAuthorizer lets a customer view their own orders and nothing
+// else, deciding on the resource attributes as the policy does.
+type customerAuthorizer struct{}
+
+func (customerAuthorizer) Check(_ context.Context, subject authz.Subject, action string, resource authz.Resource) (bool, error) {
+	return action == "view" && resource.Type == "orders" && resource.Attributes["customer"] == subject.Key, nil
+}
+
+// userStub answers user lookups by username for the given users, each with
+// the customer role.
+func userStub(usernames ...string) stubQuery {
+	return stubQuery{
+		match: "FROM users WHERE username = $1",
+		columns: []string{"id", "username", "roles", "email", "first_name", "last_name", "disabled", "active",
+			"totp_enabled", "department", "age_verified", "created_at"},
+		rows: func(args []driver.Value) [][]driver.Value {
+			for _, username := range usernames {
+				if args[0] == username {
+					return [][]driver.Value{{uuid.NewString(), username, []byte("{customer}"), username + "@example.com",
+						"", "", false, true, false, "", false, time.Now()}}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func TestExplainMatchesOrderHandlers(t *testing.T) {
+	orderID := uuid.New()
+	db, _ := newStubDB(t,
+		userStub("alice", "bob"),
+		stubQuery{
+			match:   "WITH RECURSIVE effective",
+			columns: []string{"key"},
+			rows:    func([]driver.Value) [][]driver.Value { return [][]driver.Value{{"customer"}} },
+		},
+		stubQuery{
+			match:   "FROM orders WHERE id = $1",
+			columns: []string{"id", "user_id", "customer", "status", "currency", "total", "created_at", "updated_at"},
+			rows: func([]driver.Value) [][]driver.Value {
+				return [][]driver.Value{{orderID.String(), nil, "alice", "pending", "EUR", int64(2500), time.Now(), time.Now()}}
+			},
+		},
+		stubQuery{
+			match:   "FROM order_items",
+			columns: []string{"book_id", "title", "quantity", "unit_price"},
+			rows:    func([]driver.Value) [][]driver.Value { return nil },
+		},
+		stubQuery{
+			match:   "FROM resource_grants",
+			columns: []string{"resource_key"},
+			rows:    func([]driver.Value) [][]driver.Value { return nil },
+		},
+	)
+	h := &Handlers{db: db, authorizer: customerAuthorizer{}}
+
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"alice", true},
+		{"bob", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			result, err := h.explain(context.Background(), explainQuery{
+				Username:     tt.username,
+				Action:       "view",
+				ResourceType: "orders",
+				ResourceKey:  orderID.String(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = h.loadOrder(httptest.NewRequest("GET", "/orders/"+orderID.String(), nil), tt.username, orderID)
+			if err != nil && !errors.Is(err, errAccessDenied) {
+				t.Fatal(err)
+			}
+			handlerAllowed := err == nil
+
+			if result.Allowed != handlerAllowed {
+				t.Errorf("explain allowed = %t, the order handlers allowed = %t", result.Allowed, handlerAllowed)
+			}
+			if handlerAllowed != tt.want {
+				t.Errorf("allowed = %t, want %t", handlerAllowed, tt.want)
+			}
+			if result.Resource.Attributes["customer"] != "alice" {
+				t.Errorf("explain resource = %+v, want the order's attributes", result.Resource)
+			}
+		})
+	}
+}
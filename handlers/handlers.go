@@ -1,26 +1,61 @@
 package handlers
 
 import (
+	"bookstore/authz"
+	"bookstore/isbn"
+	"bookstore/mailer"
 	"bookstore/middleware"
 	"bookstore/models" // Use your models package here
+	"bookstore/payments"
+	"bookstore/sso"
+	"bookstore/storage"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-
+	"github.com/gorilla/mux"
 	"github.com/permitio/permit-golang/pkg/config"
-	"github.com/permitio/permit-golang/pkg/enforcement"
 	permitModels "github.com/permitio/permit-golang/pkg/models"
 	"github.com/permitio/permit-golang/pkg/permit"
 )
 
-var tmpl = template.Must(template.ParseGlob("templates/*.html"))
+// templates returns the parsed templates, reading them on first use. They
+// are never executed directly: render clones them per request to bind
+// request-specific functions such as csrfField.
+var templates = sync.OnceValue(func() *template.Template {
+	return template.Must(template.New("").Funcs(template.FuncMap{
+		"csrfField": func() template.HTML { return "" },
+		"money":     models.FormatMoney,
+		"indent":    indentClass,
+	}).ParseGlob("templates/*.html"))
+})
+
+// indentClass is the Tailwind padding that indents a category tree entry
+// by its depth. Inline styles are ruled out by the content security policy.
+func indentClass(depth int) string {
+	switch {
+	case depth <= 0:
+		return "pl-0"
+	case depth == 1:
+		return "pl-4"
+	case depth == 2:
+		return "pl-8"
+	case depth == 3:
+		return "pl-12"
+	default:
+		return "pl-16"
+	}
+}
 
 // Helper function to convert string to *string
 func StringPtr(s string) *string {
@@ -30,27 +65,366 @@ func StringPtr(s string) *string {
 type Handlers struct {
 	db           *sql.DB
 	permitClient *permit.Client
+	authorizer   authz.Authorizer
+	mailer       mailer.Mailer
+	payments     payments.PaymentProvider
+	isbnLookup   isbn.Provider
+	blobs        storage.BlobStore
+	baseURL      string
+
+	// Password reset requests are throttled per account and per client IP.
+	resetAccountLimiter *middleware.RateLimiter
+	resetIPLimiter      *middleware.RateLimiter
+
+	mfaRequiredRoles map[string]bool
+	loginThrottle    *middleware.LoginThrottle
+	sso              *sso.Provider
+}
+
+// Options carries optional collaborators and settings for Handlers. Zero
+// values fall back to development defaults.
+type Options struct {
+	// Mailer delivers verification and notification emails. Defaults to
+	// mailer.LogMailer.
+	Mailer mailer.Mailer
+	// BaseURL is the externally visible address used to build links in
+	// emails. Defaults to http://localhost:8080.
+	BaseURL string
+	// MFARequiredRoles lists roles that must have two-factor authentication
+	// enabled before they can use anything beyond the enrolment page.
+	MFARequiredRoles []string
+	// LoginThrottle controls backoff and lockout after failed logins.
+	// Defaults to middleware.DefaultLoginThrottle().
+	LoginThrottle *middleware.LoginThrottle
+	// SSO enables OpenID Connect login when set.
+	SSO *sso.Provider
+	// Authorizer makes permission checks. Defaults to the Permit.io PDP.
+	Authorizer authz.Authorizer
+	// Payments takes payment for orders. Defaults to the fake gateway
+	// without a webhook secret, which rejects every webhook.
+	Payments payments.PaymentProvider
+	// ISBNLookup prefills the add form from an ISBN. Lookup is off when
+	// it is nil.
+	ISBNLookup isbn.Provider
+	// Blobs stores cover images. Defaults to files under data/blobs.
+	Blobs storage.BlobStore
 }
 
-func NewHandlers(db *sql.DB, apiKey string) *Handlers {
+func NewHandlers(db *sql.DB, apiKey string, opts Options) *Handlers {
 	permitConfig := config.NewConfigBuilder(apiKey).
-		WithPdpUrl("http://localhost:7766").
+		WithPdpUrl(authz.DefaultPDPURL).
 		Build()
 	permitClient := permit.NewPermit(permitConfig)
 	if permitClient == nil {
 		log.Fatalf("Failed to initialize Permit.io client")
 	}
 
+	// Broken templates should stop the server at startup, not fail the
+	// first page that renders one.
+	templates()
+
+	if opts.Mailer == nil {
+		opts.Mailer = mailer.LogMailer{}
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = "http://localhost:8080"
+	}
+	if opts.LoginThrottle == nil {
+		opts.LoginThrottle = middleware.DefaultLoginThrottle()
+	}
+	if opts.Authorizer == nil {
+		opts.Authorizer = authz.NewPermit(permitClient, authz.DefaultPDPURL, apiKey)
+	}
+	if opts.Payments == nil {
+		opts.Payments = payments.NewFake("")
+	}
+	if opts.Blobs == nil {
+		blobs, err := storage.NewLocal("data/blobs")
+		if err != nil {
+			log.Fatalf("Failed to initialize blob store: %v", err)
+		}
+		opts.Blobs = blobs
+	}
+
+	mfaRequiredRoles := make(map[string]bool)
+	for _, role := range opts.MFARequiredRoles {
+		mfaRequiredRoles[role] = true
+	}
+
 	return &Handlers{
 		db:           db,
 		permitClient: permitClient,
+		authorizer:   opts.Authorizer,
+		mailer:       opts.Mailer,
+		payments:     opts.Payments,
+		isbnLookup:   opts.ISBNLookup,
+		blobs:        opts.Blobs,
+		baseURL:      strings.TrimRight(opts.BaseURL, "/"),
+
+		resetAccountLimiter: middleware.NewRateLimiter(3, time.Hour),
+		resetIPLimiter:      middleware.NewRateLimiter(10, time.Hour),
+
+		mfaRequiredRoles: mfaRequiredRoles,
+		loginThrottle:    opts.LoginThrottle,
+		sso:              opts.SSO,
+	}
+}
+
+const (
+	sessionCookie = "session"
+	sessionTTL    = 24 * time.Hour
+)
+
+// errMFASetupRequired is returned for users whose role requires two-factor
+// authentication but who have not enrolled yet.
+var errMFASetupRequired = errors.New("two-factor authentication setup required")
+
+// sessionUser resolves the session cookie to the logged-in user without
+// applying the two-factor policy.
+func (h *Handlers) sessionUser(r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.GetSessionUser(h.db, cookie.Value)
+}
+
+// currentUsername resolves the API token or session cookie to the logged-in
+// username.
+func (h *Handlers) currentUsername(r *http.Request) (string, error) {
+	// Tokens can only be created from a session that already passed the
+	// two-factor policy, so it is not applied to them again.
+	if p := principalFrom(r); p != nil {
+		return p.user.Username, nil
+	}
+
+	user, err := h.sessionUser(r)
+	if err != nil {
+		return "", err
+	}
+	if !user.TOTPEnabled && h.mfaRequired(user) {
+		return "", errMFASetupRequired
+	}
+	return user.Username, nil
+}
+
+// requireLogin returns the logged-in username, or writes a 401 (or a
+// redirect to two-factor enrolment) and returns false.
+func (h *Handlers) requireLogin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, err := h.currentUsername(r)
+	if errors.Is(err, errMFASetupRequired) {
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+		return "", false
+	}
+	return username, true
+}
+
+// subject describes a user to the authorizer.
+func (h *Handlers) subject(username string) (authz.Subject, error) {
+	user, err := middleware.GetUserByUsername(h.db, username)
+	if err != nil {
+		return authz.Subject{}, fmt.Errorf("error retrieving user: %v", err)
+	}
+	roles, err := middleware.EffectiveRoles(h.db, user.Roles)
+	if err != nil {
+		return authz.Subject{}, fmt.Errorf("error resolving roles: %v", err)
+	}
+
+	return authz.Subject{
+		Key:   username,
+		Roles: roles,
+		Attributes: map[string]interface{}{
+			"roles":        roles,
+			"department":   user.Department,
+			"age_verified": user.AgeVerified,
+		},
+	}, nil
+}
+
+// resource describes a resource type, or one instance of it, to the
+// authorizer. Books and orders are looked up so their attributes are sent
+// along just as the handlers that act on them send them.
+func (h *Handlers) resource(resourceType, key string) (authz.Resource, error) {
+	if key == "" {
+		return authz.Resource{Type: resourceType}, nil
+	}
+
+	switch resourceType {
+	case "books":
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return authz.Resource{}, validationError{"invalid book ID"}
+		}
+		book, err := middleware.GetBookByID(h.db, id)
+		if err != nil {
+			return authz.Resource{}, err
+		}
+		return bookResource(book), nil
+	case "orders":
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return authz.Resource{}, validationError{"invalid order ID"}
+		}
+		order, err := middleware.GetOrder(h.db, id)
+		if err != nil {
+			return authz.Resource{}, err
+		}
+		return orderResource(order), nil
+	}
+	return authz.Resource{Type: resourceType, Key: key}, nil
+}
+
+// bookResource describes one book to the authorizer.
+func bookResource(book *models.Book) authz.Resource {
+	return authz.Resource{
+		Type: "books",
+		Key:  book.ID.String(),
+		Attributes: map[string]interface{}{
+			"genre":      book.Genre,
+			"restricted": book.Restricted,
+			"age_rating": book.AgeRating,
+		},
+	}
+}
+
+// tokenAllows reports whether a request made with an API token is within
+// the token's scopes. Session requests are not limited.
+func tokenAllows(r *http.Request, username, action, resourceType string) bool {
+	if p := principalFrom(r); p != nil && !middleware.ScopeAllows(p.token.Scopes, resourceType, action) {
+		log.Printf("Token %s of user %s lacks scope %s:%s\n", p.token.ID, username, resourceType, action)
+		return false
+	}
+	return true
+}
+
+// permitted reports whether username may perform action on the given
+// resource type. Requests made with an API token are further limited to the
+// token's scopes.
+func (h *Handlers) permitted(r *http.Request, username, action, resourceType string) (bool, error) {
+	return h.permittedOn(r, username, action, authz.Resource{Type: resourceType})
+}
+
+// permittedOn is like permitted but decides on a single resource, so the
+// authorizer can take its attributes into account.
+func (h *Handlers) permittedOn(r *http.Request, username, action string, resource authz.Resource) (bool, error) {
+	if !tokenAllows(r, username, action, resource.Type) {
+		return false, nil
+	}
+
+	subject, err := h.subject(username)
+	if err != nil {
+		return false, err
+	}
+
+	permitted, err := h.authorizer.Check(r.Context(), subject, action, resource)
+	if err != nil {
+		return false, fmt.Errorf("error checking permissions: %v", err)
+	}
+
+	if !permitted {
+		if permitted, err = h.granted(r, username, action, resource.Type, resource.Key); err != nil || permitted {
+			return permitted, err
+		}
+		log.Printf("Access denied for user %s with roles %v to %s %s %s\n", username, subject.Roles, action, resource.Type, resource.Key)
+	}
+	return permitted, nil
+}
+
+// granted reports whether username holds an approved access request for
+// action on the resource with the given key, or on every resource of the
+// type. Like permitted it honours API token scopes.
+func (h *Handlers) granted(r *http.Request, username, action, resourceType, key string) (bool, error) {
+	if !tokenAllows(r, username, action, resourceType) {
+		return false, nil
+	}
+
+	keys, err := middleware.GrantedResourceKeys(h.db, username, action, resourceType)
+	if err != nil {
+		return false, fmt.Errorf("error checking resource grants: %v", err)
+	}
+	for _, k := range keys {
+		if k == "" || k == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// visibleBooks keeps the books username may view.
+func (h *Handlers) visibleBooks(r *http.Request, username string, books []models.Book) ([]models.Book, error) {
+	if !tokenAllows(r, username, "view", "books") {
+		return nil, nil
+	}
+
+	subject, err := h.subject(username)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]authz.Resource, len(books))
+	for i := range books {
+		resources[i] = bookResource(&books[i])
+	}
+	allowed, err := authz.CheckAll(r.Context(), h.authorizer, subject, "view", resources)
+	if err != nil {
+		return nil, fmt.Errorf("error checking permissions: %v", err)
+	}
+
+	keys, err := middleware.GrantedResourceKeys(h.db, username, "view", "books")
+	if err != nil {
+		return nil, fmt.Errorf("error checking resource grants: %v", err)
+	}
+	granted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		granted[key] = true
+	}
+
+	visible := make([]models.Book, 0, len(books))
+	for i, book := range books {
+		if allowed[i] || granted[""] || granted[book.ID.String()] {
+			visible = append(visible, book)
+		}
 	}
+	return visible, nil
+}
+
+// authorize checks whether the logged-in user may perform action on the given
+// resource type. When the check fails it writes the error response itself and
+// returns false.
+func (h *Handlers) authorize(w http.ResponseWriter, r *http.Request, action, resourceType string) (string, bool) {
+	username, ok := h.requireLogin(w, r)
+	if !ok {
+		return "", false
+	}
+
+	permitted, err := h.permitted(r, username, action, resourceType)
+	if err != nil {
+		log.Printf("Permission check error: %v\n", err)
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return "", false
+	}
+	if !permitted {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return "", false
+	}
+
+	return username, true
 }
 
 func (h *Handlers) LoginHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
-			if err := tmpl.ExecuteTemplate(w, "login.html", nil); err != nil {
+			data := struct {
+				SSOLabel string
+			}{}
+			if h.sso != nil {
+				data.SSOLabel = h.sso.Label()
+			}
+			if err := render(w, r, "login.html", data); err != nil {
 				http.Error(w, "Error rendering template", http.StatusInternalServerError)
 				return
 			}
@@ -59,132 +433,208 @@ func (h *Handlers) LoginHandler() http.HandlerFunc {
 
 		username := r.FormValue("username")
 		password := r.FormValue("password")
+		ip := middleware.ClientIP(r)
 
-		user, err := middleware.LoginUser(h.db, username, password)
+		wait, err := h.loginThrottle.RetryAfter(h.db, username, ip)
 		if err != nil {
-			log.Printf("Login failed for user %s: %v\n", username, err)
-			http.Error(w, "Invalid login credentials", http.StatusUnauthorized)
+			log.Printf("Login throttle lookup error: %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
 			return
 		}
-		role := user.Role // Extract the role string
-
-		// Set username in a cookie to persist across requests
-		http.SetCookie(w, &http.Cookie{
-			Name:     "username",
-			Value:    username,
-			Path:     "/",
-			Expires:  time.Now().Add(24 * time.Hour),
-			HttpOnly: true,
-			Secure:   r.TLS != nil, // Only secure if using HTTPS
-		})
-
-		// Create context for syncing user with Permit.io
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-		defer cancel()
-
-		// Create Permit.io User object with attributes
-		permitUser := permitModels.NewUserCreate(username)
-		permitUser.SetAttributes(map[string]interface{}{
-			"role": role,
-		})
-
-		_, err = h.permitClient.SyncUser(ctx, *permitUser)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		user, err := middleware.LoginUser(h.db, username, password)
 		if err != nil {
-			log.Printf("Permit sync failed: %v\n", err)
+			log.Printf("Login failed for user %s from %s: %v\n", username, ip, err)
+			if errors.Is(err, middleware.ErrInvalidCredentials) {
+				h.recordLoginFailure(username, ip)
+			} else {
+				h.releaseLogin(username)
+			}
+			http.Error(w, "Invalid login credentials", http.StatusUnauthorized)
+			return
 		}
 
-		// Render the index.html page with the user's username and role
-		data := struct {
-			Username string
-			Role     string
-		}{
-			Username: username,
-			Role:     role,
+		// The failure count is only cleared once the second factor, if
+		// any, is also right; see completeLogin. The second step claims
+		// the throttle again.
+		if user.TOTPEnabled {
+			h.releaseLogin(username)
 		}
+		h.beginSession(w, r, user)
+	}
+}
 
-		if err := tmpl.ExecuteTemplate(w, "index.html", data); err != nil {
-			log.Printf("Template execution error: %v\n", err)
-			http.Error(w, "Error displaying page", http.StatusInternalServerError)
+// beginSession logs in a user whose first factor has been verified. Users
+// with two-factor authentication get a second step before a session is
+// created.
+func (h *Handlers) beginSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.TOTPEnabled {
+		challenge, err := middleware.CreateLoginChallenge(h.db, user.ID, loginChallengeTTL)
+		if err != nil {
+			log.Printf("Login challenge creation failed for user %s: %v\n", user.Username, err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
 		}
+		h.renderTOTPStep(w, r, http.StatusOK, challenge, "")
+		return
+	}
+
+	h.completeLogin(w, r, user)
+}
+
+// recordLoginFailure counts a failed password or second-factor attempt and
+// audits the lockout if it caused one.
+func (h *Handlers) recordLoginFailure(username, ip string) {
+	locked, err := h.loginThrottle.RecordFailure(h.db, username, ip)
+	if err != nil {
+		log.Printf("Login throttle update error: %v\n", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	log.Printf("Account %s locked after repeated failed logins, last from %s\n", username, ip)
+	if user, err := middleware.GetUserByUsername(h.db, username); err == nil {
+		h.audit("system", "user.lock", user.ID, map[string]interface{}{"ip": ip})
+	}
+}
 
+// releaseLogin ends a login attempt that neither failed nor succeeded.
+func (h *Handlers) releaseLogin(username string) {
+	if err := h.loginThrottle.Release(h.db, username); err != nil {
+		log.Printf("Login throttle release error: %v\n", err)
+	}
+}
+
+// completeLogin starts a session for a fully authenticated user, syncs them
+// to Permit.io and shows the welcome page.
+func (h *Handlers) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	username := user.Username
+
+	if err := h.loginThrottle.RecordSuccess(h.db, username); err != nil {
+		log.Printf("Login throttle reset error: %v\n", err)
+	}
+
+	token, err := middleware.CreateSession(h.db, user.ID, sessionTTL)
+	if err != nil {
+		log.Printf("Session creation failed for user %s: %v\n", username, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	// Store the session token in a cookie to persist across requests
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil, // Only secure if using HTTPS
+		// Lax keeps the session on links from other sites but not on their
+		// cross-site POSTs; the CSRF token covers older browsers.
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	roles, err := middleware.EffectiveRoles(h.db, user.Roles)
+	if err != nil {
+		log.Printf("Role lookup failed for user %s: %v\n", username, err)
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	// Create context for syncing user with Permit.io
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// Create Permit.io User object with attributes
+	permitUser := permitModels.NewUserCreate(username)
+	permitUser.SetAttributes(map[string]interface{}{
+		"roles": roles,
+	})
+
+	_, err = h.permitClient.SyncUser(ctx, *permitUser)
+	if err != nil {
+		log.Printf("Permit sync failed: %v\n", err)
+	}
+
+	// Privileged roles must enrol in two-factor authentication first
+	if !user.TOTPEnabled && h.mfaRequired(user) {
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	// Render the index.html page with the user's username and roles
+	data := struct {
+		Username string
+		Roles    []string
+	}{
+		Username: username,
+		Roles:    roles,
+	}
+
+	if err := render(w, r, "index.html", data); err != nil {
+		log.Printf("Template execution error: %v\n", err)
+		http.Error(w, "Error displaying page", http.StatusInternalServerError)
 	}
 }
 
 func (h *Handlers) BooksHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("username")
-		if err != nil {
-			log.Printf("Cookie error: %v\n", err)
-			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+		username, ok := h.requireLogin(w, r)
+		if !ok {
 			return
 		}
-		username := cookie.Value
 
-		role, err := middleware.GetUserRole(h.db, username)
+		books, err := middleware.GetBooks(h.db)
 		if err != nil {
-			log.Printf("Database role lookup error: %v\n", err)
-			http.Error(w, "Error retrieving user role", http.StatusInternalServerError)
+			log.Printf("Database query error: %v\n", err)
+			http.Error(w, "Error fetching books", http.StatusInternalServerError)
 			return
 		}
 
-		user := enforcement.UserBuilder(username).
-			WithAttributes(map[string]interface{}{
-				"role": role,
-			}).
-			Build()
-
-		resource := enforcement.ResourceBuilder("books").
-			WithTenant("default").
-			Build()
-
-		permitted, err := h.permitClient.Check(user, "view", resource)
+		// Each book is checked on its own so that attribute rules, such
+		// as those on restricted titles, hide individual books.
+		books, err = h.visibleBooks(r, username, books)
 		if err != nil {
 			log.Printf("Permission check error: %v\n", err)
 			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
 			return
 		}
 
-		if !permitted {
-			log.Printf("Access denied for user %s with role %s\n", username, role)
-			http.Error(w, "Access denied", http.StatusForbidden)
+		categories, err := middleware.ListCategories(h.db)
+		if err != nil {
+			log.Printf("Error fetching categories: %v\n", err)
+			http.Error(w, "Error fetching books", http.StatusInternalServerError)
 			return
 		}
-
-		rows, err := h.db.Query("SELECT id, title, author, published_at, created_at FROM books")
+		classes, err := middleware.ListClassifications(h.db)
 		if err != nil {
-			log.Printf("Database query error: %v\n", err)
+			log.Printf("Error fetching book classifications: %v\n", err)
 			http.Error(w, "Error fetching books", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var books []models.Book
-		for rows.Next() {
-			var book models.Book
-			var publishedAt sql.NullTime
-
-			err := rows.Scan(&book.ID, &book.Title, &book.Author, &publishedAt, &book.CreatedAt)
-			if err != nil {
-				log.Printf("Row scan error: %v\n", err)
-				http.Error(w, "Error reading book data", http.StatusInternalServerError)
-				return
+		var tags []string
+		for _, tag := range r.URL.Query()["tag"] {
+			if tag = normalizeTag(tag); tag != "" {
+				tags = append(tags, tag)
 			}
-
-			if publishedAt.Valid {
-				book.PublishedAt = &publishedAt.Time
-			}
-
-			books = append(books, book)
 		}
-
-		if err = rows.Err(); err != nil {
-			log.Printf("Row iteration error: %v\n", err)
-			http.Error(w, "Error reading book data", http.StatusInternalServerError)
+		// Facets are counted after the permission filter so that they
+		// never give away books the user cannot see.
+		browse, err := browseBooks(books, categories, classes, r.URL.Query().Get("category"), tags)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
 
 		// Render the books template
-		if err := tmpl.ExecuteTemplate(w, "books.html", books); err != nil {
+		if err := render(w, r, "books.html", browse); err != nil {
 			log.Printf("Template execution error: %v\n", err)
 			http.Error(w, "Error displaying books", http.StatusInternalServerError)
 		}
@@ -193,99 +643,121 @@ func (h *Handlers) BooksHandler() http.HandlerFunc {
 
 func (h *Handlers) AddBookHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Entered AddBookHandler") // Log entry into handler
-
-		// Retrieve username from session or cookie
-		cookie, err := r.Cookie("username")
-		if err != nil {
-			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
-			return
-		}
-		username := cookie.Value
-
-		// Retrieve user's role from the database
-		role, err := middleware.GetUserRole(h.db, username)
-		if err != nil {
-			log.Printf("Database role lookup error: %v\n", err)
-			http.Error(w, "Error retrieving user role", http.StatusInternalServerError)
+		// Retrieve username from the session
+		username, ok := h.requireLogin(w, r)
+		if !ok {
 			return
 		}
 
 		// Permission check (using Permit.io) - only allow users with "create" permission
-		user := enforcement.UserBuilder(username).
-			WithAttributes(map[string]interface{}{
-				"role": role,
-			}).
-			Build()
-
-		resource := enforcement.ResourceBuilder("books").
-			WithTenant("default").
-			Build()
-
-		permitted, err := h.permitClient.Check(user, "create", resource)
+		permitted, err := h.permitted(r, username, "create", "books")
 		if err != nil {
 			log.Printf("Permission check error: %v\n", err)
 			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
 			return
 		}
 
-		// If not permitted, display alert and deny access
+		// If not permitted, deny access
 		if !permitted {
-			w.Header().Set("Content-Type", "text/html")
-			fmt.Fprint(w, `
-				<!DOCTYPE html>
-				<html lang="en">
-				<head>
-					<meta charset="UTF-8">
-					<meta name="viewport" content="width=device-width, initial-scale=1.0">
-					<title>Access Denied</title>
-					<script>alert('You cannot add a book as you are an admin.')</script>
-				</head>
-				<body>
-					<p>You do not have permission to add books.</p>
-					<a href="/books">Back to Books</a>
-				</body>
-				</html>
-			`)
+			renderMessage(w, r, http.StatusForbidden, "Access Denied", "You do not have permission to add books.",
+				accessRequestLink("create", "books", ""), "Request access")
 			return
 		}
 
-		// Handle GET request to render add.html
+		// Handle GET request to render add.html, prefilled from an ISBN
+		// lookup when one is asked for
 		if r.Method == http.MethodGet {
-			log.Println("Rendering add.html for GET request")
-			if err := tmpl.ExecuteTemplate(w, "add.html", nil); err != nil {
-				log.Printf("Template execution error: %v\n", err)
-				http.Error(w, "Error displaying page", http.StatusInternalServerError)
+			form := &addBookForm{}
+			if raw := r.URL.Query().Get("isbn"); raw != "" {
+				isbn13, err := parseISBN(raw)
+				if err != nil {
+					form.Book.ISBN13 = raw
+					form.LookupMessage = err.Error()
+				} else if book, msg := h.lookupBook(r, isbn13); book != nil {
+					form.Book = *book
+				} else {
+					form.Book.ISBN13, form.LookupMessage = isbn13, msg
+				}
 			}
+			h.renderAddBook(w, r, form)
 			return
 		}
 
 		// Handle POST request to add a new book
 		if r.Method == http.MethodPost {
-			title := strings.TrimSpace(r.FormValue("title"))
-			author := strings.TrimSpace(r.FormValue("author"))
-			publishedAt := strings.TrimSpace(r.FormValue("published_at"))
-
-			// Debugging: Print received values
-			log.Printf("Received values - Title: %s, Author: %s, Published At: %s\n", title, author, publishedAt)
-
-			// Parse published_at date
-			var pubDate sql.NullTime
-			if publishedAt != "" {
-				parsedDate, err := time.Parse("2006-01-02", publishedAt)
-				if err == nil {
-					pubDate = sql.NullTime{Time: parsedDate, Valid: true}
+			book := bookFromForm(r)
+
+			credits, err := parseCredits(book.Author)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			categoryIDs, tags, err := classificationFromForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if book.ISBN13, err = parseISBN(book.ISBN13); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cover, err := readCoverUpload(r)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+
+			// Likely duplicates send the form back with a warning. A
+			// shared ISBN is final; a matching title and author can be
+			// confirmed.
+			book.ID = uuid.New()
+			duplicates, taken, err := h.duplicateBooks(r, username, &book, credits)
+			if err != nil {
+				log.Printf("Error checking for duplicate books: %v\n", err)
+				http.Error(w, "Error adding book", http.StatusInternalServerError)
+				return
+			}
+			if taken || (len(duplicates) > 0 && r.FormValue("confirm_duplicate") != "on") {
+				form := &addBookForm{
+					Book:       book,
+					Filed:      make(map[int64]bool),
+					TagList:    strings.Join(tags, ", "),
+					Duplicates: duplicates,
+					ISBNTaken:  taken,
 				}
+				for _, id := range categoryIDs {
+					form.Filed[id] = true
+				}
+				h.renderAddBook(w, r, form)
+				return
 			}
 
 			// Insert book into the database
-			_, err := h.db.Exec("INSERT INTO books (id, title, author, published_at, created_at) VALUES ($1, $2, $3, $4, NOW())",
-				uuid.New(), title, author, pubDate)
-			if err != nil {
+			_, err = h.db.Exec(`INSERT INTO books (id, title, author, published_at, genre, restricted, age_rating, isbn, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NOW())`,
+				book.ID, book.Title, book.Author, book.PublishedAt, book.Genre, book.Restricted, book.AgeRating, book.ISBN13)
+			if err = isbnTaken(err); err != nil {
 				log.Printf("Error adding book to database: %v\n", err)
+				http.Error(w, "Error adding book: "+err.Error(), errorStatus(err))
+				return
+			}
+			if err := h.setBookCredits(username, book.ID, credits); err != nil {
+				log.Printf("Error linking book authors: %v\n", err)
 				http.Error(w, "Error adding book", http.StatusInternalServerError)
 				return
 			}
+			if err := h.classifyBook(username, book.ID, categoryIDs, tags); err != nil {
+				log.Printf("Error classifying book: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			if cover != nil {
+				if _, err := h.storeCover(r.Context(), username, book.ID, cover); err != nil {
+					log.Printf("Error storing cover: %v\n", err)
+					http.Error(w, "Error adding book cover", http.StatusInternalServerError)
+					return
+				}
+			}
 
 			// Redirect to books page after successful addition
 			http.Redirect(w, r, "/books", http.StatusSeeOther)
@@ -295,34 +767,20 @@ func (h *Handlers) AddBookHandler() http.HandlerFunc {
 
 func (h *Handlers) DeleteBookHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve username from session or cookie
-		cookie, err := r.Cookie("username")
-		if err != nil {
-			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+		// Retrieve username from the session
+		username, ok := h.requireLogin(w, r)
+		if !ok {
 			return
 		}
-		username := cookie.Value
 
-		// Retrieve user's role from the database
-		role, err := middleware.GetUserRole(h.db, username)
-		if err != nil {
-			log.Printf("Database role lookup error: %v\n", err)
-			http.Error(w, "Error retrieving user role", http.StatusInternalServerError)
+		book, ok := h.viewableBook(w, r, username)
+		if !ok {
 			return
 		}
 
-		// Permission check for "delete" action using Permit.io
-		user := enforcement.UserBuilder(username).
-			WithAttributes(map[string]interface{}{
-				"role": role,
-			}).
-			Build()
-
-		resource := enforcement.ResourceBuilder("books").
-			WithTenant("default").
-			Build()
-
-		permitted, err := h.permitClient.Check(user, "delete", resource)
+		// Permission check for "delete" action on this book using
+		// Permit.io, or an approved access request for it
+		permitted, err := h.permittedOn(r, username, "delete", bookResource(book))
 		if err != nil {
 			log.Printf("Permission check error: %v\n", err)
 			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
@@ -330,27 +788,32 @@ func (h *Handlers) DeleteBookHandler() http.HandlerFunc {
 		}
 
 		if !permitted {
-			log.Printf("Access denied for user %s with role %s\n", username, role)
-			http.Error(w, "Access denied", http.StatusForbidden)
+			renderMessage(w, r, http.StatusForbidden, "Access Denied", "You do not have permission to delete this book.",
+				accessRequestLink("delete", "books", book.ID.String()), "Request access")
 			return
 		}
 
-		// Retrieve book ID from the form data
-		bookIDStr := r.FormValue("id")
-		bookID, err := uuid.Parse(bookIDStr)
+		// The cover row goes with the book, so note its images first
+		cover, err := middleware.GetBookCover(h.db, book.ID)
+		if errors.Is(err, middleware.ErrCoverNotFound) {
+			cover, err = nil, nil
+		}
 		if err != nil {
-			log.Printf("Invalid book ID: %v\n", err)
-			http.Error(w, "Invalid book ID", http.StatusBadRequest)
+			log.Printf("Error fetching book cover: %v\n", err)
+			http.Error(w, "Error deleting book", http.StatusInternalServerError)
 			return
 		}
 
 		// Delete the book from the database
-		_, err = h.db.Exec("DELETE FROM books WHERE id = $1", bookID)
+		_, err = h.db.Exec("DELETE FROM books WHERE id = $1", book.ID)
 		if err != nil {
 			log.Printf("Database delete error: %v\n", err)
 			http.Error(w, "Error deleting book", http.StatusInternalServerError)
 			return
 		}
+		if cover != nil {
+			h.deleteCoverBlobs(r.Context(), cover)
+		}
 
 		// Redirect to the books page after successful deletion
 		http.Redirect(w, r, "/books", http.StatusSeeOther)
@@ -359,34 +822,20 @@ func (h *Handlers) DeleteBookHandler() http.HandlerFunc {
 
 func (h *Handlers) UpdateBookHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve username from session or cookie
-		cookie, err := r.Cookie("username")
-		if err != nil {
-			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+		// Retrieve username from the session
+		username, ok := h.requireLogin(w, r)
+		if !ok {
 			return
 		}
-		username := cookie.Value
 
-		// Retrieve user's role from the database
-		role, err := middleware.GetUserRole(h.db, username)
-		if err != nil {
-			log.Printf("Database role lookup error: %v\n", err)
-			http.Error(w, "Error retrieving user role", http.StatusInternalServerError)
+		book, ok := h.viewableBook(w, r, username)
+		if !ok {
 			return
 		}
 
-		// Permission check for "update" action using Permit.io
-		user := enforcement.UserBuilder(username).
-			WithAttributes(map[string]interface{}{
-				"role": role,
-			}).
-			Build()
-
-		resource := enforcement.ResourceBuilder("books").
-			WithTenant("default").
-			Build()
-
-		permitted, err := h.permitClient.Check(user, "update", resource)
+		// Permission check for "update" action on this book using
+		// Permit.io, or an approved access request for it
+		permitted, err := h.permittedOn(r, username, "update", bookResource(book))
 		if err != nil {
 			log.Printf("Permission check error: %v\n", err)
 			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
@@ -394,38 +843,33 @@ func (h *Handlers) UpdateBookHandler() http.HandlerFunc {
 		}
 
 		if !permitted {
-			w.Header().Set("Content-Type", "text/html")
-			fmt.Fprint(w, `
-				<!DOCTYPE html>
-				<html lang="en">
-				<head>
-					<meta charset="UTF-8">
-					<meta name="viewport" content="width=device-width, initial-scale=1.0">
-					<title>Access Denied</title>
-					<script>alert('You are not authorized to update books.')</script>
-				</head>
-				<body>
-					<p>Access Denied. You do not have permission to update books.</p>
-					<a href="/books">Back to Books</a>
-				</body>
-				</html>
-			`)
+			renderMessage(w, r, http.StatusForbidden, "Access Denied", "You do not have permission to update this book.",
+				accessRequestLink("update", "books", book.ID.String()), "Request access")
 			return
 		}
 
 		// If request is GET, render the update page with current book details
 		if r.Method == http.MethodGet {
-			bookID := r.FormValue("id")
-			var book models.Book
-			err := h.db.QueryRow("SELECT id, title, author, published_at FROM books WHERE id = $1", bookID).
-				Scan(&book.ID, &book.Title, &book.Author, &book.PublishedAt)
+			categories, err := middleware.ListCategories(h.db)
+			if err == nil {
+				err = h.loadClassification(book)
+			}
 			if err != nil {
-				log.Printf("Error fetching book for update: %v\n", err)
-				http.Error(w, "Error fetching book", http.StatusInternalServerError)
+				log.Printf("Error fetching book classification: %v\n", err)
+				http.Error(w, "Error displaying update page", http.StatusInternalServerError)
 				return
 			}
-
-			if err := tmpl.ExecuteTemplate(w, "update.html", book); err != nil {
+			filed := make(map[int64]bool, len(book.Categories))
+			for _, c := range book.Categories {
+				filed[c.ID] = true
+			}
+			data := struct {
+				*models.Book
+				AllCategories []models.Category
+				Filed         map[int64]bool
+				TagList       string
+			}{book, categories, filed, strings.Join(book.Tags, ", ")}
+			if err := render(w, r, "update.html", data); err != nil {
 				log.Printf("Template execution error: %v\n", err)
 				http.Error(w, "Error displaying update page", http.StatusInternalServerError)
 			}
@@ -434,28 +878,214 @@ func (h *Handlers) UpdateBookHandler() http.HandlerFunc {
 
 		// Handle POST request for updating book details
 		if r.Method == http.MethodPost {
-			bookID := r.FormValue("id")
-			title := r.FormValue("title")
-			author := r.FormValue("author")
-			publishedAt := r.FormValue("published_at")
-
-			var pubDate sql.NullTime
-			if publishedAt != "" {
-				parsedDate, err := time.Parse("2006-01-02", publishedAt)
-				if err == nil {
-					pubDate = sql.NullTime{Time: parsedDate, Valid: true}
-				}
+			update := bookFromForm(r)
+			credits, err := parseCredits(update.Author)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-
-			_, err := h.db.Exec("UPDATE books SET title = $1, author = $2, published_at = $3 WHERE id = $4",
-				title, author, pubDate, bookID)
+			categoryIDs, tags, err := classificationFromForm(r)
 			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if update.ISBN13, err = parseISBN(update.ISBN13); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cover, err := readCoverUpload(r)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+
+			_, err = h.db.Exec(`UPDATE books
+				SET title = $1, author = $2, published_at = $3, genre = $4, restricted = $5, age_rating = $6, isbn = NULLIF($7, '')
+				WHERE id = $8`,
+				update.Title, update.Author, update.PublishedAt, update.Genre, update.Restricted, update.AgeRating, update.ISBN13, book.ID)
+			if err = isbnTaken(err); err != nil {
 				log.Printf("Error updating book: %v\n", err)
+				http.Error(w, "Error updating book: "+err.Error(), errorStatus(err))
+				return
+			}
+			if err := h.setBookCredits(username, book.ID, credits); err != nil {
+				log.Printf("Error linking book authors: %v\n", err)
 				http.Error(w, "Error updating book", http.StatusInternalServerError)
 				return
 			}
+			if err := h.classifyBook(username, book.ID, categoryIDs, tags); err != nil {
+				log.Printf("Error classifying book: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+
+			// A new upload replaces the cover; otherwise it can be removed.
+			if cover != nil {
+				_, err = h.storeCover(r.Context(), username, book.ID, cover)
+			} else if r.FormValue("remove_cover") == "on" {
+				if err = h.removeCover(r.Context(), username, book.ID); errors.Is(err, middleware.ErrCoverNotFound) {
+					err = nil
+				}
+			}
+			if err != nil {
+				log.Printf("Error updating book cover: %v\n", err)
+				http.Error(w, "Error updating book cover", http.StatusInternalServerError)
+				return
+			}
 
 			http.Redirect(w, r, "/books", http.StatusSeeOther)
 		}
 	}
 }
+
+// BookHandler shows a single book to users who may view it.
+func (h *Handlers) BookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		book, ok := h.viewableBook(w, r, username)
+		if !ok {
+			return
+		}
+		authors, err := middleware.ListBookAuthors(h.db, book.ID)
+		if err != nil {
+			log.Printf("Error fetching book authors: %v\n", err)
+			http.Error(w, "Error fetching book", http.StatusInternalServerError)
+			return
+		}
+		book.Authors = authors
+		if err := h.loadClassification(book); err != nil {
+			log.Printf("Error fetching book classification: %v\n", err)
+			http.Error(w, "Error fetching book", http.StatusInternalServerError)
+			return
+		}
+
+		if err := render(w, r, "book.html", book); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying book", http.StatusInternalServerError)
+		}
+	}
+}
+
+// viewableBook loads the book named by the "id" form value and checks that
+// username may view it. When either fails it writes the error response
+// itself and returns false.
+func (h *Handlers) viewableBook(w http.ResponseWriter, r *http.Request, username string) (*models.Book, bool) {
+	bookID, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	book, err := middleware.GetBookByID(h.db, bookID)
+	if errors.Is(err, middleware.ErrBookNotFound) {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error fetching book: %v\n", err)
+		http.Error(w, "Error fetching book", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	permitted, err := h.permittedOn(r, username, "view", bookResource(book))
+	if err != nil {
+		log.Printf("Permission check error: %v\n", err)
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !permitted {
+		renderMessage(w, r, http.StatusForbidden, "Access Denied", "You do not have permission to view this book.",
+			accessRequestLink("view", "books", book.ID.String()), "Request access")
+		return nil, false
+	}
+	return book, true
+}
+
+// permittedBook is like viewableBook but also checks that the logged-in user
+// may perform action on the book, showing the denied message with a link to
+// request access otherwise.
+func (h *Handlers) permittedBook(w http.ResponseWriter, r *http.Request, action, denied string) (string, *models.Book, bool) {
+	username, ok := h.requireLogin(w, r)
+	if !ok {
+		return "", nil, false
+	}
+
+	book, ok := h.viewableBook(w, r, username)
+	if !ok {
+		return "", nil, false
+	}
+
+	permitted, err := h.permittedOn(r, username, action, bookResource(book))
+	if err != nil {
+		log.Printf("Permission check error: %v\n", err)
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		return "", nil, false
+	}
+	if !permitted {
+		renderMessage(w, r, http.StatusForbidden, "Access Denied", denied,
+			accessRequestLink(action, "books", book.ID.String()), "Request access")
+		return "", nil, false
+	}
+	return username, book, true
+}
+
+// apiBook loads the book named in the URL and checks that the caller
+// may view it and, unless action is "view", perform action on it. When
+// either fails it writes the JSON error itself and returns false.
+func (h *Handlers) apiBook(w http.ResponseWriter, r *http.Request, action string) (string, *models.Book, bool) {
+	username, ok := h.requireLogin(w, r)
+	if !ok {
+		return "", nil, false
+	}
+
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid book ID")
+		return "", nil, false
+	}
+	book, err := middleware.GetBookByID(h.db, id)
+	if err != nil {
+		writeJSONError(w, errorStatus(err), err.Error())
+		return "", nil, false
+	}
+
+	actions := []string{"view"}
+	if action != "view" {
+		actions = append(actions, action)
+	}
+	for _, a := range actions {
+		permitted, err := h.permittedOn(r, username, a, bookResource(book))
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking permissions")
+			return "", nil, false
+		}
+		if !permitted {
+			writeJSONError(w, http.StatusForbidden, "access denied")
+			return "", nil, false
+		}
+	}
+	return username, book, true
+}
+
+// bookFromForm reads the book fields submitted by the add and update forms.
+func bookFromForm(r *http.Request) models.Book {
+	book := models.Book{
+		Title:      strings.TrimSpace(r.FormValue("title")),
+		Author:     strings.TrimSpace(r.FormValue("author")),
+		Genre:      strings.TrimSpace(r.FormValue("genre")),
+		Restricted: r.FormValue("restricted") == "on",
+		ISBN13:     strings.TrimSpace(r.FormValue("isbn")),
+	}
+	if publishedAt, err := time.Parse("2006-01-02", strings.TrimSpace(r.FormValue("published_at"))); err == nil {
+		book.PublishedAt = &publishedAt
+	}
+	if ageRating, err := strconv.Atoi(r.FormValue("age_rating")); err == nil && ageRating >= 0 {
+		book.AgeRating = ageRating
+	}
+	return book
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"bookstore/bookimport"
+	"bookstore/middleware"
+	"bookstore/models"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxImportBody caps the upload of an import file. LimitRequestBody lets
+// the import routes through with it instead of MaxRequestBody.
+const MaxImportBody = 32 << 20
+
+// importBatchSize is how many rows each import transaction writes.
+const importBatchSize = 100
+
+// What an import does with a row. Rows planned for creating or updating
+// become importFailed when their batch cannot be committed.
+const (
+	importCreate = "create"
+	importUpdate = "update"
+	importReject = "reject"
+	importFailed = "failed"
+)
+
+// importRow is the outcome of one row of an import file. BookID is set for
+// updates and, once committed, for new books.
+type importRow struct {
+	Line     int        `json:"line"`
+	Action   string     `json:"action"`
+	BookID   *uuid.UUID `json:"book_id,omitempty"`
+	Title    string     `json:"title,omitempty"`
+	ISBN     string     `json:"isbn,omitempty"`
+	Errors   []string   `json:"errors,omitempty"`
+	Warnings []string   `json:"warnings,omitempty"`
+
+	book *middleware.ImportedBook
+}
+
+// importReport tells what an import did, or in a dry run would do, with
+// every row of the file.
+type importReport struct {
+	DryRun         bool        `json:"dry_run"`
+	IgnoredColumns []string    `json:"ignored_columns"`
+	Created        int         `json:"created"`
+	Updated        int         `json:"updated"`
+	Rejected       int         `json:"rejected"`
+	Failed         int         `json:"failed"`
+	Rows           []importRow `json:"rows"`
+}
+
+func (report *importReport) count() {
+	report.Created, report.Updated, report.Rejected, report.Failed = 0, 0, 0, 0
+	for _, row := range report.Rows {
+		switch row.Action {
+		case importCreate:
+			report.Created++
+		case importUpdate:
+			report.Updated++
+		case importReject:
+			report.Rejected++
+		case importFailed:
+			report.Failed++
+		}
+	}
+}
+
+// parseImportBool reads the restricted column, which spreadsheets fill in
+// many ways. Blank means false.
+func parseImportBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "no", "n":
+		return false, nil
+	case "yes", "y":
+		return true, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// validateImportRow checks every field the row sets and returns the book
+// it describes, with nil credits, categories or tags where the file has no
+// such column. categories maps slugs to IDs.
+func validateImportRow(row bookimport.Row, categories map[string]int64) (*middleware.ImportedBook, []string) {
+	in := &middleware.ImportedBook{}
+	var errs []string
+	fail := func(err error) {
+		errs = append(errs, err.Error())
+	}
+
+	b := &in.Book
+	b.Title = row.Values[bookimport.Title]
+	if row.Has(bookimport.Title) && b.Title == "" {
+		errs = append(errs, "title is required")
+	}
+	if row.Has(bookimport.Author) {
+		credits, err := parseCredits(row.Values[bookimport.Author])
+		if err != nil {
+			fail(err)
+		}
+		in.Credits = credits
+		b.Author = row.Values[bookimport.Author]
+	}
+	if v := row.Values[bookimport.PublishedAt]; v != "" {
+		published, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			errs = append(errs, "published_at must be a date like 2006-01-02")
+		} else {
+			b.PublishedAt = &published
+		}
+	}
+	b.Genre = row.Values[bookimport.Genre]
+	restricted, err := parseImportBool(row.Values[bookimport.Restricted])
+	if err != nil {
+		errs = append(errs, "restricted must be true or false")
+	}
+	b.Restricted = restricted
+	if v := row.Values[bookimport.AgeRating]; v != "" {
+		rating, err := strconv.Atoi(v)
+		if err != nil || rating < 0 {
+			errs = append(errs, "age_rating must be a whole number of years")
+		}
+		b.AgeRating = rating
+	}
+	if b.ISBN13, err = parseISBN(row.Values[bookimport.ISBN]); err != nil {
+		fail(err)
+	}
+
+	if row.Has(bookimport.Categories) {
+		in.CategoryIDs = []int64{}
+		for _, slug := range strings.Split(row.Values[bookimport.Categories], ",") {
+			slug = strings.ToLower(strings.TrimSpace(slug))
+			if slug == "" {
+				continue
+			}
+			id, ok := categories[slug]
+			if !ok {
+				errs = append(errs, "unknown category "+strconv.Quote(slug))
+				continue
+			}
+			in.CategoryIDs = append(in.CategoryIDs, id)
+		}
+	}
+	if row.Has(bookimport.Tags) {
+		if in.Tags, err = parseTags(row.Values[bookimport.Tags]); err != nil {
+			fail(err)
+		}
+	}
+	return in, errs
+}
+
+// mergeImportRow lays the fields an import row sets over the existing book
+// it updates.
+func mergeImportRow(row bookimport.Row, in *middleware.ImportedBook, existing *models.Book) {
+	b := in.Book
+	in.Book = *existing
+	if row.Has(bookimport.Title) {
+		in.Book.Title = b.Title
+	}
+	if row.Has(bookimport.Author) {
+		in.Book.Author = b.Author
+	}
+	if row.Has(bookimport.PublishedAt) {
+		in.Book.PublishedAt = b.PublishedAt
+	}
+	if row.Has(bookimport.Genre) {
+		in.Book.Genre = b.Genre
+	}
+	if row.Has(bookimport.Restricted) {
+		in.Book.Restricted = b.Restricted
+	}
+	if row.Has(bookimport.AgeRating) {
+		in.Book.AgeRating = b.AgeRating
+	}
+	in.Update = true
+}
+
+// planImport validates every row of an import file and decides whether it
+// creates a book, updates the book with its ISBN or is rejected. Books with
+// the ISBN that username may not view are not updated.
+func (h *Handlers) planImport(r *http.Request, username string, file *bookimport.File) (*importReport, error) {
+	categories, err := middleware.ListCategories(h.db)
+	if err != nil {
+		return nil, err
+	}
+	slugs := make(map[string]int64, len(categories))
+	for _, c := range categories {
+		slugs[c.Slug] = c.ID
+	}
+
+	report := &importReport{IgnoredColumns: file.Ignored, Rows: make([]importRow, len(file.Rows))}
+	if report.IgnoredColumns == nil {
+		report.IgnoredColumns = []string{}
+	}
+	firstLine := make(map[string]int)
+	var isbns []string
+	for i, row := range file.Rows {
+		in, errs := validateImportRow(row, slugs)
+		result := importRow{Line: row.Line, Title: in.Book.Title, ISBN: in.Book.ISBN13, Errors: errs, book: in}
+		if isbn13 := in.Book.ISBN13; isbn13 != "" {
+			if line, ok := firstLine[isbn13]; ok {
+				result.Errors = append(result.Errors, "ISBN already appears on line "+strconv.Itoa(line))
+			} else {
+				firstLine[isbn13] = row.Line
+				isbns = append(isbns, isbn13)
+			}
+		}
+		report.Rows[i] = result
+	}
+
+	existing, err := middleware.ListBooksByISBN(h.db, isbns)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]models.Book, 0, len(existing))
+	for _, book := range existing {
+		found = append(found, book)
+	}
+	visible, err := h.visibleBooks(r, username, found)
+	if err != nil {
+		return nil, err
+	}
+	updatable := make(map[uuid.UUID]bool, len(visible))
+	for _, book := range visible {
+		updatable[book.ID] = true
+	}
+
+	for i, row := range file.Rows {
+		result := &report.Rows[i]
+		in := result.book
+		if book, ok := existing[in.Book.ISBN13]; ok && in.Book.ISBN13 != "" {
+			if !updatable[book.ID] {
+				result.Errors = append(result.Errors, errISBNTaken.Error())
+			} else if len(result.Errors) == 0 {
+				mergeImportRow(row, in, &book)
+				result.BookID = &book.ID
+				result.Title = in.Book.Title
+			}
+		} else {
+			if !row.Has(bookimport.Title) {
+				result.Errors = append(result.Errors, "title is required")
+			}
+			if !row.Has(bookimport.Author) {
+				result.Errors = append(result.Errors, "at least one author is required")
+			}
+			if in.Book.ISBN13 == "" {
+				result.Warnings = append(result.Warnings, "no ISBN, so importing this row again adds the book again")
+			}
+			in.Book.ID = uuid.New()
+		}
+
+		switch {
+		case len(result.Errors) > 0:
+			result.Action, result.book = importReject, nil
+		case in.Update:
+			result.Action = importUpdate
+		default:
+			result.Action = importCreate
+		}
+	}
+	report.count()
+	return report, nil
+}
+
+// commitImport writes the planned rows in batches of importBatchSize, each
+// in its own transaction. A batch that fails is rolled back and its rows
+// marked as failed; the batches after it are still tried.
+func (h *Handlers) commitImport(actor string, report *importReport) {
+	var batch []*importRow
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		books := make([]middleware.ImportedBook, len(batch))
+		for i, row := range batch {
+			books[i] = *row.book
+		}
+
+		err := middleware.ImportBooks(h.db, books)
+		if err != nil {
+			log.Printf("Error importing books: %v\n", err)
+			var importErr *middleware.ImportError
+			culprit := -1
+			if errors.As(err, &importErr) {
+				culprit = importErr.Index
+				err = isbnTaken(importErr.Err)
+			}
+			for i, row := range batch {
+				row.Action = importFailed
+				if i == culprit {
+					row.Errors = append(row.Errors, err.Error())
+				} else if culprit >= 0 {
+					row.Errors = append(row.Errors, "not imported: line "+strconv.Itoa(batch[culprit].Line)+" of the same batch failed")
+				} else {
+					row.Errors = append(row.Errors, "not imported: the batch could not be saved")
+				}
+			}
+		} else {
+			for _, row := range batch {
+				id := row.book.Book.ID
+				row.BookID = &id
+				h.auditBook(actor, "book.import", id, map[string]interface{}{
+					"action": row.Action,
+					"line":   row.Line,
+				})
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for i := range report.Rows {
+		if row := &report.Rows[i]; row.book != nil {
+			batch = append(batch, row)
+			if len(batch) == importBatchSize {
+				flush()
+			}
+		}
+	}
+	flush()
+	report.count()
+}
+
+// runImport parses an import file and, unless dryRun is set, imports the
+// rows that pass validation. A file that cannot be parsed is a
+// validationError.
+func (h *Handlers) runImport(r *http.Request, username string, body io.Reader, format bookimport.Format, dryRun bool) (*importReport, error) {
+	file, err := bookimport.Parse(body, format)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, validationError{"invalid import file: " + err.Error()}
+	}
+
+	report, err := h.planImport(r, username, file)
+	if err != nil {
+		return nil, err
+	}
+	report.DryRun = dryRun
+	if !dryRun {
+		h.commitImport(username, report)
+	}
+	return report, nil
+}
+
+// importStatus is the status of a failed import: 413 for an oversized
+// file, otherwise as for errorStatus.
+func importStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return errorStatus(err)
+}
+
+// ImportHandler shows the import form (GET) or checks or imports an
+// uploaded catalogue file (POST). The form does a dry run unless it is
+// told otherwise.
+func (h *Handlers) ImportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.authorize(w, r, "import", "books")
+		if !ok {
+			return
+		}
+
+		data := struct {
+			Report *importReport
+			Error  string
+			Format string
+		}{Format: r.FormValue("format")}
+		show := func(status int) {
+			w.WriteHeader(status)
+			if err := render(w, r, "import.html", data); err != nil {
+				log.Printf("Template execution error: %v\n", err)
+			}
+		}
+		if r.Method != http.MethodPost {
+			show(http.StatusOK)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			data.Error = "Choose a CSV or JSON lines file to import."
+			show(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		format, err := bookimport.DetectFormat(data.Format, header.Filename, header.Header.Get("Content-Type"))
+		if err != nil {
+			data.Error = err.Error()
+			show(http.StatusBadRequest)
+			return
+		}
+
+		data.Report, err = h.runImport(r, username, file, format, r.FormValue("dry_run") == "on")
+		if err != nil {
+			log.Printf("Error importing books: %v\n", err)
+			data.Error = err.Error()
+			show(importStatus(err))
+			return
+		}
+		show(http.StatusOK)
+	}
+}
+
+// APIImportHandler imports the catalogue file in the request body and
+// returns the report. The format comes from ?format=csv|jsonl or the
+// Content-Type; ?dry_run=true only checks the file.
+func (h *Handlers) APIImportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.authorize(w, r, "import", "books")
+		if !ok {
+			return
+		}
+
+		format, err := bookimport.DetectFormat(r.URL.Query().Get("format"), "", r.Header.Get("Content-Type"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		if err != nil && r.URL.Query().Get("dry_run") != "" {
+			writeJSONError(w, http.StatusBadRequest, "dry_run must be true or false")
+			return
+		}
+
+		report, err := h.runImport(r, username, r.Body, format, dryRun)
+		if err != nil {
+			log.Printf("Error importing books: %v\n", err)
+			writeJSONError(w, importStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bookstore/authz"
+	"bookstore/bookimport"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateImportRow(t *testing.T) {
+	categories := map[string]int64{"fiction": 1, "poetry": 2}
+	tests := []struct {
+		name       string
+		values     map[string]string
+		wantErrs   []string
+		categories []int64
+	}{
+		{
+			name:       "valid",
+			values:     map[string]string{"title": "Go", "author": "Ann", "isbn": "0-306-40615-2", "categories": "Fiction, poetry,"},
+			categories: []int64{1, 2},
+		},
+		{
+			name:     "unknown category",
+			values:   map[string]string{"title": "Go", "categories": "fiction, cookery"},
+			wantErrs: []string{`unknown category "cookery"`},
+		},
+		{
+			name:       "blank categories clear them",
+			values:     map[string]string{"title": "Go", "categories": ""},
+			categories: []int64{},
+		},
+		{
+			name:     "blank title",
+			values:   map[string]string{"title": ""},
+			wantErrs: []string{"title is required"},
+		},
+		{
+			name: "bad values",
+			values: map[string]string{"title": "Go", "published_at": "12/31/2020", "restricted": "maybe",
+				"age_rating": "-1", "isbn": "9780306406158"},
+			wantErrs: []string{
+				"published_at must be a date like 2006-01-02",
+				"restricted must be true or false",
+				"age_rating must be a whole number of years",
+				"ISBN must be a valid ISBN-10 or ISBN-13",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, errs := validateImportRow(bookimport.Row{Line: 2, Values: tt.values}, categories)
+			if !reflect.DeepEqual(errs, tt.wantErrs) {
+				t.Errorf("errors = %q, want %q", errs, tt.wantErrs)
+			}
+			if len(tt.wantErrs) == 0 && !reflect.DeepEqual(in.CategoryIDs, tt.categories) {
+				t.Errorf("categories = %v, want %v", in.CategoryIDs, tt.categories)
+			}
+		})
+	}
+
+	in, _ := validateImportRow(bookimport.Row{Values: map[string]string{"isbn": "0-306-40615-2", "restricted": "Y"}}, categories)
+	if in.Book.ISBN13 != "9780306406157" || !in.Book.Restricted {
+		t.Errorf("book = %+v, want the normalized ISBN and restricted", in.Book)
+	}
+	if in.CategoryIDs != nil || in.Tags != nil || in.Credits != nil {
+		t.Errorf("book = %+v, want no categories, tags or credits for a file without such columns", in)
+	}
+}
+
+// unrestrictedAuthorizer lets everyone view the books that are not
+// restricted.
+type unrestrictedAuthorizer struct{}
+
+func (unrestrictedAuthorizer) Check(_ context.Context, _ authz.Subject, action string, resource authz.Resource) (bool, error) {
+	return action == "view" && resource.Type == "books" && resource.Attributes["restricted"] == false, nil
+}
+
+const (
+	visibleISBN    = "9780134190440"
+	restrictedISBN = "9780131103627"
+	newISBN        = "9780306406157"
+)
+
+// importDB answers the queries of an import into a catalogue holding a
+// visible book and a restricted one.
+func importDB(t *testing.T) (*Handlers, *stubDB, map[string]uuid.UUID) {
+	ids := map[string]uuid.UUID{visibleISBN: uuid.New(), restrictedISBN: uuid.New()}
+	db, stub := newStubDB(t,
+		userStub("clerk"),
+		stubQuery{
+			match:   "FROM authors WHERE name_key",
+			columns: []string{"id", "name"},
+			rows: func(args []driver.Value) [][]driver.Value {
+				return [][]driver.Value{{uuid.NewString(), args[0]}}
+			},
+		},
+		stubQuery{
+			match:   "WITH RECURSIVE effective",
+			columns: []string{"key"},
+			rows:    func([]driver.Value) [][]driver.Value { return [][]driver.Value{{"customer"}} },
+		},
+		stubQuery{
+			match:   "WITH RECURSIVE tree",
+			columns: []string{"id", "name", "slug", "parent_id", "created_at", "path", "depth"},
+			rows: func([]driver.Value) [][]driver.Value {
+				return [][]driver.Value{{int64(1), "Fiction", "fiction", nil, time.Now(), "Fiction", int64(0)}}
+			},
+		},
+		stubQuery{
+			match: "WHERE books.isbn = ANY($1)",
+			columns: []string{"id", "title", "author", "published_at", "genre", "restricted", "age_rating", "isbn", "etag",
+				"created_at", "price_id", "currency", "list_price", "sale_price", "effective_at", "created_by", "price_created_at"},
+			rows: func(args []driver.Value) [][]driver.Value {
+				isbns, _ := args[0].(string)
+				var rows [][]driver.Value
+				for isbn13, restricted := range map[string]bool{visibleISBN: false, restrictedISBN: true} {
+					if strings.Contains(isbns, isbn13) {
+						rows = append(rows, []driver.Value{ids[isbn13].String(), "Old title", "Old author", nil, "", restricted,
+							int64(0), isbn13, nil, time.Now(), nil, nil, nil, nil, nil, nil, nil})
+					}
+				}
+				return rows
+			},
+		},
+		stubQuery{
+			match:   "FROM resource_grants",
+			columns: []string{"resource_key"},
+			rows:    func([]driver.Value) [][]driver.Value { return nil },
+		},
+	)
+	return &Handlers{db: db, authorizer: unrestrictedAuthorizer{}}, stub, ids
+}
+
+func importFile(rows ...map[string]string) *bookimport.File {
+	file := &bookimport.File{}
+	for i, values := range rows {
+		file.Rows = append(file.Rows, bookimport.Row{Line: i + 2, Values: values})
+	}
+	return file
+}
+
+func TestPlanImport(t *testing.T) {
+	h, _, ids := importDB(t)
+	file := importFile(
+		map[string]string{"title": "New", "author": "Ann", "isbn": newISBN},
+		map[string]string{"title": "Updated", "isbn": visibleISBN},
+		map[string]string{"title": "Hidden", "isbn": restrictedISBN},
+		map[string]string{"title": "Again", "author": "Bob", "isbn": "0-306-40615-2"},
+		map[string]string{"title": "Shelved", "author": "Cy", "categories": "fiction, cookery"},
+		map[string]string{"title": "No ISBN", "author": "Di"},
+		map[string]string{"isbn": "9781861972712"},
+	)
+	report, err := h.planImport(httptest.NewRequest("POST", "/books/import", nil), "clerk", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		action string
+		errs   []string
+	}{
+		{importCreate, nil},
+		{importUpdate, nil},
+		// A restricted book the importer cannot see is not given away.
+		{importReject, []string{errISBNTaken.Error()}},
+		{importReject, []string{"ISBN already appears on line 2"}},
+		{importReject, []string{`unknown category "cookery"`}},
+		{importCreate, nil},
+		{importReject, []string{"title is required", "at least one author is required"}},
+	}
+	for i, row := range report.Rows {
+		if row.Action != want[i].action || !reflect.DeepEqual(row.Errors, want[i].errs) {
+			t.Errorf("line %d: %s %q, want %s %q", row.Line, row.Action, row.Errors, want[i].action, want[i].errs)
+		}
+	}
+	if id := report.Rows[1].BookID; id == nil || *id != ids[visibleISBN] {
+		t.Errorf("update book ID = %v, want %s", id, ids[visibleISBN])
+	}
+	if book := report.Rows[1].book.Book; book.Title != "Updated" || book.Author != "Old author" {
+		t.Errorf("updated book = %q by %q, want the new title and the old author", book.Title, book.Author)
+	}
+	if got := report.Rows[5].Warnings; len(got) != 1 {
+		t.Errorf("warnings for a book without ISBN = %q, want one", got)
+	}
+	if report.Created != 2 || report.Updated != 1 || report.Rejected != 4 {
+		t.Errorf("report counts %d created, %d updated, %d rejected, want 2, 1, 4", report.Created, report.Updated, report.Rejected)
+	}
+}
+
+func TestCommitImportMarksFailedBatches(t *testing.T) {
+	h, stub, _ := importDB(t)
+	stub.fail = func(query string, args []driver.Value) error {
+		if strings.Contains(query, "INSERT INTO books") && args[1] == "Broken" {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+
+	rows := make([]map[string]string, importBatchSize+1)
+	for i := range rows {
+		rows[i] = map[string]string{"title": "Book", "author": "Ann"}
+	}
+	rows[1]["title"] = "Broken"
+	report, err := h.planImport(httptest.NewRequest("POST", "/books/import", nil), "clerk", importFile(rows...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.commitImport("clerk", report)
+
+	if report.Failed != importBatchSize || report.Created != 1 {
+		t.Fatalf("report counts %d failed, %d created, want %d, 1", report.Failed, report.Created, importBatchSize)
+	}
+	first, culprit := report.Rows[0], report.Rows[1]
+	if want := []string{"connection reset"}; !reflect.DeepEqual(culprit.Errors, want) {
+		t.Errorf("failed row errors = %q, want %q", culprit.Errors, want)
+	}
+	if want := []string{"not imported: line 3 of the same batch failed"}; !reflect.DeepEqual(first.Errors, want) {
+		t.Errorf("other row errors = %q, want %q", first.Errors, want)
+	}
+	if first.BookID != nil {
+		t.Errorf("failed row has book ID %s", first.BookID)
+	}
+	// The next batch is still written.
+	if last := report.Rows[importBatchSize]; last.Action != importCreate || last.BookID == nil {
+		t.Errorf("row of the next batch: %s with ID %v, want it created", last.Action, last.BookID)
+	}
+}
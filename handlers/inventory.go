@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// stockInput is a stock movement as submitted by the stock forms or the
+// API.
+type stockInput struct {
+	Kind     string `json:"kind"`
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+}
+
+// movement turns in into a ledger entry for bookID. Received, sold and
+// damaged copies are given as a count; adjustments carry their own sign.
+func (in stockInput) movement(bookID uuid.UUID, actor string) (*models.StockMovement, error) {
+	quantity := in.Quantity
+	switch in.Kind {
+	case models.StockReceived:
+	case models.StockSold, models.StockDamaged:
+		quantity = -quantity
+	case models.StockAdjusted:
+		if in.Quantity == 0 {
+			return nil, validationError{"an adjustment must change the stock"}
+		}
+	default:
+		return nil, validationError{"unknown stock movement " + in.Kind}
+	}
+	if in.Kind != models.StockAdjusted && in.Quantity <= 0 {
+		return nil, validationError{"quantity must be positive"}
+	}
+	if in.Kind == models.StockAdjusted && strings.TrimSpace(in.Reason) == "" {
+		return nil, validationError{"adjustments need a reason"}
+	}
+
+	return &models.StockMovement{
+		BookID:    bookID,
+		Kind:      in.Kind,
+		Quantity:  quantity,
+		Reason:    strings.TrimSpace(in.Reason),
+		CreatedBy: actor,
+	}, nil
+}
+
+// stockRow is a book together with its stock, for the stock page.
+type stockRow struct {
+	Book  models.Book
+	Stock models.StockLevel
+}
+
+// StockHandler lists the stock of every book the user may view, or only
+// those low on stock with ?low=1.
+func (h *Handlers) StockHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		books, err := middleware.GetBooks(h.db)
+		if err != nil {
+			log.Printf("Error fetching books: %v\n", err)
+			http.Error(w, "Error fetching books", http.StatusInternalServerError)
+			return
+		}
+		if books, err = h.visibleBooks(r, username, books); err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		levels, err := middleware.ListStockLevels(h.db)
+		if err != nil {
+			log.Printf("Error fetching stock levels: %v\n", err)
+			http.Error(w, "Error fetching stock", http.StatusInternalServerError)
+			return
+		}
+
+		lowOnly := r.URL.Query().Get("low") == "1"
+		rows := make([]stockRow, 0, len(books))
+		for _, book := range books {
+			level := levels[book.ID]
+			if lowOnly && !level.Low {
+				continue
+			}
+			rows = append(rows, stockRow{Book: book, Stock: level})
+		}
+
+		data := struct {
+			Rows    []stockRow
+			LowOnly bool
+		}{
+			Rows:    rows,
+			LowOnly: lowOnly,
+		}
+
+		if err := render(w, r, "stock.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying stock", http.StatusInternalServerError)
+		}
+	}
+}
+
+// StockBookHandler shows the stock and stock ledger of one book, with the
+// forms to change them for users who may adjust stock.
+func (h *Handlers) StockBookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		book, ok := h.viewableBook(w, r, username)
+		if !ok {
+			return
+		}
+
+		canAdjust, err := h.permittedOn(r, username, "adjust_stock", bookResource(book))
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		level, err := middleware.GetStockLevel(h.db, book.ID)
+		if err != nil {
+			log.Printf("Error fetching stock level: %v\n", err)
+			http.Error(w, "Error fetching stock", http.StatusInternalServerError)
+			return
+		}
+		movements, err := middleware.ListStockMovements(h.db, book.ID, 100)
+		if err != nil {
+			log.Printf("Error fetching stock movements: %v\n", err)
+			http.Error(w, "Error fetching stock", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Book      *models.Book
+			Stock     *models.StockLevel
+			Movements []models.StockMovement
+			Kinds     []string
+			CanAdjust bool
+		}{
+			Book:      book,
+			Stock:     level,
+			Movements: movements,
+			Kinds:     models.StockMovementKinds,
+			CanAdjust: canAdjust,
+		}
+
+		if err := render(w, r, "stock_book.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying stock", http.StatusInternalServerError)
+		}
+	}
+}
+
+// StockAdjustHandler records a stock movement for a book.
+func (h *Handlers) StockAdjustHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, book, ok := h.permittedBook(w, r, "adjust_stock", "You do not have permission to adjust stock.")
+		if !ok {
+			return
+		}
+
+		quantity, err := strconv.Atoi(r.FormValue("quantity"))
+		if err != nil {
+			http.Error(w, "Invalid quantity", http.StatusBadRequest)
+			return
+		}
+		in := stockInput{Kind: r.FormValue("kind"), Quantity: quantity, Reason: r.FormValue("reason")}
+
+		movement, err := in.movement(book.ID, username)
+		if err == nil {
+			_, err = middleware.RecordStockMovement(h.db, movement)
+		}
+		if err != nil {
+			log.Printf("Error recording stock movement: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/stock/book?id="+book.ID.String(), http.StatusSeeOther)
+	}
+}
+
+// StockThresholdHandler sets the low-stock threshold of a book.
+func (h *Handlers) StockThresholdHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, book, ok := h.permittedBook(w, r, "adjust_stock", "You do not have permission to adjust stock.")
+		if !ok {
+			return
+		}
+
+		threshold, err := strconv.Atoi(r.FormValue("threshold"))
+		if err != nil || threshold < 0 {
+			http.Error(w, "Invalid threshold", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := middleware.SetLowStockThreshold(h.db, book.ID, threshold); err != nil {
+			log.Printf("Error setting low-stock threshold: %v\n", err)
+			http.Error(w, "Error saving threshold", errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/stock/book?id="+book.ID.String(), http.StatusSeeOther)
+	}
+}
+
+// APIBookStockHandler returns the stock of a book (GET) or sets its
+// low-stock threshold (PUT).
+func (h *Handlers) APIBookStockHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "view"
+		if r.Method == http.MethodPut {
+			action = "adjust_stock"
+		}
+		_, book, ok := h.apiBook(w, r, action)
+		if !ok {
+			return
+		}
+
+		var level *models.StockLevel
+		var err error
+		if r.Method == http.MethodPut {
+			var body struct {
+				LowStockThreshold *int `json:"low_stock_threshold"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			if body.LowStockThreshold == nil || *body.LowStockThreshold < 0 {
+				writeJSONError(w, http.StatusBadRequest, "low_stock_threshold must be zero or more")
+				return
+			}
+			level, err = middleware.SetLowStockThreshold(h.db, book.ID, *body.LowStockThreshold)
+		} else {
+			level, err = middleware.GetStockLevel(h.db, book.ID)
+		}
+		if err != nil {
+			log.Printf("Error handling stock level: %v\n", err)
+			writeJSONError(w, errorStatus(err), "error handling stock level")
+			return
+		}
+		writeJSON(w, http.StatusOK, level)
+	}
+}
+
+// APIBookStockMovementsHandler lists a book's stock ledger (GET) or records
+// a movement (POST), answering with the new stock level.
+func (h *Handlers) APIBookStockMovementsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "view"
+		if r.Method == http.MethodPost {
+			action = "adjust_stock"
+		}
+		username, book, ok := h.apiBook(w, r, action)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			movements, err := middleware.ListStockMovements(h.db, book.ID, 100)
+			if err != nil {
+				log.Printf("Error fetching stock movements: %v\n", err)
+				writeJSONError(w, http.StatusInternalServerError, "error fetching stock movements")
+				return
+			}
+			writeJSON(w, http.StatusOK, movements)
+			return
+		}
+
+		var in stockInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		movement, err := in.movement(book.ID, username)
+		if err != nil {
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		level, err := middleware.RecordStockMovement(h.db, movement)
+		if err != nil {
+			log.Printf("Error recording stock movement: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, level)
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bookstore/isbn"
+	"bookstore/middleware"
+	"bookstore/models"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// errISBNTaken is returned when another book already has the ISBN.
+var errISBNTaken = errors.New("another book already has this ISBN")
+
+// parseISBN normalizes an ISBN typed in either form to ISBN-13. An empty
+// string means the book has no ISBN.
+func parseISBN(s string) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return "", nil
+	}
+	isbn13, err := isbn.Normalize(s)
+	if err != nil {
+		return "", validationError{"ISBN must be a valid ISBN-10 or ISBN-13"}
+	}
+	return isbn13, nil
+}
+
+// isbnTaken turns a unique violation on books.isbn into errISBNTaken.
+func isbnTaken(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "books_isbn_key" {
+		return errISBNTaken
+	}
+	return err
+}
+
+// addBookForm is the data behind add.html: the values typed so far, any
+// likely duplicates of them, and the result of an ISBN lookup.
+type addBookForm struct {
+	Book       models.Book
+	Categories []models.Category
+	Filed      map[int64]bool
+	TagList    string
+	// Duplicates are existing books the user may view that look like
+	// this one. ISBNTaken is set when one of them, or a book the user
+	// cannot see, has the same ISBN; that cannot be overridden.
+	Duplicates []middleware.DuplicateBook
+	ISBNTaken  bool
+
+	LookupEnabled bool
+	LookupMessage string
+}
+
+func (h *Handlers) renderAddBook(w http.ResponseWriter, r *http.Request, form *addBookForm) {
+	categories, err := middleware.ListCategories(h.db)
+	if err != nil {
+		log.Printf("Error fetching categories: %v\n", err)
+		http.Error(w, "Error displaying page", http.StatusInternalServerError)
+		return
+	}
+	form.Categories = categories
+	form.LookupEnabled = h.isbnLookup != nil
+	if form.Filed == nil {
+		form.Filed = make(map[int64]bool)
+	}
+
+	if err := render(w, r, "add.html", form); err != nil {
+		log.Printf("Template execution error: %v\n", err)
+		http.Error(w, "Error displaying page", http.StatusInternalServerError)
+	}
+}
+
+// duplicateBooks finds existing books that look like book, limited to
+// those username may view, and whether any book at all has its ISBN.
+func (h *Handlers) duplicateBooks(r *http.Request, username string, book *models.Book, credits []models.BookAuthor) ([]middleware.DuplicateBook, bool, error) {
+	names := make([]string, len(credits))
+	for i, c := range credits {
+		names[i] = c.Name
+	}
+	found, err := middleware.FindDuplicateBooks(h.db, book.ISBN13, book.Title, names, book.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	books := make([]models.Book, len(found))
+	taken := false
+	for i := range found {
+		books[i] = found[i].Book
+		if found[i].Reason == middleware.DuplicateISBN {
+			taken = true
+		}
+	}
+	books, err = h.visibleBooks(r, username, books)
+	if err != nil {
+		return nil, false, err
+	}
+	visible := make(map[uuid.UUID]bool, len(books))
+	for _, b := range books {
+		visible[b.ID] = true
+	}
+
+	var shown []middleware.DuplicateBook
+	for _, d := range found {
+		if visible[d.ID] {
+			shown = append(shown, d)
+		}
+	}
+	return shown, taken, nil
+}
+
+// lookupBook prefills a book from the ISBN lookup provider. It reports a
+// message for the form when there is nothing to prefill.
+func (h *Handlers) lookupBook(r *http.Request, isbn13 string) (*models.Book, string) {
+	if h.isbnLookup == nil {
+		return nil, "ISBN lookup is not configured."
+	}
+	meta, err := h.isbnLookup.Lookup(r.Context(), isbn13)
+	if errors.Is(err, isbn.ErrNotFound) {
+		return nil, "No details found for ISBN " + isbn13 + "."
+	}
+	if err != nil {
+		log.Printf("ISBN lookup error (%s): %v\n", h.isbnLookup.Name(), err)
+		return nil, "ISBN lookup failed; enter the details by hand."
+	}
+
+	book := &models.Book{
+		ISBN13: isbn13,
+		Title:  meta.Title,
+		Author: strings.Join(meta.Authors, "; "),
+		Genre:  meta.Genre,
+	}
+	if published, err := time.Parse("2006-01-02", meta.Published); err == nil {
+		book.PublishedAt = &published
+	}
+	return book, ""
+}
+
+// APIISBNHandler validates an ISBN in either form and returns both forms,
+// the metadata the lookup provider has for it, if any, and the books the
+// caller may view that already carry it.
+func (h *Handlers) APIISBNHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		isbn13, err := isbn.Normalize(mux.Vars(r)["isbn"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		isbn10, _ := isbn.To10(isbn13)
+
+		var books []models.Book
+		existing, err := middleware.GetBookByISBN(h.db, isbn13)
+		if err == nil {
+			books, err = h.visibleBooks(r, username, []models.Book{*existing})
+		} else if errors.Is(err, middleware.ErrBookNotFound) {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Error fetching book by ISBN: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching books")
+			return
+		}
+		if books == nil {
+			books = []models.Book{}
+		}
+
+		var meta *isbn.Metadata
+		if h.isbnLookup != nil {
+			meta, err = h.isbnLookup.Lookup(r.Context(), isbn13)
+			if err != nil && !errors.Is(err, isbn.ErrNotFound) {
+				log.Printf("ISBN lookup error (%s): %v\n", h.isbnLookup.Name(), err)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			ISBN13   string         `json:"isbn_13"`
+			ISBN10   string         `json:"isbn_10,omitempty"`
+			Metadata *isbn.Metadata `json:"metadata,omitempty"`
+			Books    []models.Book  `json:"books"`
+		}{isbn13, isbn10, meta, books})
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"bookstore/authz"
+	"bookstore/middleware"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// mismatchReport is the data behind admin_mismatches.html and the JSON
+// report.
+type mismatchReport struct {
+	Days    int                          `json:"days"`
+	Summary []middleware.MismatchSummary `json:"summary"`
+	Recent  []authz.Mismatch             `json:"recent"`
+}
+
+func (h *Handlers) mismatchReport(r *http.Request) (*mismatchReport, error) {
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 1 {
+		days = 7
+	}
+
+	summary, err := middleware.SummarizeAuthzMismatches(h.db, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return nil, err
+	}
+	recent, err := middleware.ListAuthzMismatches(h.db, 50)
+	if err != nil {
+		return nil, err
+	}
+	return &mismatchReport{Days: days, Summary: summary, Recent: recent}, nil
+}
+
+// AdminMismatchesHandler shows where the shadow authorization backend
+// disagreed with the enforced one (GET) and clears the record (POST).
+func (h *Handlers) AdminMismatchesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if err := middleware.ClearAuthzMismatches(h.db); err != nil {
+				log.Printf("Authorization mismatch clear error: %v\n", err)
+				http.Error(w, "Error clearing mismatches", http.StatusInternalServerError)
+				return
+			}
+			if err := middleware.RecordAudit(h.db, actor, "authz.clear_mismatches", "authz", "", nil); err != nil {
+				log.Printf("Audit log error: %v\n", err)
+			}
+			http.Redirect(w, r, "/admin/authz/mismatches", http.StatusSeeOther)
+			return
+		}
+
+		report, err := h.mismatchReport(r)
+		if err != nil {
+			log.Printf("Authorization mismatch report error: %v\n", err)
+			http.Error(w, "Error loading mismatches", http.StatusInternalServerError)
+			return
+		}
+
+		if err := render(w, r, "admin_mismatches.html", report); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+		}
+	}
+}
+
+// APIMismatchesHandler returns the mismatch report as JSON.
+func (h *Handlers) APIMismatchesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.authorize(w, r, "manage", "users"); !ok {
+			return
+		}
+
+		report, err := h.mismatchReport(r)
+		if err != nil {
+			log.Printf("Authorization mismatch report error: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error loading mismatches")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"bookstore/sso"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// OIDCLoginHandler starts the authorization code flow with PKCE.
+func (h *Handlers) OIDCLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.sso == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		nonce, _, err := middleware.NewToken()
+		if err != nil {
+			log.Printf("OIDC nonce error: %v\n", err)
+			http.Error(w, "Error starting sign-in", http.StatusInternalServerError)
+			return
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		state, err := middleware.CreateOIDCState(h.db, nonce, verifier, oidcStateTTL)
+		if err != nil {
+			log.Printf("OIDC state error: %v\n", err)
+			http.Error(w, "Error starting sign-in", http.StatusInternalServerError)
+			return
+		}
+
+		// Binding the state to this browser stops an attacker from
+		// completing their own login in the victim's session.
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/login/oidc",
+			MaxAge:   int(oidcStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, h.sso.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+	}
+}
+
+// OIDCCallbackHandler finishes the flow: it validates the ID token,
+// provisions or updates the local user and logs them in.
+func (h *Handlers) OIDCCallbackHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.sso == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    "",
+			Path:     "/login/oidc",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+		})
+
+		if errParam := r.FormValue("error"); errParam != "" {
+			log.Printf("OIDC provider returned error: %s %s\n", errParam, r.FormValue("error_description"))
+			renderMessage(w, r, http.StatusUnauthorized, "Sign-in failed",
+				"The identity provider did not sign you in.", "/login", "Back to Login")
+			return
+		}
+
+		state := r.FormValue("state")
+		cookie, err := r.Cookie(oidcStateCookie)
+		if err != nil || state == "" || cookie.Value != state {
+			renderMessage(w, r, http.StatusBadRequest, "Sign-in expired",
+				"Your sign-in attempt could not be matched to this browser. Please try again.", "/login", "Back to Login")
+			return
+		}
+
+		nonce, verifier, err := middleware.ConsumeOIDCState(h.db, state)
+		if errors.Is(err, middleware.ErrInvalidToken) {
+			renderMessage(w, r, http.StatusBadRequest, "Sign-in expired",
+				"Your sign-in attempt took too long. Please try again.", "/login", "Back to Login")
+			return
+		}
+		if err != nil {
+			log.Printf("OIDC state lookup error: %v\n", err)
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+
+		identity, err := h.sso.Exchange(r.Context(), r.FormValue("code"), nonce, verifier)
+		if err != nil {
+			log.Printf("OIDC exchange error: %v\n", err)
+			renderMessage(w, r, http.StatusUnauthorized, "Sign-in failed",
+				"We could not verify your identity with the provider.", "/login", "Back to Login")
+			return
+		}
+
+		roles, err := h.knownRoles(h.sso.MapRoles(identity))
+		if err != nil {
+			log.Printf("OIDC role lookup error: %v\n", err)
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+		if len(roles) == 0 {
+			log.Printf("OIDC user %s has no mapped role (claims %v)\n", identity.Subject, identity.RoleValues)
+			renderMessage(w, r, http.StatusForbidden, "No access",
+				"Your account is not allowed to use the bookstore.", "/login", "Back to Login")
+			return
+		}
+
+		user, err := h.provisionOIDCUser(identity, roles)
+		if err != nil {
+			log.Printf("OIDC provisioning error: %v\n", err)
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			renderMessage(w, r, http.StatusForbidden, "Account disabled",
+				"Your bookstore account has been disabled.", "/login", "Back to Login")
+			return
+		}
+		if !user.Active {
+			renderMessage(w, r, http.StatusForbidden, "Account not activated",
+				"Your bookstore account has not been activated yet.", "/login", "Back to Login")
+			return
+		}
+
+		h.beginSession(w, r, user)
+	}
+}
+
+// knownRoles drops the roles that do not exist, logging them; they point to
+// a mistake in OIDC_ROLE_MAP or OIDC_DEFAULT_ROLE.
+func (h *Handlers) knownRoles(roles []string) ([]string, error) {
+	unknown, err := middleware.UnknownRoles(h.db, roles)
+	if err != nil || len(unknown) == 0 {
+		return roles, err
+	}
+	log.Printf("OIDC role mapping names unknown roles %v\n", unknown)
+
+	skip := make(map[string]bool)
+	for _, role := range unknown {
+		skip[role] = true
+	}
+	var known []string
+	for _, role := range roles {
+		if !skip[role] {
+			known = append(known, role)
+		}
+	}
+	return known, nil
+}
+
+// provisionOIDCUser returns the local user for an identity, linking an
+// existing unprivileged account by verified email or creating one just in
+// time. A linked account keeps its roles. The permanent roles of accounts
+// created here follow the provider's claims on every login; time-bound
+// grants are kept.
+func (h *Handlers) provisionOIDCUser(identity *sso.Identity, roles []string) (*models.User, error) {
+	user, err := middleware.GetUserByOIDCSubject(h.db, identity.Issuer, identity.Subject)
+	if errors.Is(err, middleware.ErrUserNotFound) && identity.EmailVerified && identity.Email != "" {
+		user, err = middleware.LinkOIDCSubjectByEmail(h.db, identity.Email, identity.Issuer, identity.Subject)
+		if err == nil {
+			h.audit("system", "user.link_oidc", user.ID, map[string]interface{}{"issuer": identity.Issuer})
+			return user, nil
+		}
+	}
+
+	if errors.Is(err, middleware.ErrUserNotFound) {
+		username, err := h.uniqueUsername(identity)
+		if err != nil {
+			return nil, err
+		}
+
+		user = &models.User{
+			Username:  username,
+			Roles:     roles,
+			Email:     identity.Email,
+			FirstName: identity.FirstName,
+			LastName:  identity.LastName,
+		}
+		if err := middleware.CreateOIDCUser(h.db, user, identity.Issuer, identity.Subject); err != nil {
+			return nil, err
+		}
+
+		h.syncPermitUser(user, nil)
+		h.audit("system", "user.provision_oidc", user.ID, map[string]interface{}{
+			"issuer": identity.Issuer,
+			"roles":  roles,
+		})
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	managed, err := middleware.OIDCManagesRoles(h.db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !managed {
+		return user, nil
+	}
+	permanent, err := h.permanentRoles(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(permanent, ",") != strings.Join(roles, ",") {
+		previousRoles, err := middleware.EffectiveRoles(h.db, user.Roles)
+		if err != nil {
+			return nil, err
+		}
+		if err := middleware.SetUserRoles(h.db, user.ID, roles, "oidc"); err != nil {
+			return nil, err
+		}
+		if user, err = middleware.GetUserByID(h.db, user.ID); err != nil {
+			return nil, err
+		}
+		h.syncPermitUser(user, previousRoles)
+		h.audit("system", "user.update", user.ID, map[string]interface{}{
+			"roles":  map[string][]string{"from": permanent, "to": roles},
+			"source": "oidc",
+		})
+	}
+	return user, nil
+}
+
+// uniqueUsername derives a free username from the identity's preferred
+// username or email address.
+func (h *Handlers) uniqueUsername(identity *sso.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 2; i < 100; i++ {
+		ok, err := middleware.UsernameAvailable(h.db, candidate)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+	return "", fmt.Errorf("no free username for %s", base)
+}
@@ -0,0 +1,686 @@
+package handlers
+
+import (
+	"bookstore/authz"
+	"bookstore/middleware"
+	"bookstore/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// errAccessDenied is returned when the authorizer refuses an action the
+// caller asked for, so handlers can answer with 403.
+var errAccessDenied = errors.New("access denied")
+
+// maxCartQuantity caps the copies of one book in a cart.
+const maxCartQuantity = 100
+
+// transitionActions names the authorizer action that moves an order into
+// each state.
+var transitionActions = map[string]string{
+	models.OrderPaid:      "mark_paid",
+	models.OrderShipped:   "ship",
+	models.OrderCancelled: "cancel",
+	models.OrderRefunded:  "refund",
+}
+
+// orderResource describes one order to the authorizer.
+func orderResource(order *models.Order) authz.Resource {
+	return authz.Resource{
+		Type: "orders",
+		Key:  order.ID.String(),
+		Attributes: map[string]interface{}{
+			"customer": order.Customer,
+			"status":   order.Status,
+			"total":    order.Total,
+		},
+	}
+}
+
+// ownOrdersResource stands for the orders username placed, for checking
+// whether they may view their own orders at all.
+func ownOrdersResource(username string) authz.Resource {
+	return authz.Resource{
+		Type:       "orders",
+		Attributes: map[string]interface{}{"customer": username},
+	}
+}
+
+// cartTotals sums a cart per currency.
+func cartTotals(items []models.CartItem) map[string]int64 {
+	totals := make(map[string]int64)
+	for _, item := range items {
+		if item.Price != nil {
+			totals[item.Price.Currency] += item.Price.Amount() * int64(item.Quantity)
+		}
+	}
+	return totals
+}
+
+// setCartQuantity puts quantity copies of a book in username's cart, or adds
+// them to those already there. Only books the user may view can be added.
+func (h *Handlers) setCartQuantity(r *http.Request, username string, bookID uuid.UUID, quantity int, add bool) error {
+	if quantity < 0 || quantity > maxCartQuantity || (add && quantity == 0) {
+		return validationError{"quantity must be between 1 and " + strconv.Itoa(maxCartQuantity)}
+	}
+
+	user, err := middleware.GetUserByUsername(h.db, username)
+	if err != nil {
+		return err
+	}
+	if quantity == 0 {
+		return middleware.SetCartQuantity(h.db, user.ID, bookID, 0)
+	}
+
+	book, err := middleware.GetBookByID(h.db, bookID)
+	if err != nil {
+		return err
+	}
+	permitted, err := h.permittedOn(r, username, "view", bookResource(book))
+	if err != nil {
+		return err
+	}
+	if !permitted {
+		return errAccessDenied
+	}
+
+	if add {
+		return middleware.AddToCart(h.db, user.ID, bookID, quantity)
+	}
+	return middleware.SetCartQuantity(h.db, user.ID, bookID, quantity)
+}
+
+// checkout turns username's cart into a pending order at today's prices,
+// reserving the stock it needs. An order that costs nothing is paid
+// straight away.
+func (h *Handlers) checkout(r *http.Request, username string) (*models.Order, error) {
+	permitted, err := h.permitted(r, username, "create", "orders")
+	if err != nil {
+		return nil, err
+	}
+	if !permitted {
+		return nil, errAccessDenied
+	}
+
+	user, err := middleware.GetUserByUsername(h.db, username)
+	if err != nil {
+		return nil, err
+	}
+	items, err := middleware.ListCart(h.db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, validationError{"your cart is empty"}
+	}
+
+	order := &models.Order{UserID: &user.ID, Customer: user.Username}
+	for _, item := range items {
+		if item.Price == nil {
+			return nil, validationError{item.Title + " has no price and cannot be ordered"}
+		}
+		if order.Currency == "" {
+			order.Currency = item.Price.Currency
+		}
+		if item.Price.Currency != order.Currency {
+			return nil, validationError{"all books in an order must be priced in the same currency"}
+		}
+
+		bookID := item.BookID
+		line := models.OrderItem{
+			BookID:    &bookID,
+			Title:     item.Title,
+			Quantity:  item.Quantity,
+			UnitPrice: item.Price.Amount(),
+		}
+		order.Items = append(order.Items, line)
+		order.Total += line.Subtotal()
+	}
+
+	if err := middleware.CreateOrder(h.db, order); err != nil {
+		return nil, err
+	}
+	// No payment provider takes a payment of nothing, so free orders are
+	// paid as soon as they are placed.
+	if order.Total == 0 {
+		if err := middleware.TransitionOrder(h.db, order, models.OrderPaid, paymentsActor, "nothing to pay"); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// transitionOrder moves an order into state to, provided the state machine
+// allows it and the authorizer lets username perform the matching action on
+// this order.
+func (h *Handlers) transitionOrder(r *http.Request, username string, order *models.Order, to, note string) error {
+	if !models.CanTransition(order.Status, to) {
+		return validationError{"an order that is " + order.Status + " cannot become " + to}
+	}
+
+	permitted, err := h.permittedOn(r, username, transitionActions[to], orderResource(order))
+	if err != nil {
+		return err
+	}
+	if !permitted {
+		return errAccessDenied
+	}
+
+	if to == models.OrderRefunded {
+		// The payments are marked for refund in the transaction that claims
+		// the transition, so two admins cannot both refund the order, and
+		// are refunded at the provider once it commits.
+		err := middleware.TransitionOrderWith(h.db, order, to, username, note, func(tx *sql.Tx) error {
+			return middleware.MarkOrderRefundPending(tx, order.ID)
+		})
+		if err != nil {
+			return err
+		}
+		if err := h.refundOrderPayments(r.Context(), order); err != nil {
+			return fmt.Errorf("order refunded, but the payment refund will be retried: %v", err)
+		}
+		return nil
+	}
+	return middleware.TransitionOrder(h.db, order, to, username, note)
+}
+
+// allowedTransitions lists the states username may move order into.
+func (h *Handlers) allowedTransitions(r *http.Request, username string, order *models.Order) ([]string, error) {
+	var allowed []string
+	for _, to := range models.OrderTransitions[order.Status] {
+		permitted, err := h.permittedOn(r, username, transitionActions[to], orderResource(order))
+		if err != nil {
+			return nil, err
+		}
+		if permitted {
+			allowed = append(allowed, to)
+		}
+	}
+	return allowed, nil
+}
+
+// loadOrder fetches an order and checks that username may view it.
+func (h *Handlers) loadOrder(r *http.Request, username string, id uuid.UUID) (*models.Order, error) {
+	order, err := middleware.GetOrder(h.db, id)
+	if err != nil {
+		return nil, err
+	}
+	permitted, err := h.permittedOn(r, username, "view", orderResource(order))
+	if err != nil {
+		return nil, err
+	}
+	if !permitted {
+		return nil, errAccessDenied
+	}
+	return order, nil
+}
+
+// CartHandler shows the cart (GET) or changes how many copies of a book it
+// holds, removing the book at zero (POST).
+func (h *Handlers) CartHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.authorize(w, r, "create", "orders")
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			bookID, err := uuid.Parse(r.FormValue("id"))
+			if err != nil {
+				http.Error(w, "Invalid book ID", http.StatusBadRequest)
+				return
+			}
+			quantity, err := strconv.Atoi(r.FormValue("quantity"))
+			if err != nil {
+				http.Error(w, "Invalid quantity", http.StatusBadRequest)
+				return
+			}
+			if err := h.setCartQuantity(r, username, bookID, quantity, r.FormValue("add") != ""); err != nil {
+				log.Printf("Error updating cart: %v\n", err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		}
+
+		user, err := middleware.GetUserByUsername(h.db, username)
+		if err != nil {
+			log.Printf("Error retrieving user: %v\n", err)
+			http.Error(w, "Error fetching cart", http.StatusInternalServerError)
+			return
+		}
+		items, err := middleware.ListCart(h.db, user.ID)
+		if err != nil {
+			log.Printf("Error fetching cart: %v\n", err)
+			http.Error(w, "Error fetching cart", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Items  []models.CartItem
+			Totals map[string]int64
+		}{
+			Items:  items,
+			Totals: cartTotals(items),
+		}
+
+		if err := render(w, r, "cart.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying cart", http.StatusInternalServerError)
+		}
+	}
+}
+
+// CheckoutHandler places an order for everything in the cart.
+func (h *Handlers) CheckoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		order, err := h.checkout(r, username)
+		if err != nil {
+			log.Printf("Error placing order: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/orders/view?id="+order.ID.String(), http.StatusSeeOther)
+	}
+}
+
+// OrdersHandler lists the user's own orders.
+func (h *Handlers) OrdersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+		permitted, err := h.permittedOn(r, username, "view", ownOrdersResource(username))
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		if !permitted {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		user, err := middleware.GetUserByUsername(h.db, username)
+		if err != nil {
+			log.Printf("Error retrieving user: %v\n", err)
+			http.Error(w, "Error fetching orders", http.StatusInternalServerError)
+			return
+		}
+		orders, err := middleware.ListUserOrders(h.db, user.ID, 100)
+		if err != nil {
+			log.Printf("Error fetching orders: %v\n", err)
+			http.Error(w, "Error fetching orders", http.StatusInternalServerError)
+			return
+		}
+		staff, err := h.permitted(r, username, "view", "orders")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Title  string
+			Orders []models.Order
+			Manage bool
+			Staff  bool
+			Status string
+			States []string
+		}{
+			Title:  "My Orders",
+			Orders: orders,
+			Staff:  staff,
+		}
+
+		if err := render(w, r, "orders.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying orders", http.StatusInternalServerError)
+		}
+	}
+}
+
+// ManageOrdersHandler lists every customer's orders for staff, optionally
+// only those in one state.
+func (h *Handlers) ManageOrdersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := h.authorize(w, r, "view", "orders"); !ok {
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		orders, err := middleware.ListOrders(h.db, status, 200)
+		if err != nil {
+			log.Printf("Error fetching orders: %v\n", err)
+			http.Error(w, "Error fetching orders", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Title  string
+			Orders []models.Order
+			Manage bool
+			Staff  bool
+			Status string
+			States []string
+		}{
+			Title:  "Manage Orders",
+			Orders: orders,
+			Manage: true,
+			Staff:  true,
+			Status: status,
+			States: models.OrderStates,
+		}
+
+		if err := render(w, r, "orders.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying orders", http.StatusInternalServerError)
+		}
+	}
+}
+
+// OrderHandler shows one order with its history and the state changes the
+// user may make.
+func (h *Handlers) OrderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+		order, err := h.loadOrder(r, username, id)
+		if err != nil {
+			log.Printf("Error fetching order: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		events, err := middleware.ListOrderEvents(h.db, order.ID)
+		if err != nil {
+			log.Printf("Error fetching order events: %v\n", err)
+			http.Error(w, "Error fetching order", http.StatusInternalServerError)
+			return
+		}
+		transitions, err := h.allowedTransitions(r, username, order)
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+
+		attempts, err := middleware.ListOrderPayments(h.db, order.ID)
+		if err != nil {
+			log.Printf("Error fetching payments: %v\n", err)
+			http.Error(w, "Error fetching order", http.StatusInternalServerError)
+			return
+		}
+		canPay := false
+		if order.Status == models.OrderPending {
+			if canPay, err = h.permittedOn(r, username, "pay", orderResource(order)); err != nil {
+				log.Printf("Permission check error: %v\n", err)
+				http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// A fresh idempotency key per page view makes a double-submitted
+		// payment form one payment attempt. An attempt that never finished
+		// is resumed under its own key, as the order cannot have two.
+		paymentKey := uuid.NewString()
+		for _, p := range attempts {
+			if p.Status == models.PaymentPending || p.Status == models.PaymentAuthorized {
+				paymentKey = p.IdempotencyKey
+			}
+		}
+		data := struct {
+			Order       *models.Order
+			Events      []models.OrderEvent
+			Transitions []string
+			Payments    []models.Payment
+			CanPay      bool
+			PaymentKey  string
+			Provider    string
+		}{
+			Order:       order,
+			Events:      events,
+			Transitions: transitions,
+			Payments:    attempts,
+			CanPay:      canPay,
+			PaymentKey:  paymentKey,
+			Provider:    h.payments.Name(),
+		}
+
+		if err := render(w, r, "order.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying order", http.StatusInternalServerError)
+		}
+	}
+}
+
+// OrderTransitionHandler moves an order into another state.
+func (h *Handlers) OrderTransitionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+		order, err := h.loadOrder(r, username, id)
+		if err == nil {
+			err = h.transitionOrder(r, username, order, r.FormValue("status"), strings.TrimSpace(r.FormValue("note")))
+		}
+		if err != nil {
+			log.Printf("Error changing order: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/orders/view?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// APICartHandler returns the cart (GET) or sets how many copies of a book
+// it holds, removing the book at zero (PUT).
+func (h *Handlers) APICartHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+		// The cart only exists to place an order from.
+		permitted, err := h.permitted(r, username, "create", "orders")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking permissions")
+			return
+		}
+		if !permitted {
+			writeJSONError(w, http.StatusForbidden, "access denied")
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var body struct {
+				BookID   uuid.UUID `json:"book_id"`
+				Quantity int       `json:"quantity"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			if err := h.setCartQuantity(r, username, body.BookID, body.Quantity, false); err != nil {
+				log.Printf("Error updating cart: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+		}
+
+		user, err := middleware.GetUserByUsername(h.db, username)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error fetching cart")
+			return
+		}
+		items, err := middleware.ListCart(h.db, user.ID)
+		if err != nil {
+			log.Printf("Error fetching cart: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching cart")
+			return
+		}
+		if items == nil {
+			items = []models.CartItem{}
+		}
+		writeJSON(w, http.StatusOK, items)
+	}
+}
+
+// APIOrdersHandler lists orders (GET), every customer's for staff and
+// their own for everyone else, or checks the cart out (POST).
+func (h *Handlers) APIOrdersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			order, err := h.checkout(r, username)
+			if err != nil {
+				log.Printf("Error placing order: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusCreated, order)
+			return
+		}
+
+		staff, err := h.permitted(r, username, "view", "orders")
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error checking permissions")
+			return
+		}
+
+		if !staff {
+			permitted, err := h.permittedOn(r, username, "view", ownOrdersResource(username))
+			if err != nil {
+				log.Printf("Permission check error: %v\n", err)
+				writeJSONError(w, http.StatusInternalServerError, "error checking permissions")
+				return
+			}
+			if !permitted {
+				writeJSONError(w, http.StatusForbidden, "access denied")
+				return
+			}
+		}
+
+		var orders []models.Order
+		if staff {
+			orders, err = middleware.ListOrders(h.db, r.URL.Query().Get("status"), 200)
+		} else {
+			var user *models.User
+			if user, err = middleware.GetUserByUsername(h.db, username); err == nil {
+				orders, err = middleware.ListUserOrders(h.db, user.ID, 100)
+			}
+		}
+		if err != nil {
+			log.Printf("Error fetching orders: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching orders")
+			return
+		}
+		writeJSON(w, http.StatusOK, orders)
+	}
+}
+
+// APIOrderHandler returns one order with its items and history.
+func (h *Handlers) APIOrderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid order ID")
+			return
+		}
+		order, err := h.loadOrder(r, username, id)
+		if err != nil {
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		events, err := middleware.ListOrderEvents(h.db, order.ID)
+		if err != nil {
+			log.Printf("Error fetching order events: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching order")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			*models.Order
+			Events []models.OrderEvent `json:"events"`
+		}{order, events})
+	}
+}
+
+// APIOrderTransitionsHandler moves an order into another state.
+func (h *Handlers) APIOrderTransitionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid order ID")
+			return
+		}
+		var body struct {
+			Status string `json:"status"`
+			Note   string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		order, err := h.loadOrder(r, username, id)
+		if err == nil {
+			err = h.transitionOrder(r, username, order, body.Status, strings.TrimSpace(body.Note))
+		}
+		if err != nil {
+			log.Printf("Error changing order: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, order)
+	}
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bookstore/mailer"
+	"bookstore/middleware"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+func (h *Handlers) LogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if err := middleware.DeleteSession(h.db, cookie.Value); err != nil {
+				log.Printf("Session delete error: %v\n", err)
+			}
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
+
+// ForgotPasswordHandler mails a reset link to the account matching the
+// submitted username or email. The response is the same whether or not an
+// account was found so the page cannot be used to probe for accounts.
+func (h *Handlers) ForgotPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if err := render(w, r, "forgot_password.html", nil); err != nil {
+				log.Printf("Template execution error: %v\n", err)
+				http.Error(w, "Error displaying page", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if !h.resetIPLimiter.Allow(middleware.ClientIP(r)) {
+			log.Printf("Password reset rate limit hit for IP %s\n", middleware.ClientIP(r))
+			http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		identifier := strings.TrimSpace(r.FormValue("identifier"))
+		if identifier != "" {
+			users, err := middleware.FindUsersForReset(h.db, identifier)
+			if err != nil {
+				log.Printf("Password reset lookup error: %v\n", err)
+				http.Error(w, "Error processing request", http.StatusInternalServerError)
+				return
+			}
+
+			for _, user := range users {
+				if !h.resetAccountLimiter.Allow(user.ID.String()) {
+					log.Printf("Password reset rate limit hit for user %s\n", user.Username)
+					continue
+				}
+
+				token, err := middleware.CreatePasswordReset(h.db, user.ID, passwordResetTTL)
+				if err != nil {
+					log.Printf("Password reset token error: %v\n", err)
+					continue
+				}
+
+				link := h.baseURL + "/reset-password?token=" + url.QueryEscape(token)
+				err = h.mailer.Send(r.Context(), mailer.Message{
+					To:      user.Email,
+					Subject: "Reset your Bookstore password",
+					Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, follow this link:\n\n%s\n\nThe link can be used once and expires in one hour. If you did not ask for this, you can ignore this email.\n",
+						user.Username, link),
+				})
+				if err != nil {
+					log.Printf("Password reset mail error: %v\n", err)
+					continue
+				}
+
+				h.audit(user.Username, "user.request_password_reset", user.ID, map[string]interface{}{
+					"ip": middleware.ClientIP(r),
+				})
+			}
+		}
+
+		renderMessage(w, r, http.StatusOK, "Check your email",
+			"If an account matches what you entered, we have sent it a link to reset the password.",
+			"/login", "Back to Login")
+	}
+}
+
+func (h *Handlers) ResetPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+
+		if r.Method == http.MethodGet {
+			err := middleware.CheckPasswordReset(h.db, token)
+			if errors.Is(err, middleware.ErrInvalidToken) {
+				renderMessage(w, r, http.StatusBadRequest, "Link expired",
+					"This reset link is invalid, expired or has already been used.",
+					"/forgot-password", "Request a new link")
+				return
+			}
+			if err != nil {
+				log.Printf("Password reset check error: %v\n", err)
+				http.Error(w, "Error processing request", http.StatusInternalServerError)
+				return
+			}
+
+			h.renderResetForm(w, r, http.StatusOK, token, "")
+			return
+		}
+
+		if !h.resetIPLimiter.Allow(middleware.ClientIP(r)) {
+			http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		password := r.FormValue("password")
+		if password != r.FormValue("confirm_password") {
+			h.renderResetForm(w, r, http.StatusBadRequest, token, "passwords do not match")
+			return
+		}
+		if err := validatePassword(password); err != nil {
+			h.renderResetForm(w, r, http.StatusBadRequest, token, err.Error())
+			return
+		}
+
+		userID, err := middleware.ResetPassword(h.db, token, password)
+		if errors.Is(err, middleware.ErrInvalidToken) {
+			renderMessage(w, r, http.StatusBadRequest, "Link expired",
+				"This reset link is invalid, expired or has already been used.",
+				"/forgot-password", "Request a new link")
+			return
+		}
+		if err != nil {
+			log.Printf("Password reset error: %v\n", err)
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+
+		if user, err := middleware.GetUserByID(h.db, userID); err == nil {
+			h.audit(user.Username, "user.password_reset", userID, map[string]interface{}{
+				"ip": middleware.ClientIP(r),
+			})
+		}
+
+		renderMessage(w, r, http.StatusOK, "Password changed",
+			"Your password has been reset, you have been signed out everywhere and your API tokens have been revoked. Log in with your new password.",
+			"/login", "Log in")
+	}
+}
+
+func (h *Handlers) renderResetForm(w http.ResponseWriter, r *http.Request, status int, token, formError string) {
+	w.WriteHeader(status)
+	data := struct {
+		Token string
+		Error string
+	}{token, formError}
+	if err := render(w, r, "reset_password.html", data); err != nil {
+		log.Printf("Template execution error: %v\n", err)
+	}
+}
@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"bookstore/payments"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// paymentsActor is recorded as the actor of order changes made while
+// reconciling webhooks from the payment provider.
+const paymentsActor = "payments"
+
+// maxIdempotencyKeyLength bounds client-chosen idempotency keys.
+const maxIdempotencyKeyLength = 200
+
+// paymentInput is a payment attempt, from either the order page or the
+// JSON API. Clients pick the idempotency key and send the same one when
+// they retry.
+type paymentInput struct {
+	IdempotencyKey string `json:"idempotency_key"`
+	Method         string `json:"payment_method"`
+}
+
+// payOrder takes payment for a pending order through the payment provider
+// and marks the order paid once the money is captured. Repeating an
+// attempt with the same idempotency key picks up where the earlier one
+// stopped, or returns its outcome if it finished; it never charges twice.
+// A declined payment comes back with status failed and no error.
+func (h *Handlers) payOrder(r *http.Request, username string, order *models.Order, in paymentInput) (*models.Payment, error) {
+	in.IdempotencyKey = strings.TrimSpace(in.IdempotencyKey)
+	in.Method = strings.TrimSpace(in.Method)
+	if in.IdempotencyKey == "" || len(in.IdempotencyKey) > maxIdempotencyKeyLength {
+		return nil, validationError{fmt.Sprintf("idempotency key must be 1 to %d characters", maxIdempotencyKeyLength)}
+	}
+	if in.Method == "" {
+		return nil, validationError{"payment method is required"}
+	}
+
+	permitted, err := h.permittedOn(r, username, "pay", orderResource(order))
+	if err != nil {
+		return nil, err
+	}
+	if !permitted {
+		return nil, errAccessDenied
+	}
+
+	payment, err := middleware.GetPaymentByIdempotencyKey(h.db, in.IdempotencyKey)
+	if err != nil && !errors.Is(err, middleware.ErrPaymentNotFound) {
+		return nil, err
+	}
+	if payment == nil {
+		if order.Status != models.OrderPending {
+			return nil, validationError{"only pending orders can be paid, this one is " + order.Status}
+		}
+		if order.Total <= 0 {
+			return nil, validationError{"this order has nothing to pay"}
+		}
+		if payment, _, err = middleware.StartPayment(h.db, &models.Payment{
+			OrderID:        order.ID,
+			Provider:       h.payments.Name(),
+			IdempotencyKey: in.IdempotencyKey,
+			Amount:         order.Total,
+			Currency:       order.Currency,
+			CreatedBy:      username,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if payment.OrderID != order.ID {
+		return nil, validationError{"idempotency key was already used for another order"}
+	}
+
+	return payment, h.processPayment(r.Context(), username, order, payment, in.Method)
+}
+
+// processPayment moves a payment attempt on as far as it goes: authorize,
+// capture, then mark the order paid. Each step is stored before the next,
+// so a retry after a failure resumes rather than starts over.
+func (h *Handlers) processPayment(ctx context.Context, actor string, order *models.Order, payment *models.Payment, method string) error {
+	if payment.Status == models.PaymentPending {
+		auth, err := h.payments.Authorize(ctx, payments.AuthorizeRequest{
+			IdempotencyKey: payment.IdempotencyKey,
+			Amount:         payment.Amount,
+			Currency:       payment.Currency,
+			Method:         method,
+			Reference:      order.ID.String(),
+		})
+		if errors.Is(err, payments.ErrDeclined) {
+			payment.Status = models.PaymentFailed
+			payment.Error = err.Error()
+			return middleware.UpdatePayment(h.db, payment)
+		}
+		if err != nil {
+			return fmt.Errorf("error authorizing payment: %v", err)
+		}
+
+		payment.Status = models.PaymentAuthorized
+		payment.ProviderRef = auth.ID
+		if err := middleware.UpdatePayment(h.db, payment); err != nil {
+			return err
+		}
+	}
+
+	if payment.Status == models.PaymentAuthorized {
+		if err := h.payments.Capture(ctx, payment.ProviderRef, payment.Amount); err != nil {
+			return fmt.Errorf("error capturing payment: %v", err)
+		}
+		payment.Status = models.PaymentCaptured
+		if err := middleware.UpdatePayment(h.db, payment); err != nil {
+			return err
+		}
+	}
+
+	if payment.Status == models.PaymentCaptured {
+		_, err := h.settleCapturedPayment(ctx, actor, payment)
+		return err
+	}
+	return nil
+}
+
+// settleCapturedPayment marks the order of a captured payment paid. If the
+// order was cancelled in the meantime the money goes back.
+func (h *Handlers) settleCapturedPayment(ctx context.Context, actor string, payment *models.Payment) (string, error) {
+	order, err := middleware.GetOrder(h.db, payment.OrderID)
+	if err != nil {
+		return "", err
+	}
+
+	switch order.Status {
+	case models.OrderPending:
+		err := middleware.TransitionOrder(h.db, order, models.OrderPaid, actor, "payment "+payment.ProviderRef)
+		if err != nil {
+			return "", err
+		}
+		return "order paid", nil
+	case models.OrderCancelled:
+		if err := h.refundPayment(ctx, payment); err != nil {
+			return "", err
+		}
+		log.Printf("Refunded payment %s captured for cancelled order %s\n", payment.ProviderRef, order.ID)
+		return "refunded, order was cancelled", nil
+	default:
+		return "order already " + order.Status, nil
+	}
+}
+
+// refundPayment gives the money of a captured payment back.
+func (h *Handlers) refundPayment(ctx context.Context, payment *models.Payment) error {
+	if err := h.payments.Refund(ctx, payment.ProviderRef, payment.Amount); err != nil {
+		return fmt.Errorf("error refunding payment: %v", err)
+	}
+	payment.Status = models.PaymentRefunded
+	return middleware.UpdatePayment(h.db, payment)
+}
+
+// refundOrderPayments gives back the payments of a refunded order that are
+// marked refund_pending. Those that fail are retried by RetryRefunds.
+func (h *Handlers) refundOrderPayments(ctx context.Context, order *models.Order) error {
+	attempts, err := middleware.ListOrderPayments(h.db, order.ID)
+	if err != nil {
+		return err
+	}
+	for i := range attempts {
+		if attempts[i].Status != models.PaymentRefundPending {
+			continue
+		}
+		if err := h.refundPayment(ctx, &attempts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetryRefunds refunds, every interval, the payments whose refund was
+// recorded but did not go through, until ctx is done. Refunds are safe to
+// repeat, so a payment refunded just before its status was stored is not
+// paid back twice.
+func (h *Handlers) RetryRefunds(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.retryRefunds(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handlers) retryRefunds(ctx context.Context) {
+	pending, err := middleware.ListRefundPendingPayments(h.db)
+	if err != nil {
+		log.Printf("Error listing pending refunds: %v\n", err)
+		return
+	}
+	for i := range pending {
+		if err := h.refundPayment(ctx, &pending[i]); err != nil {
+			log.Printf("Error refunding payment %s of order %s: %v\n", pending[i].ProviderRef, pending[i].OrderID, err)
+		}
+	}
+}
+
+// reconcilePaymentEvent applies a webhook event to the payment and order it
+// concerns and describes what it did. Events for payments we do not know,
+// or whose amount does not match, are recorded but change nothing.
+func (h *Handlers) reconcilePaymentEvent(ctx context.Context, event *payments.WebhookEvent) (string, error) {
+	payment, err := middleware.GetPaymentByProviderRef(h.db, h.payments.Name(), event.PaymentID)
+	if errors.Is(err, middleware.ErrPaymentNotFound) {
+		log.Printf("Payment webhook %s for unknown payment %s\n", event.ID, event.PaymentID)
+		return "unmatched payment", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if event.Amount != payment.Amount || !strings.EqualFold(event.Currency, payment.Currency) {
+		log.Printf("Payment webhook %s reports %d %s for payment %s of %d %s\n",
+			event.ID, event.Amount, event.Currency, payment.ProviderRef, payment.Amount, payment.Currency)
+		return "amount mismatch", nil
+	}
+
+	switch event.Type {
+	case payments.EventCaptured:
+		if payment.Status == models.PaymentPending || payment.Status == models.PaymentAuthorized {
+			payment.Status = models.PaymentCaptured
+			if err := middleware.UpdatePayment(h.db, payment); err != nil {
+				return "", err
+			}
+		}
+		if payment.Status != models.PaymentCaptured {
+			return "ignored, payment is " + payment.Status, nil
+		}
+		return h.settleCapturedPayment(ctx, paymentsActor, payment)
+
+	case payments.EventFailed:
+		if payment.Status != models.PaymentPending && payment.Status != models.PaymentAuthorized {
+			return "ignored, payment is " + payment.Status, nil
+		}
+		payment.Status = models.PaymentFailed
+		payment.Error = "failed at the payment provider"
+		if err := middleware.UpdatePayment(h.db, payment); err != nil {
+			return "", err
+		}
+		return "payment failed", nil
+
+	case payments.EventRefunded:
+		if payment.Status != models.PaymentRefunded {
+			payment.Status = models.PaymentRefunded
+			if err := middleware.UpdatePayment(h.db, payment); err != nil {
+				return "", err
+			}
+		}
+		order, err := middleware.GetOrder(h.db, payment.OrderID)
+		if err != nil {
+			return "", err
+		}
+		if !models.CanTransition(order.Status, models.OrderRefunded) {
+			return "payment refunded, order is " + order.Status, nil
+		}
+		if err := middleware.TransitionOrder(h.db, order, models.OrderRefunded, paymentsActor, "refunded at the payment provider"); err != nil {
+			return "", err
+		}
+		return "order refunded", nil
+
+	default:
+		return "ignored event type " + event.Type, nil
+	}
+}
+
+// PayOrderHandler pays for an order from the order page.
+func (h *Handlers) PayOrderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+		order, err := h.loadOrder(r, username, id)
+		var payment *models.Payment
+		if err == nil {
+			payment, err = h.payOrder(r, username, order, paymentInput{
+				IdempotencyKey: r.FormValue("idempotency_key"),
+				Method:         r.FormValue("payment_method"),
+			})
+		}
+		if err != nil {
+			log.Printf("Error paying for order: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		if payment.Status == models.PaymentFailed {
+			renderMessage(w, r, http.StatusPaymentRequired, "Payment Failed", payment.Error,
+				"/orders/view?id="+id.String(), "Back to the order")
+			return
+		}
+		http.Redirect(w, r, "/orders/view?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// APIOrderPaymentsHandler lists the payment attempts of an order (GET) or
+// pays for it (POST). The idempotency key may also be sent in the
+// Idempotency-Key header. A declined payment is answered with 402.
+func (h *Handlers) APIOrderPaymentsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid order ID")
+			return
+		}
+		order, err := h.loadOrder(r, username, id)
+		if err != nil {
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			var in paymentInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			if in.IdempotencyKey == "" {
+				in.IdempotencyKey = r.Header.Get("Idempotency-Key")
+			}
+
+			payment, err := h.payOrder(r, username, order, in)
+			if err != nil {
+				log.Printf("Error paying for order: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			status := http.StatusOK
+			if payment.Status == models.PaymentFailed {
+				status = http.StatusPaymentRequired
+			}
+			writeJSON(w, status, payment)
+			return
+		}
+
+		attempts, err := middleware.ListOrderPayments(h.db, order.ID)
+		if err != nil {
+			log.Printf("Error fetching payments: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching payments")
+			return
+		}
+		if attempts == nil {
+			attempts = []models.Payment{}
+		}
+		writeJSON(w, http.StatusOK, attempts)
+	}
+}
+
+// PaymentWebhookHandler receives event notifications from the payment
+// provider. Events are verified, recorded once and reconciled against
+// payments and orders; redeliveries of a reconciled event are acknowledged
+// without doing anything. Failures answer 500 so the provider retries.
+func (h *Handlers) PaymentWebhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "error reading body")
+			return
+		}
+
+		event, err := h.payments.VerifyWebhook(r.Header, body)
+		if errors.Is(err, payments.ErrInvalidSignature) {
+			log.Printf("Payment webhook with invalid signature from %s\n", middleware.ClientIP(r))
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		provider := h.payments.Name()
+		fresh, err := middleware.RecordPaymentEvent(h.db, provider, event.ID, event.Type, event.PaymentID, event.Amount, event.Currency)
+		if err != nil {
+			log.Printf("Error recording payment webhook: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error recording event")
+			return
+		}
+		if !fresh {
+			writeJSON(w, http.StatusOK, map[string]string{"result": "duplicate"})
+			return
+		}
+
+		result, err := h.reconcilePaymentEvent(r.Context(), event)
+		if err != nil {
+			log.Printf("Error reconciling payment webhook %s: %v\n", event.ID, err)
+			writeJSONError(w, http.StatusInternalServerError, "error reconciling event")
+			return
+		}
+		if err := middleware.SetPaymentEventResult(h.db, provider, event.ID, result); err != nil {
+			log.Printf("Error recording payment webhook result: %v\n", err)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": result})
+	}
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// defaultCurrency is offered for books that have no price yet.
+const defaultCurrency = "USD"
+
+// priceInput is a new price as submitted by the price form or the API, in
+// minor units. A nil EffectiveAt means right away.
+type priceInput struct {
+	Currency    string     `json:"currency"`
+	ListPrice   int64      `json:"list_price"`
+	SalePrice   *int64     `json:"sale_price"`
+	EffectiveAt *time.Time `json:"effective_at"`
+}
+
+// priceInputFromForm reads the price form, which takes amounts in major
+// units and the effective date as a local date and time.
+func priceInputFromForm(r *http.Request) (priceInput, error) {
+	in := priceInput{Currency: strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))}
+
+	listPrice, err := models.ParseMoney(r.FormValue("list_price"), in.Currency)
+	if err != nil {
+		return in, validationError{"invalid list price"}
+	}
+	in.ListPrice = listPrice
+
+	if s := strings.TrimSpace(r.FormValue("sale_price")); s != "" {
+		salePrice, err := models.ParseMoney(s, in.Currency)
+		if err != nil {
+			return in, validationError{"invalid sale price"}
+		}
+		in.SalePrice = &salePrice
+	}
+
+	if s := r.FormValue("effective_at"); s != "" {
+		effectiveAt, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local)
+		if err != nil {
+			return in, validationError{"invalid effective date"}
+		}
+		in.EffectiveAt = &effectiveAt
+	}
+	return in, nil
+}
+
+func validatePriceInput(in priceInput) error {
+	if !currencyPattern.MatchString(in.Currency) {
+		return validationError{"currency must be a three-letter ISO 4217 code"}
+	}
+	if in.ListPrice < 0 {
+		return validationError{"list price must not be negative"}
+	}
+	if in.SalePrice != nil && (*in.SalePrice < 0 || *in.SalePrice > in.ListPrice) {
+		return validationError{"sale price must be between zero and the list price"}
+	}
+	// Prices that already applied are history and cannot be rewritten.
+	if in.EffectiveAt != nil && in.EffectiveAt.Before(time.Now().Add(-time.Minute)) {
+		return validationError{"effective date must not be in the past"}
+	}
+	return nil
+}
+
+// setPrice adds a price for a book, in effect right away or from
+// in.EffectiveAt on.
+func (h *Handlers) setPrice(actor string, bookID uuid.UUID, in priceInput) (*models.Price, error) {
+	if err := validatePriceInput(in); err != nil {
+		return nil, err
+	}
+
+	price := &models.Price{
+		BookID:      bookID,
+		Currency:    in.Currency,
+		ListPrice:   in.ListPrice,
+		SalePrice:   in.SalePrice,
+		EffectiveAt: time.Now(),
+		CreatedBy:   actor,
+	}
+	if in.EffectiveAt != nil && in.EffectiveAt.After(price.EffectiveAt) {
+		price.EffectiveAt = *in.EffectiveAt
+	}
+	if err := middleware.CreatePrice(h.db, price); err != nil {
+		return nil, err
+	}
+
+	details := map[string]interface{}{
+		"price_id":     price.ID,
+		"currency":     price.Currency,
+		"list_price":   price.ListPrice,
+		"effective_at": price.EffectiveAt.UTC().Format(time.RFC3339),
+	}
+	if price.SalePrice != nil {
+		details["sale_price"] = *price.SalePrice
+	}
+	h.auditBook(actor, "book.set_price", bookID, details)
+	return price, nil
+}
+
+// cancelPrice removes a scheduled price change.
+func (h *Handlers) cancelPrice(actor string, bookID uuid.UUID, priceID int64) error {
+	if err := middleware.DeleteScheduledPrice(h.db, bookID, priceID); err != nil {
+		return err
+	}
+	h.auditBook(actor, "book.cancel_price", bookID, map[string]interface{}{"price_id": priceID})
+	return nil
+}
+
+func (h *Handlers) auditBook(actor, action string, bookID uuid.UUID, details map[string]interface{}) {
+	if err := middleware.RecordAudit(h.db, actor, action, "book", bookID.String(), details); err != nil {
+		log.Printf("Audit log error: %v\n", err)
+	}
+}
+
+// bookPrices is a book's price history split at the present.
+type bookPrices struct {
+	Current   *models.Price  `json:"current"`
+	Scheduled []models.Price `json:"scheduled"`
+	History   []models.Price `json:"history"`
+}
+
+// pricesOf loads the prices of a book. History lists every price that has
+// taken effect, latest first, so the current price heads it; Scheduled
+// lists the changes still to come, soonest first.
+func (h *Handlers) pricesOf(book *models.Book) (*bookPrices, error) {
+	prices, err := middleware.ListPrices(h.db, book.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &bookPrices{Current: book.Price, Scheduled: []models.Price{}, History: []models.Price{}}
+	now := time.Now()
+	for _, price := range prices {
+		if price.EffectiveAt.After(now) {
+			result.Scheduled = append([]models.Price{price}, result.Scheduled...)
+		} else {
+			result.History = append(result.History, price)
+		}
+	}
+	return result, nil
+}
+
+// PricesHandler shows the current, scheduled and past prices of a book,
+// with the form to change them for users who may set prices.
+func (h *Handlers) PricesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := h.requireLogin(w, r)
+		if !ok {
+			return
+		}
+
+		book, ok := h.viewableBook(w, r, username)
+		if !ok {
+			return
+		}
+
+		canSet, err := h.permittedOn(r, username, "set_price", bookResource(book))
+		if err != nil {
+			log.Printf("Permission check error: %v\n", err)
+			http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+			return
+		}
+		prices, err := h.pricesOf(book)
+		if err != nil {
+			log.Printf("Error fetching prices: %v\n", err)
+			http.Error(w, "Error fetching prices", http.StatusInternalServerError)
+			return
+		}
+
+		currency := defaultCurrency
+		if book.Price != nil {
+			currency = book.Price.Currency
+		}
+
+		data := struct {
+			Book     *models.Book
+			Prices   *bookPrices
+			Currency string
+			CanSet   bool
+		}{
+			Book:     book,
+			Prices:   prices,
+			Currency: currency,
+			CanSet:   canSet,
+		}
+
+		if err := render(w, r, "prices.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying prices", http.StatusInternalServerError)
+		}
+	}
+}
+
+// SetPriceHandler adds a price for a book from the price form.
+func (h *Handlers) SetPriceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, book, ok := h.permittedBook(w, r, "set_price", "You do not have permission to set prices.")
+		if !ok {
+			return
+		}
+
+		in, err := priceInputFromForm(r)
+		if err == nil {
+			_, err = h.setPrice(username, book.ID, in)
+		}
+		if err != nil {
+			log.Printf("Error setting price: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/prices?id="+book.ID.String(), http.StatusSeeOther)
+	}
+}
+
+// CancelPriceHandler removes a scheduled price change.
+func (h *Handlers) CancelPriceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, book, ok := h.permittedBook(w, r, "set_price", "You do not have permission to set prices.")
+		if !ok {
+			return
+		}
+
+		priceID, err := strconv.ParseInt(r.FormValue("price"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid price ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.cancelPrice(username, book.ID, priceID); err != nil {
+			log.Printf("Error cancelling price: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/prices?id="+book.ID.String(), http.StatusSeeOther)
+	}
+}
+
+// APIBookPricesHandler returns the current, scheduled and past prices of a
+// book (GET) or adds a price (POST).
+func (h *Handlers) APIBookPricesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "view"
+		if r.Method == http.MethodPost {
+			action = "set_price"
+		}
+		username, book, ok := h.apiBook(w, r, action)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			var in priceInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			in.Currency = strings.ToUpper(strings.TrimSpace(in.Currency))
+
+			price, err := h.setPrice(username, book.ID, in)
+			if err != nil {
+				log.Printf("Error setting price: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusCreated, price)
+			return
+		}
+
+		prices, err := h.pricesOf(book)
+		if err != nil {
+			log.Printf("Error fetching prices: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching prices")
+			return
+		}
+		writeJSON(w, http.StatusOK, prices)
+	}
+}
+
+// APIBookPriceHandler cancels a scheduled price change.
+func (h *Handlers) APIBookPriceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, book, ok := h.apiBook(w, r, "set_price")
+		if !ok {
+			return
+		}
+
+		priceID, err := strconv.ParseInt(mux.Vars(r)["price"], 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid price ID")
+			return
+		}
+
+		if err := h.cancelPrice(username, book.ID, priceID); err != nil {
+			log.Printf("Error cancelling price: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPriceInputFromForm(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		want    priceInput
+		wantErr string
+	}{
+		{
+			name: "list price only",
+			form: url.Values{"currency": {" eur "}, "list_price": {"12.5"}},
+			want: priceInput{Currency: "EUR", ListPrice: 1250},
+		},
+		{
+			name: "sale price in a currency without decimals",
+			form: url.Values{"currency": {"JPY"}, "list_price": {"1500"}, "sale_price": {"1200"}},
+			want: priceInput{Currency: "JPY", ListPrice: 1500, SalePrice: ptr(int64(1200))},
+		},
+		{
+			name:    "too many decimals",
+			form:    url.Values{"currency": {"USD"}, "list_price": {"9.999"}},
+			wantErr: "invalid list price",
+		},
+		{
+			name:    "thousands separator",
+			form:    url.Values{"currency": {"USD"}, "list_price": {"10.00"}, "sale_price": {"1,000"}},
+			wantErr: "invalid sale price",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/books/prices", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			in, err := priceInputFromForm(r)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.Currency != tt.want.Currency || in.ListPrice != tt.want.ListPrice ||
+				(in.SalePrice == nil) != (tt.want.SalePrice == nil) || (in.SalePrice != nil && *in.SalePrice != *tt.want.SalePrice) {
+				t.Errorf("input = %+v, want %+v", in, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePriceInput(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name  string
+		in    priceInput
+		valid bool
+	}{
+		{"plain price", priceInput{Currency: "USD", ListPrice: 1250}, true},
+		{"free book", priceInput{Currency: "USD", ListPrice: 0}, true},
+		{"sale price", priceInput{Currency: "USD", ListPrice: 1250, SalePrice: ptr(int64(999))}, true},
+		{"sale price equal to list price", priceInput{Currency: "USD", ListPrice: 1250, SalePrice: ptr(int64(1250))}, true},
+		{"scheduled", priceInput{Currency: "USD", ListPrice: 1250, EffectiveAt: &future}, true},
+		{"lower case currency", priceInput{Currency: "usd", ListPrice: 1250}, false},
+		{"no currency", priceInput{ListPrice: 1250}, false},
+		{"negative list price", priceInput{Currency: "USD", ListPrice: -1}, false},
+		{"negative sale price", priceInput{Currency: "USD", ListPrice: 1250, SalePrice: ptr(int64(-1))}, false},
+		{"sale price above list price", priceInput{Currency: "USD", ListPrice: 1250, SalePrice: ptr(int64(1251))}, false},
+		{"in the past", priceInput{Currency: "USD", ListPrice: 1250, EffectiveAt: &past}, false},
+	}
+	for _, tt := range tests {
+		if err := validatePriceInput(tt.in); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
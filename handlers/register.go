@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"bookstore/mailer"
+	"bookstore/middleware"
+	"bookstore/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const verificationTTL = 24 * time.Hour
+
+// registration is the sign-up form, shared by the HTML page and the API.
+type registration struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// register creates an inactive account with the default role and mails the
+// verification link. The account is synced to Permit.io only once the link
+// has been followed.
+func (h *Handlers) register(ctx context.Context, reg registration) (*models.User, error) {
+	reg.Username = strings.TrimSpace(reg.Username)
+	reg.Email = strings.TrimSpace(reg.Email)
+
+	if reg.Username == "" {
+		return nil, validationError{"username is required"}
+	}
+	if _, err := mail.ParseAddress(reg.Email); err != nil {
+		return nil, validationError{"a valid email address is required"}
+	}
+	if err := validatePassword(reg.Password); err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username:  reg.Username,
+		Roles:     []string{models.DefaultRole},
+		Email:     reg.Email,
+		FirstName: strings.TrimSpace(reg.FirstName),
+		LastName:  strings.TrimSpace(reg.LastName),
+	}
+	if err := middleware.CreateUser(h.db, user, reg.Password); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, validationError{"username " + reg.Username + " is already taken"}
+		}
+		return nil, err
+	}
+
+	token, err := middleware.CreateEmailVerification(h.db, user.ID, verificationTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	link := h.baseURL + "/verify?token=" + url.QueryEscape(token)
+	err = h.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your Bookstore account",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address to activate your account:\n\n%s\n\nThe link expires in 24 hours.\n",
+			user.Username, link),
+	})
+	if err != nil {
+		// Remove the account so the user can simply try again.
+		if delErr := middleware.DeleteUser(h.db, user.ID); delErr != nil {
+			log.Printf("Error removing unverified user %s: %v\n", user.Username, delErr)
+		}
+		return nil, fmt.Errorf("error sending verification email: %v", err)
+	}
+
+	h.audit(user.Username, "user.register", user.ID, nil)
+	return user, nil
+}
+
+// renderMessage shows a simple page with a heading, a message and an
+// optional link.
+func renderMessage(w http.ResponseWriter, r *http.Request, status int, title, message, link, linkText string) {
+	w.WriteHeader(status)
+	data := struct {
+		Title, Message, Link, LinkText string
+	}{title, message, link, linkText}
+	if err := render(w, r, "message.html", data); err != nil {
+		log.Printf("Template execution error: %v\n", err)
+	}
+}
+
+func (h *Handlers) RegisterHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			reg := registration{
+				Username:  r.FormValue("username"),
+				Email:     r.FormValue("email"),
+				Password:  r.FormValue("password"),
+				FirstName: r.FormValue("first_name"),
+				LastName:  r.FormValue("last_name"),
+			}
+
+			_, err := h.register(r.Context(), reg)
+			if err == nil {
+				renderMessage(w, r, http.StatusOK, "Check your email",
+					"We sent a confirmation link to "+reg.Email+". Follow it to activate your account.",
+					"/login", "Back to Login")
+				return
+			}
+			if errorStatus(err) != http.StatusBadRequest {
+				log.Printf("Registration error: %v\n", err)
+				http.Error(w, "Error creating account", http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			if err := render(w, r, "register.html", struct {
+				Form  registration
+				Error string
+			}{reg, err.Error()}); err != nil {
+				log.Printf("Template execution error: %v\n", err)
+			}
+			return
+		}
+
+		if err := render(w, r, "register.html", nil); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying page", http.StatusInternalServerError)
+		}
+	}
+}
+
+func (h *Handlers) VerifyEmailHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := middleware.VerifyEmail(h.db, r.FormValue("token"))
+		if errors.Is(err, middleware.ErrInvalidToken) {
+			renderMessage(w, r, http.StatusBadRequest, "Link expired",
+				"This confirmation link is invalid or has already been used.", "/register", "Register again")
+			return
+		}
+		if err != nil {
+			log.Printf("Email verification error: %v\n", err)
+			http.Error(w, "Error verifying email", http.StatusInternalServerError)
+			return
+		}
+
+		user, err := middleware.GetUserByID(h.db, userID)
+		if err != nil {
+			log.Printf("Error loading verified user: %v\n", err)
+			http.Error(w, "Error verifying email", http.StatusInternalServerError)
+			return
+		}
+
+		h.syncPermitUser(user, nil)
+		h.audit(user.Username, "user.activate", user.ID, nil)
+
+		renderMessage(w, r, http.StatusOK, "Account activated",
+			"Your email address is confirmed. You can now log in.", "/login", "Log in")
+	}
+}
+
+func (h *Handlers) APIRegisterHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reg registration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		user, err := h.register(r.Context(), reg)
+		if err != nil {
+			log.Printf("Registration error: %v\n", err)
+			status := errorStatus(err)
+			msg := err.Error()
+			if status == http.StatusInternalServerError {
+				msg = "error creating account"
+			}
+			writeJSONError(w, status, msg)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, user)
+	}
+}
@@ -0,0 +1,710 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bookstore/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	permitModels "github.com/permitio/permit-golang/pkg/models"
+)
+
+// grantDurations are the lengths, in days, offered for time-bound grants.
+var grantDurations = []int{1, 7, 30, 90}
+
+var roleKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// mfaRequired reports whether any of the user's effective roles must use
+// two-factor authentication. When the roles cannot be resolved it assumes
+// they must.
+func (h *Handlers) mfaRequired(user *models.User) bool {
+	if len(h.mfaRequiredRoles) == 0 {
+		return false
+	}
+	roles, err := middleware.EffectiveRoles(h.db, user.Roles)
+	if err != nil {
+		log.Printf("Role lookup failed for user %s: %v\n", user.Username, err)
+		return true
+	}
+	for _, role := range roles {
+		if h.mfaRequiredRoles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoles returns a validationError naming any role that does not exist.
+func (h *Handlers) checkRoles(roles []string) error {
+	unknown, err := middleware.UnknownRoles(h.db, roles)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return validationError{"unknown role " + strings.Join(unknown, ", ")}
+	}
+	return nil
+}
+
+// permanentRoles lists the roles a user holds without an expiry.
+func (h *Handlers) permanentRoles(userID uuid.UUID) ([]string, error) {
+	grants, err := middleware.ListRoleGrants(h.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	roles := []string{}
+	for _, grant := range grants {
+		if grant.ExpiresAt == nil {
+			roles = append(roles, grant.Role)
+		}
+	}
+	return roles, nil
+}
+
+func sortedRoles(roles []string) []string {
+	sorted := append([]string{}, roles...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// grantRole gives a user a role until expiresAt, or for good if it is nil.
+func (h *Handlers) grantRole(actor string, userID uuid.UUID, role string, expiresAt *time.Time) error {
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return validationError{"expiry must be in the future"}
+	}
+	if err := h.checkRoles([]string{role}); err != nil {
+		return err
+	}
+
+	previousRoles, err := h.userEffectiveRoles(userID)
+	if err != nil {
+		return err
+	}
+	if err := middleware.GrantRole(h.db, userID, role, actor, expiresAt); err != nil {
+		return err
+	}
+	return h.roleGranted(actor, userID, role, expiresAt, previousRoles)
+}
+
+// userEffectiveRoles returns the roles a user holds, directly or through
+// role inheritance.
+func (h *Handlers) userEffectiveRoles(userID uuid.UUID) ([]string, error) {
+	user, err := middleware.GetUserByID(h.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.EffectiveRoles(h.db, user.Roles)
+}
+
+// roleGranted syncs a user to Permit.io and records the audit entry once
+// role has been granted to them. previousRoles are the effective roles they
+// held before.
+func (h *Handlers) roleGranted(actor string, userID uuid.UUID, role string, expiresAt *time.Time, previousRoles []string) error {
+	user, err := middleware.GetUserByID(h.db, userID)
+	if err != nil {
+		return err
+	}
+
+	h.syncPermitUser(user, previousRoles)
+	details := map[string]interface{}{"role": role}
+	if expiresAt != nil {
+		details["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+	h.audit(actor, "user.grant_role", userID, details)
+	return nil
+}
+
+// revokeRole takes a role away from a user.
+func (h *Handlers) revokeRole(actor string, userID uuid.UUID, role string) error {
+	user, err := middleware.GetUserByID(h.db, userID)
+	if err != nil {
+		return err
+	}
+	previousRoles, err := middleware.EffectiveRoles(h.db, user.Roles)
+	if err != nil {
+		return err
+	}
+
+	if err := middleware.RevokeRole(h.db, userID, role); err != nil {
+		return err
+	}
+	if user, err = middleware.GetUserByID(h.db, userID); err != nil {
+		return err
+	}
+
+	h.syncPermitUser(user, previousRoles)
+	h.audit(actor, "user.revoke_role", userID, map[string]interface{}{"role": role})
+	return nil
+}
+
+// ExpireGrants removes time-bound role and resource grants once they run
+// out, every interval until ctx is done. Expired grants stop counting as
+// soon as they expire; this cleans them up and takes the roles away in
+// Permit.io too.
+func (h *Handlers) ExpireGrants(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.expireRoleGrants()
+		h.expireResourceGrants()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handlers) expireRoleGrants() {
+	grants, err := middleware.ExpireRoleGrants(h.db)
+	if err != nil {
+		log.Printf("Error expiring role grants: %v\n", err)
+		return
+	}
+
+	expired := make(map[uuid.UUID][]string)
+	for _, grant := range grants {
+		expired[grant.UserID] = append(expired[grant.UserID], grant.Role)
+	}
+	for userID, roles := range expired {
+		h.audit("system", "user.expire_role", userID, map[string]interface{}{"roles": roles})
+
+		user, err := middleware.GetUserByID(h.db, userID)
+		if err != nil {
+			log.Printf("Error loading user %s after role expiry: %v\n", userID, err)
+			continue
+		}
+		previousRoles, err := middleware.EffectiveRoles(h.db, append(roles, user.Roles...))
+		if err != nil {
+			log.Printf("Error resolving roles of %s: %v\n", user.Username, err)
+			continue
+		}
+		h.syncPermitUser(user, previousRoles)
+	}
+}
+
+// roleInput is the set of role fields an admin may submit.
+type roleInput struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Extends     string `json:"extends"`
+}
+
+func roleInputFromForm(r *http.Request) roleInput {
+	return roleInput{
+		Key:         strings.TrimSpace(r.FormValue("key")),
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Extends:     strings.TrimSpace(r.FormValue("extends")),
+	}
+}
+
+func (h *Handlers) validateRoleInput(in roleInput) error {
+	if in.Name == "" {
+		return validationError{"name is required"}
+	}
+	if in.Extends != "" {
+		return h.checkRoles([]string{in.Extends})
+	}
+	return nil
+}
+
+// createRole stores a custom role and creates it in Permit.io so it can be
+// assigned there.
+func (h *Handlers) createRole(actor string, in roleInput) (*models.Role, error) {
+	if !roleKeyPattern.MatchString(in.Key) {
+		return nil, validationError{"key must be lower case letters, digits, - or _ and start with a letter"}
+	}
+	if err := h.validateRoleInput(in); err != nil {
+		return nil, err
+	}
+
+	role := &models.Role{Key: in.Key, Name: in.Name, Description: in.Description, Extends: in.Extends}
+	if err := middleware.CreateRole(h.db, role); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, validationError{"role " + in.Key + " already exists"}
+		}
+		return nil, err
+	}
+
+	h.syncPermitRole(role, true)
+	h.auditRole(actor, "role.create", role.Key, map[string]interface{}{
+		"name":    role.Name,
+		"extends": role.Extends,
+	})
+	return role, nil
+}
+
+// updateRole changes a role's name, description and parent.
+func (h *Handlers) updateRole(actor, key string, in roleInput) (*models.Role, error) {
+	role, err := middleware.GetRole(h.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.validateRoleInput(in); err != nil {
+		return nil, err
+	}
+
+	changes := map[string]interface{}{}
+	if in.Name != role.Name {
+		changes["name"] = in.Name
+	}
+	if in.Description != role.Description {
+		changes["description"] = in.Description
+	}
+	if in.Extends != role.Extends {
+		changes["extends"] = map[string]string{"from": role.Extends, "to": in.Extends}
+	}
+	if len(changes) == 0 {
+		return role, nil
+	}
+
+	// A new parent changes the effective roles of everyone holding the
+	// role, directly or through a role that extends it.
+	var holders []roleHolder
+	if in.Extends != role.Extends {
+		if holders, err = h.roleHolders(role.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	role.Name, role.Description, role.Extends = in.Name, in.Description, in.Extends
+	if err := middleware.UpdateRole(h.db, role); err != nil {
+		return nil, err
+	}
+
+	h.syncPermitRole(role, false)
+	h.resyncRoleHolders(holders)
+	h.auditRole(actor, "role.update", role.Key, changes)
+	return role, nil
+}
+
+// deleteRole removes a custom role and every grant of it.
+func (h *Handlers) deleteRole(actor, key string) error {
+	holders, err := h.roleHolders(key)
+	if err != nil {
+		return err
+	}
+	if err := middleware.DeleteRole(h.db, key); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return validationError{"role " + key + " is extended by other roles"}
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := h.permitClient.Api.Roles.Delete(ctx, key); err != nil {
+		log.Printf("Permit role delete failed for %s: %v\n", key, err)
+	}
+	h.resyncRoleHolders(holders)
+	h.auditRole(actor, "role.delete", key, nil)
+	return nil
+}
+
+// roleHolder is a user holding a role that is about to change, with the
+// effective roles they had before.
+type roleHolder struct {
+	userID        uuid.UUID
+	previousRoles []string
+}
+
+// roleHolders lists the users holding the role key, directly or through a
+// role that extends it, with their current effective roles.
+func (h *Handlers) roleHolders(key string) ([]roleHolder, error) {
+	users, err := middleware.ListUsersWithRole(h.db, key)
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]roleHolder, 0, len(users))
+	for _, user := range users {
+		previousRoles, err := middleware.EffectiveRoles(h.db, user.Roles)
+		if err != nil {
+			return nil, err
+		}
+		holders = append(holders, roleHolder{userID: user.ID, previousRoles: previousRoles})
+	}
+	return holders, nil
+}
+
+// resyncRoleHolders brings the Permit.io role assignments of holders in
+// line with their effective roles after a role changed.
+func (h *Handlers) resyncRoleHolders(holders []roleHolder) {
+	for _, holder := range holders {
+		user, err := middleware.GetUserByID(h.db, holder.userID)
+		if err != nil {
+			log.Printf("Error loading user %s after role change: %v\n", holder.userID, err)
+			continue
+		}
+		h.syncPermitUser(user, holder.previousRoles)
+	}
+}
+
+// syncPermitRole creates or updates the role in Permit.io. Users are
+// assigned their effective roles there, so the parent is not pushed; the
+// role's permissions come from the policy file.
+func (h *Handlers) syncPermitRole(role *models.Role, created bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var err error
+	if created {
+		create := permitModels.NewRoleCreate(role.Key, role.Name)
+		create.SetDescription(role.Description)
+		_, err = h.permitClient.Api.Roles.Create(ctx, *create)
+	} else {
+		update := permitModels.NewRoleUpdate()
+		update.SetName(role.Name)
+		update.SetDescription(role.Description)
+		_, err = h.permitClient.Api.Roles.Update(ctx, role.Key, *update)
+	}
+	if err != nil {
+		log.Printf("Permit role sync failed for %s: %v\n", role.Key, err)
+	}
+}
+
+func (h *Handlers) auditRole(actor, action, key string, details map[string]interface{}) {
+	if err := middleware.RecordAudit(h.db, actor, action, "role", key, details); err != nil {
+		log.Printf("Audit log error: %v\n", err)
+	}
+}
+
+// AdminRolesHandler lists roles (GET) or creates a custom one (POST).
+func (h *Handlers) AdminRolesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		var formError string
+		if r.Method == http.MethodPost {
+			_, err := h.createRole(actor, roleInputFromForm(r))
+			if err == nil {
+				http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+				return
+			}
+			if errorStatus(err) != http.StatusBadRequest {
+				log.Printf("Error creating role: %v\n", err)
+				http.Error(w, "Error creating role", http.StatusInternalServerError)
+				return
+			}
+			formError = err.Error()
+		}
+
+		roles, err := middleware.ListRoles(h.db)
+		if err != nil {
+			log.Printf("Error listing roles: %v\n", err)
+			http.Error(w, "Error fetching roles", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Roles []models.Role
+			Error string
+		}{
+			Roles: roles,
+			Error: formError,
+		}
+
+		if err := render(w, r, "admin_roles.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying roles", http.StatusInternalServerError)
+		}
+	}
+}
+
+// AdminEditRoleHandler shows (GET) or saves (POST) a role.
+func (h *Handlers) AdminEditRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		key := r.FormValue("key")
+		var formError string
+		if r.Method == http.MethodPost {
+			_, err := h.updateRole(actor, key, roleInputFromForm(r))
+			if err == nil {
+				http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+				return
+			}
+			if status := errorStatus(err); status != http.StatusBadRequest {
+				log.Printf("Error updating role: %v\n", err)
+				http.Error(w, "Error updating role", status)
+				return
+			}
+			formError = err.Error()
+		}
+
+		role, err := middleware.GetRole(h.db, key)
+		if err != nil {
+			log.Printf("Error fetching role for edit: %v\n", err)
+			http.Error(w, "Role not found", errorStatus(err))
+			return
+		}
+
+		roles, err := middleware.ListRoles(h.db)
+		if err != nil {
+			log.Printf("Error listing roles: %v\n", err)
+			http.Error(w, "Error fetching roles", http.StatusInternalServerError)
+			return
+		}
+
+		history, err := middleware.ListAuditEntries(h.db, "role", key, 20)
+		if err != nil {
+			log.Printf("Error fetching audit entries: %v\n", err)
+		}
+
+		data := struct {
+			Role    *models.Role
+			Roles   []models.Role
+			History []models.AuditEntry
+			Error   string
+		}{
+			Role:    role,
+			Roles:   roles,
+			History: history,
+			Error:   formError,
+		}
+
+		if err := render(w, r, "admin_role_edit.html", data); err != nil {
+			log.Printf("Template execution error: %v\n", err)
+			http.Error(w, "Error displaying role", http.StatusInternalServerError)
+		}
+	}
+}
+
+// AdminDeleteRoleHandler removes a custom role.
+func (h *Handlers) AdminDeleteRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		if err := h.deleteRole(actor, r.FormValue("key")); err != nil {
+			log.Printf("Error deleting role: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+	}
+}
+
+// AdminGrantRoleHandler grants a user a role, for good or for a number of
+// days.
+func (h *Handlers) AdminGrantRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		var expiresAt *time.Time
+		if days, err := strconv.Atoi(r.FormValue("days")); err == nil && days > 0 {
+			t := time.Now().AddDate(0, 0, days)
+			expiresAt = &t
+		}
+
+		if err := h.grantRole(actor, id, r.FormValue("role"), expiresAt); err != nil {
+			log.Printf("Error granting role: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/users/edit?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// AdminRevokeRoleHandler takes a role away from a user.
+func (h *Handlers) AdminRevokeRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.revokeRole(actor, id, r.FormValue("role")); err != nil {
+			log.Printf("Error revoking role: %v\n", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		http.Redirect(w, r, "/admin/users/edit?id="+id.String(), http.StatusSeeOther)
+	}
+}
+
+// APIRolesHandler lists roles (GET) or creates a custom one (POST).
+func (h *Handlers) APIRolesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			roles, err := middleware.ListRoles(h.db)
+			if err != nil {
+				log.Printf("Error listing roles: %v\n", err)
+				writeJSONError(w, http.StatusInternalServerError, "error fetching roles")
+				return
+			}
+			writeJSON(w, http.StatusOK, roles)
+			return
+		}
+
+		var in roleInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		role, err := h.createRole(actor, in)
+		if err != nil {
+			log.Printf("Error creating role: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, role)
+	}
+}
+
+// APIRoleHandler reads (GET), updates (PUT) or deletes (DELETE) a role.
+func (h *Handlers) APIRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		key := mux.Vars(r)["key"]
+		switch r.Method {
+		case http.MethodGet:
+			role, err := middleware.GetRole(h.db, key)
+			if err != nil {
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, role)
+
+		case http.MethodPut:
+			var in roleInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			role, err := h.updateRole(actor, key, in)
+			if err != nil {
+				log.Printf("Error updating role: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, role)
+
+		case http.MethodDelete:
+			if err := h.deleteRole(actor, key); err != nil {
+				log.Printf("Error deleting role: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// APIUserRolesHandler lists a user's role grants (GET) or grants a role
+// (POST), optionally until expires_at.
+func (h *Handlers) APIUserRolesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			var body struct {
+				Role      string     `json:"role"`
+				ExpiresAt *time.Time `json:"expires_at"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			if err := h.grantRole(actor, id, body.Role, body.ExpiresAt); err != nil {
+				log.Printf("Error granting role: %v\n", err)
+				writeJSONError(w, errorStatus(err), err.Error())
+				return
+			}
+		}
+
+		if _, err := middleware.GetUserByID(h.db, id); err != nil {
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		grants, err := middleware.ListRoleGrants(h.db, id)
+		if err != nil {
+			log.Printf("Error listing role grants: %v\n", err)
+			writeJSONError(w, http.StatusInternalServerError, "error fetching roles")
+			return
+		}
+		writeJSON(w, http.StatusOK, grants)
+	}
+}
+
+// APIUserRoleHandler revokes one of a user's roles.
+func (h *Handlers) APIUserRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := h.authorize(w, r, "manage", "users")
+		if !ok {
+			return
+		}
+
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+
+		if err := h.revokeRole(actor, id, mux.Vars(r)["role"]); err != nil {
+			log.Printf("Error revoking role: %v\n", err)
+			writeJSONError(w, errorStatus(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
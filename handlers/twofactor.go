@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"bookstore/middleware"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+const loginChallengeTTL = 5 * time.Minute
+
+// twoFactorPage is the data behind two_factor.html.
+type twoFactorPage struct {
+	Enabled       bool
+	Required      bool
+	QRCode        template.URL
+	Secret        string
+	RecoveryCodes []string
+	CodesLeft     int
+	Error         string
+}
+
+func (h *Handlers) renderTOTPStep(w http.ResponseWriter, r *http.Request, status int, challenge, formError string) {
+	w.WriteHeader(status)
+	data := struct {
+		Challenge string
+		Error     string
+	}{challenge, formError}
+	if err := render(w, r, "login_totp.html", data); err != nil {
+		log.Printf("Template execution error: %v\n", err)
+	}
+}
+
+// LoginTOTPHandler completes the second login step with a TOTP or recovery
+// code.
+func (h *Handlers) LoginTOTPHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		challenge := r.FormValue("challenge")
+
+		userID, err := middleware.AttemptLoginChallenge(h.db, challenge)
+		if errors.Is(err, middleware.ErrInvalidToken) {
+			renderMessage(w, r, http.StatusUnauthorized, "Login expired",
+				"Your login attempt has expired or had too many wrong codes. Please log in again.",
+				"/login", "Back to Login")
+			return
+		}
+		if err != nil {
+			log.Printf("Login challenge error: %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+
+		user, err := middleware.GetUserByID(h.db, userID)
+		if err != nil || user.Disabled || !user.Active {
+			http.Error(w, "Invalid login credentials", http.StatusUnauthorized)
+			return
+		}
+
+		// Wrong codes count against the account like wrong passwords, so
+		// starting fresh challenges does not give unlimited guesses.
+		ip := middleware.ClientIP(r)
+		wait, err := h.loginThrottle.RetryAfter(h.db, user.Username, ip)
+		if err != nil {
+			log.Printf("Login throttle lookup error: %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		ok, err := middleware.VerifySecondFactor(h.db, userID, r.FormValue("code"))
+		if err != nil {
+			h.releaseLogin(user.Username)
+			log.Printf("Second factor verification error: %v\n", err)
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			log.Printf("Invalid second factor for user %s from %s\n", user.Username, ip)
+			h.recordLoginFailure(user.Username, ip)
+			h.renderTOTPStep(w, r, http.StatusUnauthorized, challenge, "That code is not valid. Try again.")
+			return
+		}
+
+		if err := middleware.DeleteLoginChallenge(h.db, challenge); err != nil {
+			log.Printf("Login challenge delete error: %v\n", err)
+		}
+
+		h.completeLogin(w, r, user)
+	}
+}
+
+// TwoFactorHandler shows the enrolment page (GET) and confirms enrolment
+// with a first code (POST).
+func (h *Handlers) TwoFactorHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := h.sessionUser(r)
+		if err != nil {
+			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+			return
+		}
+
+		data := twoFactorPage{
+			Enabled:  user.TOTPEnabled,
+			Required: h.mfaRequired(user),
+		}
+
+		if r.Method == http.MethodPost && !user.TOTPEnabled {
+			codes, err := middleware.EnableTOTP(h.db, user.ID, r.FormValue("code"))
+			if err == nil {
+				h.audit(user.Username, "user.enable_2fa", user.ID, nil)
+				data.Enabled = true
+				data.RecoveryCodes = codes
+				h.renderTwoFactor(w, r, http.StatusOK, data)
+				return
+			}
+			if !errors.Is(err, middleware.ErrInvalidToken) {
+				log.Printf("Two-factor enable error: %v\n", err)
+				http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			data.Error = "That code is not valid. Scan the new QR code and try again."
+		}
+
+		if data.Enabled {
+			if data.CodesLeft, err = middleware.CountRecoveryCodes(h.db, user.ID); err != nil {
+				log.Printf("Recovery code count error: %v\n", err)
+			}
+			h.renderTwoFactor(w, r, http.StatusOK, data)
+			return
+		}
+
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      "Bookstore",
+			AccountName: user.Username,
+		})
+		if err != nil {
+			log.Printf("TOTP key generation error: %v\n", err)
+			http.Error(w, "Error starting enrolment", http.StatusInternalServerError)
+			return
+		}
+		if err := middleware.SetPendingTOTPSecret(h.db, user.ID, key.Secret()); err != nil {
+			log.Printf("TOTP secret store error: %v\n", err)
+			http.Error(w, "Error starting enrolment", http.StatusInternalServerError)
+			return
+		}
+
+		img, err := key.Image(200, 200)
+		if err != nil {
+			log.Printf("QR code generation error: %v\n", err)
+			http.Error(w, "Error starting enrolment", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			log.Printf("QR code encode error: %v\n", err)
+			http.Error(w, "Error starting enrolment", http.StatusInternalServerError)
+			return
+		}
+
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()))
+		data.Secret = key.Secret()
+
+		status := http.StatusOK
+		if data.Error != "" {
+			status = http.StatusBadRequest
+		}
+		h.renderTwoFactor(w, r, status, data)
+	}
+}
+
+// TwoFactorDisableHandler turns two-factor authentication off after checking
+// a current code. Users whose role requires it cannot turn it off.
+func (h *Handlers) TwoFactorDisableHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := h.sessionUser(r)
+		if err != nil {
+			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+			return
+		}
+
+		if h.mfaRequired(user) {
+			http.Error(w, "Two-factor authentication is required for your role", http.StatusForbidden)
+			return
+		}
+
+		ok, err := middleware.VerifySecondFactor(h.db, user.ID, r.FormValue("code"))
+		if err != nil {
+			log.Printf("Second factor verification error: %v\n", err)
+			http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		if err := middleware.DisableTOTP(h.db, user.ID); err != nil {
+			log.Printf("Two-factor disable error: %v\n", err)
+			http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		h.audit(user.Username, "user.disable_2fa", user.ID, nil)
+
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+	}
+}
+
+// RecoveryCodesHandler replaces the user's recovery codes after checking a
+// current code.
+func (h *Handlers) RecoveryCodesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := h.sessionUser(r)
+		if err != nil || !user.TOTPEnabled {
+			http.Error(w, "Unauthorized access: no username found", http.StatusUnauthorized)
+			return
+		}
+
+		ok, err := middleware.VerifySecondFactor(h.db, user.ID, r.FormValue("code"))
+		if err != nil {
+			log.Printf("Second factor verification error: %v\n", err)
+			http.Error(w, "Error regenerating recovery codes", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := middleware.RegenerateRecoveryCodes(h.db, user.ID)
+		if err != nil {
+			log.Printf("Recovery code regeneration error: %v\n", err)
+			http.Error(w, "Error regenerating recovery codes", http.StatusInternalServerError)
+			return
+		}
+		h.audit(user.Username, "user.regenerate_recovery_codes", user.ID, nil)
+
+		h.renderTwoFactor(w, r, http.StatusOK, twoFactorPage{
+			Enabled:       true,
+			Required:      h.mfaRequired(user),
+			RecoveryCodes: codes,
+		})
+	}
+}
+
+func (h *Handlers) renderTwoFactor(w http.ResponseWriter, r *http.Request, status int, data twoFactorPage) {
+	w.WriteHeader(status)
+	if err := render(w, r, "two_factor.html", data); err != nil {
+		log.Printf("Template execution error: %v\n", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Package isbn validates, normalizes and converts ISBN-10 and ISBN-13
+// identifiers, and looks up book metadata by ISBN through the Provider
+// interface.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalid is returned for strings that are not a well-formed ISBN with
+// a correct check digit.
+var ErrInvalid = errors.New("invalid ISBN")
+
+// ErrNoISBN10 is returned when converting an ISBN-13 with the 979 prefix,
+// which has no ISBN-10 form.
+var ErrNoISBN10 = errors.New("ISBN has no ISBN-10 form")
+
+// clean strips an optional "ISBN", "ISBN-10:" or "ISBN-13:" label and the
+// hyphens and spaces ISBNs are usually printed with. It does not check
+// what is left.
+func clean(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 4 && strings.EqualFold(s[:4], "ISBN") {
+		s = strings.TrimPrefix(strings.TrimPrefix(s[4:], "-10"), "-13")
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "-10"), "-13")
+		s = strings.TrimPrefix(strings.TrimSpace(s), ":")
+	}
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+}
+
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// check10 computes the ISBN-10 check character for the first nine digits.
+func check10(first9 string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(first9[i]-'0')
+	}
+	switch c := (11 - sum%11) % 11; c {
+	case 10:
+		return 'X'
+	default:
+		return byte('0' + c)
+	}
+}
+
+// check13 computes the ISBN-13 check digit for the first twelve digits.
+func check13(first12 string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(first12[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// Valid10 reports whether s, after cleaning, is an ISBN-10 with a correct
+// check character.
+func Valid10(s string) bool {
+	s = clean(s)
+	return len(s) == 10 && digits(s[:9]) && s[9] == check10(s[:9])
+}
+
+// Valid13 reports whether s, after cleaning, is an ISBN-13 with the 978 or
+// 979 prefix and a correct check digit.
+func Valid13(s string) bool {
+	s = clean(s)
+	return len(s) == 13 && digits(s) && (s[:3] == "978" || s[:3] == "979") && s[12] == check13(s[:12])
+}
+
+// Normalize accepts either form, with or without hyphens, and returns the
+// bare ISBN-13, the form books are stored and compared in.
+func Normalize(s string) (string, error) {
+	switch c := clean(s); {
+	case Valid13(c):
+		return c, nil
+	case Valid10(c):
+		return To13(c)
+	default:
+		return "", ErrInvalid
+	}
+}
+
+// To13 converts an ISBN-10 to its ISBN-13 form.
+func To13(isbn10 string) (string, error) {
+	s := clean(isbn10)
+	if !Valid10(s) {
+		return "", ErrInvalid
+	}
+	first12 := "978" + s[:9]
+	return first12 + string(check13(first12)), nil
+}
+
+// To10 converts an ISBN-13 to its ISBN-10 form. Only 978 ISBNs have one.
+func To10(isbn13 string) (string, error) {
+	s := clean(isbn13)
+	if !Valid13(s) {
+		return "", ErrInvalid
+	}
+	if s[:3] != "978" {
+		return "", ErrNoISBN10
+	}
+	return s[3:12] + string(check10(s[3:12])), nil
+}
@@ -0,0 +1,93 @@
+package isbn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		in      string
+		valid10 bool
+		valid13 bool
+	}{
+		{"0306406152", true, false},
+		{"0-306-40615-2", true, false},
+		{"080442957X", true, false},
+		{"080442957x", true, false},
+		{"ISBN 0-8044-2957-X", true, false},
+		{"ISBN-10: 0 8044 2957 X", true, false},
+		{"0306406153", false, false},
+		{"X306406152", false, false},
+		{"03064061X2", false, false},
+		{"030640615", false, false},
+		{"9780306406157", false, true},
+		{"978-0-306-40615-7", false, true},
+		{"ISBN-13: 978-0-306-40615-7", false, true},
+		{"isbn 9780306406157", false, true},
+		{"979-10-90636-07-1", false, true},
+		{"9780306406158", false, false},
+		{"9770306406154", false, false},
+		{"978030640615X", false, false},
+		{"97803064061570", false, false},
+		{"", false, false},
+		{"ISBN", false, false},
+	}
+	for _, tt := range tests {
+		if got := Valid10(tt.in); got != tt.valid10 {
+			t.Errorf("Valid10(%q) = %t, want %t", tt.in, got, tt.valid10)
+		}
+		if got := Valid13(tt.in); got != tt.valid13 {
+			t.Errorf("Valid13(%q) = %t, want %t", tt.in, got, tt.valid13)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{"0-306-40615-2", "9780306406157", nil},
+		{"080442957X", "9780804429573", nil},
+		{"316148410X", "9783161484100", nil},
+		{" 978-0-306-40615-7 ", "9780306406157", nil},
+		{"ISBN-13: 979-10-90636-07-1", "9791090636071", nil},
+		{"0-306-40615-3", "", ErrInvalid},
+		{"978-0-306-40615-8", "", ErrInvalid},
+		{"not an isbn", "", ErrInvalid},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.in)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Normalize(%q) = %q, %v; want %q, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	pairs := []struct{ isbn10, isbn13 string }{
+		{"0306406152", "9780306406157"},
+		{"080442957X", "9780804429573"},
+		{"316148410X", "9783161484100"},
+	}
+	for _, p := range pairs {
+		if got, err := To13(p.isbn10); got != p.isbn13 || err != nil {
+			t.Errorf("To13(%q) = %q, %v; want %q", p.isbn10, got, err, p.isbn13)
+		}
+		if got, err := To10(p.isbn13); got != p.isbn10 || err != nil {
+			t.Errorf("To10(%q) = %q, %v; want %q", p.isbn13, got, err, p.isbn10)
+		}
+	}
+
+	if _, err := To10("9791090636071"); !errors.Is(err, ErrNoISBN10) {
+		t.Errorf("To10 of a 979 ISBN: error = %v, want %v", err, ErrNoISBN10)
+	}
+	if _, err := To10("0306406152"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("To10 of an ISBN-10: error = %v, want %v", err, ErrInvalid)
+	}
+	if _, err := To13("0306406153"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("To13 with a bad check digit: error = %v, want %v", err, ErrInvalid)
+	}
+}
@@ -0,0 +1,53 @@
+package isbn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNotFound is returned by a Provider that has no record of an ISBN.
+var ErrNotFound = errors.New("no metadata found for ISBN")
+
+// Metadata is what a Provider knows about a book, in the shape the add
+// form needs: Published is a YYYY-MM-DD date or empty.
+type Metadata struct {
+	ISBN      string   `json:"isbn"`
+	Title     string   `json:"title"`
+	Authors   []string `json:"authors"`
+	Published string   `json:"published,omitempty"`
+	Genre     string   `json:"genre,omitempty"`
+}
+
+// Provider looks up book metadata by ISBN to prefill the add form.
+type Provider interface {
+	// Name identifies the provider in logs and API responses.
+	Name() string
+	// Lookup returns the metadata for a normalized ISBN-13, or
+	// ErrNotFound.
+	Lookup(ctx context.Context, isbn13 string) (*Metadata, error)
+}
+
+// FromEnv picks a provider based on ISBN_LOOKUP_PROVIDER. Lookup is off
+// unless it is set: "fixture" reads the JSON file named by
+// ISBN_LOOKUP_FIXTURES, or the built-in fixtures when that is empty.
+func FromEnv() (Provider, error) {
+	switch name := os.Getenv("ISBN_LOOKUP_PROVIDER"); name {
+	case "", "none":
+		return nil, nil
+	case "fixture":
+		path := os.Getenv("ISBN_LOOKUP_FIXTURES")
+		if path == "" {
+			return DefaultFixture(), nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return NewFixture(f)
+	default:
+		return nil, fmt.Errorf("unknown ISBN lookup provider %q", name)
+	}
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"bookstore/authz"
 	"bookstore/handlers"
+	"bookstore/isbn"
+	"bookstore/mailer"
+	"bookstore/middleware"
+	"bookstore/migrations"
+	"bookstore/payments"
+	"bookstore/policy"
+	"bookstore/server"
+	"bookstore/sso"
+	"bookstore/storage"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -27,6 +41,68 @@ func connectDB() *sql.DB {
 	return db
 }
 
+// splitList parses a comma-separated environment value, ignoring blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envOr returns the environment variable name, or fallback if it is unset.
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// newAuthorizer builds the authorization backend called name: "permit" for
+// the Permit.io PDP or "local" for the policy file, which is reloaded when
+// it changes.
+func newAuthorizer(name, policyFile, permitApiKey string) (authz.Authorizer, error) {
+	switch name {
+	case "permit":
+		return authz.NewPermitFromKey(permitApiKey, authz.DefaultPDPURL), nil
+	case "local":
+		engine, err := policy.NewEngine(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := engine.Watch(context.Background()); err != nil {
+				log.Printf("Policy reloading disabled for %s: %v\n", policyFile, err)
+			}
+		}()
+		return engine, nil
+	}
+	return nil, fmt.Errorf("unknown authorization backend %q", name)
+}
+
+// loginThrottleFromEnv applies LOCKOUT_THRESHOLD and LOCKOUT_DURATION on top
+// of the default login throttle settings.
+func loginThrottleFromEnv() *middleware.LoginThrottle {
+	throttle := middleware.DefaultLoginThrottle()
+	if v := os.Getenv("LOCKOUT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid LOCKOUT_THRESHOLD %q", v)
+		}
+		throttle.AccountThreshold = n
+	}
+	if v := os.Getenv("LOCKOUT_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid LOCKOUT_DURATION %q: %v", v, err)
+		}
+		throttle.LockoutDuration = d
+	}
+	return throttle
+}
+
 func main() {
 	// Load environment variables from .env file
 
@@ -44,20 +120,221 @@ func main() {
 	db := connectDB()
 	defer db.Close()
 
+	if err := migrations.Apply(db); err != nil {
+		log.Fatal("Error applying migrations:", err)
+	}
+
+	tlsConfig, err := server.TLSConfigFromEnv()
+	if err != nil {
+		log.Fatal("Error reading TLS settings:", err)
+	}
+
 	r := mux.NewRouter()
 
 	// Create handlers with the API key
-	h := handlers.NewHandlers(db, permitApiKey)
+	baseURL := os.Getenv("APP_BASE_URL")
+
+	var ssoProvider *sso.Provider
+	if ssoConfig := sso.ConfigFromEnv(baseURL); ssoConfig != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		ssoProvider, err = sso.New(ctx, *ssoConfig)
+		cancel()
+		if err != nil {
+			log.Fatal("Error initializing OIDC login:", err)
+		}
+	}
+
+	// AUTHZ_BACKEND=local evaluates policy.yaml (or POLICY_FILE) in-process
+	// instead of asking the Permit.io PDP. AUTHZ_SHADOW names a second
+	// backend that is asked too but only logged, to compare a new policy
+	// with the live one; a local shadow reads AUTHZ_SHADOW_POLICY_FILE.
+	authorizer, err := newAuthorizer(envOr("AUTHZ_BACKEND", "permit"), envOr("POLICY_FILE", "policy.yaml"), permitApiKey)
+	if err != nil {
+		log.Fatal("Error setting up authorization:", err)
+	}
+	if shadow := os.Getenv("AUTHZ_SHADOW"); shadow != "" {
+		secondary, err := newAuthorizer(shadow, envOr("AUTHZ_SHADOW_POLICY_FILE", envOr("POLICY_FILE", "policy.yaml")), permitApiKey)
+		if err != nil {
+			log.Fatal("Error setting up shadow authorization:", err)
+		}
+		authorizer = authz.NewShadow(authorizer, envOr("AUTHZ_BACKEND", "permit"), secondary, shadow, func(m authz.Mismatch) {
+			if err := middleware.RecordAuthzMismatch(db, m); err != nil {
+				log.Printf("Error recording authorization mismatch: %v\n", err)
+			}
+		})
+	}
+
+	// PAYMENT_PROVIDER picks the payment gateway; PAYMENT_PROVIDER=fake
+	// verifies webhooks signed with PAYMENT_WEBHOOK_SECRET.
+	paymentProvider, err := payments.FromEnv()
+	if err != nil {
+		log.Fatal("Error setting up payments:", err)
+	}
+	if paymentProvider.Name() == "fake" {
+		log.Println("WARNING: using the fake payment gateway; orders are marked paid without taking any money")
+	}
+
+	// ISBN_LOOKUP_PROVIDER=fixture prefills the add form from offline
+	// fixtures; lookup is off by default.
+	isbnLookup, err := isbn.FromEnv()
+	if err != nil {
+		log.Fatal("Error setting up ISBN lookup:", err)
+	}
+
+	// BLOB_STORE_DIR is where cover images are kept; see storage.FromEnv.
+	blobs, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Error setting up blob storage:", err)
+	}
+
+	h := handlers.NewHandlers(db, permitApiKey, handlers.Options{
+		Mailer:  mailer.FromEnv(),
+		BaseURL: baseURL,
+		// Comma-separated, e.g. MFA_REQUIRED_ROLES=admin
+		MFARequiredRoles: splitList(os.Getenv("MFA_REQUIRED_ROLES")),
+		LoginThrottle:    loginThrottleFromEnv(),
+		SSO:              ssoProvider,
+		Authorizer:       authorizer,
+		Payments:         paymentProvider,
+		ISBNLookup:       isbnLookup,
+		Blobs:            blobs,
+	})
+
+	// Time-bound role grants and approved access requests stop counting the
+	// moment they expire; this deletes them and takes the roles away in
+	// Permit.io as well.
+	go h.ExpireGrants(context.Background(), time.Minute)
+
+	// Refunds recorded with an order but not yet taken by the payment
+	// provider are retried until they go through.
+	go h.RetryRefunds(context.Background(), time.Minute)
+
+	// Bearer API tokens authenticate any route; browsers keep using cookies.
+	// Cookie-authenticated unsafe requests must carry the CSRF token, either
+	// in the csrf_token form field or the X-CSRF-Token header. Anonymous
+	// JSON registration has no session to ride on and is exempt, as are
+	// payment webhooks, which are signed by the provider instead. Bodies are
+	// capped before any of that reads them; catalogue imports may be larger.
+	importLimits := map[string]int64{"/import": handlers.MaxImportBody, "/api/books/import": handlers.MaxImportBody}
+	r.Use(handlers.LimitRequestBody(handlers.MaxRequestBody, importLimits), handlers.SecurityHeaders(handlers.DefaultSecurityPolicy()),
+		h.Authenticate, h.CSRF("/api/register", "/webhooks/payments"))
+
+	// With a client CA configured, the JSON API is only reachable by callers
+	// holding a certificate it signed.
+	if tlsConfig != nil && tlsConfig.ClientCAFile != "" {
+		r.Use(server.RequireClientCert("/api/"))
+	}
+
+	// Pages whose URLs carry one-time tokens must not leak them in the
+	// Referer header.
+	noReferrer := handlers.DefaultSecurityPolicy()
+	noReferrer.ReferrerPolicy = "no-referrer"
+
+	// Vendored CSS and other assets; see cmd/vendorassets
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static", handlers.StaticHandler("static")))
 
 	// Register routes
 	r.HandleFunc("/login", h.LoginHandler()).Methods("GET", "POST")
+	r.HandleFunc("/login/oidc", h.OIDCLoginHandler()).Methods("GET")
+	r.Handle("/login/oidc/callback", handlers.WithSecurityPolicy(noReferrer, h.OIDCCallbackHandler())).Methods("GET")
+	r.HandleFunc("/login/totp", h.LoginTOTPHandler()).Methods("POST")
+	r.HandleFunc("/account/2fa", h.TwoFactorHandler()).Methods("GET", "POST")
+	r.HandleFunc("/account/2fa/disable", h.TwoFactorDisableHandler()).Methods("POST")
+	r.HandleFunc("/account/2fa/recovery-codes", h.RecoveryCodesHandler()).Methods("POST")
+	r.HandleFunc("/account/tokens", h.APITokensHandler()).Methods("GET", "POST")
+	r.HandleFunc("/account/tokens/revoke", h.RevokeAPITokenHandler()).Methods("POST")
+	r.HandleFunc("/logout", h.LogoutHandler()).Methods("POST")
+	r.HandleFunc("/forgot-password", h.ForgotPasswordHandler()).Methods("GET", "POST")
+	r.Handle("/reset-password", handlers.WithSecurityPolicy(noReferrer, h.ResetPasswordHandler())).Methods("GET", "POST")
+	r.HandleFunc("/register", h.RegisterHandler()).Methods("GET", "POST")
+	r.Handle("/verify", handlers.WithSecurityPolicy(noReferrer, h.VerifyEmailHandler())).Methods("GET")
 	r.HandleFunc("/books", h.BooksHandler()).Methods("GET")
+	r.HandleFunc("/book", h.BookHandler()).Methods("GET")
 	r.HandleFunc("/add", h.AddBookHandler()).Methods("GET", "POST")
 	r.HandleFunc("/delete", h.DeleteBookHandler()).Methods("POST")
 	r.HandleFunc("/update", h.UpdateBookHandler()).Methods("GET", "POST")
+	r.HandleFunc("/covers/{id}/{size}", h.CoverHandler()).Methods("GET")
+	r.HandleFunc("/import", h.ImportHandler()).Methods("GET", "POST")
+	r.HandleFunc("/stock", h.StockHandler()).Methods("GET")
+	r.HandleFunc("/stock/book", h.StockBookHandler()).Methods("GET")
+	r.HandleFunc("/stock/adjust", h.StockAdjustHandler()).Methods("POST")
+	r.HandleFunc("/stock/threshold", h.StockThresholdHandler()).Methods("POST")
+	r.HandleFunc("/prices", h.PricesHandler()).Methods("GET")
+	r.HandleFunc("/prices/set", h.SetPriceHandler()).Methods("POST")
+	r.HandleFunc("/prices/cancel", h.CancelPriceHandler()).Methods("POST")
+	r.HandleFunc("/authors", h.AuthorsHandler()).Methods("GET", "POST")
+	r.HandleFunc("/authors/view", h.AuthorHandler()).Methods("GET")
+	r.HandleFunc("/authors/edit", h.EditAuthorHandler()).Methods("POST")
+	r.HandleFunc("/authors/merge", h.MergeAuthorsHandler()).Methods("GET", "POST")
+	r.HandleFunc("/categories", h.CategoriesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/categories/edit", h.EditCategoryHandler()).Methods("GET", "POST")
+	r.HandleFunc("/categories/delete", h.DeleteCategoryHandler()).Methods("POST")
+	r.HandleFunc("/cart", h.CartHandler()).Methods("GET", "POST")
+	r.HandleFunc("/checkout", h.CheckoutHandler()).Methods("POST")
+	r.HandleFunc("/orders", h.OrdersHandler()).Methods("GET")
+	r.HandleFunc("/orders/view", h.OrderHandler()).Methods("GET")
+	r.HandleFunc("/orders/transition", h.OrderTransitionHandler()).Methods("POST")
+	r.HandleFunc("/orders/pay", h.PayOrderHandler()).Methods("POST")
+	r.HandleFunc("/orders/manage", h.ManageOrdersHandler()).Methods("GET")
+	r.HandleFunc("/access-requests", h.AccessRequestsHandler()).Methods("GET", "POST")
+
+	// Admin user management
+	r.HandleFunc("/admin/users", h.AdminUsersHandler()).Methods("GET", "POST")
+	r.HandleFunc("/admin/users/edit", h.AdminEditUserHandler()).Methods("GET", "POST")
+	r.HandleFunc("/admin/users/disable", h.AdminDisableUserHandler()).Methods("POST")
+	r.HandleFunc("/admin/users/delete", h.AdminDeleteUserHandler()).Methods("POST")
+	r.HandleFunc("/admin/users/password", h.AdminResetPasswordHandler()).Methods("POST")
+	r.HandleFunc("/admin/users/2fa", h.AdminResetTwoFactorHandler()).Methods("POST")
+	r.HandleFunc("/admin/users/unlock", h.AdminUnlockUserHandler()).Methods("POST")
+	r.HandleFunc("/admin/users/roles", h.AdminGrantRoleHandler()).Methods("POST")
+	r.HandleFunc("/admin/users/roles/revoke", h.AdminRevokeRoleHandler()).Methods("POST")
+	r.HandleFunc("/admin/roles", h.AdminRolesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/admin/roles/edit", h.AdminEditRoleHandler()).Methods("GET", "POST")
+	r.HandleFunc("/admin/roles/delete", h.AdminDeleteRoleHandler()).Methods("POST")
+	r.HandleFunc("/admin/access-requests", h.AdminAccessRequestsHandler()).Methods("GET")
+	r.HandleFunc("/admin/access-requests/decide", h.AdminDecideAccessRequestHandler()).Methods("POST")
+	r.HandleFunc("/admin/authz/explain", h.AdminExplainHandler()).Methods("GET")
+	r.HandleFunc("/admin/authz/mismatches", h.AdminMismatchesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/register", h.APIRegisterHandler()).Methods("POST")
+	r.HandleFunc("/api/users", h.APIUsersHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/users/{id}", h.APIUserHandler()).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/api/users/{id}/password", h.APIUserPasswordHandler()).Methods("POST")
+	r.HandleFunc("/api/users/{id}/unlock", h.APIUserUnlockHandler()).Methods("POST")
+	r.HandleFunc("/api/users/{id}/roles", h.APIUserRolesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/users/{id}/roles/{role}", h.APIUserRoleHandler()).Methods("DELETE")
+	r.HandleFunc("/api/roles", h.APIRolesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/roles/{key}", h.APIRoleHandler()).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/api/books/{id}/stock", h.APIBookStockHandler()).Methods("GET", "PUT")
+	r.HandleFunc("/api/books/{id}/stock/movements", h.APIBookStockMovementsHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/books/{id}/prices", h.APIBookPricesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/books/{id}/prices/{price}", h.APIBookPriceHandler()).Methods("DELETE")
+	r.HandleFunc("/api/books/{id}/authors", h.APIBookAuthorsHandler()).Methods("GET", "PUT")
+	r.HandleFunc("/api/authors", h.APIAuthorsHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/authors/{id}", h.APIAuthorHandler()).Methods("GET", "PUT")
+	r.HandleFunc("/api/authors/{id}/merge", h.APIAuthorMergeHandler()).Methods("POST")
+	r.HandleFunc("/api/isbn/{isbn}", h.APIISBNHandler()).Methods("GET")
+	r.HandleFunc("/api/books/import", h.APIImportHandler()).Methods("POST")
+	r.HandleFunc("/api/books/{id}/cover", h.APIBookCoverHandler()).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/api/books/{id}/classification", h.APIBookClassificationHandler()).Methods("GET", "PUT")
+	r.HandleFunc("/api/categories", h.APICategoriesHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/categories/{id}", h.APICategoryHandler()).Methods("PUT", "DELETE")
+	r.HandleFunc("/api/cart", h.APICartHandler()).Methods("GET", "PUT")
+	r.HandleFunc("/api/orders", h.APIOrdersHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/orders/{id}", h.APIOrderHandler()).Methods("GET")
+	r.HandleFunc("/api/orders/{id}/transitions", h.APIOrderTransitionsHandler()).Methods("POST")
+	r.HandleFunc("/api/orders/{id}/payments", h.APIOrderPaymentsHandler()).Methods("GET", "POST")
+	r.HandleFunc("/webhooks/payments", h.PaymentWebhookHandler()).Methods("POST")
+	r.HandleFunc("/api/access-requests", h.APIAccessRequestsHandler()).Methods("GET", "POST")
+	r.HandleFunc("/api/access-requests/{id}/decision", h.APIAccessRequestDecisionHandler()).Methods("POST")
+	r.HandleFunc("/api/authz/explain", h.APIExplainHandler()).Methods("GET")
+	r.HandleFunc("/api/authz/mismatches", h.APIMismatchesHandler()).Methods("GET")
 
-	fmt.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal(err)
+	if tlsConfig == nil {
+		fmt.Println("Server starting on :8080")
+		if err := http.ListenAndServe(":8080", r); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
+	log.Fatal(server.ListenAndServeTLS(tlsConfig, r))
 }
@@ -0,0 +1,227 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrAccessRequestNotFound is returned when no request matches the ID.
+	ErrAccessRequestNotFound = errors.New("access request not found")
+	// ErrAccessRequestDecided is returned when deciding a request twice.
+	ErrAccessRequestDecided = errors.New("access request was already decided")
+)
+
+const accessRequestColumns = `r.id, r.user_id, u.username, r.action, r.resource_type, r.resource_key,
+	r.justification, r.status, r.decided_by, r.decided_at, r.note, r.granted_role, r.expires_at, r.created_at`
+
+func scanAccessRequest(row interface{ Scan(...interface{}) error }) (*models.AccessRequest, error) {
+	var req models.AccessRequest
+	var decidedAt, expiresAt sql.NullTime
+	err := row.Scan(
+		&req.ID,
+		&req.UserID,
+		&req.Username,
+		&req.Action,
+		&req.ResourceType,
+		&req.ResourceKey,
+		&req.Justification,
+		&req.Status,
+		&req.DecidedBy,
+		&decidedAt,
+		&req.Note,
+		&req.GrantedRole,
+		&expiresAt,
+		&req.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if decidedAt.Valid {
+		req.DecidedAt = &decidedAt.Time
+	}
+	if expiresAt.Valid {
+		req.ExpiresAt = &expiresAt.Time
+	}
+	return &req, nil
+}
+
+func queryAccessRequests(db *sql.DB, where string, args ...interface{}) ([]models.AccessRequest, error) {
+	rows, err := db.Query(`
+		SELECT `+accessRequestColumns+`
+		FROM access_requests r JOIN users u ON u.id = r.user_id
+		`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []models.AccessRequest
+	for rows.Next() {
+		req, err := scanAccessRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *req)
+	}
+	return requests, rows.Err()
+}
+
+// CreateAccessRequest files a pending request
+func CreateAccessRequest(db *sql.DB, req *models.AccessRequest) error {
+	req.ID = uuid.New()
+	req.Status = models.AccessRequestPending
+	return db.QueryRow(`
+		INSERT INTO access_requests (id, user_id, action, resource_type, resource_key, justification)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at
+	`, req.ID, req.UserID, req.Action, req.ResourceType, req.ResourceKey, req.Justification).Scan(&req.CreatedAt)
+}
+
+// GetAccessRequest retrieves a single request by ID
+func GetAccessRequest(db *sql.DB, id uuid.UUID) (*models.AccessRequest, error) {
+	requests, err := queryAccessRequests(db, "WHERE r.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, ErrAccessRequestNotFound
+	}
+	return &requests[0], nil
+}
+
+// ListAccessRequests retrieves the latest requests, pending ones first
+func ListAccessRequests(db *sql.DB, limit int) ([]models.AccessRequest, error) {
+	return queryAccessRequests(db, `
+		ORDER BY r.status = 'pending' DESC, r.created_at DESC
+		LIMIT $1
+	`, limit)
+}
+
+// ListUserAccessRequests retrieves the latest requests filed by a user
+func ListUserAccessRequests(db *sql.DB, userID uuid.UUID, limit int) ([]models.AccessRequest, error) {
+	return queryAccessRequests(db, `
+		WHERE r.user_id = $1
+		ORDER BY r.created_at DESC
+		LIMIT $2
+	`, userID, limit)
+}
+
+// DecideAccessRequest records the outcome of a pending request and calls
+// grant, if not nil, once the request is claimed. grant writes the access
+// through the transaction it is given, so the access and the decision are
+// committed together: the access is granted at most once, and neither is
+// kept if either fails.
+func DecideAccessRequest(db *sql.DB, req *models.AccessRequest, grant func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		UPDATE access_requests
+		SET status = $1, decided_by = $2, decided_at = NOW(), note = $3, granted_role = $4, expires_at = $5
+		WHERE id = $6 AND status = 'pending'
+		RETURNING decided_at
+	`, req.Status, req.DecidedBy, req.Note, req.GrantedRole, req.ExpiresAt, req.ID).Scan(&req.DecidedAt)
+	if err == sql.ErrNoRows {
+		return ErrAccessRequestDecided
+	}
+	if err != nil {
+		return err
+	}
+	if grant != nil {
+		if err := grant(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateResourceGrant stores a per-resource permission
+func CreateResourceGrant(db Queryer, grant *models.ResourceGrant) error {
+	return db.QueryRow(`
+		INSERT INTO resource_grants (user_id, action, resource_type, resource_key, request_id, granted_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`,
+		grant.UserID,
+		grant.Action,
+		grant.ResourceType,
+		grant.ResourceKey,
+		grant.RequestID,
+		grant.GrantedBy,
+		grant.ExpiresAt,
+	).Scan(&grant.ID, &grant.CreatedAt)
+}
+
+// GrantedResourceKeys returns the keys of the resourceType resources
+// username holds an unexpired grant for action on. An empty key means every
+// resource of the type.
+func GrantedResourceKeys(db *sql.DB, username, action, resourceType string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT g.resource_key
+		FROM resource_grants g JOIN users u ON u.id = g.user_id
+		WHERE u.username = $1 AND g.action = $2 AND g.resource_type = $3
+		AND (g.expires_at IS NULL OR g.expires_at > NOW())
+	`, username, action, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ExpireResourceGrants deletes the grants whose time is up and returns them.
+func ExpireResourceGrants(db *sql.DB) ([]models.ResourceGrant, error) {
+	rows, err := db.Query(`
+		DELETE FROM resource_grants WHERE expires_at <= NOW()
+		RETURNING id, user_id, action, resource_type, resource_key, request_id, granted_by, expires_at, created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []models.ResourceGrant
+	for rows.Next() {
+		var grant models.ResourceGrant
+		var requestID uuid.NullUUID
+		var expiresAt sql.NullTime
+		err := rows.Scan(
+			&grant.ID,
+			&grant.UserID,
+			&grant.Action,
+			&grant.ResourceType,
+			&grant.ResourceKey,
+			&requestID,
+			&grant.GrantedBy,
+			&expiresAt,
+			&grant.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if requestID.Valid {
+			grant.RequestID = &requestID.UUID
+		}
+		if expiresAt.Valid {
+			grant.ExpiresAt = &expiresAt.Time
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
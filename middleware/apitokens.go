@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// APITokenPrefix marks bookstore tokens so they are easy to recognise in
+// logs and secret scanners.
+const APITokenPrefix = "bst_"
+
+// ErrTokenNotFound is returned when no token matches the given ID and owner.
+var ErrTokenNotFound = errors.New("token not found")
+
+// CreateAPIToken stores a new token for a user and returns the secret that
+// must be shown to them exactly once.
+func CreateAPIToken(db *sql.DB, token *models.APIToken) (string, error) {
+	secret, _, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	secret = APITokenPrefix + secret
+
+	token.ID = uuid.New()
+	err = db.QueryRow(`
+		INSERT INTO api_tokens (id, user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at
+	`, token.ID, token.UserID, token.Name, HashToken(secret), pq.Array(token.Scopes), token.ExpiresAt).Scan(&token.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ListAPITokens returns a user's tokens, newest first
+func ListAPITokens(db *sql.DB, userID uuid.UUID) ([]models.APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, name, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []models.APIToken
+	for rows.Next() {
+		var t models.APIToken
+		var lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, pq.Array(&t.Scopes), &t.ExpiresAt, &lastUsed, &revoked, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		if revoked.Valid {
+			t.RevokedAt = &revoked.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken revokes one of a user's tokens
+func RevokeAPIToken(db *sql.DB, userID, tokenID uuid.UUID) error {
+	result, err := db.Exec(`
+		UPDATE api_tokens SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrTokenNotFound)
+}
+
+// ResolveAPIToken returns the user and token behind a bearer secret, and
+// records when the token was last used. Revoked and expired tokens, and
+// tokens of users who can no longer log in, are rejected.
+func ResolveAPIToken(db *sql.DB, secret string) (*models.User, *models.APIToken, error) {
+	if !strings.HasPrefix(secret, APITokenPrefix) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	var token models.APIToken
+	err := db.QueryRow(`
+		UPDATE api_tokens SET last_used_at = NOW()
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING id, user_id, name, scopes, expires_at, created_at
+	`, HashToken(secret)).Scan(&token.ID, &token.UserID, &token.Name, pq.Array(&token.Scopes), &token.ExpiresAt, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+` FROM users
+		WHERE id = $1 AND active AND NOT disabled
+	`, token.UserID))
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &token, nil
+}
+
+// ScopeAllows reports whether a token's scopes permit action on a resource
+// type. Scopes only narrow what the user's role already allows.
+func ScopeAllows(scopes []string, resourceType, action string) bool {
+	for _, scope := range scopes {
+		if scope == "*" || scope == resourceType+":*" || scope == resourceType+":"+action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"encoding/json"
+)
+
+// RecordAudit appends an entry to the audit log
+func RecordAudit(db *sql.DB, actor, action, targetType, targetID string, details map[string]interface{}) error {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO audit_log (actor, action, target_type, target_id, details)
+		VALUES ($1, $2, $3, $4, $5)
+	`, actor, action, targetType, targetID, raw)
+	return err
+}
+
+// ListAuditEntries returns the most recent audit entries for a target, newest first
+func ListAuditEntries(db *sql.DB, targetType, targetID string, limit int) ([]models.AuditEntry, error) {
+	rows, err := db.Query(`
+		SELECT id, actor, action, target_type, target_id, details, created_at
+		FROM audit_log
+		WHERE target_type = $1 AND target_id = $2
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, targetType, targetID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.AuditEntry
+	for rows.Next() {
+		var entry models.AuditEntry
+		var raw []byte
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.TargetType, &entry.TargetID, &raw, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &entry.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
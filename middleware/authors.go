@@ -0,0 +1,330 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrAuthorNotFound is returned when no author matches the given ID.
+var ErrAuthorNotFound = errors.New("author not found")
+
+// nameKey is the SQL form of authors.name_key, for matching names that are
+// not stored yet.
+const nameKey = `lower(regexp_replace($1, '[^[:alnum:]]+', '', 'g'))`
+
+// refreshBylines rewrites books.author from the links of every book the
+// author $1 is credited on.
+const refreshBylines = `
+	UPDATE books b
+	SET author = s.byline
+	FROM (
+		SELECT ba.book_id, string_agg(
+			a.name || CASE WHEN ba.role = 'author' THEN '' ELSE ' (' || ba.role || ')' END,
+			'; ' ORDER BY ba.position) AS byline
+		FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+		WHERE ba.book_id IN (SELECT book_id FROM book_authors WHERE author_id = $1)
+		GROUP BY ba.book_id
+	) s
+	WHERE s.book_id = b.id`
+
+const authorColumns = `a.id, a.name, a.bio, a.created_at,
+	(SELECT COUNT(DISTINCT book_id) FROM book_authors WHERE author_id = a.id)`
+
+func scanAuthor(row interface{ Scan(...interface{}) error }) (*models.Author, error) {
+	var author models.Author
+	err := row.Scan(&author.ID, &author.Name, &author.Bio, &author.CreatedAt, &author.BookCount)
+	if err == sql.ErrNoRows {
+		return nil, ErrAuthorNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func queryAuthors(db *sql.DB, query string, args ...interface{}) ([]models.Author, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authors []models.Author
+	for rows.Next() {
+		author, err := scanAuthor(rows)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, *author)
+	}
+	return authors, rows.Err()
+}
+
+// ListAuthors retrieves authors by name, optionally only those whose name
+// contains search.
+func ListAuthors(db *sql.DB, search string, limit int) ([]models.Author, error) {
+	return queryAuthors(db, `
+		SELECT `+authorColumns+` FROM authors a
+		WHERE $1 = '' OR a.name ILIKE '%' || $1 || '%'
+		ORDER BY a.name, a.created_at
+		LIMIT $2
+	`, search, limit)
+}
+
+// ListDuplicateAuthors retrieves groups of authors whose names differ only
+// in case, spacing or punctuation, the likeliest candidates for merging.
+func ListDuplicateAuthors(db *sql.DB) ([][]models.Author, error) {
+	rows, err := db.Query(`
+		SELECT a.name_key, ` + authorColumns + ` FROM authors a
+		WHERE a.name_key IN (
+			SELECT name_key FROM authors GROUP BY name_key HAVING COUNT(*) > 1
+		)
+		ORDER BY a.name_key, a.created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups [][]models.Author
+	var last string
+	for rows.Next() {
+		var key string
+		author, err := scanAuthor(rowScanner(func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&key}, dest...)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || key != last {
+			groups = append(groups, nil)
+			last = key
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], *author)
+	}
+	return groups, rows.Err()
+}
+
+// GetAuthor retrieves a single author by ID
+func GetAuthor(db *sql.DB, id uuid.UUID) (*models.Author, error) {
+	return scanAuthor(db.QueryRow("SELECT "+authorColumns+" FROM authors a WHERE a.id = $1", id))
+}
+
+// CreateAuthor stores a new author
+func CreateAuthor(db *sql.DB, author *models.Author) error {
+	return db.QueryRow(`
+		INSERT INTO authors (name, bio) VALUES ($1, $2)
+		RETURNING id, created_at
+	`, author.Name, author.Bio).Scan(&author.ID, &author.CreatedAt)
+}
+
+// UpdateAuthor changes an author's name and bio and rewrites the bylines of
+// their books.
+func UpdateAuthor(db *sql.DB, author *models.Author) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE authors SET name = $2, bio = $3 WHERE id = $1", author.ID, author.Name, author.Bio)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result, ErrAuthorNotFound); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(refreshBylines, author.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListBookAuthors retrieves the credits of a book in order
+func ListBookAuthors(db *sql.DB, bookID uuid.UUID) ([]models.BookAuthor, error) {
+	rows, err := db.Query(`
+		SELECT a.id, a.name, ba.role
+		FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+		WHERE ba.book_id = $1
+		ORDER BY ba.position
+	`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credits []models.BookAuthor
+	for rows.Next() {
+		var c models.BookAuthor
+		if err := rows.Scan(&c.AuthorID, &c.Name, &c.Role); err != nil {
+			return nil, err
+		}
+		credits = append(credits, c)
+	}
+	return credits, rows.Err()
+}
+
+// AuthorBook is a book an author is credited on, with their role in it.
+type AuthorBook struct {
+	models.Book
+	Role string `json:"role"`
+}
+
+// ListAuthorBooks retrieves the books an author is credited on, newest
+// first.
+func ListAuthorBooks(db *sql.DB, authorID uuid.UUID) ([]AuthorBook, error) {
+	rows, err := db.Query(`
+		SELECT `+bookColumns+`, ba.role
+		FROM `+bookFrom+` JOIN book_authors ba ON ba.book_id = books.id
+		WHERE ba.author_id = $1
+		ORDER BY books.published_at DESC NULLS LAST, books.title
+	`, authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []AuthorBook
+	for rows.Next() {
+		var role string
+		book, err := scanBook(rowScanner(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &role)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, AuthorBook{Book: *book, Role: role})
+	}
+	return books, rows.Err()
+}
+
+// SetBookAuthors replaces the credits of a book and rewrites its byline.
+// Credits without an AuthorID are matched to an existing author by name,
+// ignoring case, spacing and punctuation, or create one; their AuthorID
+// and Name are filled in.
+func SetBookAuthors(db *sql.DB, bookID uuid.UUID, credits []models.BookAuthor) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setBookAuthors(tx, bookID, credits); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setBookAuthors is SetBookAuthors within the caller's transaction.
+func setBookAuthors(tx *sql.Tx, bookID uuid.UUID, credits []models.BookAuthor) error {
+	var err error
+	for i := range credits {
+		c := &credits[i]
+		if c.AuthorID != uuid.Nil {
+			err = tx.QueryRow("SELECT name FROM authors WHERE id = $1", c.AuthorID).Scan(&c.Name)
+		} else {
+			err = tx.QueryRow(`
+				SELECT id, name FROM authors WHERE name_key = `+nameKey+`
+				ORDER BY created_at, id LIMIT 1
+			`, c.Name).Scan(&c.AuthorID, &c.Name)
+			if err == sql.ErrNoRows {
+				err = tx.QueryRow("INSERT INTO authors (name) VALUES ($1) RETURNING id", c.Name).Scan(&c.AuthorID)
+			}
+		}
+		if err == sql.ErrNoRows {
+			return ErrAuthorNotFound
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM book_authors WHERE book_id = $1", bookID); err != nil {
+		return err
+	}
+	// Names spelled differently may still resolve to the same author.
+	var byline string
+	seen := make(map[models.BookAuthor]bool)
+	for _, c := range credits {
+		if seen[c] {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO book_authors (book_id, author_id, role, position)
+			VALUES ($1, $2, $3, $4)
+		`, bookID, c.AuthorID, c.Role, len(seen)+1)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if len(seen) > 0 {
+			byline += "; "
+		}
+		byline += c.Credit()
+		seen[c] = true
+	}
+
+	_, err = tx.Exec("UPDATE books SET author = $2 WHERE id = $1", bookID, byline)
+	return err
+}
+
+// MergeAuthors moves every credit of author from to author into, rewrites
+// the affected bylines and deletes from. into keeps its name; it takes
+// from's bio if it has none. It returns how many books were moved.
+func MergeAuthors(db *sql.DB, from, into uuid.UUID) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var bio string
+	if err := tx.QueryRow("SELECT bio FROM authors WHERE id = $1 FOR UPDATE", from).Scan(&bio); err == sql.ErrNoRows {
+		return 0, ErrAuthorNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`
+		UPDATE authors SET bio = CASE WHEN bio = '' THEN $2 ELSE bio END
+		WHERE id = $1
+	`, into, bio)
+	if err != nil {
+		return 0, err
+	}
+	if err := expectOneRow(result, ErrAuthorNotFound); err != nil {
+		return 0, err
+	}
+
+	// A book crediting both keeps the earlier credit.
+	moved, err := tx.Exec(`
+		INSERT INTO book_authors (book_id, author_id, role, position)
+		SELECT book_id, $2, role, position FROM book_authors WHERE author_id = $1
+		ON CONFLICT (book_id, author_id, role) DO UPDATE
+		SET position = LEAST(book_authors.position, EXCLUDED.position)
+	`, from, into)
+	if err != nil {
+		return 0, err
+	}
+	n, err := moved.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM book_authors WHERE author_id = $1", from); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM authors WHERE id = $1", from); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(refreshBylines, into); err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
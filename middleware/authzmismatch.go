@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bookstore/authz"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// RecordAuthzMismatch stores a disagreement found by the shadow authorizer
+func RecordAuthzMismatch(db *sql.DB, m authz.Mismatch) error {
+	subject, err := json.Marshal(m.Subject)
+	if err != nil {
+		return err
+	}
+	resource, err := json.Marshal(m.Resource)
+	if err != nil {
+		return err
+	}
+	if m.Reasons == nil {
+		m.Reasons = map[string][]string{}
+	}
+	reasons, err := json.Marshal(m.Reasons)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO authz_mismatches (subject_key, subject, action, resource_type, resource,
+			primary_backend, primary_allowed, secondary_backend, secondary_allowed, secondary_error, reasons, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, m.Subject.Key, subject, m.Action, m.Resource.Type, resource,
+		m.PrimaryBackend, m.PrimaryAllowed, m.SecondaryBackend, m.SecondaryAllowed, m.SecondaryError, reasons, m.CreatedAt)
+	return err
+}
+
+// ListAuthzMismatches returns the most recent mismatches, newest first
+func ListAuthzMismatches(db *sql.DB, limit int) ([]authz.Mismatch, error) {
+	rows, err := db.Query(`
+		SELECT id, subject, action, resource, primary_backend, primary_allowed,
+			secondary_backend, secondary_allowed, secondary_error, reasons, created_at
+		FROM authz_mismatches
+		ORDER BY created_at DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mismatches []authz.Mismatch
+	for rows.Next() {
+		var m authz.Mismatch
+		var subject, resource, reasons []byte
+		if err := rows.Scan(&m.ID, &subject, &m.Action, &resource, &m.PrimaryBackend, &m.PrimaryAllowed,
+			&m.SecondaryBackend, &m.SecondaryAllowed, &m.SecondaryError, &reasons, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(subject, &m.Subject); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(resource, &m.Resource); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(reasons, &m.Reasons); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// MismatchSummary counts mismatches of one kind.
+type MismatchSummary struct {
+	Action           string    `json:"action"`
+	ResourceType     string    `json:"resource_type"`
+	PrimaryAllowed   bool      `json:"primary_allowed"`
+	SecondaryAllowed bool      `json:"secondary_allowed"`
+	Errors           bool      `json:"errors"`
+	Count            int       `json:"count"`
+	Users            int       `json:"users"`
+	LastSeen         time.Time `json:"last_seen"`
+}
+
+// SummarizeAuthzMismatches groups mismatches since a point in time by
+// action, resource type and the two decisions, most frequent first
+func SummarizeAuthzMismatches(db *sql.DB, since time.Time) ([]MismatchSummary, error) {
+	rows, err := db.Query(`
+		SELECT action, resource_type, primary_allowed, secondary_allowed, secondary_error <> '',
+			COUNT(*), COUNT(DISTINCT subject_key), MAX(created_at)
+		FROM authz_mismatches
+		WHERE created_at >= $1
+		GROUP BY 1, 2, 3, 4, 5
+		ORDER BY 6 DESC, 8 DESC
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []MismatchSummary
+	for rows.Next() {
+		var s MismatchSummary
+		if err := rows.Scan(&s.Action, &s.ResourceType, &s.PrimaryAllowed, &s.SecondaryAllowed, &s.Errors,
+			&s.Count, &s.Users, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+// ClearAuthzMismatches deletes all recorded mismatches, e.g. after fixing
+// the policy that caused them
+func ClearAuthzMismatches(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM authz_mismatches")
+	return err
+}
@@ -0,0 +1,318 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrCategoryNotFound is returned when no category matches the given ID.
+	ErrCategoryNotFound = errors.New("category not found")
+	// ErrCategoryCycle is returned when a category would end up inside
+	// itself.
+	ErrCategoryCycle = errors.New("a category cannot be placed under itself or its subcategories")
+	// ErrCategoryHasChildren is returned when deleting a category that
+	// still has subcategories.
+	ErrCategoryHasChildren = errors.New("category has subcategories; move or delete them first")
+)
+
+// ListCategories retrieves the whole category tree in display order: each
+// category follows its parent, siblings sorted by name. Path and Depth are
+// filled in.
+func ListCategories(db *sql.DB) ([]models.Category, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE tree AS (
+			SELECT id, name, slug, parent_id, created_at,
+				name AS path, 0 AS depth, ARRAY[lower(name), slug] AS sort_key
+			FROM categories WHERE parent_id IS NULL
+			UNION ALL
+			SELECT c.id, c.name, c.slug, c.parent_id, c.created_at,
+				t.path || ' / ' || c.name, t.depth + 1, t.sort_key || ARRAY[lower(c.name), c.slug]
+			FROM categories c JOIN tree t ON c.parent_id = t.id
+		)
+		SELECT id, name, slug, parent_id, created_at, path, depth FROM tree
+		ORDER BY sort_key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []models.Category
+	for rows.Next() {
+		var c models.Category
+		var parentID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &parentID, &c.CreatedAt, &c.Path, &c.Depth); err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			c.ParentID = &parentID.Int64
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// GetCategory retrieves a single category by ID. Path and Depth are left
+// empty.
+func GetCategory(db *sql.DB, id int64) (*models.Category, error) {
+	var c models.Category
+	var parentID sql.NullInt64
+	err := db.QueryRow(`
+		SELECT id, name, slug, parent_id, created_at FROM categories WHERE id = $1
+	`, id).Scan(&c.ID, &c.Name, &c.Slug, &parentID, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCategoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if parentID.Valid {
+		c.ParentID = &parentID.Int64
+	}
+	return &c, nil
+}
+
+// foreignKeyViolation reports whether err is a foreign key violation: a
+// category or parent that does not exist, or a category still referenced
+// by its subcategories.
+func foreignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// CreateCategory stores a new category
+func CreateCategory(db *sql.DB, category *models.Category) error {
+	err := db.QueryRow(`
+		INSERT INTO categories (name, slug, parent_id) VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, category.Name, category.Slug, category.ParentID).Scan(&category.ID, &category.CreatedAt)
+	if foreignKeyViolation(err) {
+		return ErrCategoryNotFound
+	}
+	return err
+}
+
+// UpdateCategory renames a category or moves it under another parent.
+func UpdateCategory(db *sql.DB, category *models.Category) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Moves are serialised so two cannot combine into a cycle.
+	if _, err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+	if category.ParentID != nil {
+		var cycle bool
+		err := tx.QueryRow(`
+			WITH RECURSIVE ancestors AS (
+				SELECT id, parent_id FROM categories WHERE id = $1
+				UNION
+				SELECT c.id, c.parent_id FROM categories c JOIN ancestors a ON c.id = a.parent_id
+			)
+			SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)
+		`, *category.ParentID, category.ID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE categories SET name = $2, slug = $3, parent_id = $4 WHERE id = $1
+	`, category.ID, category.Name, category.Slug, category.ParentID)
+	if foreignKeyViolation(err) {
+		return ErrCategoryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result, ErrCategoryNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteCategory removes a category with no subcategories. Books filed
+// under it lose that category.
+func DeleteCategory(db *sql.DB, id int64) error {
+	result, err := db.Exec("DELETE FROM categories WHERE id = $1", id)
+	if foreignKeyViolation(err) {
+		return ErrCategoryHasChildren
+	}
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrCategoryNotFound)
+}
+
+// ListBookCategories retrieves the categories a book is filed under, by
+// name.
+func ListBookCategories(db *sql.DB, bookID uuid.UUID) ([]models.Category, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.name, c.slug, c.parent_id, c.created_at
+		FROM book_categories bc JOIN categories c ON c.id = bc.category_id
+		WHERE bc.book_id = $1
+		ORDER BY lower(c.name), c.slug
+	`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []models.Category
+	for rows.Next() {
+		var c models.Category
+		var parentID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &parentID, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			c.ParentID = &parentID.Int64
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// ListBookTags retrieves the tags of a book in alphabetical order
+func ListBookTags(db *sql.DB, bookID uuid.UUID) ([]string, error) {
+	rows, err := db.Query("SELECT tag FROM book_tags WHERE book_id = $1 ORDER BY tag", bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// Classifications maps each classified book to the IDs of the categories
+// it is filed under and to its tags, for browsing without a query per
+// book.
+type Classifications struct {
+	Categories map[uuid.UUID][]int64
+	Tags       map[uuid.UUID][]string
+}
+
+// ListClassifications retrieves the categories and tags of every book.
+func ListClassifications(db *sql.DB) (*Classifications, error) {
+	c := &Classifications{
+		Categories: make(map[uuid.UUID][]int64),
+		Tags:       make(map[uuid.UUID][]string),
+	}
+
+	rows, err := db.Query("SELECT book_id, category_id FROM book_categories")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bookID uuid.UUID
+		var categoryID int64
+		if err := rows.Scan(&bookID, &categoryID); err != nil {
+			return nil, err
+		}
+		c.Categories[bookID] = append(c.Categories[bookID], categoryID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tagRows, err := db.Query("SELECT book_id, tag FROM book_tags ORDER BY tag")
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var bookID uuid.UUID
+		var tag string
+		if err := tagRows.Scan(&bookID, &tag); err != nil {
+			return nil, err
+		}
+		c.Tags[bookID] = append(c.Tags[bookID], tag)
+	}
+	return c, tagRows.Err()
+}
+
+// SetBookClassification replaces the categories and tags of a book. Tags
+// must already be normalised to lower case.
+func SetBookClassification(db *sql.DB, bookID uuid.UUID, categoryIDs []int64, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)", bookID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrBookNotFound
+	}
+
+	if err := setBookCategories(tx, bookID, categoryIDs); err != nil {
+		return err
+	}
+	if err := setBookTags(tx, bookID, tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setBookCategories replaces the categories of a book within the caller's
+// transaction.
+func setBookCategories(tx *sql.Tx, bookID uuid.UUID, categoryIDs []int64) error {
+	if _, err := tx.Exec("DELETE FROM book_categories WHERE book_id = $1", bookID); err != nil {
+		return err
+	}
+	ids := append([]int64(nil), categoryIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO book_categories (book_id, category_id) VALUES ($1, $2)", bookID, id)
+		if foreignKeyViolation(err) {
+			return ErrCategoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBookTags replaces the tags of a book within the caller's transaction.
+func setBookTags(tx *sql.Tx, bookID uuid.UUID, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM book_tags WHERE book_id = $1", bookID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err := tx.Exec(`
+			INSERT INTO book_tags (book_id, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING
+		`, bookID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
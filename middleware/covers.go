@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrCoverNotFound is returned when the book has no cover.
+var ErrCoverNotFound = errors.New("cover not found")
+
+const coverColumns = "book_id, content_type, width, height, size, etag, uploaded_by, uploaded_at"
+
+func scanCover(row interface{ Scan(...interface{}) error }) (*models.Cover, error) {
+	var c models.Cover
+	err := row.Scan(&c.BookID, &c.ContentType, &c.Width, &c.Height, &c.Size, &c.ETag, &c.UploadedBy, &c.UploadedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCoverNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetBookCover retrieves the cover of a book
+func GetBookCover(db *sql.DB, bookID uuid.UUID) (*models.Cover, error) {
+	return scanCover(db.QueryRow("SELECT "+coverColumns+" FROM book_covers WHERE book_id = $1", bookID))
+}
+
+// SetBookCover stores cover as the book's cover and returns the one it
+// replaced, or nil, so the caller can delete the old images.
+func SetBookCover(db *sql.DB, cover *models.Cover) (*models.Cover, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	previous, err := scanCover(tx.QueryRow("SELECT "+coverColumns+" FROM book_covers WHERE book_id = $1 FOR UPDATE", cover.BookID))
+	if errors.Is(err, ErrCoverNotFound) {
+		previous, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO book_covers (book_id, content_type, width, height, size, etag, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (book_id) DO UPDATE SET
+			content_type = EXCLUDED.content_type, width = EXCLUDED.width, height = EXCLUDED.height,
+			size = EXCLUDED.size, etag = EXCLUDED.etag, uploaded_by = EXCLUDED.uploaded_by, uploaded_at = NOW()
+		RETURNING uploaded_at
+	`, cover.BookID, cover.ContentType, cover.Width, cover.Height, cover.Size, cover.ETag, cover.UploadedBy).Scan(&cover.UploadedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return nil, ErrBookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return previous, tx.Commit()
+}
+
+// DeleteBookCover removes the cover of a book and returns it, so the
+// caller can delete the images.
+func DeleteBookCover(db *sql.DB, bookID uuid.UUID) (*models.Cover, error) {
+	return scanCover(db.QueryRow("DELETE FROM book_covers WHERE book_id = $1 RETURNING "+coverColumns, bookID))
+}
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttleRow is a row of the login_throttle table.
+type throttleRow struct {
+	failures     int64
+	lastFailure  time.Time
+	lockedUntil  *time.Time
+	attemptUntil *time.Time
+}
+
+// throttleTable is an in-memory login_throttle table that understands the
+// statements LoginThrottle runs. Transactions are not isolated; tests run
+// attempts one step at a time instead.
+type throttleTable struct {
+	mu   sync.Mutex
+	rows map[string]*throttleRow
+}
+
+var (
+	throttleTablesMu sync.Mutex
+	throttleTables   = map[string]*throttleTable{}
+)
+
+func init() {
+	sql.Register("throttle", throttleDriver{})
+}
+
+// newThrottleDB opens a database holding an empty login_throttle table.
+func newThrottleDB(t *testing.T) (*sql.DB, *throttleTable) {
+	t.Helper()
+	table := &throttleTable{rows: map[string]*throttleRow{}}
+	throttleTablesMu.Lock()
+	throttleTables[t.Name()] = table
+	throttleTablesMu.Unlock()
+
+	db, err := sql.Open("throttle", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		throttleTablesMu.Lock()
+		delete(throttleTables, t.Name())
+		throttleTablesMu.Unlock()
+	})
+	return db, table
+}
+
+type throttleDriver struct{}
+
+func (throttleDriver) Open(name string) (driver.Conn, error) {
+	throttleTablesMu.Lock()
+	defer throttleTablesMu.Unlock()
+	table, ok := throttleTables[name]
+	if !ok {
+		return nil, fmt.Errorf("no throttle table %q", name)
+	}
+	return throttleConn{table}, nil
+}
+
+type throttleConn struct{ table *throttleTable }
+
+func (c throttleConn) Prepare(query string) (driver.Stmt, error) {
+	return throttleStmt{c.table, strings.Join(strings.Fields(query), " ")}, nil
+}
+func (c throttleConn) Close() error              { return nil }
+func (c throttleConn) Begin() (driver.Tx, error) { return throttleTx{}, nil }
+
+type throttleTx struct{}
+
+func (throttleTx) Commit() error   { return nil }
+func (throttleTx) Rollback() error { return nil }
+
+type throttleStmt struct {
+	table *throttleTable
+	query string
+}
+
+func (s throttleStmt) Close() error  { return nil }
+func (s throttleStmt) NumInput() int { return -1 }
+
+func seconds(v driver.Value) time.Duration {
+	return time.Duration(v.(float64) * float64(time.Second))
+}
+
+func (s throttleStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+	key := args[0].(string)
+	row := s.table.rows[key]
+	now := time.Now()
+
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO login_throttle (key, failures, last_failure_at) VALUES ($1, 0, NOW()) ON CONFLICT (key) DO NOTHING"):
+		if row == nil {
+			s.table.rows[key] = &throttleRow{lastFailure: now}
+		}
+	case strings.HasPrefix(s.query, "UPDATE login_throttle SET attempt_until = NOW() + $2"):
+		if row != nil {
+			until := now.Add(seconds(args[1]))
+			row.attemptUntil = &until
+		}
+	case s.query == "UPDATE login_throttle SET attempt_until = NULL WHERE key = $1":
+		if row != nil {
+			row.attemptUntil = nil
+		}
+	case strings.HasPrefix(s.query, "UPDATE login_throttle SET failures = 0, locked_until = $2"):
+		if row != nil {
+			until := args[1].(time.Time)
+			row.failures, row.lockedUntil = 0, &until
+		}
+	case s.query == "DELETE FROM login_throttle WHERE key = $1":
+		delete(s.table.rows, key)
+	case strings.HasPrefix(s.query, "DELETE FROM login_throttle WHERE key = $1 AND failures = 0"):
+		if row != nil && row.failures == 0 && (row.lockedUntil == nil || !row.lockedUntil.After(now)) {
+			delete(s.table.rows, key)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s throttleStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+	key := args[0].(string)
+	row := s.table.rows[key]
+	now := time.Now()
+
+	switch {
+	case strings.HasPrefix(s.query, "SELECT failures, last_failure_at, locked_until, attempt_until FROM login_throttle WHERE key = $1"):
+		if row == nil {
+			return &throttleRows{}, nil
+		}
+		return &throttleRows{values: []driver.Value{row.failures, row.lastFailure, nullTime(row.lockedUntil), nullTime(row.attemptUntil)}}, nil
+	case strings.HasPrefix(s.query, "INSERT INTO login_throttle (key, failures, last_failure_at) VALUES ($1, 1, NOW())"):
+		if row == nil {
+			row = &throttleRow{}
+			s.table.rows[key] = row
+		}
+		if row.lastFailure.Before(now.Add(-seconds(args[1]))) {
+			row.failures = 1
+		} else {
+			row.failures++
+		}
+		row.lastFailure, row.attemptUntil = now, nil
+		return &throttleRows{values: []driver.Value{row.failures}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+func nullTime(t *time.Time) driver.Value {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// throttleRows holds at most one row.
+type throttleRows struct {
+	values []driver.Value
+}
+
+func (r *throttleRows) Columns() []string { return make([]string, len(r.values)) }
+func (r *throttleRows) Close() error      { return nil }
+
+func (r *throttleRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
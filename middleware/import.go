@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ImportedBook is one validated row of a bulk import. Book.ID is the new
+// book's ID, or with Update set the existing book whose fields are
+// replaced. Nil Credits, CategoryIDs or Tags leave those of an existing
+// book as they are.
+type ImportedBook struct {
+	Book        models.Book
+	Update      bool
+	Credits     []models.BookAuthor
+	CategoryIDs []int64
+	Tags        []string
+}
+
+// ImportError reports which book of a batch made ImportBooks fail.
+type ImportError struct {
+	Index int
+	Err   error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("book %d of the batch: %v", e.Index+1, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ListBooksByISBN retrieves the books carrying any of the normalized
+// ISBN-13s, keyed by ISBN.
+func ListBooksByISBN(db *sql.DB, isbns []string) (map[string]models.Book, error) {
+	rows, err := db.Query("SELECT "+bookColumns+" FROM "+bookFrom+" WHERE books.isbn = ANY($1)", pq.Array(isbns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := make(map[string]models.Book)
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books[book.ISBN13] = *book
+	}
+	return books, rows.Err()
+}
+
+// ImportBooks creates and updates a batch of books in one transaction, so
+// either all of them are written or, with an *ImportError, none are.
+func ImportBooks(db *sql.DB, books []ImportedBook) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range books {
+		if err := importBook(tx, &books[i]); err != nil {
+			return &ImportError{Index: i, Err: err}
+		}
+	}
+	return tx.Commit()
+}
+
+func importBook(tx *sql.Tx, in *ImportedBook) error {
+	b := &in.Book
+	if in.Update {
+		result, err := tx.Exec(`UPDATE books
+			SET title = $1, author = $2, published_at = $3, genre = $4, restricted = $5, age_rating = $6, isbn = NULLIF($7, '')
+			WHERE id = $8`,
+			b.Title, b.Author, b.PublishedAt, b.Genre, b.Restricted, b.AgeRating, b.ISBN13, b.ID)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(result, ErrBookNotFound); err != nil {
+			return err
+		}
+	} else {
+		_, err := tx.Exec(`INSERT INTO books (id, title, author, published_at, genre, restricted, age_rating, isbn, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NOW())`,
+			b.ID, b.Title, b.Author, b.PublishedAt, b.Genre, b.Restricted, b.AgeRating, b.ISBN13)
+		if err != nil {
+			return err
+		}
+	}
+
+	if in.Credits != nil {
+		if err := setBookAuthors(tx, b.ID, in.Credits); err != nil {
+			return err
+		}
+	}
+	if in.CategoryIDs != nil {
+		if err := setBookCategories(tx, b.ID, in.CategoryIDs); err != nil {
+			return err
+		}
+	}
+	if in.Tags != nil {
+		if err := setBookTags(tx, b.ID, in.Tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrInsufficientStock is returned when a movement would take the stock on
+// hand below zero or below the copies reserved for orders, or when an
+// order asks for more copies than are available.
+var ErrInsufficientStock = errors.New("not enough copies in stock")
+
+const stockLevelColumns = `s.book_id, s.on_hand, s.reserved, s.low_stock_threshold, s.updated_at`
+
+// bookStockColumns are the stockLevelColumns of every book, including
+// those that never had stock.
+const bookStockColumns = `b.id, COALESCE(s.on_hand, 0), COALESCE(s.reserved, 0), COALESCE(s.low_stock_threshold, 0), s.updated_at`
+
+func scanStockLevel(row interface{ Scan(...interface{}) error }) (*models.StockLevel, error) {
+	var level models.StockLevel
+	var updatedAt sql.NullTime
+	err := row.Scan(
+		&level.BookID,
+		&level.OnHand,
+		&level.Reserved,
+		&level.LowStockThreshold,
+		&updatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	level.Available = level.OnHand - level.Reserved
+	level.Low = level.Available <= level.LowStockThreshold
+	if updatedAt.Valid {
+		level.UpdatedAt = &updatedAt.Time
+	}
+	return &level, nil
+}
+
+// ListStockLevels retrieves the stock of every book, keyed by book ID.
+// Books that never had stock come back with zero on hand.
+func ListStockLevels(db *sql.DB) (map[uuid.UUID]models.StockLevel, error) {
+	rows, err := db.Query(`
+		SELECT ` + bookStockColumns + `
+		FROM books b LEFT JOIN book_stock s ON s.book_id = b.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := make(map[uuid.UUID]models.StockLevel)
+	for rows.Next() {
+		level, err := scanStockLevel(rows)
+		if err != nil {
+			return nil, err
+		}
+		levels[level.BookID] = *level
+	}
+	return levels, rows.Err()
+}
+
+// GetStockLevel retrieves the stock of a single book
+func GetStockLevel(db *sql.DB, bookID uuid.UUID) (*models.StockLevel, error) {
+	level, err := scanStockLevel(db.QueryRow(`
+		SELECT `+bookStockColumns+`
+		FROM books b LEFT JOIN book_stock s ON s.book_id = b.id
+		WHERE b.id = $1
+	`, bookID))
+	if err == sql.ErrNoRows {
+		return nil, ErrBookNotFound
+	}
+	return level, err
+}
+
+// ListStockMovements retrieves the latest ledger entries of a book
+func ListStockMovements(db *sql.DB, bookID uuid.UUID, limit int) ([]models.StockMovement, error) {
+	rows, err := db.Query(`
+		SELECT id, book_id, kind, quantity, reason, created_by, created_at
+		FROM stock_movements
+		WHERE book_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`, bookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movements []models.StockMovement
+	for rows.Next() {
+		var m models.StockMovement
+		if err := rows.Scan(&m.ID, &m.BookID, &m.Kind, &m.Quantity, &m.Reason, &m.CreatedBy, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		movements = append(movements, m)
+	}
+	return movements, rows.Err()
+}
+
+// RecordStockMovement appends a movement to the ledger and applies it to the
+// stock on hand, returning the new stock level.
+func RecordStockMovement(db *sql.DB, movement *models.StockMovement) (*models.StockLevel, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	level, err := scanStockLevel(tx.QueryRow(`
+		INSERT INTO book_stock AS s (book_id, on_hand)
+		VALUES ($1, $2)
+		ON CONFLICT (book_id) DO UPDATE
+		SET on_hand = s.on_hand + EXCLUDED.on_hand, updated_at = NOW()
+		RETURNING `+stockLevelColumns,
+		movement.BookID, movement.Quantity))
+	if err != nil {
+		return nil, stockError(err)
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO stock_movements (book_id, kind, quantity, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`,
+		movement.BookID,
+		movement.Kind,
+		movement.Quantity,
+		movement.Reason,
+		movement.CreatedBy,
+	).Scan(&movement.ID, &movement.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return level, tx.Commit()
+}
+
+// SetLowStockThreshold changes the stock level at which a book counts as
+// low on stock, returning the new stock level.
+func SetLowStockThreshold(db *sql.DB, bookID uuid.UUID, threshold int) (*models.StockLevel, error) {
+	level, err := scanStockLevel(db.QueryRow(`
+		INSERT INTO book_stock AS s (book_id, low_stock_threshold)
+		VALUES ($1, $2)
+		ON CONFLICT (book_id) DO UPDATE
+		SET low_stock_threshold = EXCLUDED.low_stock_threshold, updated_at = NOW()
+		RETURNING `+stockLevelColumns,
+		bookID, threshold))
+	if err != nil {
+		return nil, stockError(err)
+	}
+	return level, nil
+}
+
+// stockError translates the constraint violations of book_stock.
+func stockError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23503":
+			return ErrBookNotFound
+		case "23514":
+			return ErrInsufficientStock
+		}
+	}
+	return err
+}
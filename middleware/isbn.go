@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// titleKey is the SQL form of a title for duplicate detection: lower case,
+// without a leading article, spacing or punctuation, so "The Hobbit" and
+// "Hobbit" match. It must match books_title_key_idx.
+func titleKey(expr string) string {
+	return `regexp_replace(regexp_replace(lower(` + expr + `), '^(the|an|a)\s+', ''), '[^[:alnum:]]+', '', 'g')`
+}
+
+// Reasons FindDuplicateBooks gives for a match.
+const (
+	DuplicateISBN        = "isbn"
+	DuplicateTitleAuthor = "title_author"
+)
+
+// DuplicateBook is an existing book that looks like the one being added.
+type DuplicateBook struct {
+	models.Book
+	Reason string `json:"reason"`
+}
+
+// GetBookByISBN retrieves the book with a normalized ISBN-13
+func GetBookByISBN(db *sql.DB, isbn13 string) (*models.Book, error) {
+	book, err := scanBook(db.QueryRow("SELECT "+bookColumns+" FROM "+bookFrom+" WHERE books.isbn = $1", isbn13))
+	if err == sql.ErrNoRows {
+		return nil, ErrBookNotFound
+	}
+	return book, err
+}
+
+// FindDuplicateBooks retrieves books other than exclude that share the
+// ISBN-13 isbn13, or whose title matches title ignoring case, punctuation
+// and a leading article while crediting one of authors under a name that
+// matches ignoring case, spacing and punctuation. ISBN matches come first.
+func FindDuplicateBooks(db *sql.DB, isbn13, title string, authors []string, exclude uuid.UUID) ([]DuplicateBook, error) {
+	rows, err := db.Query(`
+		SELECT `+bookColumns+`,
+			CASE WHEN books.isbn = $1 THEN '`+DuplicateISBN+`' ELSE '`+DuplicateTitleAuthor+`' END AS reason
+		FROM `+bookFrom+`
+		WHERE books.id <> $4 AND (
+			books.isbn = $1
+			OR (`+titleKey("books.title")+` = `+titleKey("$2")+` AND EXISTS (
+				SELECT 1 FROM unnest($3::text[]) n
+				WHERE lower(regexp_replace(n, '[^[:alnum:]]+', '', 'g')) IN (
+					SELECT a.name_key FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+					WHERE ba.book_id = books.id
+				)
+			))
+		)
+		ORDER BY reason, books.created_at
+		LIMIT 20
+	`, isbn13, title, pq.Array(authors), exclude)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var duplicates []DuplicateBook
+	for rows.Next() {
+		var reason string
+		book, err := scanBook(rowScanner(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &reason)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, DuplicateBook{Book: *book, Reason: reason})
+	}
+	return duplicates, rows.Err()
+}
@@ -1,15 +1,25 @@
 package middleware
 
 import (
+	"bookstore/isbn"
 	"bookstore/models"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Queryer is implemented by both *sql.DB and *sql.Tx, for writes that may
+// run on their own or as part of a caller's transaction.
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // HashPassword hashes the password for secure storage
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -22,54 +32,129 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-// LoginUser authenticates a user and returns the full user object
-func LoginUser(db *sql.DB, username, password string) (*models.User, error) {
-	fmt.Printf("Attempting login for username: %s\n", username)
+// ErrInvalidCredentials is returned for an unknown username or a wrong password.
+var ErrInvalidCredentials = errors.New("invalid credentials")
 
-	var user models.User
-	var passwordHash string
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
 
-	err := db.QueryRow(`
-		SELECT id, username, password_hash, role, email, first_name, last_name, created_at 
-		FROM users 
-		WHERE username = $1
-	`, username).Scan(
-		&user.ID,
-		&user.Username,
-		&passwordHash,
-		&user.Role,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.CreatedAt,
-	)
+// compareWithDummyHash spends the same bcrypt work as a real password check,
+// so unknown usernames take as long to reject as wrong passwords.
+func compareWithDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("bookstore-dummy-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
 
+// LoginUser authenticates a user and returns the full user object
+func LoginUser(db *sql.DB, username, password string) (*models.User, error) {
+	var passwordHash string
+	err := db.QueryRow("SELECT password_hash FROM users WHERE username = $1", username).Scan(&passwordHash)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			fmt.Printf("No user found with username: %s\n", username)
-			return nil, fmt.Errorf("invalid credentials")
+			compareWithDummyHash(password)
+			return nil, ErrInvalidCredentials
 		}
-		fmt.Printf("Database error: %v\n", err)
 		return nil, err
 	}
 
 	// Check password match
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
-		fmt.Printf("Password comparison failed: %v\n", err)
-		return nil, fmt.Errorf("invalid credentials")
+		return nil, ErrInvalidCredentials
+	}
+
+	user, err := GetUserByUsername(db, username)
+	if err != nil {
+		return nil, err
 	}
 
-	user.PasswordHash = "" // Clear password hash before returning
-	return &user, nil
+	if user.Disabled {
+		return nil, fmt.Errorf("account disabled")
+	}
+
+	if !user.Active {
+		return nil, fmt.Errorf("account not verified")
+	}
+
+	return user, nil
+}
+
+// ErrBookNotFound is returned when no book matches the given ID.
+var ErrBookNotFound = errors.New("book not found")
+
+// bookColumns come from bookFrom, which joins each book with the price in
+// effect now and its cover, if any.
+const bookColumns = `books.id, books.title, books.author, books.published_at, books.genre, books.restricted,
+	books.age_rating, books.isbn, bc.etag, books.created_at, p.id, p.currency, p.list_price, p.sale_price, p.effective_at, p.created_by, p.created_at`
+
+const bookFrom = `books LEFT JOIN LATERAL (
+		SELECT ` + priceColumns + ` FROM book_prices
+		WHERE book_id = books.id AND effective_at <= NOW()
+		ORDER BY effective_at DESC, id DESC
+		LIMIT 1
+	) p ON TRUE
+	LEFT JOIN book_covers bc ON bc.book_id = books.id`
+
+func scanBook(row interface{ Scan(...interface{}) error }) (*models.Book, error) {
+	var book models.Book
+	var publishedAt sql.NullTime
+	var priceID, listPrice, salePrice sql.NullInt64
+	var isbn13, coverETag, currency, createdBy sql.NullString
+	var effectiveAt, priceCreatedAt sql.NullTime
+	err := row.Scan(
+		&book.ID,
+		&book.Title,
+		&book.Author,
+		&publishedAt,
+		&book.Genre,
+		&book.Restricted,
+		&book.AgeRating,
+		&isbn13,
+		&coverETag,
+		&book.CreatedAt,
+		&priceID,
+		&currency,
+		&listPrice,
+		&salePrice,
+		&effectiveAt,
+		&createdBy,
+		&priceCreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if publishedAt.Valid {
+		book.PublishedAt = &publishedAt.Time
+	}
+	if isbn13.Valid {
+		book.ISBN13 = isbn13.String
+		// 979 ISBNs have no ISBN-10 form and leave it empty.
+		book.ISBN10, _ = isbn.To10(isbn13.String)
+	}
+	book.CoverETag = coverETag.String
+	if priceID.Valid {
+		book.Price = &models.Price{
+			ID:          priceID.Int64,
+			BookID:      book.ID,
+			Currency:    currency.String,
+			ListPrice:   listPrice.Int64,
+			EffectiveAt: effectiveAt.Time,
+			CreatedBy:   createdBy.String,
+			CreatedAt:   priceCreatedAt.Time,
+		}
+		if salePrice.Valid {
+			book.Price.SalePrice = &salePrice.Int64
+		}
+	}
+	return &book, nil
 }
 
 // GetBooks retrieves all books from the database
 func GetBooks(db *sql.DB) ([]models.Book, error) {
-	rows, err := db.Query(`
-		SELECT id, title, author, published_at, created_by, created_at 
-		FROM books
-		ORDER BY created_at DESC
-	`)
+	rows, err := db.Query("SELECT " + bookColumns + " FROM " + bookFrom + " ORDER BY books.created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -77,22 +162,23 @@ func GetBooks(db *sql.DB) ([]models.Book, error) {
 
 	var books []models.Book
 	for rows.Next() {
-		var book models.Book
-		err := rows.Scan(
-			&book.ID,
-			&book.Title,
-			&book.Author,
-			&book.PublishedAt,
-
-			&book.CreatedAt,
-		)
+		book, err := scanBook(rows)
 		if err != nil {
 			return nil, err
 		}
-		books = append(books, book)
+		books = append(books, *book)
 	}
 
-	return books, nil
+	return books, rows.Err()
+}
+
+// GetBookByID retrieves a single book by ID
+func GetBookByID(db *sql.DB, id uuid.UUID) (*models.Book, error) {
+	book, err := scanBook(db.QueryRow("SELECT "+bookColumns+" FROM "+bookFrom+" WHERE books.id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrBookNotFound
+	}
+	return book, err
 }
 
 // CreateBook creates a new book in the database
@@ -164,15 +250,3 @@ func DeleteBook(db *sql.DB, bookID uuid.UUID, userID uuid.UUID) error {
 
 	return nil
 }
-
-func GetUserRole(db *sql.DB, username string) (string, error) {
-	var role string
-	err := db.QueryRow("SELECT role FROM users WHERE username = $1", username).Scan(&role)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("no user found with username %s", username)
-		}
-		return "", err
-	}
-	return role, nil
-}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CreateOIDCState stores the nonce and PKCE verifier of a new authorization
+// request and returns the state value that identifies it.
+func CreateOIDCState(db *sql.DB, nonce, verifier string, ttl time.Duration) (string, error) {
+	state, hash, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO oidc_login_states (state_hash, nonce, verifier, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, hash, nonce, verifier, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// ConsumeOIDCState looks up and deletes an authorization request
+func ConsumeOIDCState(db *sql.DB, state string) (nonce, verifier string, err error) {
+	err = db.QueryRow(`
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING nonce, verifier
+	`, HashToken(state)).Scan(&nonce, &verifier)
+	if err == sql.ErrNoRows {
+		return "", "", ErrInvalidToken
+	}
+	return nonce, verifier, err
+}
+
+// GetUserByOIDCSubject finds the user linked to an identity provider subject
+func GetUserByOIDCSubject(db *sql.DB, issuer, subject string) (*models.User, error) {
+	user, err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+` FROM users WHERE oidc_issuer = $1 AND oidc_subject = $2
+	`, issuer, subject))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// LinkOIDCSubjectByEmail links an unlinked local account with a matching
+// email address to an identity provider subject and returns it. Only
+// active, enabled accounts that hold no role beyond viewer are linked, so
+// whoever controls the address at the provider cannot take over a staff
+// account; other matches return ErrUserNotFound.
+func LinkOIDCSubjectByEmail(db *sql.DB, email, issuer, subject string) (*models.User, error) {
+	user, err := scanUser(db.QueryRow(`
+		UPDATE users SET oidc_issuer = $2, oidc_subject = $3
+		WHERE id = (
+			SELECT u.id FROM users u
+			WHERE LOWER(u.email) = LOWER($1) AND u.oidc_subject IS NULL
+				AND u.active AND NOT u.disabled
+				AND NOT EXISTS (
+					SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id AND ur.role_key <> 'viewer'
+				)
+			ORDER BY u.created_at
+			LIMIT 1
+		)
+		RETURNING `+userColumns+`
+	`, email, issuer, subject))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// OIDCManagesRoles reports whether the user's permanent roles follow the
+// identity provider's claims, which is the case for accounts it created.
+func OIDCManagesRoles(db *sql.DB, userID uuid.UUID) (bool, error) {
+	var managed bool
+	err := db.QueryRow("SELECT oidc_managed_roles FROM users WHERE id = $1", userID).Scan(&managed)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	return managed, err
+}
+
+// CreateOIDCUser provisions an active account for an identity provider
+// subject, whose roles then follow the provider's claims. The account gets
+// a random password so it can only sign in through the provider until an
+// admin sets one.
+func CreateOIDCUser(db *sql.DB, user *models.User, issuer, subject string) error {
+	password, _, err := NewToken()
+	if err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user.Active = true
+	if err := createUser(tx, user, hash); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE users SET oidc_issuer = $1, oidc_subject = $2, oidc_managed_roles = TRUE WHERE id = $3
+	`, issuer, subject, user.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UsernameAvailable reports whether no user has the given username
+func UsernameAvailable(db *sql.DB, username string) (bool, error) {
+	var taken bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", username).Scan(&taken)
+	return !taken, err
+}
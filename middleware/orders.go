@@ -0,0 +1,359 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrOrderNotFound is returned when no order matches the ID.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrOrderChanged is returned when an order left the state a transition
+	// started from before it could be applied.
+	ErrOrderChanged = errors.New("order was changed by someone else")
+)
+
+// ListCart retrieves the books in a user's cart with their current prices
+func ListCart(db *sql.DB, userID uuid.UUID) ([]models.CartItem, error) {
+	rows, err := db.Query(`
+		SELECT `+bookColumns+`, c.quantity, c.added_at
+		FROM `+bookFrom+` JOIN cart_items c ON c.book_id = books.id
+		WHERE c.user_id = $1
+		ORDER BY c.added_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.CartItem
+	for rows.Next() {
+		var item models.CartItem
+		book, err := scanBook(rowScanner(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &item.Quantity, &item.AddedAt)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		item.BookID = book.ID
+		item.Title = book.Title
+		item.Price = book.Price
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// rowScanner adapts a function to the Scan method scanBook and friends
+// expect, so extra columns can be scanned alongside theirs.
+type rowScanner func(dest ...interface{}) error
+
+func (f rowScanner) Scan(dest ...interface{}) error {
+	return f(dest...)
+}
+
+// AddToCart puts quantity more copies of a book in a user's cart
+func AddToCart(db *sql.DB, userID, bookID uuid.UUID, quantity int) error {
+	_, err := db.Exec(`
+		INSERT INTO cart_items (user_id, book_id, quantity)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, book_id) DO UPDATE
+		SET quantity = cart_items.quantity + EXCLUDED.quantity
+	`, userID, bookID, quantity)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrBookNotFound
+	}
+	return err
+}
+
+// SetCartQuantity changes how many copies of a book are in a user's cart,
+// removing the book at zero.
+func SetCartQuantity(db *sql.DB, userID, bookID uuid.UUID, quantity int) error {
+	if quantity <= 0 {
+		_, err := db.Exec("DELETE FROM cart_items WHERE user_id = $1 AND book_id = $2", userID, bookID)
+		return err
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO cart_items (user_id, book_id, quantity)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, book_id) DO UPDATE
+		SET quantity = EXCLUDED.quantity
+	`, userID, bookID, quantity)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrBookNotFound
+	}
+	return err
+}
+
+// CreateOrder stores a pending order, reserves stock for its items and
+// empties the customer's cart, all or nothing. It fails with
+// ErrInsufficientStock when a book lacks available copies.
+func CreateOrder(db *sql.DB, order *models.Order) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order.ID = uuid.New()
+	order.Status = models.OrderPending
+	err = tx.QueryRow(`
+		INSERT INTO orders (id, user_id, customer, status, currency, total)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at
+	`,
+		order.ID,
+		order.UserID,
+		order.Customer,
+		order.Status,
+		order.Currency,
+		order.Total,
+	).Scan(&order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range order.Items {
+		_, err := tx.Exec(`
+			INSERT INTO order_items (order_id, book_id, title, quantity, unit_price)
+			VALUES ($1, $2, $3, $4, $5)
+		`, order.ID, item.BookID, item.Title, item.Quantity, item.UnitPrice)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`
+			UPDATE book_stock SET reserved = reserved + $2, updated_at = NOW()
+			WHERE book_id = $1 AND on_hand - reserved >= $2
+		`, item.BookID, item.Quantity)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(result, fmt.Errorf("%w: %s", ErrInsufficientStock, item.Title)); err != nil {
+			return err
+		}
+	}
+
+	if err := recordOrderEvent(tx, order.ID, "", order.Status, order.Customer, ""); err != nil {
+		return err
+	}
+	if order.UserID != nil {
+		if _, err := tx.Exec("DELETE FROM cart_items WHERE user_id = $1", *order.UserID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func recordOrderEvent(tx *sql.Tx, orderID uuid.UUID, from, to, actor, note string) error {
+	_, err := tx.Exec(`
+		INSERT INTO order_events (order_id, from_status, to_status, actor, note)
+		VALUES ($1, $2, $3, $4, $5)
+	`, orderID, from, to, actor, note)
+	return err
+}
+
+const orderColumns = "id, user_id, customer, status, currency, total, created_at, updated_at"
+
+func scanOrder(row interface{ Scan(...interface{}) error }) (*models.Order, error) {
+	var order models.Order
+	var userID uuid.NullUUID
+	err := row.Scan(
+		&order.ID,
+		&userID,
+		&order.Customer,
+		&order.Status,
+		&order.Currency,
+		&order.Total,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if userID.Valid {
+		order.UserID = &userID.UUID
+	}
+	return &order, nil
+}
+
+func queryOrders(db *sql.DB, query string, args ...interface{}) ([]models.Order, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// GetOrder retrieves a single order with its items
+func GetOrder(db *sql.DB, id uuid.UUID) (*models.Order, error) {
+	order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT book_id, title, quantity, unit_price
+		FROM order_items WHERE order_id = $1 ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.OrderItem
+		var bookID uuid.NullUUID
+		if err := rows.Scan(&bookID, &item.Title, &item.Quantity, &item.UnitPrice); err != nil {
+			return nil, err
+		}
+		if bookID.Valid {
+			item.BookID = &bookID.UUID
+		}
+		order.Items = append(order.Items, item)
+	}
+	return order, rows.Err()
+}
+
+// ListOrders retrieves the latest orders, optionally only those in status
+func ListOrders(db *sql.DB, status string, limit int) ([]models.Order, error) {
+	return queryOrders(db, `
+		SELECT `+orderColumns+` FROM orders
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, status, limit)
+}
+
+// ListUserOrders retrieves the latest orders of a customer
+func ListUserOrders(db *sql.DB, userID uuid.UUID, limit int) ([]models.Order, error) {
+	return queryOrders(db, `
+		SELECT `+orderColumns+` FROM orders
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, limit)
+}
+
+// ListOrderEvents retrieves the state changes of an order, oldest first
+func ListOrderEvents(db *sql.DB, orderID uuid.UUID) ([]models.OrderEvent, error) {
+	rows, err := db.Query(`
+		SELECT id, order_id, from_status, to_status, actor, note, created_at
+		FROM order_events WHERE order_id = $1
+		ORDER BY created_at, id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.OrderEvent
+	for rows.Next() {
+		var e models.OrderEvent
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.FromStatus, &e.ToStatus, &e.Actor, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// TransitionOrder moves an order from one state to another and settles its
+// reserved stock: shipping takes the copies off the shelf with a "sold"
+// movement, and cancelling or refunding an order that has not shipped
+// releases them. It fails with ErrOrderChanged if the order is no longer in
+// state from. Whether the transition is allowed is up to the caller.
+func TransitionOrder(db *sql.DB, order *models.Order, to, actor, note string) error {
+	return TransitionOrderWith(db, order, to, actor, note, nil)
+}
+
+// TransitionOrderWith is like TransitionOrder, but calls settle once the
+// transition is claimed. settle writes through the transaction it is given,
+// so its changes are committed together with the transition or not at all.
+func TransitionOrderWith(db *sql.DB, order *models.Order, to, actor, note string, settle func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	from := order.Status
+	err = tx.QueryRow(`
+		UPDATE orders SET status = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3
+		RETURNING updated_at
+	`, to, order.ID, from).Scan(&order.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrOrderChanged
+	}
+	if err != nil {
+		return err
+	}
+
+	shipping := to == models.OrderShipped
+	releasing := (to == models.OrderCancelled || to == models.OrderRefunded) && from != models.OrderShipped
+	for _, item := range order.Items {
+		if item.BookID == nil || !(shipping || releasing) {
+			continue
+		}
+
+		onHand := 0
+		if shipping {
+			onHand = item.Quantity
+		}
+		_, err := tx.Exec(`
+			UPDATE book_stock
+			SET on_hand = on_hand - $2, reserved = reserved - $3, updated_at = NOW()
+			WHERE book_id = $1
+		`, *item.BookID, onHand, item.Quantity)
+		if err != nil {
+			return stockError(err)
+		}
+
+		if shipping {
+			_, err := tx.Exec(`
+				INSERT INTO stock_movements (book_id, kind, quantity, reason, created_by)
+				VALUES ($1, $2, $3, $4, $5)
+			`, *item.BookID, models.StockSold, -item.Quantity, "order "+order.ID.String(), actor)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := recordOrderEvent(tx, order.ID, from, to, actor, note); err != nil {
+		return err
+	}
+	if settle != nil {
+		if err := settle(tx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	order.Status = to
+	return nil
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FindUsersForReset returns the active accounts matching a username or an
+// email address. Several accounts may share one address.
+func FindUsersForReset(db *sql.DB, identifier string) ([]models.User, error) {
+	rows, err := db.Query(`
+		SELECT `+userColumns+`
+		FROM users
+		WHERE (username = $1 OR LOWER(email) = LOWER($1)) AND email <> '' AND active AND NOT disabled
+	`, identifier)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// CreatePasswordReset stores a single-use reset token for a user and returns
+// the plain token to be mailed.
+func CreatePasswordReset(db *sql.DB, userID uuid.UUID, ttl time.Duration) (string, error) {
+	token, hash, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO password_resets (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hash, userID, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CheckPasswordReset reports whether a reset token can still be used
+func CheckPasswordReset(db *sql.DB, token string) error {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM password_resets
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		)
+	`, HashToken(token)).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// ResetPassword consumes a reset token, sets the new password, voids the
+// user's other outstanding reset tokens, ends all of their sessions and
+// revokes their API tokens.
+func ResetPassword(db *sql.DB, token, password string) (uuid.UUID, error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE password_resets
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, HashToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrInvalidToken
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := setPasswordHash(tx, userID, hash); err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrPaymentNotFound is returned when no payment matches.
+	ErrPaymentNotFound = errors.New("payment not found")
+	// ErrPaymentInProgress is returned when starting a payment for an
+	// order that already has one pending, authorized or captured.
+	ErrPaymentInProgress = errors.New("this order already has a payment in progress")
+)
+
+const paymentColumns = `id, order_id, provider, idempotency_key, COALESCE(provider_ref, ''),
+	status, amount, currency, error, created_by, created_at, updated_at`
+
+func scanPayment(row interface{ Scan(...interface{}) error }) (*models.Payment, error) {
+	var p models.Payment
+	err := row.Scan(
+		&p.ID,
+		&p.OrderID,
+		&p.Provider,
+		&p.IdempotencyKey,
+		&p.ProviderRef,
+		&p.Status,
+		&p.Amount,
+		&p.Currency,
+		&p.Error,
+		&p.CreatedBy,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// StartPayment records a pending payment attempt, unless one with the same
+// idempotency key exists already, in which case that attempt is returned
+// instead and created is false. An order can have only one attempt that
+// has not failed or been refunded; a second one is ErrPaymentInProgress.
+func StartPayment(db *sql.DB, payment *models.Payment) (p *models.Payment, created bool, err error) {
+	p, err = scanPayment(db.QueryRow(`
+		INSERT INTO payments (id, order_id, provider, idempotency_key, amount, currency, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+paymentColumns,
+		uuid.New(),
+		payment.OrderID,
+		payment.Provider,
+		payment.IdempotencyKey,
+		payment.Amount,
+		payment.Currency,
+		payment.CreatedBy,
+	))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "payments_active_order_idx" {
+		return nil, false, ErrPaymentInProgress
+	}
+	if err != ErrPaymentNotFound {
+		return p, err == nil, err
+	}
+
+	p, err = GetPaymentByIdempotencyKey(db, payment.IdempotencyKey)
+	return p, false, err
+}
+
+// GetPaymentByIdempotencyKey retrieves the payment attempt made with key
+func GetPaymentByIdempotencyKey(db *sql.DB, key string) (*models.Payment, error) {
+	return scanPayment(db.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE idempotency_key = $1", key))
+}
+
+// UpdatePayment stores a payment's status, gateway reference and error.
+func UpdatePayment(db *sql.DB, payment *models.Payment) error {
+	return db.QueryRow(`
+		UPDATE payments
+		SET status = $2, provider_ref = NULLIF($3, ''), error = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, payment.ID, payment.Status, payment.ProviderRef, payment.Error).Scan(&payment.UpdatedAt)
+}
+
+// GetPaymentByProviderRef retrieves the payment a gateway knows as ref
+func GetPaymentByProviderRef(db *sql.DB, provider, ref string) (*models.Payment, error) {
+	return scanPayment(db.QueryRow(`
+		SELECT `+paymentColumns+` FROM payments
+		WHERE provider = $1 AND provider_ref = $2
+	`, provider, ref))
+}
+
+// ListOrderPayments retrieves the payment attempts of an order, oldest first
+func ListOrderPayments(db *sql.DB, orderID uuid.UUID) ([]models.Payment, error) {
+	return queryPayments(db, `
+		SELECT `+paymentColumns+` FROM payments
+		WHERE order_id = $1
+		ORDER BY created_at
+	`, orderID)
+}
+
+// ListRefundPendingPayments retrieves the payments still to be given back,
+// oldest first
+func ListRefundPendingPayments(db *sql.DB) ([]models.Payment, error) {
+	return queryPayments(db, `
+		SELECT `+paymentColumns+` FROM payments
+		WHERE status = $1
+		ORDER BY updated_at
+	`, models.PaymentRefundPending)
+}
+
+// MarkOrderRefundPending marks the captured payments of an order as to be
+// refunded, within the caller's transaction.
+func MarkOrderRefundPending(tx *sql.Tx, orderID uuid.UUID) error {
+	_, err := tx.Exec(`
+		UPDATE payments SET status = $2, updated_at = NOW()
+		WHERE order_id = $1 AND status = $3
+	`, orderID, models.PaymentRefundPending, models.PaymentCaptured)
+	return err
+}
+
+func queryPayments(db *sql.DB, query string, args ...interface{}) ([]models.Payment, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []models.Payment
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
+
+// RecordPaymentEvent remembers a webhook event. It reports false if the
+// event was recorded and reconciled before; an event whose reconciliation
+// never finished is handed out again.
+func RecordPaymentEvent(db *sql.DB, provider, eventID, eventType, ref string, amount int64, currency string) (bool, error) {
+	result, err := db.Exec(`
+		INSERT INTO payment_events (provider, event_id, type, provider_ref, amount, currency)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (provider, event_id) DO UPDATE
+		SET received_at = NOW()
+		WHERE payment_events.result = ''
+	`, provider, eventID, eventType, ref, amount, currency)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// SetPaymentEventResult stores what reconciling a webhook event did
+func SetPaymentEventResult(db *sql.DB, provider, eventID, result string) error {
+	_, err := db.Exec(`
+		UPDATE payment_events SET result = $3
+		WHERE provider = $1 AND event_id = $2
+	`, provider, eventID, result)
+	return err
+}
@@ -22,19 +22,23 @@ func NewPermissionChecker(permitClient *permit.Client, db *sql.DB) *PermissionCh
 }
 
 func (pc *PermissionChecker) CheckPermission(username, action string) (enforcement.User, error) {
-	role, err := GetUserRole(pc.db, username)
+	account, err := GetUserByUsername(pc.db, username)
+	if err != nil {
+		return enforcement.User{}, fmt.Errorf("user lookup error: %w", err)
+	}
+	roles, err := EffectiveRoles(pc.db, account.Roles)
 	if err != nil {
 		return enforcement.User{}, fmt.Errorf("role lookup error: %w", err)
 	}
 
 	user := enforcement.UserBuilder(username).
-		WithAttributes(map[string]interface{}{"role": role}).
+		WithAttributes(map[string]interface{}{"roles": roles}).
 		Build()
 	resource := enforcement.ResourceBuilder("books").WithTenant("default").Build()
 
 	permitted, err := pc.permitClient.Check(user, enforcement.Action(action), resource)
 	if err != nil || !permitted {
-		return enforcement.User{}, fmt.Errorf("access denied for user %s with role %s", username, role)
+		return enforcement.User{}, fmt.Errorf("access denied for user %s with roles %v", username, roles)
 	}
 
 	return user, nil
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrPriceNotFound is returned when no scheduled price matches the ID.
+var ErrPriceNotFound = errors.New("scheduled price not found")
+
+const priceColumns = "id, currency, list_price, sale_price, effective_at, created_by, created_at"
+
+// ListPrices retrieves every price of a book, scheduled ones included,
+// latest first.
+func ListPrices(db *sql.DB, bookID uuid.UUID) ([]models.Price, error) {
+	rows, err := db.Query(`
+		SELECT `+priceColumns+` FROM book_prices
+		WHERE book_id = $1
+		ORDER BY effective_at DESC, id DESC
+	`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prices []models.Price
+	for rows.Next() {
+		price := models.Price{BookID: bookID}
+		var salePrice sql.NullInt64
+		err := rows.Scan(
+			&price.ID,
+			&price.Currency,
+			&price.ListPrice,
+			&salePrice,
+			&price.EffectiveAt,
+			&price.CreatedBy,
+			&price.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if salePrice.Valid {
+			price.SalePrice = &salePrice.Int64
+		}
+		prices = append(prices, price)
+	}
+	return prices, rows.Err()
+}
+
+// CreatePrice adds a price to a book's history, in effect from
+// price.EffectiveAt on.
+func CreatePrice(db *sql.DB, price *models.Price) error {
+	err := db.QueryRow(`
+		INSERT INTO book_prices (book_id, currency, list_price, sale_price, effective_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`,
+		price.BookID,
+		price.Currency,
+		price.ListPrice,
+		price.SalePrice,
+		price.EffectiveAt,
+		price.CreatedBy,
+	).Scan(&price.ID, &price.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrBookNotFound
+	}
+	return err
+}
+
+// DeleteScheduledPrice cancels a price change that has not taken effect
+// yet. Prices that already applied stay in the history.
+func DeleteScheduledPrice(db *sql.DB, bookID uuid.UUID, id int64) error {
+	result, err := db.Exec(`
+		DELETE FROM book_prices
+		WHERE id = $1 AND book_id = $2 AND effective_at > NOW()
+	`, id, bookID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrPriceNotFound)
+}
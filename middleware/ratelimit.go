@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter allows at most Limit events per key within a sliding Window.
+// State is kept in memory, so limits are per process.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+// Rejected events are not recorded.
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-rl.window)
+
+	recent := rl.events[key][:0]
+	for _, t := range rl.events[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= rl.limit {
+		rl.events[key] = recent
+		return false
+	}
+
+	rl.events[key] = append(recent, now)
+
+	// Drop keys that have gone quiet so the map does not grow forever.
+	if len(rl.events) > 10000 {
+		for k, ts := range rl.events {
+			if len(ts) == 0 || !ts[len(ts)-1].After(cutoff) {
+				delete(rl.events, k)
+			}
+		}
+	}
+	return true
+}
+
+// ClientIP returns the IP address of the remote end of the connection.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,320 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrRoleNotFound is returned when no role matches the given key.
+	ErrRoleNotFound = errors.New("role not found")
+	// ErrBuiltinRole is returned when deleting a role the migrations created.
+	ErrBuiltinRole = errors.New("built-in roles cannot be deleted")
+	// ErrRoleCycle is returned when a role would end up extending itself.
+	ErrRoleCycle = errors.New("a role cannot extend itself, directly or through other roles")
+	// ErrGrantNotFound is returned when the user does not hold the role.
+	ErrGrantNotFound = errors.New("role grant not found")
+)
+
+const roleColumns = "key, name, description, COALESCE(extends, ''), builtin, created_at"
+
+func scanRole(row interface{ Scan(...interface{}) error }) (*models.Role, error) {
+	var role models.Role
+	err := row.Scan(
+		&role.Key,
+		&role.Name,
+		&role.Description,
+		&role.Extends,
+		&role.Builtin,
+		&role.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// ListRoles retrieves all roles ordered by key
+func ListRoles(db *sql.DB) ([]models.Role, error) {
+	rows, err := db.Query("SELECT " + roleColumns + " FROM roles ORDER BY key")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []models.Role
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, *role)
+	}
+	return roles, rows.Err()
+}
+
+// GetRole retrieves a single role by key
+func GetRole(db *sql.DB, key string) (*models.Role, error) {
+	role, err := scanRole(db.QueryRow("SELECT "+roleColumns+" FROM roles WHERE key = $1", key))
+	if err == sql.ErrNoRows {
+		return nil, ErrRoleNotFound
+	}
+	return role, err
+}
+
+// CreateRole inserts a custom role
+func CreateRole(db *sql.DB, role *models.Role) error {
+	role.Builtin = false
+	return db.QueryRow(`
+		INSERT INTO roles (key, name, description, extends)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		RETURNING created_at
+	`, role.Key, role.Name, role.Description, role.Extends).Scan(&role.CreatedAt)
+}
+
+// UpdateRole saves the name, description and parent of a role. It refuses
+// a parent that already extends the role.
+func UpdateRole(db *sql.DB, role *models.Role) error {
+	if role.Extends != "" {
+		var cycle bool
+		err := db.QueryRow(`
+			WITH RECURSIVE ancestors(key) AS (
+				SELECT $1::TEXT
+				UNION
+				SELECT r.extends FROM roles r JOIN ancestors a ON r.key = a.key WHERE r.extends IS NOT NULL
+			)
+			SELECT EXISTS (SELECT 1 FROM ancestors WHERE key = $2)
+		`, role.Extends, role.Key).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrRoleCycle
+		}
+	}
+
+	result, err := db.Exec(`
+		UPDATE roles SET name = $1, description = $2, extends = NULLIF($3, '')
+		WHERE key = $4
+	`, role.Name, role.Description, role.Extends, role.Key)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrRoleNotFound)
+}
+
+// DeleteRole removes a custom role together with its grants
+func DeleteRole(db *sql.DB, key string) error {
+	role, err := GetRole(db, key)
+	if err != nil {
+		return err
+	}
+	if role.Builtin {
+		return ErrBuiltinRole
+	}
+
+	result, err := db.Exec("DELETE FROM roles WHERE key = $1", key)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrRoleNotFound)
+}
+
+// UnknownRoles returns the keys in roles that no role has.
+func UnknownRoles(db *sql.DB, roles []string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT k FROM UNNEST($1::TEXT[]) AS k
+		WHERE NOT EXISTS (SELECT 1 FROM roles WHERE key = k)
+	`, pq.Array(roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unknown []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		unknown = append(unknown, key)
+	}
+	return unknown, rows.Err()
+}
+
+// EffectiveRoles expands roles with every role they extend, directly or
+// through other roles.
+func EffectiveRoles(db *sql.DB, roles []string) ([]string, error) {
+	if len(roles) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+		WITH RECURSIVE effective(key) AS (
+			SELECT key FROM roles WHERE key = ANY($1)
+			UNION
+			SELECT r.extends FROM roles r JOIN effective e ON r.key = e.key WHERE r.extends IS NOT NULL
+		)
+		SELECT key FROM effective ORDER BY key
+	`, pq.Array(roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var effective []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		effective = append(effective, key)
+	}
+	return effective, rows.Err()
+}
+
+// ListUsersWithRole retrieves the enabled users holding role, directly or
+// through a role that extends it.
+func ListUsersWithRole(db *sql.DB, role string) ([]models.User, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE extending(key) AS (
+			SELECT key FROM roles WHERE key = $1
+			UNION
+			SELECT r.key FROM roles r JOIN extending e ON r.extends = e.key
+		)
+		SELECT `+userColumns+` FROM users
+		WHERE active AND NOT disabled AND EXISTS (
+			SELECT 1 FROM user_roles ur JOIN extending e ON ur.role_key = e.key
+			WHERE ur.user_id = users.id AND (ur.expires_at IS NULL OR ur.expires_at > NOW())
+		)
+		ORDER BY username
+	`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+const roleGrantColumns = "user_id, role_key, granted_by, expires_at, created_at"
+
+func scanRoleGrant(row interface{ Scan(...interface{}) error }) (*models.RoleGrant, error) {
+	var grant models.RoleGrant
+	var expiresAt sql.NullTime
+	err := row.Scan(
+		&grant.UserID,
+		&grant.Role,
+		&grant.GrantedBy,
+		&expiresAt,
+		&grant.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		grant.ExpiresAt = &expiresAt.Time
+	}
+	return &grant, nil
+}
+
+func queryRoleGrants(db *sql.DB, query string, args ...interface{}) ([]models.RoleGrant, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []models.RoleGrant
+	for rows.Next() {
+		grant, err := scanRoleGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, *grant)
+	}
+	return grants, rows.Err()
+}
+
+// ListRoleGrants retrieves the unexpired role grants of a user
+func ListRoleGrants(db *sql.DB, userID uuid.UUID) ([]models.RoleGrant, error) {
+	return queryRoleGrants(db, `
+		SELECT `+roleGrantColumns+` FROM user_roles
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY role_key
+	`, userID)
+}
+
+// GrantRole gives a user a role until expiresAt, or for good if expiresAt is
+// nil. An existing grant of the same role is replaced.
+func GrantRole(db Queryer, userID uuid.UUID, role, grantedBy string, expiresAt *time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO user_roles (user_id, role_key, granted_by, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, role_key) DO UPDATE
+		SET granted_by = EXCLUDED.granted_by, expires_at = EXCLUDED.expires_at, created_at = NOW()
+	`, userID, role, grantedBy, expiresAt)
+	return err
+}
+
+// RevokeRole takes a role away from a user
+func RevokeRole(db *sql.DB, userID uuid.UUID, role string) error {
+	result, err := db.Exec("DELETE FROM user_roles WHERE user_id = $1 AND role_key = $2", userID, role)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrGrantNotFound)
+}
+
+// SetUserRoles makes roles the user's permanent roles. Time-bound grants of
+// other roles are kept.
+func SetUserRoles(db *sql.DB, userID uuid.UUID, roles []string, grantedBy string) error {
+	if roles == nil {
+		roles = []string{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM user_roles
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at <= NOW()) AND role_key <> ALL($2)
+	`, userID, pq.Array(roles)); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if _, err := tx.Exec(`
+			INSERT INTO user_roles (user_id, role_key, granted_by)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, role_key) DO UPDATE
+			SET granted_by = EXCLUDED.granted_by, expires_at = NULL, created_at = NOW()
+			WHERE user_roles.expires_at IS NOT NULL
+		`, userID, role, grantedBy); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ExpireRoleGrants deletes the grants whose time is up and returns them.
+func ExpireRoleGrants(db *sql.DB) ([]models.RoleGrant, error) {
+	return queryRoleGrants(db, `
+		DELETE FROM user_roles WHERE expires_at <= NOW()
+		RETURNING `+roleGrantColumns)
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNoSession is returned when a session token is unknown or expired, or
+// belongs to a user who may no longer log in.
+var ErrNoSession = errors.New("no valid session")
+
+// CreateSession starts a new login session for a user and returns the
+// token to be stored in the session cookie.
+func CreateSession(db *sql.DB, userID uuid.UUID, ttl time.Duration) (string, error) {
+	token, hash, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO sessions (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hash, userID, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetSessionUser resolves a session token to the user it belongs to
+func GetSessionUser(db *sql.DB, token string) (*models.User, error) {
+	user, err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = (SELECT user_id FROM sessions WHERE token_hash = $1 AND expires_at > NOW())
+		AND active AND NOT disabled
+	`, HashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSession
+	}
+	return user, err
+}
+
+// DeleteSession ends a single session
+func DeleteSession(db *sql.DB, token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = $1", HashToken(token))
+	return err
+}
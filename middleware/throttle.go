@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// LoginThrottle slows down and eventually locks out repeated failed logins,
+// tracking usernames and client IPs separately.
+type LoginThrottle struct {
+	// FreeAttempts is how many failures are allowed before backoff starts.
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure beyond FreeAttempts. It
+	// doubles with every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// AccountThreshold and IPThreshold are the failure counts that trigger a
+	// lockout of LockoutDuration.
+	AccountThreshold int
+	IPThreshold      int
+	LockoutDuration  time.Duration
+	// ResetAfter forgets failures after this long without another one.
+	ResetAfter time.Duration
+}
+
+// DefaultLoginThrottle returns the settings used when none are configured.
+func DefaultLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		AccountThreshold: 10,
+		IPThreshold:      50,
+		LockoutDuration:  15 * time.Minute,
+		ResetAfter:       24 * time.Hour,
+	}
+}
+
+func accountKey(username string) string { return "user:" + username }
+func ipKey(ip string) string            { return "ip:" + ip }
+
+// attemptLease bounds how long a login attempt holds its account when it
+// never reports its outcome, e.g. because the server stopped.
+const attemptLease = 30 * time.Second
+
+// RetryAfter reports how long a login for username from ip must wait. Zero
+// means the attempt may go ahead; it then holds the account until it ends
+// with RecordFailure, RecordSuccess or Release, and other attempts on the
+// account wait for its outcome instead of passing the same check. The
+// client IP only counts failures, since many people may log in from one
+// office or NAT address at once.
+func (t *LoginThrottle) RetryAfter(db *sql.DB, username, ip string) (time.Duration, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	account := accountKey(username)
+	wait, err := t.retryAfter(tx, account, true)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := t.retryAfter(tx, ipKey(ip), false)
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE login_throttle SET attempt_until = NOW() + $2 * INTERVAL '1 second' WHERE key = $1
+	`, account, attemptLease.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit()
+}
+
+// retryAfter reports how long an attempt on key must wait. With lease set
+// the row of key is created if need be and locked, and an attempt already
+// in flight on it counts as a reason to wait.
+func (t *LoginThrottle) retryAfter(tx *sql.Tx, key string, lease bool) (time.Duration, error) {
+	query := "SELECT failures, last_failure_at, locked_until, attempt_until FROM login_throttle WHERE key = $1"
+	if lease {
+		_, err := tx.Exec(`
+			INSERT INTO login_throttle (key, failures, last_failure_at) VALUES ($1, 0, NOW())
+			ON CONFLICT (key) DO NOTHING
+		`, key)
+		if err != nil {
+			return 0, err
+		}
+		query += " FOR UPDATE"
+	}
+
+	var failures int
+	var lastFailure time.Time
+	var lockedUntil, attemptUntil sql.NullTime
+	err := tx.QueryRow(query, key).Scan(&failures, &lastFailure, &lockedUntil, &attemptUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		return lockedUntil.Time.Sub(now), nil
+	}
+	// Another attempt is in flight; it normally ends well within a second.
+	if lease && attemptUntil.Valid && attemptUntil.Time.After(now) {
+		return time.Second, nil
+	}
+	if now.Sub(lastFailure) > t.ResetAfter {
+		return 0, nil
+	}
+
+	if wait := lastFailure.Add(t.backoff(failures)).Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (t *LoginThrottle) backoff(failures int) time.Duration {
+	over := failures - t.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	d := time.Duration(float64(t.BaseDelay) * math.Pow(2, float64(over-1)))
+	if d > t.MaxDelay || d <= 0 {
+		return t.MaxDelay
+	}
+	return d
+}
+
+// RecordFailure counts a failed login and reports whether it locked the
+// account.
+func (t *LoginThrottle) RecordFailure(db *sql.DB, username, ip string) (bool, error) {
+	accountLocked, err := t.recordFailure(db, accountKey(username), t.AccountThreshold)
+	if err != nil {
+		return false, err
+	}
+	if _, err := t.recordFailure(db, ipKey(ip), t.IPThreshold); err != nil {
+		return false, err
+	}
+	return accountLocked, nil
+}
+
+func (t *LoginThrottle) recordFailure(db *sql.DB, key string, threshold int) (bool, error) {
+	var failures int
+	err := db.QueryRow(`
+		INSERT INTO login_throttle (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttle.last_failure_at < NOW() - $2 * INTERVAL '1 second' THEN 1
+				ELSE login_throttle.failures + 1
+			END,
+			last_failure_at = NOW(),
+			attempt_until = NULL
+		RETURNING failures
+	`, key, t.ResetAfter.Seconds()).Scan(&failures)
+	if err != nil {
+		return false, err
+	}
+
+	if failures < threshold {
+		return false, nil
+	}
+
+	// Lock and start counting afresh once the lockout ends.
+	_, err = db.Exec(`
+		UPDATE login_throttle SET failures = 0, locked_until = $2 WHERE key = $1
+	`, key, time.Now().Add(t.LockoutDuration))
+	return true, err
+}
+
+// RecordSuccess clears the failure count of an account after a good login.
+// The IP counter is left alone so one valid account cannot be used to reset
+// an attacker's address.
+func (t *LoginThrottle) RecordSuccess(db *sql.DB, username string) error {
+	_, err := db.Exec("DELETE FROM login_throttle WHERE key = $1", accountKey(username))
+	return err
+}
+
+// Release ends an attempt that neither failed nor succeeded, such as a
+// right password still waiting for its second factor, dropping the
+// account's row if it holds nothing else.
+func (t *LoginThrottle) Release(db *sql.DB, username string) error {
+	key := accountKey(username)
+	_, err := db.Exec(`
+		DELETE FROM login_throttle
+		WHERE key = $1 AND failures = 0 AND (locked_until IS NULL OR locked_until <= NOW())
+	`, key)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE login_throttle SET attempt_until = NULL WHERE key = $1", key)
+	return err
+}
+
+// AccountLockedUntil returns when an account's lockout ends, or the zero time
+// if it is not locked.
+func AccountLockedUntil(db *sql.DB, username string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := db.QueryRow(`
+		SELECT locked_until FROM login_throttle WHERE key = $1 AND locked_until > NOW()
+	`, accountKey(username)).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// UnlockAccount clears an account's lockout and failure count
+func UnlockAccount(db *sql.DB, username string) error {
+	_, err := db.Exec("DELETE FROM login_throttle WHERE key = $1", accountKey(username))
+	return err
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle := DefaultLoginThrottle()
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{9, 32 * time.Second},
+		{10, time.Minute},
+		{40, time.Minute},
+		// Large exponents overflow the duration; the wait stays capped.
+		{200, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := throttle.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottleBackoffSettings(t *testing.T) {
+	throttle := &LoginThrottle{FreeAttempts: 0, BaseDelay: 500 * time.Millisecond, MaxDelay: 3 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 500 * time.Millisecond},
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{4, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := throttle.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottleConcurrentAttempts(t *testing.T) {
+	db, _ := newThrottleDB(t)
+	throttle := DefaultLoginThrottle()
+	const office = "203.0.113.7"
+
+	// Alice's attempt is still in flight when Bob logs in from the same
+	// address: the shared IP must not make him wait.
+	if wait, err := throttle.RetryAfter(db, "alice", office); err != nil || wait != 0 {
+		t.Fatalf("alice: wait = %v, %v; want 0", wait, err)
+	}
+	if wait, err := throttle.RetryAfter(db, "bob", office); err != nil || wait != 0 {
+		t.Fatalf("bob from the same IP: wait = %v, %v; want 0", wait, err)
+	}
+
+	// A second attempt on Alice's account waits for the first, whatever
+	// address it comes from.
+	if wait, err := throttle.RetryAfter(db, "alice", "198.51.100.1"); err != nil || wait != time.Second {
+		t.Fatalf("alice again: wait = %v, %v; want 1s", wait, err)
+	}
+
+	// Once her attempt fails, the account is free again.
+	if _, err := throttle.RecordFailure(db, "alice", office); err != nil {
+		t.Fatal(err)
+	}
+	if err := throttle.RecordSuccess(db, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := throttle.RetryAfter(db, "alice", office); err != nil || wait != 0 {
+		t.Fatalf("alice after her failure: wait = %v, %v; want 0", wait, err)
+	}
+}
+
+func TestLoginThrottleIPFailures(t *testing.T) {
+	db, _ := newThrottleDB(t)
+	throttle := &LoginThrottle{FreeAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Minute,
+		AccountThreshold: 100, IPThreshold: 3, LockoutDuration: time.Minute, ResetAfter: time.Hour}
+	const ip = "203.0.113.7"
+
+	// Failures on different accounts still add up for their address.
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if wait, err := throttle.RetryAfter(db, username, ip); err != nil || wait != 0 {
+			t.Fatalf("%s: wait = %v, %v; want 0", username, wait, err)
+		}
+		if _, err := throttle.RecordFailure(db, username, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, err := throttle.RetryAfter(db, "dave", ip); err != nil || wait <= 0 {
+		t.Fatalf("dave from a locked out IP: wait = %v, %v; want a lockout", wait, err)
+	}
+	if wait, err := throttle.RetryAfter(db, "dave", "198.51.100.1"); err != nil || wait != 0 {
+		t.Fatalf("dave from another IP: wait = %v, %v; want 0", wait, err)
+	}
+}
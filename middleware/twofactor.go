@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpPeriod          = 30
+	recoveryCodeCount   = 10
+	maxChallengeAttempt = 5
+)
+
+// SetPendingTOTPSecret stores a freshly generated secret for a user who is
+// enrolling. It only takes effect once EnableTOTP confirms a code from it.
+func SetPendingTOTPSecret(db *sql.DB, userID uuid.UUID, secret string) error {
+	result, err := db.Exec(`
+		UPDATE users SET totp_secret = $1, totp_last_step = 0
+		WHERE id = $2 AND NOT totp_enabled
+	`, secret, userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+// EnableTOTP checks a code against the pending secret, turns on two-factor
+// authentication and returns a fresh set of recovery codes.
+func EnableTOTP(db *sql.DB, userID uuid.UUID, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep int64
+	err = tx.QueryRow(`
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE id = $1 AND NOT totp_enabled AND totp_secret <> ''
+		FOR UPDATE
+	`, userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := matchTOTP(secret, code, lastStep, time.Now())
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2", step, userID); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication and discards the secret
+// and recovery codes.
+func DisableTOTP(db *sql.DB, userID uuid.UUID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = '', totp_last_step = 0 WHERE id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code for a user with two-factor authentication enabled.
+func VerifySecondFactor(db *sql.DB, userID uuid.UUID, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep int64
+	err = tx.QueryRow(`
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE id = $1 AND totp_enabled
+		FOR UPDATE
+	`, userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := matchTOTP(secret, code, lastStep, time.Now()); ok {
+		if _, err := tx.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2", step, userID); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	result, err := tx.Exec(`
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE code_hash = $1 AND user_id = $2 AND used_at IS NULL
+	`, HashToken(strings.ToUpper(strings.ReplaceAll(code, "-", ""))), userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces all of a user's recovery codes
+func RegenerateRecoveryCodes(db *sql.DB, userID uuid.UUID) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func CountRecoveryCodes(db *sql.DB, userID uuid.UUID) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// CreateLoginChallenge records that a user passed the password step and
+// returns the token that lets them complete the second step.
+func CreateLoginChallenge(db *sql.DB, userID uuid.UUID, ttl time.Duration) (string, error) {
+	token, hash, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO login_challenges (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hash, userID, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AttemptLoginChallenge counts an attempt against a challenge and returns
+// its user. Challenges are dropped after too many attempts.
+func AttemptLoginChallenge(db *sql.DB, token string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := db.QueryRow(`
+		UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING user_id
+	`, HashToken(token), maxChallengeAttempt).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrInvalidToken
+	}
+	return userID, err
+}
+
+// DeleteLoginChallenge removes a completed challenge
+func DeleteLoginChallenge(db *sql.DB, token string) error {
+	_, err := db.Exec("DELETE FROM login_challenges WHERE token_hash = $1", HashToken(token))
+	return err
+}
+
+// matchTOTP checks code against the steps around now, allowing one step of
+// clock drift, and only accepts steps newer than lastStep.
+func matchTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	if len(code) != 6 {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+		if _, err := tx.Exec("INSERT INTO recovery_codes (code_hash, user_id) VALUES ($1, $2)", HashToken(raw), userID); err != nil {
+			return nil, err
+		}
+		codes = append(codes, raw[:4]+"-"+raw[4:])
+	}
+	return codes, nil
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, base32
+// encoded. Their codes are the last six digits of the published ones.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestMatchTOTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		now      int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", "287082", 0, 59, 1, true},
+		{"other vector", "081804", 0, 1111111109, 1111111109 / totpPeriod, true},
+		{"previous step", "287082", 0, 89, 1, true},
+		{"next step", "287082", 0, 29, 1, true},
+		{"two steps old", "287082", 0, 119, 0, false},
+		{"replayed step", "287082", 1, 59, 0, false},
+		{"later step already used", "287082", 2, 89, 0, false},
+		{"wrong code", "287083", 0, 59, 0, false},
+		{"too short", "28708", 0, 59, 0, false},
+		{"too long", "2870820", 0, 59, 0, false},
+		{"empty", "", 0, 59, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(rfc6238Secret, tt.code, tt.lastStep, time.Unix(tt.now, 0))
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("matchTOTP(%q, last step %d, at %d) = %d, %t; want %d, %t",
+					tt.code, tt.lastStep, tt.now, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"bookstore/models"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrUserNotFound is returned when no user matches the given ID.
+var ErrUserNotFound = errors.New("user not found")
+
+// userColumns lists the user's unexpired direct roles as "roles". It
+// qualifies users.id so it also works after UPDATE ... RETURNING.
+const userColumns = `id, username,
+	ARRAY(SELECT role_key FROM user_roles WHERE user_id = users.id AND (expires_at IS NULL OR expires_at > NOW()) ORDER BY role_key) AS roles,
+	email, first_name, last_name, disabled, active, totp_enabled, department, age_verified, created_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
+	var user models.User
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		pq.Array(&user.Roles),
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Disabled,
+		&user.Active,
+		&user.TOTPEnabled,
+		&user.Department,
+		&user.AgeVerified,
+		&user.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListUsers retrieves all users ordered by username
+func ListUsers(db *sql.DB) ([]models.User, error) {
+	rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetUserByID retrieves a single user by ID
+func GetUserByID(db *sql.DB, id uuid.UUID) (*models.User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetUserByUsername retrieves a single user by username
+func GetUserByUsername(db *sql.DB, username string) (*models.User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1", username))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no user found with username %s", username)
+	}
+	return user, err
+}
+
+// CreateUser hashes the password, inserts a new user and grants them
+// user.Roles
+func CreateUser(db *sql.DB, user *models.User, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createUser(tx, user, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createUser inserts a user and its roles within the caller's transaction.
+func createUser(tx *sql.Tx, user *models.User, hash string) error {
+	user.ID = uuid.New()
+	err := tx.QueryRow(`
+		INSERT INTO users (id, username, password_hash, email, first_name, last_name, disabled, active, department, age_verified, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+		RETURNING created_at
+	`,
+		user.ID,
+		user.Username,
+		hash,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		user.Disabled,
+		user.Active,
+		user.Department,
+		user.AgeVerified,
+	).Scan(&user.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range user.Roles {
+		if _, err := tx.Exec("INSERT INTO user_roles (user_id, role_key) VALUES ($1, $2) ON CONFLICT DO NOTHING", user.ID, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateUser saves the profile, attributes and disabled flag of an existing
+// user. Roles are changed with SetUserRoles, GrantRole and RevokeRole.
+func UpdateUser(db *sql.DB, user *models.User) error {
+	result, err := db.Exec(`
+		UPDATE users
+		SET email = $1, first_name = $2, last_name = $3, disabled = $4,
+		    department = $5, age_verified = $6
+		WHERE id = $7
+	`,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		user.Disabled,
+		user.Department,
+		user.AgeVerified,
+		user.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+// SetUserPassword replaces a user's password and, in the same
+// transaction, voids their outstanding reset tokens, ends all of their
+// sessions and revokes their API tokens.
+func SetUserPassword(db *sql.DB, id uuid.UUID, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setPasswordHash(tx, id, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setPasswordHash stores a new password hash within the caller's
+// transaction and drops every credential issued under the old password.
+func setPasswordHash(tx *sql.Tx, id uuid.UUID, hash string) error {
+	result, err := tx.Exec("UPDATE users SET password_hash = $1 WHERE id = $2", hash, id)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result, ErrUserNotFound); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", id)
+	return err
+}
+
+// DeleteUser removes a user
+func DeleteUser(db *sql.DB, id uuid.UUID) error {
+	result, err := db.Exec("DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, ErrUserNotFound)
+}
+
+func expectOneRow(result sql.Result, notFound error) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return notFound
+	}
+	return nil
+}
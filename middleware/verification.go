@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidToken is returned for unknown, used or expired tokens.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// CreateEmailVerification stores a new verification token for a user and
+// returns the plain token to be mailed.
+func CreateEmailVerification(db *sql.DB, userID uuid.UUID, ttl time.Duration) (string, error) {
+	token, hash, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO email_verifications (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hash, userID, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// VerifyEmail consumes a verification token and activates its user,
+// returning the user's ID.
+func VerifyEmail(db *sql.DB, token string) (uuid.UUID, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE email_verifications
+		SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, HashToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrInvalidToken
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET active = TRUE WHERE id = $1", userID); err != nil {
+		return uuid.Nil, err
+	}
+
+	return userID, tx.Commit()
+}
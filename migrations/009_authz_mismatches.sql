@@ -0,0 +1,18 @@
+-- Disagreements between the enforced and the shadow authorization backend.
+CREATE TABLE IF NOT EXISTS authz_mismatches (
+    id                BIGSERIAL PRIMARY KEY,
+    subject_key       TEXT NOT NULL,
+    subject           JSONB NOT NULL,
+    action            TEXT NOT NULL,
+    resource_type     TEXT NOT NULL,
+    resource          JSONB NOT NULL,
+    primary_backend   TEXT NOT NULL,
+    primary_allowed   BOOLEAN NOT NULL,
+    secondary_backend TEXT NOT NULL,
+    secondary_allowed BOOLEAN NOT NULL,
+    secondary_error   TEXT NOT NULL DEFAULT '',
+    reasons           JSONB NOT NULL DEFAULT '{}',
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS authz_mismatches_created_idx ON authz_mismatches (created_at);
@@ -0,0 +1,8 @@
+-- Attributes passed to the authorizer so policies can make per-book and
+-- per-user decisions.
+ALTER TABLE books ADD COLUMN IF NOT EXISTS genre TEXT NOT NULL DEFAULT '';
+ALTER TABLE books ADD COLUMN IF NOT EXISTS restricted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE books ADD COLUMN IF NOT EXISTS age_rating INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS department TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS age_verified BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,40 @@
+-- Roles move out of the users.role column into their own table so they can
+-- inherit from one another and be created in-app. A user may hold several
+-- roles, and a grant may expire.
+CREATE TABLE IF NOT EXISTS roles (
+    key         TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    extends     TEXT REFERENCES roles (key),
+    builtin     BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO roles (key, name, description, extends, builtin) VALUES
+    ('viewer', 'Viewer', 'Browses the catalogue.', NULL, TRUE),
+    ('editor', 'Editor', 'Adds and edits books.', 'viewer', TRUE),
+    ('admin', 'Administrator', 'Manages books and user accounts.', 'editor', TRUE)
+ON CONFLICT (key) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id    UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_key   TEXT NOT NULL REFERENCES roles (key) ON DELETE CASCADE,
+    granted_by TEXT NOT NULL DEFAULT 'system',
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role_key)
+);
+
+CREATE INDEX IF NOT EXISTS user_roles_expires_at_idx ON user_roles (expires_at) WHERE expires_at IS NOT NULL;
+
+-- The old "user" role is now "viewer". Any other role someone was given by
+-- hand becomes a custom role so nobody loses access.
+INSERT INTO roles (key, name)
+SELECT DISTINCT role, role FROM users WHERE role NOT IN ('user', 'viewer', 'editor', 'admin')
+ON CONFLICT (key) DO NOTHING;
+
+INSERT INTO user_roles (user_id, role_key, granted_by)
+SELECT id, CASE role WHEN 'user' THEN 'viewer' ELSE role END, 'migration' FROM users
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,38 @@
+-- Requests for permissions a user was denied, and the per-resource grants
+-- approving one can create.
+CREATE TABLE IF NOT EXISTS access_requests (
+    id            UUID PRIMARY KEY,
+    user_id       UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    action        TEXT NOT NULL,
+    resource_type TEXT NOT NULL,
+    resource_key  TEXT NOT NULL DEFAULT '',
+    justification TEXT NOT NULL,
+    status        TEXT NOT NULL DEFAULT 'pending',
+    decided_by    TEXT NOT NULL DEFAULT '',
+    decided_at    TIMESTAMPTZ,
+    note          TEXT NOT NULL DEFAULT '',
+    granted_role  TEXT NOT NULL DEFAULT '',
+    expires_at    TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS access_requests_status_idx ON access_requests (status, created_at);
+
+-- One open request per user and permission.
+CREATE UNIQUE INDEX IF NOT EXISTS access_requests_pending_idx
+    ON access_requests (user_id, action, resource_type, resource_key) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS resource_grants (
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    action        TEXT NOT NULL,
+    resource_type TEXT NOT NULL,
+    -- An empty key covers every resource of the type.
+    resource_key  TEXT NOT NULL DEFAULT '',
+    request_id    UUID REFERENCES access_requests (id) ON DELETE SET NULL,
+    granted_by    TEXT NOT NULL,
+    expires_at    TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS resource_grants_lookup_idx ON resource_grants (user_id, resource_type, action);
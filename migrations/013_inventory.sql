@@ -0,0 +1,34 @@
+-- Physical copies on hand. Stock is tracked per book until branches exist.
+-- on_hand is kept in step with stock_movements, the ledger it is derived
+-- from, in the same transaction.
+CREATE TABLE IF NOT EXISTS book_stock (
+    book_id             UUID PRIMARY KEY REFERENCES books (id) ON DELETE CASCADE,
+    on_hand             INTEGER NOT NULL DEFAULT 0 CHECK (on_hand >= 0),
+    low_stock_threshold INTEGER NOT NULL DEFAULT 0 CHECK (low_stock_threshold >= 0),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+    id         BIGSERIAL PRIMARY KEY,
+    book_id    UUID NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    kind       TEXT NOT NULL CHECK (kind IN ('received', 'sold', 'damaged', 'adjusted')),
+    -- The signed change to on_hand.
+    quantity   INTEGER NOT NULL CHECK (quantity <> 0),
+    reason     TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS stock_movements_book_idx ON stock_movements (book_id, created_at);
+
+-- The ledger is append-only: mistakes are corrected with an "adjusted"
+-- movement, and rows only go away together with their book.
+CREATE OR REPLACE FUNCTION stock_movements_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'stock_movements is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stock_movements_append_only ON stock_movements;
+CREATE TRIGGER stock_movements_append_only BEFORE UPDATE ON stock_movements
+    FOR EACH ROW EXECUTE PROCEDURE stock_movements_append_only();
@@ -0,0 +1,16 @@
+-- Book prices in minor units (e.g. cents) of an ISO 4217 currency. Each
+-- row is the price from effective_at on, so the rows of a book are its
+-- price history and rows with effective_at in the future are scheduled
+-- changes. Rows are never updated; only scheduled ones may be deleted.
+CREATE TABLE IF NOT EXISTS book_prices (
+    id           BIGSERIAL PRIMARY KEY,
+    book_id      UUID NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    currency     CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    list_price   BIGINT NOT NULL CHECK (list_price >= 0),
+    sale_price   BIGINT CHECK (sale_price >= 0 AND sale_price <= list_price),
+    effective_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_by   TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS book_prices_book_idx ON book_prices (book_id, effective_at);
@@ -0,0 +1,55 @@
+-- Copies set aside for orders that have not shipped yet. Shipping takes
+-- them off on_hand as well; cancelling or refunding an unshipped order
+-- releases them.
+ALTER TABLE book_stock ADD COLUMN IF NOT EXISTS reserved INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE book_stock DROP CONSTRAINT IF EXISTS book_stock_reserved_check;
+ALTER TABLE book_stock ADD CONSTRAINT book_stock_reserved_check CHECK (reserved >= 0 AND reserved <= on_hand);
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    user_id  UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    book_id  UUID NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, book_id)
+);
+
+-- Orders outlive the accounts and books they refer to, so they keep the
+-- customer's username and each item's title and price as they were.
+CREATE TABLE IF NOT EXISTS orders (
+    id         UUID PRIMARY KEY,
+    user_id    UUID REFERENCES users (id) ON DELETE SET NULL,
+    customer   TEXT NOT NULL,
+    status     TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'paid', 'shipped', 'cancelled', 'refunded')),
+    currency   CHAR(3) NOT NULL,
+    total      BIGINT NOT NULL CHECK (total >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_idx ON orders (user_id, created_at);
+CREATE INDEX IF NOT EXISTS orders_status_idx ON orders (status, created_at);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id         BIGSERIAL PRIMARY KEY,
+    order_id   UUID NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    book_id    UUID REFERENCES books (id) ON DELETE SET NULL,
+    title      TEXT NOT NULL,
+    quantity   INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price BIGINT NOT NULL CHECK (unit_price >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS order_items_order_idx ON order_items (order_id);
+
+-- Every state change of an order, starting with its creation.
+CREATE TABLE IF NOT EXISTS order_events (
+    id          BIGSERIAL PRIMARY KEY,
+    order_id    UUID NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    from_status TEXT NOT NULL DEFAULT '',
+    to_status   TEXT NOT NULL,
+    actor       TEXT NOT NULL,
+    note        TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_events_order_idx ON order_events (order_id, created_at);
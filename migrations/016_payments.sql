@@ -0,0 +1,35 @@
+-- One row per payment attempt. The idempotency key comes from the client,
+-- so a retried or double-submitted attempt finds the existing row instead
+-- of charging twice; the gateway gets the same key.
+CREATE TABLE IF NOT EXISTS payments (
+    id              UUID PRIMARY KEY,
+    order_id        UUID NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    provider        TEXT NOT NULL,
+    idempotency_key TEXT NOT NULL UNIQUE,
+    provider_ref    TEXT,
+    status          TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'authorized', 'captured', 'failed', 'refunded')),
+    amount          BIGINT NOT NULL CHECK (amount > 0),
+    currency        CHAR(3) NOT NULL,
+    error           TEXT NOT NULL DEFAULT '',
+    created_by      TEXT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS payments_order_idx ON payments (order_id, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS payments_provider_ref_idx ON payments (provider, provider_ref);
+
+-- Webhook events already seen, so redeliveries are acknowledged without
+-- being applied twice. result says what reconciliation did with them.
+CREATE TABLE IF NOT EXISTS payment_events (
+    provider     TEXT NOT NULL,
+    event_id     TEXT NOT NULL,
+    type         TEXT NOT NULL,
+    provider_ref TEXT NOT NULL,
+    amount       BIGINT NOT NULL,
+    currency     TEXT NOT NULL,
+    result       TEXT NOT NULL DEFAULT '',
+    received_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, event_id)
+);
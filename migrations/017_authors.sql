@@ -0,0 +1,64 @@
+-- Authors are their own records, linked to books in credit order with the
+-- part they played. name_key ignores case, spacing and punctuation, so
+-- "J.R.R. Tolkien" and "JRR Tolkien" share one; it is how new credits find
+-- an existing author and how likely duplicates are spotted.
+CREATE TABLE IF NOT EXISTS authors (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name       TEXT NOT NULL CHECK (name <> ''),
+    name_key   TEXT GENERATED ALWAYS AS (lower(regexp_replace(name, '[^[:alnum:]]+', '', 'g'))) STORED,
+    bio        TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS authors_name_key_idx ON authors (name_key);
+
+CREATE TABLE IF NOT EXISTS book_authors (
+    book_id   UUID NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    author_id UUID NOT NULL REFERENCES authors (id),
+    role      TEXT NOT NULL DEFAULT 'author'
+        CHECK (role IN ('author', 'editor', 'translator')),
+    position  INTEGER NOT NULL,
+    PRIMARY KEY (book_id, author_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS book_authors_author_idx ON book_authors (author_id);
+
+-- Split the free-text author of every book not linked yet on ";", "&" and
+-- " and ", then link each part to an author, creating one per name_key
+-- under its most common spelling.
+CREATE TEMP TABLE author_credits ON COMMIT DROP AS
+SELECT book_id, name, lower(regexp_replace(name, '[^[:alnum:]]+', '', 'g')) AS name_key, position
+FROM (
+    SELECT b.id AS book_id, btrim(regexp_replace(s.name, '\s+', ' ', 'g')) AS name, s.position::INTEGER AS position
+    FROM books b,
+         regexp_split_to_table(b.author, '\s*;\s*|\s*&\s*|\s+and\s+') WITH ORDINALITY AS s (name, position)
+    WHERE NOT EXISTS (SELECT 1 FROM book_authors ba WHERE ba.book_id = b.id)
+) parts
+WHERE name <> '';
+
+INSERT INTO authors (name)
+SELECT mode() WITHIN GROUP (ORDER BY c.name)
+FROM author_credits c
+WHERE c.name_key <> ''
+  AND NOT EXISTS (SELECT 1 FROM authors a WHERE a.name_key = c.name_key)
+GROUP BY c.name_key;
+
+INSERT INTO book_authors (book_id, author_id, role, position)
+SELECT c.book_id,
+       (SELECT a.id FROM authors a WHERE a.name_key = c.name_key ORDER BY a.created_at, a.id LIMIT 1),
+       'author',
+       c.position
+FROM author_credits c
+WHERE c.name_key <> ''
+ON CONFLICT DO NOTHING;
+
+-- books.author stays as the byline shown in lists, now always derived from
+-- the links: "Name; Name (translator)".
+UPDATE books b
+SET author = s.byline
+FROM (
+    SELECT ba.book_id, string_agg(a.name, '; ' ORDER BY ba.position) AS byline
+    FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+    GROUP BY ba.book_id
+) s
+WHERE s.book_id = b.id;
@@ -0,0 +1,28 @@
+-- Categories form a tree; a book filed under a category also counts as
+-- being in every category above it. Slugs name categories in URLs.
+CREATE TABLE IF NOT EXISTS categories (
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT NOT NULL CHECK (name <> ''),
+    slug       TEXT NOT NULL UNIQUE CHECK (slug ~ '^[a-z0-9]+(-[a-z0-9]+)*$'),
+    parent_id  BIGINT REFERENCES categories (id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_idx ON categories (parent_id);
+
+CREATE TABLE IF NOT EXISTS book_categories (
+    book_id     UUID NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    category_id BIGINT NOT NULL REFERENCES categories (id) ON DELETE CASCADE,
+    PRIMARY KEY (book_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS book_categories_category_idx ON book_categories (category_id);
+
+-- Tags are free-form, stored lower-case so "Dragons" and "dragons" are one.
+CREATE TABLE IF NOT EXISTS book_tags (
+    book_id UUID NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+    tag     TEXT NOT NULL CHECK (tag <> '' AND tag = lower(tag)),
+    PRIMARY KEY (book_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS book_tags_tag_idx ON book_tags (tag);
@@ -0,0 +1,12 @@
+-- ISBNs are stored as bare ISBN-13; the ISBN-10 form, where one exists, is
+-- derived from it. Books without an ISBN keep NULL, which the unique
+-- index ignores.
+ALTER TABLE books ADD COLUMN IF NOT EXISTS isbn TEXT
+    CHECK (isbn ~ '^97[89][0-9]{10}$');
+
+CREATE UNIQUE INDEX IF NOT EXISTS books_isbn_key ON books (isbn);
+
+-- Duplicate detection compares titles ignoring case, punctuation and a
+-- leading article. The expression must match titleKey in the middleware.
+CREATE INDEX IF NOT EXISTS books_title_key_idx
+    ON books ((regexp_replace(regexp_replace(lower(title), '^(the|an|a)\s+', ''), '[^[:alnum:]]+', '', 'g')));
@@ -0,0 +1,13 @@
+-- One cover per book. The image and its thumbnails live in the blob store
+-- under keys derived from book_id and etag, a hash of the original, so a
+-- replaced cover never shares keys or cached copies with the old one.
+CREATE TABLE IF NOT EXISTS book_covers (
+    book_id      UUID PRIMARY KEY REFERENCES books (id) ON DELETE CASCADE,
+    content_type TEXT NOT NULL CHECK (content_type IN ('image/jpeg', 'image/png', 'image/gif')),
+    width        INTEGER NOT NULL CHECK (width > 0),
+    height       INTEGER NOT NULL CHECK (height > 0),
+    size         BIGINT NOT NULL CHECK (size > 0),
+    etag         TEXT NOT NULL,
+    uploaded_by  TEXT NOT NULL,
+    uploaded_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
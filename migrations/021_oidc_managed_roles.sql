@@ -0,0 +1,5 @@
+-- Only accounts the identity provider created have their permanent roles
+-- follow its claims on every sign-in. Accounts linked to an existing local
+-- account, and every account linked before this migration, keep the roles
+-- an admin gives them.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_managed_roles BOOLEAN NOT NULL DEFAULT FALSE;
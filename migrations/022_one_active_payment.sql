@@ -0,0 +1,5 @@
+-- An order has at most one payment attempt in flight or captured, so two
+-- tabs or two API calls with different idempotency keys cannot both charge
+-- it. Failed and refunded attempts do not count.
+CREATE UNIQUE INDEX IF NOT EXISTS payments_active_order_idx ON payments (order_id)
+    WHERE status IN ('pending', 'authorized', 'captured');
@@ -0,0 +1,4 @@
+-- A login attempt that passed the throttle holds its account until it reports
+-- its outcome, or until attempt_until if it never does, so parallel guesses
+-- cannot all pass the same check.
+ALTER TABLE login_throttle ADD COLUMN IF NOT EXISTS attempt_until TIMESTAMPTZ;
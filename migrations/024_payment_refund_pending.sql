@@ -0,0 +1,9 @@
+-- Refunding an order marks its captured payments refund_pending in the
+-- same transaction, and they become refunded once the gateway has given
+-- the money back. A refund that fails stays pending and is retried.
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check
+    CHECK (status IN ('pending', 'authorized', 'captured', 'failed', 'refund_pending', 'refunded'));
+
+CREATE INDEX IF NOT EXISTS payments_refund_pending_idx ON payments (updated_at)
+    WHERE status = 'refund_pending';
@@ -0,0 +1,20 @@
+-- The ledger that stock is derived from cannot be deleted from or
+-- truncated either. Rows still go away together with their book: the
+-- cascade from books runs inside the foreign key's own trigger, one level
+-- further down than a DELETE issued directly.
+CREATE OR REPLACE FUNCTION stock_movements_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND pg_trigger_depth() > 1 THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'stock_movements is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stock_movements_append_only ON stock_movements;
+CREATE TRIGGER stock_movements_append_only BEFORE UPDATE OR DELETE ON stock_movements
+    FOR EACH ROW EXECUTE PROCEDURE stock_movements_append_only();
+
+DROP TRIGGER IF EXISTS stock_movements_no_truncate ON stock_movements;
+CREATE TRIGGER stock_movements_no_truncate BEFORE TRUNCATE ON stock_movements
+    FOR EACH STATEMENT EXECUTE PROCEDURE stock_movements_append_only();
@@ -34,26 +34,394 @@ func (n NullUUID) Value() (driver.Value, error) {
 	return n.UUID[:], nil
 }
 
+// User is an account. Roles lists the roles granted to the user directly,
+// not the ones those roles extend; expired grants are left out.
 type User struct {
 	ID           uuid.UUID `json:"id"`
 	Username     string    `json:"username"`
 	PasswordHash string    `json:"-"`
-	Role         string    `json:"role"`
+	Roles        []string  `json:"roles"`
 	Email        string    `json:"email"`
 	FirstName    string    `json:"first_name"`
 	LastName     string    `json:"last_name"`
+	Disabled     bool      `json:"disabled"`
+	Active       bool      `json:"active"`
+	TOTPEnabled  bool      `json:"totp_enabled"`
+	Department   string    `json:"department"`
+	AgeVerified  bool      `json:"age_verified"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// DefaultRole is given to users who sign up themselves.
+const DefaultRole = "viewer"
+
+// Role is a set of permissions a user can be granted. A role has every
+// permission of the role it extends as well as its own.
+type Role struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Extends     string `json:"extends,omitempty"`
+	// Builtin roles are created by the migrations and cannot be deleted.
+	Builtin   bool      `json:"builtin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RoleGrant gives a user a role, optionally only until ExpiresAt.
+type RoleGrant struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	Role      string     `json:"role"`
+	GrantedBy string     `json:"granted_by"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Access request states.
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+)
+
+// AccessRequest asks for a permission the user was denied. Approving it
+// grants either GrantedRole or, when that is empty, a ResourceGrant.
+type AccessRequest struct {
+	ID            uuid.UUID  `json:"id"`
+	UserID        uuid.UUID  `json:"user_id"`
+	Username      string     `json:"username"`
+	Action        string     `json:"action"`
+	ResourceType  string     `json:"resource_type"`
+	ResourceKey   string     `json:"resource_key,omitempty"`
+	Justification string     `json:"justification"`
+	Status        string     `json:"status"`
+	DecidedBy     string     `json:"decided_by,omitempty"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+	Note          string     `json:"note,omitempty"`
+	GrantedRole   string     `json:"granted_role,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// ResourceGrant lets a user perform one action on one resource, or on every
+// resource of the type when ResourceKey is empty, whatever the policy says.
+type ResourceGrant struct {
+	ID           int64      `json:"id"`
+	UserID       uuid.UUID  `json:"user_id"`
+	Action       string     `json:"action"`
+	ResourceType string     `json:"resource_type"`
+	ResourceKey  string     `json:"resource_key,omitempty"`
+	RequestID    *uuid.UUID `json:"request_id,omitempty"`
+	GrantedBy    string     `json:"granted_by"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
 type Book struct {
 	ID          uuid.UUID  `json:"id"`
 	Title       string     `json:"title"`
 	Author      string     `json:"author"`
 	PublishedAt *time.Time `json:"published_at,omitempty"`
+	Genre       string     `json:"genre"`
+	Restricted  bool       `json:"restricted"`
+	AgeRating   int        `json:"age_rating"`
+	// ISBN13 is the book's normalized ISBN, empty when it has none.
+	// ISBN10 is derived from it and empty for 979 ISBNs.
+	ISBN13 string `json:"isbn_13,omitempty"`
+	ISBN10 string `json:"isbn_10,omitempty"`
+	// CoverETag identifies the book's cover image, empty when it has
+	// none; it versions the cover URLs.
+	CoverETag string `json:"cover_etag,omitempty"`
+	// Price is the price in effect now, if the book has one.
+	Price *Price `json:"price,omitempty"`
+	// Authors credits the book's authors, editors and translators in
+	// order. It is only loaded for single books; Author is the byline
+	// derived from it.
+	Authors []BookAuthor `json:"authors,omitempty"`
+	// Categories and Tags classify the book. They are loaded for single
+	// books and for browsing, not by every query.
+	Categories []Category `json:"categories,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Cover describes a book's uploaded cover image. The image itself and its
+// thumbnails are kept in the blob store.
+type Cover struct {
+	BookID      uuid.UUID `json:"book_id"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Size        int64     `json:"size"`
+	ETag        string    `json:"etag"`
+	UploadedBy  string    `json:"uploaded_by"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// Price is what a book sells for from EffectiveAt on, in minor units of
+// Currency. A price whose EffectiveAt is still ahead is a scheduled change.
+type Price struct {
+	ID          int64     `json:"id"`
+	BookID      uuid.UUID `json:"book_id"`
+	Currency    string    `json:"currency"`
+	ListPrice   int64     `json:"list_price"`
+	SalePrice   *int64    `json:"sale_price,omitempty"`
+	EffectiveAt time.Time `json:"effective_at"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Amount is what the book sells for: the sale price when there is one,
+// the list price otherwise.
+func (p Price) Amount() int64 {
+	if p.SalePrice != nil {
+		return *p.SalePrice
+	}
+	return p.ListPrice
+}
+
+// Category is a node in the category tree. Path names it with its
+// ancestors, e.g. "Fiction / Fantasy", and Depth is how many ancestors it
+// has; both are filled in by listings of the whole tree.
+type Category struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	ParentID  *int64    `json:"parent_id,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Depth     int       `json:"depth"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Author roles: the part an author played in a book.
+const (
+	AuthorRoleAuthor     = "author"
+	AuthorRoleEditor     = "editor"
+	AuthorRoleTranslator = "translator"
+)
+
+// AuthorRoles lists every author role.
+var AuthorRoles = []string{AuthorRoleAuthor, AuthorRoleEditor, AuthorRoleTranslator}
+
+// Author is a person credited on books. BookCount is only filled in by
+// listings.
+type Author struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Bio       string    `json:"bio,omitempty"`
+	BookCount int       `json:"book_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BookAuthor credits an author on a book.
+type BookAuthor struct {
+	AuthorID uuid.UUID `json:"author_id"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+}
+
+// Credit is how the byline shows the author: the name, followed by the
+// role in parentheses unless it is plain authorship.
+func (a BookAuthor) Credit() string {
+	if a.Role == "" || a.Role == AuthorRoleAuthor {
+		return a.Name
+	}
+	return a.Name + " (" + a.Role + ")"
+}
+
+// Stock movement kinds.
+const (
+	StockReceived = "received"
+	StockSold     = "sold"
+	StockDamaged  = "damaged"
+	StockAdjusted = "adjusted"
+)
+
+// StockMovementKinds lists the kinds of stock movement, in the order the
+// stock forms offer them.
+var StockMovementKinds = []string{StockReceived, StockSold, StockDamaged, StockAdjusted}
+
+// StockLevel is how many copies of a book are on hand, and how many of
+// those are reserved for orders that have not shipped. Low is set once the
+// copies still available drop to LowStockThreshold or below.
+type StockLevel struct {
+	BookID            uuid.UUID  `json:"book_id"`
+	OnHand            int        `json:"on_hand"`
+	Reserved          int        `json:"reserved"`
+	Available         int        `json:"available"`
+	LowStockThreshold int        `json:"low_stock_threshold"`
+	Low               bool       `json:"low"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+// StockMovement is one entry in the append-only stock ledger. Quantity is
+// the signed change to the stock on hand.
+type StockMovement struct {
+	ID        int64     `json:"id"`
+	BookID    uuid.UUID `json:"book_id"`
+	Kind      string    `json:"kind"`
+	Quantity  int       `json:"quantity"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Order states.
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderShipped   = "shipped"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// OrderStates lists every order state in lifecycle order.
+var OrderStates = []string{OrderPending, OrderPaid, OrderShipped, OrderCancelled, OrderRefunded}
+
+// OrderTransitions lists the states an order in each state may move to.
+// Cancelled and refunded orders are final.
+var OrderTransitions = map[string][]string{
+	OrderPending: {OrderPaid, OrderCancelled},
+	OrderPaid:    {OrderShipped, OrderRefunded},
+	OrderShipped: {OrderRefunded},
+}
+
+// CanTransition reports whether an order may move from one state to
+// another.
+func CanTransition(from, to string) bool {
+	for _, next := range OrderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CartItem is a book in a user's cart, with the price it would sell for
+// now.
+type CartItem struct {
+	BookID   uuid.UUID `json:"book_id"`
+	Title    string    `json:"title"`
+	Quantity int       `json:"quantity"`
+	Price    *Price    `json:"price,omitempty"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// Order is a customer's purchase. Totals and prices are in minor units of
+// Currency. UserID is nil once the customer's account is deleted.
+type Order struct {
+	ID        uuid.UUID   `json:"id"`
+	UserID    *uuid.UUID  `json:"user_id,omitempty"`
+	Customer  string      `json:"customer"`
+	Status    string      `json:"status"`
+	Currency  string      `json:"currency"`
+	Total     int64       `json:"total"`
+	Items     []OrderItem `json:"items,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// OrderItem is one line of an order, with the title and price the book had
+// when it was ordered. BookID is nil once the book is deleted.
+type OrderItem struct {
+	BookID    *uuid.UUID `json:"book_id,omitempty"`
+	Title     string     `json:"title"`
+	Quantity  int        `json:"quantity"`
+	UnitPrice int64      `json:"unit_price"`
+}
+
+// Subtotal is the price of all copies on the line.
+func (i OrderItem) Subtotal() int64 {
+	return i.UnitPrice * int64(i.Quantity)
+}
+
+// OrderEvent records one state change of an order. FromStatus is empty for
+// the order's creation.
+type OrderEvent struct {
+	ID         int64     `json:"id"`
+	OrderID    uuid.UUID `json:"order_id"`
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Actor      string    `json:"actor"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Payment states.
+const (
+	PaymentPending    = "pending"
+	PaymentAuthorized = "authorized"
+	PaymentCaptured   = "captured"
+	PaymentFailed     = "failed"
+	// PaymentRefundPending is a captured payment of a refunded order whose
+	// money the provider has not given back yet.
+	PaymentRefundPending = "refund_pending"
+	PaymentRefunded      = "refunded"
+)
+
+// Payment is one attempt to pay for an order through a payment provider.
+// ProviderRef is the gateway's reference, known once it authorized the
+// payment.
+type Payment struct {
+	ID             uuid.UUID `json:"id"`
+	OrderID        uuid.UUID `json:"order_id"`
+	Provider       string    `json:"provider"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	ProviderRef    string    `json:"provider_ref,omitempty"`
+	Status         string    `json:"status"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Error          string    `json:"error,omitempty"`
+	CreatedBy      string    `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// AuditEntry records a single administrative change.
+type AuditEntry struct {
+	ID         int64                  `json:"id"`
+	Actor      string                 `json:"actor"`
+	Action     string                 `json:"action"`
+	TargetType string                 `json:"target_type"`
+	TargetID   string                 `json:"target_id"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// APIToken is a personal access token. The secret itself is only shown
+// once, when the token is created.
+type APIToken struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TokenScopes lists the scopes offered when creating an API token.
+var TokenScopes = []string{
+	"books:view",
+	"books:create",
+	"books:update",
+	"books:delete",
+	"books:adjust_stock",
+	"books:set_price",
+	"books:import",
+	"orders:view",
+	"orders:create",
+	"orders:pay",
+	"orders:mark_paid",
+	"orders:ship",
+	"orders:cancel",
+	"orders:refund",
+	"authors:manage",
+	"categories:manage",
+	"users:manage",
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -0,0 +1,36 @@
+package models
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]string]bool{
+		{OrderPending, OrderPaid}:      true,
+		{OrderPending, OrderCancelled}: true,
+		{OrderPaid, OrderShipped}:      true,
+		{OrderPaid, OrderRefunded}:     true,
+		{OrderShipped, OrderRefunded}:  true,
+	}
+
+	// Every pair of states, so a transition or state added without a
+	// matching entry here fails.
+	for _, from := range OrderStates {
+		for _, to := range OrderStates {
+			want := allowed[[2]string{from, to}]
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%q, %q) = %t, want %t", from, to, got, want)
+			}
+		}
+	}
+
+	for _, tt := range []struct{ from, to string }{
+		{"", OrderPaid},
+		{OrderPending, ""},
+		{"unknown", OrderPaid},
+		{OrderPending, "unknown"},
+		{"Pending", OrderPaid},
+	} {
+		if CanTransition(tt.from, tt.to) {
+			t.Errorf("CanTransition(%q, %q) = true, want false", tt.from, tt.to)
+		}
+	}
+}
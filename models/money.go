@@ -0,0 +1,66 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyDigits lists the currencies whose minor unit is not a hundredth.
+var currencyDigits = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"VND": 0,
+}
+
+// CurrencyDigits returns the number of decimal places of a currency's minor
+// unit.
+func CurrencyDigits(currency string) int {
+	if digits, ok := currencyDigits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// FormatMoney formats an amount in minor units, e.g. 1250 USD as
+// "USD 12.50".
+func FormatMoney(amount int64, currency string) string {
+	digits := CurrencyDigits(currency)
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if digits == 0 {
+		return fmt.Sprintf("%s %s%d", currency, sign, amount)
+	}
+	unit := int64(1)
+	for i := 0; i < digits; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s %s%d.%0*d", currency, sign, amount/unit, digits, amount%unit)
+}
+
+// ParseMoney reads an amount in major units, e.g. "12.5", into minor units
+// of currency.
+func ParseMoney(s, currency string) (int64, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, _ := strings.Cut(s, ".")
+	digits := CurrencyDigits(currency)
+	if whole == "" || len(frac) > digits || strings.HasPrefix(whole, "-") || strings.HasPrefix(whole, "+") {
+		return 0, errors.New("invalid amount " + s)
+	}
+
+	amount, err := strconv.ParseInt(whole+frac+strings.Repeat("0", digits-len(frac)), 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid amount " + s)
+	}
+	return amount, nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{in: "12.50", currency: "USD", want: 1250},
+		{in: "12.5", currency: "USD", want: 1250},
+		{in: "12", currency: "USD", want: 1200},
+		{in: "12.", currency: "USD", want: 1200},
+		{in: " 0.99 ", currency: "EUR", want: 99},
+		{in: "0", currency: "EUR", want: 0},
+		{in: "1500", currency: "JPY", want: 1500},
+		{in: "1.5", currency: "BHD", want: 1500},
+		{in: "1.234", currency: "BHD", want: 1234},
+		{in: "92233720368547758.07", currency: "USD", want: math.MaxInt64},
+		// Amounts are never rounded: more decimals than the currency has
+		// are refused.
+		{in: "12.345", currency: "USD", wantErr: true},
+		{in: "12.5", currency: "JPY", wantErr: true},
+		{in: "1.2345", currency: "BHD", wantErr: true},
+		{in: "-1.00", currency: "USD", wantErr: true},
+		{in: "+1.00", currency: "USD", wantErr: true},
+		{in: "1.-5", currency: "USD", wantErr: true},
+		{in: "1,000.00", currency: "USD", wantErr: true},
+		{in: "1 000", currency: "USD", wantErr: true},
+		{in: "1.000,00", currency: "USD", wantErr: true},
+		{in: "92233720368547758.08", currency: "USD", wantErr: true},
+		{in: "99999999999999999999", currency: "JPY", wantErr: true},
+		{in: ".50", currency: "USD", wantErr: true},
+		{in: "1.2.3", currency: "BHD", wantErr: true},
+		{in: "12 USD", currency: "USD", wantErr: true},
+		{in: "", currency: "USD", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMoney(%q, %s) = %d, want an error", tt.in, tt.currency, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMoney(%q, %s) = %d, %v; want %d", tt.in, tt.currency, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		want     string
+	}{
+		{1250, "USD", "USD 12.50"},
+		{5, "EUR", "EUR 0.05"},
+		{0, "EUR", "EUR 0.00"},
+		{-1250, "USD", "USD -12.50"},
+		{1500, "JPY", "JPY 1500"},
+		{1234, "BHD", "BHD 1.234"},
+	}
+	for _, tt := range tests {
+		if got := FormatMoney(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatMoney(%d, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+		if tt.amount < 0 {
+			continue
+		}
+		// What is shown parses back to the same amount.
+		_, major, _ := strings.Cut(tt.want, " ")
+		if back, err := ParseMoney(major, tt.currency); err != nil || back != tt.amount {
+			t.Errorf("ParseMoney(%q) = %d, %v; want %d", major, back, err, tt.amount)
+		}
+	}
+}
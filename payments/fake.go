@@ -0,0 +1,109 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Payment methods the fake gateway understands. Any other method is
+// approved like FakeMethodApproved.
+const (
+	FakeMethodApproved = "fake_card_ok"
+	FakeMethodDeclined = "fake_card_declined"
+)
+
+// FakeSignatureHeader carries the hex HMAC-SHA256 of a fake webhook body.
+const FakeSignatureHeader = "X-Fake-Signature"
+
+const fakeIDPrefix = "fake_"
+
+// Fake is a deterministic gateway for local development and tests. It
+// keeps no state: payment IDs are derived from the idempotency key, the
+// outcome depends only on the payment method, and capture and refund
+// succeed for any payment it could have issued. Webhooks are signed with
+// HMAC-SHA256; SignWebhook produces the header for hand-made events, e.g.
+//
+//	printf '%s' "$BODY" | openssl dgst -sha256 -hmac "$PAYMENT_WEBHOOK_SECRET"
+type Fake struct {
+	secret []byte
+}
+
+// NewFake returns a fake gateway signing webhooks with secret. With an
+// empty secret it rejects every webhook, as anyone could sign one.
+func NewFake(secret string) *Fake {
+	return &Fake{secret: []byte(secret)}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	if req.IdempotencyKey == "" {
+		return nil, fmt.Errorf("fake gateway: idempotency key is required")
+	}
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("fake gateway: amount must be positive")
+	}
+	if req.Method == FakeMethodDeclined {
+		return nil, fmt.Errorf("%w: card declined by the fake gateway", ErrDeclined)
+	}
+
+	sum := sha256.Sum256([]byte(req.IdempotencyKey))
+	return &Authorization{
+		ID:       fakeIDPrefix + hex.EncodeToString(sum[:12]),
+		Amount:   req.Amount,
+		Currency: req.Currency,
+	}, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, paymentID string, amount int64) error {
+	return f.check(paymentID, amount)
+}
+
+func (f *Fake) Refund(ctx context.Context, paymentID string, amount int64) error {
+	return f.check(paymentID, amount)
+}
+
+func (f *Fake) check(paymentID string, amount int64) error {
+	if !strings.HasPrefix(paymentID, fakeIDPrefix) {
+		return fmt.Errorf("fake gateway: unknown payment %q", paymentID)
+	}
+	if amount <= 0 {
+		return fmt.Errorf("fake gateway: amount must be positive")
+	}
+	return nil
+}
+
+func (f *Fake) VerifyWebhook(header http.Header, body []byte) (*WebhookEvent, error) {
+	signature, err := hex.DecodeString(header.Get(FakeSignatureHeader))
+	if err != nil || len(f.secret) == 0 || !hmac.Equal(signature, f.mac(body)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("fake gateway: invalid webhook body: %v", err)
+	}
+	if event.ID == "" || event.PaymentID == "" {
+		return nil, fmt.Errorf("fake gateway: webhook is missing id or payment_id")
+	}
+	return &event, nil
+}
+
+// SignWebhook returns the FakeSignatureHeader value for a webhook body.
+func (f *Fake) SignWebhook(body []byte) string {
+	return hex.EncodeToString(f.mac(body))
+}
+
+func (f *Fake) mac(body []byte) []byte {
+	m := hmac.New(sha256.New, f.secret)
+	m.Write(body)
+	return m.Sum(nil)
+}
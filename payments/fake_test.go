@@ -0,0 +1,72 @@
+package payments
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFakeVerifyWebhook(t *testing.T) {
+	const body = `{"id":"evt_1","type":"payment.captured","payment_id":"fake_abc","amount":1299,"currency":"EUR"}`
+	fake := NewFake("test-secret")
+	signature := fake.SignWebhook([]byte(body))
+
+	tests := []struct {
+		name      string
+		fake      *Fake
+		body      string
+		signature string
+		wantErr   error
+	}{
+		{name: "valid", fake: fake, body: body, signature: signature},
+		{name: "upper case hex", fake: fake, body: body, signature: strings.ToUpper(signature)},
+		{name: "missing signature", fake: fake, body: body, signature: "", wantErr: ErrInvalidSignature},
+		{name: "not hex", fake: fake, body: body, signature: "zz" + signature[2:], wantErr: ErrInvalidSignature},
+		{name: "truncated", fake: fake, body: body, signature: signature[:len(signature)-2], wantErr: ErrInvalidSignature},
+		{name: "tampered body", fake: fake, body: strings.Replace(body, "1299", "1", 1), signature: signature, wantErr: ErrInvalidSignature},
+		{name: "other secret", fake: NewFake("other-secret"), body: body, signature: signature, wantErr: ErrInvalidSignature},
+		{name: "no secret", fake: NewFake(""), body: body, signature: NewFake("").SignWebhook([]byte(body)), wantErr: ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.signature != "" {
+				header.Set(FakeSignatureHeader, tt.signature)
+			}
+			event, err := tt.fake.VerifyWebhook(header, []byte(tt.body))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.ID != "evt_1" || event.Type != EventCaptured || event.PaymentID != "fake_abc" || event.Amount != 1299 || event.Currency != "EUR" {
+				t.Errorf("event = %+v", event)
+			}
+		})
+	}
+}
+
+func TestFakeVerifyWebhookBody(t *testing.T) {
+	fake := NewFake("test-secret")
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not JSON", "payment captured"},
+		{"missing id", `{"type":"payment.captured","payment_id":"fake_abc"}`},
+		{"missing payment", `{"id":"evt_1","type":"payment.captured"}`},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set(FakeSignatureHeader, fake.SignWebhook([]byte(tt.body)))
+		_, err := fake.VerifyWebhook(header, []byte(tt.body))
+		if err == nil || errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: error = %v, want a body error", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package payments talks to payment gateways. Handlers only see the
+// PaymentProvider interface; FromEnv picks the implementation.
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	// ErrDeclined is returned when the gateway refuses to authorize a
+	// payment, e.g. because the card was declined. Retrying will not help.
+	ErrDeclined = errors.New("payment declined")
+	// ErrInvalidSignature is returned for webhooks that were not signed by
+	// the gateway.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Webhook event types, as reported by every provider.
+const (
+	EventCaptured = "payment.captured"
+	EventFailed   = "payment.failed"
+	EventRefunded = "payment.refunded"
+)
+
+// AuthorizeRequest asks the gateway to hold Amount minor units of Currency
+// on a payment method. Attempts with the same IdempotencyKey are one
+// attempt as far as the gateway is concerned: retrying returns the original
+// authorization instead of charging again.
+type AuthorizeRequest struct {
+	IdempotencyKey string
+	Amount         int64
+	Currency       string
+	// Method is the gateway's token for the card or account to charge.
+	Method string
+	// Reference identifies the order on the gateway's side.
+	Reference string
+}
+
+// Authorization is money held on a payment method, waiting to be captured.
+type Authorization struct {
+	// ID is the gateway's reference for the payment.
+	ID       string
+	Amount   int64
+	Currency string
+}
+
+// WebhookEvent is a verified notification from the gateway about a
+// payment that changed on its side.
+type WebhookEvent struct {
+	// ID is unique per event, so redelivered events can be recognised.
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	PaymentID string `json:"payment_id"`
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+}
+
+// PaymentProvider is a payment gateway. Capture and Refund must be safe to
+// repeat for the same payment and amount.
+type PaymentProvider interface {
+	// Name identifies the provider in stored payments, e.g. "fake".
+	Name() string
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error)
+	Capture(ctx context.Context, paymentID string, amount int64) error
+	Refund(ctx context.Context, paymentID string, amount int64) error
+	// VerifyWebhook checks that a webhook request body came from the
+	// gateway and decodes it. It returns ErrInvalidSignature otherwise.
+	VerifyWebhook(header http.Header, body []byte) (*WebhookEvent, error)
+}
+
+// FromEnv picks a provider based on PAYMENT_PROVIDER, which must be set:
+// a missing or unknown provider is an error rather than a silent fallback
+// that would never take real money. Only "fake" exists so far, and it
+// needs PAYMENT_WEBHOOK_SECRET to verify webhooks.
+func FromEnv() (PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set; set it to fake for development")
+	case "fake":
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, errors.New("PAYMENT_WEBHOOK_SECRET is not set")
+		}
+		return NewFake(secret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
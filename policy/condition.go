@@ -0,0 +1,175 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// condition is a parsed "left op right" expression. Operands are attribute
+// references (user.x, resource.x) or JSON literals: true, 18, "fiction",
+// ["a","b"]. Literals may not contain spaces.
+type condition struct {
+	expr  string
+	left  operand
+	op    string
+	right operand
+}
+
+type operand struct {
+	// ref is "user" or "resource" for attribute references, empty for
+	// literals.
+	ref   string
+	attr  string
+	value interface{}
+}
+
+var operators = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true}
+
+func parseCondition(expr string) (condition, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 3 {
+		return condition{}, fmt.Errorf("want \"<operand> <operator> <operand>\"")
+	}
+	if !operators[fields[1]] {
+		return condition{}, fmt.Errorf("unknown operator %q", fields[1])
+	}
+
+	left, err := parseOperand(fields[0])
+	if err != nil {
+		return condition{}, err
+	}
+	right, err := parseOperand(fields[2])
+	if err != nil {
+		return condition{}, err
+	}
+	if left.ref == "" && right.ref == "" {
+		return condition{}, fmt.Errorf("compares two literals")
+	}
+	return condition{expr: expr, left: left, op: fields[1], right: right}, nil
+}
+
+func parseOperand(s string) (operand, error) {
+	if ref, attr, ok := strings.Cut(s, "."); ok && (ref == "user" || ref == "resource") {
+		if attr == "" {
+			return operand{}, fmt.Errorf("missing attribute name in %q", s)
+		}
+		return operand{ref: ref, attr: attr}, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return operand{}, fmt.Errorf("%q is neither an attribute reference nor a literal", s)
+	}
+	return operand{value: v}, nil
+}
+
+// check verifies that the referenced attributes are declared.
+func (c condition) check(userAttrs, resourceAttrs map[string]string) error {
+	for _, o := range []operand{c.left, c.right} {
+		switch o.ref {
+		case "user":
+			if _, ok := userAttrs[o.attr]; !ok && o.attr != "key" {
+				return fmt.Errorf("undeclared user attribute %q", o.attr)
+			}
+		case "resource":
+			if _, ok := resourceAttrs[o.attr]; !ok && o.attr != "key" {
+				return fmt.Errorf("undeclared resource attribute %q", o.attr)
+			}
+		}
+	}
+	return nil
+}
+
+// eval reports whether the condition holds. Missing attributes make it
+// false.
+func (c condition) eval(user, resource map[string]interface{}) bool {
+	left, ok := c.left.resolve(user, resource)
+	if !ok {
+		return false
+	}
+	right, ok := c.right.resolve(user, resource)
+	if !ok {
+		return false
+	}
+
+	switch c.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			if strs, isStrs := right.([]string); isStrs {
+				for _, s := range strs {
+					list = append(list, s)
+				}
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+		for _, item := range list {
+			if equal(left, item) {
+				return true
+			}
+		}
+		return false
+	}
+
+	l, lok := number(left)
+	r, rok := number(right)
+	if !lok || !rok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	}
+	return false
+}
+
+func (o operand) resolve(user, resource map[string]interface{}) (interface{}, bool) {
+	switch o.ref {
+	case "user":
+		v, ok := user[o.attr]
+		return v, ok
+	case "resource":
+		v, ok := resource[o.attr]
+		return v, ok
+	}
+	return o.value, true
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+package policy
+
+import "testing"
+
+func TestConditionEval(t *testing.T) {
+	user := map[string]interface{}{
+		"key":          "alice",
+		"age_verified": true,
+		"roles":        []string{"viewer", "editor"},
+		"department":   "sales",
+	}
+	resource := map[string]interface{}{
+		"customer":   "alice",
+		"restricted": false,
+		"age_rating": 18,
+		"total":      int64(2500),
+		"genre":      "fiction",
+		"score":      4.5,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"resource.customer == user.key", true},
+		{"user.key == resource.customer", true},
+		{"resource.customer != user.key", false},
+		{"resource.restricted == false", true},
+		{"user.age_verified == true", true},
+		{"user.age_verified == 1", false},
+		{"resource.age_rating < 18", false},
+		{"resource.age_rating <= 18", true},
+		{"resource.age_rating > 17", true},
+		{"resource.age_rating >= 19", false},
+		{"resource.age_rating == 18.0", true},
+		{"resource.total > 1000", true},
+		{"resource.score < 5", true},
+		{`resource.genre == "fiction"`, true},
+		{`resource.genre != "poetry"`, true},
+		{`resource.genre in ["fiction","poetry"]`, true},
+		{`resource.genre in ["poetry"]`, false},
+		{`"editor" in user.roles`, true},
+		{`"admin" in user.roles`, false},
+		{`resource.genre in "fiction"`, false},
+		// Ordering only applies to numbers.
+		{`resource.genre < "z"`, false},
+		{"resource.restricted < 1", false},
+		// Missing attributes make any condition false, even !=.
+		{"resource.missing == false", false},
+		{"resource.missing != false", false},
+		{"user.missing < 1", false},
+	}
+	for _, tt := range tests {
+		c, err := parseCondition(tt.expr)
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.eval(user, resource); got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"resource.restricted",
+		"resource.restricted ==",
+		"resource.restricted = false",
+		"resource.restricted == false extra",
+		"resource.genre ~= fiction",
+		"resource. == false",
+		"resource.genre == fiction",
+		"1 == 1",
+		`"a" in ["a"]`,
+	}
+	for _, expr := range tests {
+		if _, err := parseCondition(expr); err == nil {
+			t.Errorf("parseCondition(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestConditionCheck(t *testing.T) {
+	userAttrs := map[string]string{"age_verified": "bool"}
+	resourceAttrs := map[string]string{"restricted": "bool"}
+
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"resource.restricted == false", false},
+		{"user.age_verified == true", false},
+		{"resource.key == user.key", false},
+		{"resource.rating < 18", true},
+		{"user.department == resource.restricted", true},
+	}
+	for _, tt := range tests {
+		c, err := parseCondition(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCondition(%q): %v", tt.expr, err)
+		}
+		if err := c.check(userAttrs, resourceAttrs); (err != nil) != tt.wantErr {
+			t.Errorf("check(%q) error = %v, want error %t", tt.expr, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package policy
+
+import (
+	"bookstore/authz"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Engine evaluates the policy file locally. It implements authz.Authorizer.
+type Engine struct {
+	path   string
+	policy atomic.Pointer[Policy]
+}
+
+// NewEngine loads the policy file at path.
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Policy returns the policy currently in force.
+func (e *Engine) Policy() *Policy {
+	return e.policy.Load()
+}
+
+// Reload reads the policy file again. If it does not load or validate, the
+// previous policy stays in force.
+func (e *Engine) Reload() error {
+	p, err := Load(e.path)
+	if err != nil {
+		return err
+	}
+	e.policy.Store(p)
+	return nil
+}
+
+// Watch reloads the policy whenever its file changes, until ctx is done.
+func (e *Engine) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Editors often save by writing a new file and renaming it over the
+	// old one, so watch the directory.
+	if err := watcher.Add(filepath.Dir(e.path)); err != nil {
+		return fmt.Errorf("error watching %s: %v", e.path, err)
+	}
+
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(e.path) {
+				debounce.Reset(200 * time.Millisecond)
+			}
+		case <-debounce.C:
+			if err := e.Reload(); err != nil {
+				log.Printf("Policy reload failed, keeping the previous policy: %v\n", err)
+				continue
+			}
+			log.Printf("Reloaded policy from %s\n", e.path)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Policy watch error: %v\n", err)
+		}
+	}
+}
+
+// Rule identifies a permission of a role that took part in a decision.
+type Rule struct {
+	Role    string
+	Actions []string
+	When    []string
+	// Failed lists the conditions that did not hold.
+	Failed []string
+}
+
+func (r Rule) String() string {
+	s := r.Role + ": " + strings.Join(r.Actions, ", ")
+	if len(r.When) > 0 {
+		s += " when " + strings.Join(r.When, " and ")
+	}
+	return s
+}
+
+// Decision is the outcome of evaluating one check, with the rules that
+// granted it or came close.
+type Decision struct {
+	Allowed bool
+	// Matched holds the rule that granted access.
+	Matched *Rule
+	// Considered holds the rules for the action whose conditions failed.
+	Considered []Rule
+	// UnknownRoles lists subject roles the policy does not define.
+	UnknownRoles []string
+}
+
+// Evaluate decides a check and explains the decision.
+func (e *Engine) Evaluate(subject authz.Subject, action string, resource authz.Resource) Decision {
+	p := e.policy.Load()
+
+	userAttrs := withKey(subject.Attributes, subject.Key)
+	resourceAttrs := withKey(resource.Attributes, resource.Key)
+
+	var d Decision
+	for _, roleKey := range subject.Roles {
+		role, ok := p.Roles[roleKey]
+		if !ok {
+			d.UnknownRoles = append(d.UnknownRoles, roleKey)
+			continue
+		}
+		for _, perm := range role.Permissions {
+			if perm.Resource != resource.Type || !contains(perm.Actions, action) {
+				continue
+			}
+			rule := Rule{Role: roleKey, Actions: perm.Actions, When: perm.When}
+			for _, c := range perm.conditions {
+				if !c.eval(userAttrs, resourceAttrs) {
+					rule.Failed = append(rule.Failed, c.expr)
+				}
+			}
+			if len(rule.Failed) == 0 {
+				d.Allowed = true
+				d.Matched = &rule
+				return d
+			}
+			d.Considered = append(d.Considered, rule)
+		}
+	}
+	return d
+}
+
+// Explain implements authz.Explainer.
+func (e *Engine) Explain(ctx context.Context, subject authz.Subject, action string, resource authz.Resource) (*authz.Explanation, error) {
+	d := e.Evaluate(subject, action, resource)
+
+	ex := &authz.Explanation{Backend: "local", Allowed: d.Allowed}
+	for _, role := range d.UnknownRoles {
+		ex.Reasons = append(ex.Reasons, "role "+role+" is not defined in the policy")
+	}
+	for _, rule := range d.Considered {
+		ex.Reasons = append(ex.Reasons, "not granted by "+rule.String()+" (failed: "+strings.Join(rule.Failed, ", ")+")")
+	}
+	if d.Matched != nil {
+		ex.Reasons = append(ex.Reasons, "granted by "+d.Matched.String())
+	} else if len(d.Considered) == 0 {
+		ex.Reasons = append(ex.Reasons, "no role of the user grants "+action+" on "+resource.Type)
+	}
+	return ex, nil
+}
+
+// Check implements authz.Authorizer.
+func (e *Engine) Check(ctx context.Context, subject authz.Subject, action string, resource authz.Resource) (bool, error) {
+	return e.Evaluate(subject, action, resource).Allowed, nil
+}
+
+func withKey(attrs map[string]interface{}, key string) map[string]interface{} {
+	out := make(map[string]interface{}, len(attrs)+1)
+	for k, v := range attrs {
+		out[k] = v
+	}
+	if key != "" {
+		out["key"] = key
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+// Package policy reads the bookstore's authorization policy from a YAML or
+// JSON file kept in the repository, validates it and evaluates it locally.
+// The same file is pushed to Permit.io by cmd/policy so the dashboard
+// matches what is in git.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Attribute types accepted in resource and user attribute declarations.
+// They match Permit.io's attribute types.
+var attributeTypes = map[string]bool{
+	"bool":   true,
+	"number": true,
+	"string": true,
+	"array":  true,
+}
+
+// Policy is the whole policy file.
+type Policy struct {
+	// UserAttributes declares the user attributes conditions may refer to,
+	// mapping each name to its type.
+	UserAttributes map[string]string   `yaml:"user_attributes,omitempty" json:"user_attributes,omitempty"`
+	Resources      map[string]Resource `yaml:"resources" json:"resources"`
+	Roles          map[string]Role     `yaml:"roles" json:"roles"`
+}
+
+// Resource is a type of thing that can be acted on.
+type Resource struct {
+	Name        string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Actions     []string `yaml:"actions" json:"actions"`
+	// Attributes maps attribute names to their types.
+	Attributes map[string]string `yaml:"attributes,omitempty" json:"attributes,omitempty"`
+}
+
+// Role groups permissions.
+type Role struct {
+	Name        string       `yaml:"name,omitempty" json:"name,omitempty"`
+	Description string       `yaml:"description,omitempty" json:"description,omitempty"`
+	Permissions []Permission `yaml:"permissions" json:"permissions"`
+}
+
+// Permission grants actions on a resource type, optionally only when all of
+// its conditions hold.
+type Permission struct {
+	Resource string   `yaml:"resource" json:"resource"`
+	Actions  []string `yaml:"actions" json:"actions"`
+	// When lists conditions such as "resource.restricted == false" or
+	// "user.age_verified == true". All of them must hold.
+	When []string `yaml:"when,omitempty" json:"when,omitempty"`
+
+	conditions []condition
+}
+
+// Load reads and validates a policy file. Files ending in .json are parsed
+// as JSON, everything else as YAML.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	} else {
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		err = dec.Decode(&p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Validate checks that roles only refer to declared resources, actions and
+// attributes, and that every condition parses. It reports all problems at
+// once, and prepares the conditions for evaluation.
+func (p *Policy) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(p.Resources) == 0 {
+		add("no resources defined")
+	}
+	for name, typ := range p.UserAttributes {
+		if !attributeTypes[typ] {
+			add("user attribute %s: unknown type %q", name, typ)
+		}
+	}
+	for _, key := range sortedKeys(p.Resources) {
+		res := p.Resources[key]
+		if len(res.Actions) == 0 {
+			add("resource %s: no actions", key)
+		}
+		if dup := duplicate(res.Actions); dup != "" {
+			add("resource %s: action %s listed twice", key, dup)
+		}
+		for name, typ := range res.Attributes {
+			if !attributeTypes[typ] {
+				add("resource %s attribute %s: unknown type %q", key, name, typ)
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(p.Roles) {
+		role := p.Roles[key]
+		for i := range role.Permissions {
+			perm := &role.Permissions[i]
+			res, ok := p.Resources[perm.Resource]
+			if !ok {
+				add("role %s: unknown resource %q", key, perm.Resource)
+				continue
+			}
+			if len(perm.Actions) == 0 {
+				add("role %s: permission on %s has no actions", key, perm.Resource)
+			}
+			for _, action := range perm.Actions {
+				if !contains(res.Actions, action) {
+					add("role %s: resource %s has no action %q", key, perm.Resource, action)
+				}
+			}
+
+			perm.conditions = perm.conditions[:0]
+			for _, expr := range perm.When {
+				c, err := parseCondition(expr)
+				if err == nil {
+					err = c.check(p.UserAttributes, res.Attributes)
+				}
+				if err != nil {
+					add("role %s: condition %q: %v", key, expr, err)
+					continue
+				}
+				perm.conditions = append(perm.conditions, c)
+			}
+		}
+		p.Roles[key] = role
+	}
+
+	return errors.Join(errs...)
+}
+
+// Conditional reports whether the permission only applies under conditions.
+func (perm Permission) Conditional() bool {
+	return len(perm.When) > 0
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func duplicate(list []string) string {
+	seen := make(map[string]bool)
+	for _, item := range list {
+		if seen[item] {
+			return item
+		}
+		seen[item] = true
+	}
+	return ""
+}
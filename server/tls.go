@@ -0,0 +1,259 @@
+// Package server runs the HTTP listeners: plain HTTP for development, or
+// HTTPS with hot-reloaded certificates, an HTTP to HTTPS redirect and
+// optional mutual TLS.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TLSConfig describes how the server terminates TLS.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// Addr is the HTTPS listen address.
+	Addr string
+	// RedirectAddr is a plain HTTP listener that redirects every request to
+	// HTTPS. Empty disables it.
+	RedirectAddr string
+	MinVersion   uint16
+	// ClientCAFile enables mutual TLS: client certificates signed by these
+	// CAs are verified, and RequireClientCert can insist on one.
+	ClientCAFile string
+}
+
+// TLSConfigFromEnv reads the TLS_* environment variables. It returns nil if
+// TLS_CERT_FILE is not set, meaning the server speaks plain HTTP.
+func TLSConfigFromEnv() (*TLSConfig, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	if certFile == "" {
+		return nil, nil
+	}
+
+	cfg := &TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		Addr:         os.Getenv("TLS_ADDR"),
+		RedirectAddr: os.Getenv("TLS_REDIRECT_ADDR"),
+		MinVersion:   tls.VersionTLS12,
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+	if cfg.KeyFile == "" {
+		return nil, errors.New("TLS_KEY_FILE must be set with TLS_CERT_FILE")
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = ":8443"
+	}
+	switch cfg.RedirectAddr {
+	case "":
+		cfg.RedirectAddr = ":8080"
+	case "off":
+		cfg.RedirectAddr = ""
+	}
+
+	switch v := os.Getenv("TLS_MIN_VERSION"); v {
+	case "", "1.2":
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid TLS_MIN_VERSION %q, want 1.2 or 1.3", v)
+	}
+	return cfg, nil
+}
+
+// CertReloader serves the current certificate and swaps it when the files
+// change on disk or the process receives SIGHUP.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the initial certificate.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate and key again. On error the previous
+// certificate stays in use.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate until ctx is done. The directories are
+// watched rather than the files so that atomic renames and symlink swaps,
+// as done by certbot and Kubernetes secrets, are noticed too.
+func (c *CertReloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := map[string]bool{filepath.Dir(c.certFile): true, filepath.Dir(c.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("error watching %s: %v", dir, err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Certificate and key are usually written one after the other; wait for
+	// writes to settle before reloading.
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			c.reloadAndLog("SIGHUP")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				debounce.Reset(500 * time.Millisecond)
+			}
+		case <-debounce.C:
+			c.reloadAndLog("file change")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Certificate watch error: %v\n", err)
+		}
+	}
+}
+
+func (c *CertReloader) reloadAndLog(reason string) {
+	if err := c.Reload(); err != nil {
+		log.Printf("Certificate reload after %s failed, keeping the old one: %v\n", reason, err)
+		return
+	}
+	log.Printf("Reloaded TLS certificate after %s\n", reason)
+}
+
+// ListenAndServeTLS serves handler over HTTPS until it fails, along with the
+// redirect listener if one is configured.
+func ListenAndServeTLS(cfg *TLSConfig, handler http.Handler) error {
+	reloader, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := reloader.Watch(context.Background()); err != nil {
+			log.Printf("Certificate reloading disabled: %v\n", err)
+		}
+	}()
+
+	tlsConfig := &tls.Config{
+		MinVersion:     cfg.MinVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// Browsers are not asked for a certificate they do not have;
+		// RequireClientCert enforces it where needed.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if cfg.RedirectAddr != "" {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS\n", cfg.RedirectAddr)
+			if err := http.ListenAndServe(cfg.RedirectAddr, RedirectHandler(cfg.Addr)); err != nil {
+				log.Printf("HTTP redirect listener stopped: %v\n", err)
+			}
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Server starting on %s (TLS)\n", cfg.Addr)
+	return srv.ListenAndServeTLS("", "")
+}
+
+// RedirectHandler sends every request to the same URL over HTTPS on the
+// port of httpsAddr.
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// RequireClientCert rejects requests under pathPrefix that did not present a
+// client certificate verified against the configured CAs.
+func RequireClientCert(pathPrefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, pathPrefix) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				http.Error(w, "Client certificate required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
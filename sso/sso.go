@@ -0,0 +1,201 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Config describes an OpenID Connect identity provider.
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Label is shown on the login button, e.g. "Sign in with Okta".
+	Label string
+	// RoleClaim names the ID token claim holding the user's groups or
+	// roles. It may be a string or a list of strings.
+	RoleClaim string
+	// RoleMap translates claim values to bookstore roles. A user gets every
+	// role one of their claim values maps to.
+	RoleMap map[string]string
+	// DefaultRole is given when no claim value maps to a role. Leave it
+	// empty to refuse users without a mapped role.
+	DefaultRole string
+}
+
+// ConfigFromEnv reads the OIDC_* environment variables. It returns nil if
+// OIDC_ISSUER is not set, meaning single sign-on is turned off.
+func ConfigFromEnv(baseURL string) *Config {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	cfg := &Config{
+		IssuerURL:    issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Label:        os.Getenv("OIDC_LABEL"),
+		RoleClaim:    os.Getenv("OIDC_ROLE_CLAIM"),
+		RoleMap:      make(map[string]string),
+		DefaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = strings.TrimRight(baseURL, "/") + "/login/oidc/callback"
+	}
+	if cfg.Label == "" {
+		cfg.Label = "Sign in with SSO"
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "groups"
+	}
+
+	// OIDC_ROLE_MAP=bookstore-admins=admin,bookstore-editors=editor
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ",") {
+		claim, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok {
+			cfg.RoleMap[strings.TrimSpace(claim)] = strings.TrimSpace(role)
+		}
+	}
+	return cfg
+}
+
+// Identity is what the provider told us about a user.
+type Identity struct {
+	Issuer            string
+	Subject           string
+	PreferredUsername string
+	Email             string
+	EmailVerified     bool
+	FirstName         string
+	LastName          string
+	// RoleValues holds the raw values of the configured role claim.
+	RoleValues []string
+}
+
+// Provider runs the authorization code flow with PKCE against one issuer.
+type Provider struct {
+	cfg      Config
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New fetches the issuer's discovery document and prepares the client.
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("error loading OIDC discovery document: %v", err)
+	}
+
+	return &Provider{
+		cfg: cfg,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// Label is the text for the login button.
+func (p *Provider) Label() string {
+	return p.cfg.Label
+}
+
+// AuthCodeURL returns the provider URL to send the browser to. The caller
+// must keep state, nonce and verifier for the callback.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange redeems an authorization code and validates the returned ID
+// token's signature, issuer, audience, expiry and nonce.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*Identity, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging authorization code: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response did not include an id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("error reading ID token claims: %v", err)
+	}
+
+	identity := &Identity{
+		Issuer:            idToken.Issuer,
+		Subject:           idToken.Subject,
+		PreferredUsername: stringClaim(claims, "preferred_username"),
+		Email:             stringClaim(claims, "email"),
+		FirstName:         stringClaim(claims, "given_name"),
+		LastName:          stringClaim(claims, "family_name"),
+		RoleValues:        listClaim(claims, p.cfg.RoleClaim),
+	}
+	if verified, ok := claims["email_verified"].(bool); ok {
+		identity.EmailVerified = verified
+	}
+	return identity, nil
+}
+
+// MapRoles returns the bookstore roles an identity's claim values map to,
+// or the default role when none do.
+func (p *Provider) MapRoles(identity *Identity) []string {
+	var roles []string
+	seen := make(map[string]bool)
+	for _, value := range identity.RoleValues {
+		if role, ok := p.cfg.RoleMap[value]; ok && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 && p.cfg.DefaultRole != "" {
+		roles = append(roles, p.cfg.DefaultRole)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+func listClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(strings.ReplaceAll(v, ",", " "))
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Package storage keeps binary objects such as cover images behind the
+// BlobStore interface; FromEnv picks the implementation.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when no blob is stored under the key.
+	ErrNotFound = errors.New("blob not found")
+	// ErrInvalidKey is returned for keys that are empty, absolute or
+	// climb out of the store with "..".
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// BlobStore stores opaque blobs under slash-separated keys such as
+// "covers/<book>/<etag>/small". Put replaces any blob under the same key,
+// and a reader never sees a partly written blob.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the blob under key, or ErrNotFound. The caller closes
+	// it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob under key. Deleting a missing blob is not
+	// an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey checks that key is relative and made of plain path segments of
+// letters, digits, '.', '-' and '_'.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+		for _, r := range segment {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+				return ErrInvalidKey
+			}
+		}
+	}
+	return nil
+}
+
+// FromEnv picks a blob store based on BLOB_STORE. Only "local" exists so
+// far: files under BLOB_STORE_DIR, defaulting to data/blobs.
+func FromEnv() (BlobStore, error) {
+	switch name := os.Getenv("BLOB_STORE"); name {
+	case "", "local":
+		dir := os.Getenv("BLOB_STORE_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		return NewLocal(dir)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", name)
+	}
+}